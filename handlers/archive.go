@@ -0,0 +1,272 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"denchokun-api/models"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// archiveIndexColumns are the columns of index.csv in a period archive (key, Japanese header)
+var archiveIndexColumns = [][2]string{
+	{"NO", "取引番号"},
+	{"DealDate", "取引日"},
+	{"DealPartner", "取引先"},
+	{"DealPrice", "金額（税込）"},
+	{"DealType", "取引種別"},
+	{"RecStatus", "状態"},
+	{"Role", "種類"},
+	{"FileName", "ファイル名"},
+	{"OriginalFileName", "元のファイル名"},
+	{"Hash", "ファイルハッシュ（SHA-256）"},
+	{"Note", "備考"},
+}
+
+// periodArchive writes the files of a period archive and remembers their hashes for the manifest
+type periodArchive struct {
+	zip      *zip.Writer
+	manifest bytes.Buffer
+	names    map[string]bool
+}
+
+// add writes one file into the archive and returns the SHA-256 of what was written
+func (a *periodArchive) add(name string, modified time.Time, r io.Reader) (string, error) {
+	header := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified}
+	w, err := a.zip.CreateHeader(header)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, h), r); err != nil {
+		return "", err
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	fmt.Fprintf(&a.manifest, "%s  %s\n", sum, name)
+	return sum, nil
+}
+
+// addStoredFile copies a stored file into the archive under name.
+// A file that cannot be read is left out and the reason returned as a note for the index;
+// err is only set when writing the archive failed.
+func (a *periodArchive) addStoredFile(name, path, recordedHash string) (note string, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "file missing", nil
+		}
+		return "file unreadable", nil
+	}
+	defer file.Close()
+
+	modified := time.Now()
+	if info, err := file.Stat(); err == nil {
+		modified = info.ModTime()
+	}
+
+	sum, err := a.add(name, modified, file)
+	if err != nil {
+		return "", err
+	}
+	if recordedHash != "" && sum != recordedHash {
+		return "hash mismatch", nil
+	}
+	return "", nil
+}
+
+// uniqueName returns name, or name with a number added if it is already in the archive
+func (a *periodArchive) uniqueName(name string) string {
+	unique := name
+	ext := filepath.Ext(name)
+	for i := 2; a.names[unique]; i++ {
+		unique = fmt.Sprintf("%s_%d%s", strings.TrimSuffix(name, ext), i, ext)
+	}
+	a.names[unique] = true
+	return unique
+}
+
+// archiveFileName makes a name sent by a client safe to use as one path element in a ZIP
+func archiveFileName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, clientFileName(name))
+	if name == "" || name == "." || name == ".." {
+		return "file"
+	}
+	return name
+}
+
+// ExportPeriodArchive handles GET /periods/export.
+// It streams a ZIP with every attached file of the period (files/ for the files of the
+// deal records, including update history and deleted records, and attachments/<NO>/ for
+// the additional attachments), an index.csv listing the records and their files, and a
+// manifest.sha256 with the SHA-256 of every file in the ZIP in sha256sum format.
+// header=ja gives index.csv Japanese column headers.
+func ExportPeriodArchive(c *gin.Context) {
+	period := c.Query("period")
+	if period == "" {
+		sendMissingPeriod(c)
+		return
+	}
+
+	japaneseHeader := false
+	switch c.Query("header") {
+	case "", "en":
+	case "ja":
+		japaneseHeader = true
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid_request",
+			"message": "invalid header parameter. Must be 'en' or 'ja'",
+		})
+		return
+	}
+
+	// Fail before the headers are written if the period does not exist
+	if _, err := models.ConnectPeriodDB(period); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "period_not_found",
+			"message": "Period not found: " + period,
+		})
+		return
+	}
+
+	attachments, err := models.GetPeriodAttachments(period)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "database_error",
+			"message": err.Error(),
+		})
+		return
+	}
+	attachmentsByDeal := map[string][]models.Attachment{}
+	for _, attachment := range attachments {
+		attachmentsByDeal[attachment.DealNO] = append(attachmentsByDeal[attachment.DealNO], attachment)
+	}
+
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", contentDisposition("attachment", "denchokun_"+period+".zip"))
+	c.Status(http.StatusOK)
+
+	archive := &periodArchive{zip: zip.NewWriter(c.Writer), names: map[string]bool{}}
+	var index [][]string
+	count := 0
+
+	filter := &models.DealFilter{Period: period, View: "history"}
+	err = models.ForEachDeal(filter, func(deal *models.Deal) error {
+		// Columns users can type freely are escaped as in GET /deals/export
+		row := func(role, fileName, originalName, hash, note string) []string {
+			return []string{deal.NO, deal.DealDate, escapeFormula(deal.DealPartner), strconv.Itoa(deal.DealPrice),
+				escapeFormula(deal.DealType), deal.RecStatus, role, escapeFormula(fileName),
+				escapeFormula(originalName), hash, note}
+		}
+
+		if deal.FilePath == "" {
+			index = append(index, row("", "", "", "", ""))
+		} else {
+			name := archive.uniqueName("files/" + archiveFileName(deal.FilePath))
+			note := "file missing"
+			if path, err := models.AttachmentPath(period, deal); err == nil {
+				if note, err = archive.addStoredFile(name, path, deal.Hash); err != nil {
+					return err
+				}
+			}
+			if note == "file missing" || note == "file unreadable" {
+				name = ""
+			}
+			index = append(index, row("primary", name, deal.OriginalFileName, deal.Hash, note))
+		}
+
+		for _, attachment := range attachmentsByDeal[deal.NO] {
+			name := archive.uniqueName(fmt.Sprintf("attachments/%s/%d_%s",
+				archiveFileName(deal.NO), attachment.ID, archiveFileName(attachment.OriginalName)))
+			note := "file missing"
+			if path, err := models.AttachmentFilePath(&attachment); err == nil {
+				if note, err = archive.addStoredFile(name, path, attachment.Hash); err != nil {
+					return err
+				}
+			}
+			if note == "file missing" || note == "file unreadable" {
+				name = ""
+			}
+			if attachment.Status == models.AttachmentRemoved {
+				note = strings.TrimPrefix(note+"; removed "+attachment.Removed, "; ")
+			}
+			index = append(index, row(attachment.Role, name, attachment.OriginalName, attachment.Hash, note))
+		}
+
+		count++
+		c.Writer.Flush()
+		return nil
+	})
+	if err != nil {
+		// The status is already sent; the truncated ZIP is the only signal left to the client
+		log.Printf("ExportPeriodArchive: Export of period %s aborted after %d records: %v", period, count, err)
+		return
+	}
+
+	if err := writeArchiveIndex(archive, index, japaneseHeader); err != nil {
+		log.Printf("ExportPeriodArchive: Failed to write index of period %s: %v", period, err)
+		return
+	}
+
+	// The manifest lists every other file, so it is written last
+	manifest := archive.manifest.Bytes()
+	w, err := archive.zip.CreateHeader(&zip.FileHeader{Name: "manifest.sha256", Method: zip.Deflate, Modified: time.Now()})
+	if err == nil {
+		_, err = w.Write(manifest)
+	}
+	if err == nil {
+		err = archive.zip.Close()
+	}
+	if err != nil {
+		log.Printf("ExportPeriodArchive: Failed to finish export of period %s: %v", period, err)
+		return
+	}
+
+	log.Printf("ExportPeriodArchive: Exported %d records of period %s", count, period)
+}
+
+// writeArchiveIndex writes index.csv (UTF-8 with BOM, CRLF) into the archive
+func writeArchiveIndex(archive *periodArchive, index [][]string, japaneseHeader bool) error {
+	var buf bytes.Buffer
+	buf.WriteString("\xEF\xBB\xBF")
+
+	writer := csv.NewWriter(&buf)
+	writer.UseCRLF = true
+	header := make([]string, len(archiveIndexColumns))
+	for i, column := range archiveIndexColumns {
+		header[i] = column[0]
+		if japaneseHeader {
+			header[i] = column[1]
+		}
+	}
+	writer.Write(header)
+	writer.WriteAll(index)
+	if err := writer.Error(); err != nil {
+		return err
+	}
+
+	_, err := archive.add("index.csv", time.Now(), &buf)
+	return err
+}
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"denchokun-api/models"
+	"encoding/csv"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestExportPeriodArchive(t *testing.T) {
+	setupTestDB(t)
+	const period = "2025"
+	if _, err := models.ConnectToPeriod(period); err != nil {
+		t.Fatal(err)
+	}
+
+	deal := &models.Deal{
+		NO:          "20250401_000001",
+		DealType:    "領収書",
+		DealDate:    "2025-04-01",
+		DealName:    "文房具",
+		DealPartner: "=HYPERLINK(\"http://example.com\")",
+		DealPrice:   1100,
+		RecStatus:   "NEW",
+	}
+	if err := models.CreateDeal(period, deal); err != nil {
+		t.Fatal(err)
+	}
+
+	upload, err := models.NewBlobWriter(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := upload.Write([]byte("%PDF-1.4 receipt")); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := upload.Commit(".pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	attachment := &models.Attachment{DealNO: deal.NO, Role: models.AttachmentRoleReceipt,
+		OriginalName: "+receipt.pdf", Hash: hash}
+	if err := models.AddDealAttachment(period, attachment); err != nil {
+		t.Fatal(err)
+	}
+
+	router := gin.New()
+	router.GET("/periods/export", ExportPeriodArchive)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/periods/export?period="+period, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, body %s", w.Code, w.Body)
+	}
+
+	reader, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{}
+	for _, file := range reader.File {
+		r, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[file.Name] = data
+	}
+
+	// The manifest lists every other file of the ZIP with its SHA-256
+	listed := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSpace(string(files["manifest.sha256"])), "\n") {
+		sum, name, ok := strings.Cut(line, "  ")
+		if !ok {
+			t.Fatalf("malformed manifest line %q", line)
+		}
+		data, exists := files[name]
+		if !exists {
+			t.Errorf("manifest lists %s, which is not in the ZIP", name)
+			continue
+		}
+		digest := sha256.Sum256(data)
+		if got := hex.EncodeToString(digest[:]); got != sum {
+			t.Errorf("%s: SHA-256 %s, manifest %s", name, got, sum)
+		}
+		listed[name] = true
+	}
+	for name := range files {
+		if name != "manifest.sha256" && !listed[name] {
+			t.Errorf("%s is not in the manifest", name)
+		}
+	}
+
+	// Free-text columns of index.csv are not read as formulas
+	index := strings.TrimPrefix(string(files["index.csv"]), "\xEF\xBB\xBF")
+	records, err := csv.NewReader(strings.NewReader(index)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("index.csv has %d records, want header, deal and attachment", len(records))
+	}
+	attachmentRow := records[2]
+	if got := attachmentRow[2]; got != "'"+deal.DealPartner {
+		t.Errorf("DealPartner = %q", got)
+	}
+	if got := attachmentRow[8]; got != "'+receipt.pdf" {
+		t.Errorf("OriginalFileName = %q", got)
+	}
+	if _, ok := files[attachmentRow[7]]; !ok {
+		t.Errorf("FileName %q is not in the ZIP", attachmentRow[7])
+	}
+}
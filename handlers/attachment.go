@@ -0,0 +1,353 @@
+package handlers
+
+import (
+	"denchokun-api/middleware"
+	"denchokun-api/models"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AttachmentRequest adds an attachment with base64 data or a completed upload
+type AttachmentRequest struct {
+	Period   string       `json:"period"`
+	Role     string       `json:"role"`
+	FileData *FileRequest `json:"fileData"`
+}
+
+// GetDealAttachments handles GET /deals/:dealId/attachments.
+// The deal's own file is returned as primary; removed attachments are listed only
+// with include_removed=true.
+func GetDealAttachments(c *gin.Context) {
+	dealID := c.Param("dealId")
+	period := c.Query("period")
+	if period == "" {
+		sendMissingPeriod(c)
+		return
+	}
+
+	deal, err := models.GetDealByID(period, dealID)
+	if err != nil {
+		sendAttachmentError(c, err)
+		return
+	}
+
+	attachments, err := models.GetDealAttachments(period, dealID, c.Query("include_removed") == "true")
+	if err != nil {
+		sendAttachmentError(c, err)
+		return
+	}
+
+	var primary gin.H
+	if deal.FilePath != "" {
+		primary = gin.H{
+			"filePath": deal.FilePath,
+			"hash":     deal.Hash,
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":     true,
+		"dealNo":      deal.NO,
+		"recStatus":   deal.RecStatus,
+		"primary":     primary,
+		"attachments": attachments,
+		"count":       len(attachments),
+	})
+}
+
+// AddDealAttachment handles POST /deals/:dealId/attachments.
+// The file is sent as the file part of a multipart request (with role and period
+// fields), or as fileData.base64Data or fileData.uploadId of a JSON request. Only the
+// current version of a deal takes attachments, and the same duplicate check as for
+// deal files applies unless force=true.
+func AddDealAttachment(c *gin.Context) {
+	dealID := c.Param("dealId")
+
+	var req AttachmentRequest
+	var upload *models.BlobWriter
+	var fileName string
+	defer func() { abortUpload(upload) }()
+
+	if strings.Contains(c.GetHeader("Content-Type"), "multipart/form-data") {
+		fields, fileUpload, uploadName, ok := readMultipartUpload(c, "AddDealAttachment", "period", "role")
+		if !ok {
+			return
+		}
+		upload, fileName = fileUpload, uploadName
+		req.Period, req.Role = fields["period"], fields["role"]
+	} else {
+		limitRequestBody(c, true)
+		if err := c.ShouldBindJSON(&req); err != nil {
+			if sendUploadTooLarge(c, err) {
+				return
+			}
+			c.JSON(http.StatusBadRequest, gin.H{
+				"success": false,
+				"error":   "invalid_request",
+				"message": err.Error(),
+			})
+			return
+		}
+
+		if req.FileData != nil && req.FileData.Base64Data != "" {
+			fileUpload, ok := readBase64Upload(c, "AddDealAttachment", req.FileData.Base64Data)
+			if !ok {
+				return
+			}
+			upload = fileUpload
+			fileName = req.FileData.Name
+			req.FileData.Base64Data = ""
+		} else if req.FileData != nil && req.FileData.UploadID != "" {
+			fileUpload, uploadName, ok := readSessionUpload(c, "AddDealAttachment", req.FileData.UploadID)
+			if !ok {
+				return
+			}
+			upload = fileUpload
+			fileName = req.FileData.Name
+			if fileName == "" {
+				fileName = uploadName
+			}
+		}
+	}
+
+	if req.Period == "" {
+		req.Period = c.Query("period")
+	}
+	if req.Period == "" {
+		sendMissingPeriod(c)
+		return
+	}
+
+	if upload == nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "missing_file",
+			"message": "A file is required",
+		})
+		return
+	}
+
+	if req.Role == "" {
+		req.Role = models.AttachmentRoleOther
+	}
+	if !models.IsValidAttachmentRole(req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid_role",
+			"message": "role must be one of invoice, receipt, delivery_note, quote, contract or other",
+		})
+		return
+	}
+
+	deal, err := models.GetDealByID(req.Period, dealID)
+	if err != nil {
+		sendAttachmentError(c, err)
+		return
+	}
+	if deal.RecStatus != "NEW" {
+		sendAttachmentError(c, fmt.Errorf("deal %s is not the current version (%s)", dealID, deal.RecStatus))
+		return
+	}
+	middleware.SetAuditTarget(c, req.Period, dealID, "")
+
+	// The same content must not be registered twice, as a deal file or as an attachment
+	hash := upload.Hash()
+	forceUpload := c.Query("force") == "true"
+	duplicates, err := models.GetDealsByHashAllPeriods(hash)
+	if err != nil {
+		log.Printf("AddDealAttachment: Failed to check duplicate hash: %v", err)
+	} else if len(duplicates) > 0 && !forceUpload {
+		var duplicateInfo []gin.H
+		for _, dup := range duplicates {
+			duplicateInfo = append(duplicateInfo, gin.H{
+				"NO":          dup.NO,
+				"DealDate":    dup.DealDate,
+				"DealPartner": dup.DealPartner,
+				"DealPrice":   dup.DealPrice,
+				"DealPeriod":  dup.Period,
+			})
+		}
+
+		c.JSON(http.StatusConflict, gin.H{
+			"success":    false,
+			"error":      "duplicate_file",
+			"message":    "このファイルは既に登録されています。強制登録する場合は?force=trueを付けてください",
+			"duplicates": duplicateInfo,
+		})
+		return
+	}
+
+	if _, err := upload.Commit(filepath.Ext(fileName)); err != nil {
+		log.Printf("AddDealAttachment: Failed to save file: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "file_save_error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	attachment := models.Attachment{
+		DealNO:       dealID,
+		Role:         req.Role,
+		OriginalName: clientFileName(fileName),
+		Hash:         hash,
+		UploadedBy:   c.GetString(middleware.ActorKey),
+	}
+	if err := models.AddDealAttachment(req.Period, &attachment); err != nil {
+		log.Printf("AddDealAttachment: Failed to add attachment: %v", err)
+		sendAttachmentError(c, err)
+		return
+	}
+	middleware.SetAuditAfter(c, attachment)
+
+	response := gin.H{
+		"success":    true,
+		"message":    "Attachment added successfully",
+		"attachment": attachment,
+	}
+	if len(duplicates) > 0 {
+		var duplicateWarnings []gin.H
+		for _, dup := range duplicates {
+			duplicateWarnings = append(duplicateWarnings, gin.H{
+				"NO":     dup.NO,
+				"Period": dup.Period,
+			})
+		}
+		response["warning"] = "duplicate_file"
+		response["duplicates"] = duplicateWarnings
+	}
+	addAttachmentTimestampToResponse(response, req.Period, &attachment)
+
+	log.Printf("AddDealAttachment: Added attachment %d to deal %s", attachment.ID, dealID)
+	c.JSON(http.StatusCreated, response)
+}
+
+// DownloadDealAttachment handles GET /deals/:dealId/attachments/:attachmentId/download.
+// Removed attachments can still be downloaded as history.
+func DownloadDealAttachment(c *gin.Context) {
+	dealID := c.Param("dealId")
+	period := c.Query("period")
+	if period == "" {
+		sendMissingPeriod(c)
+		return
+	}
+
+	id, ok := getAttachmentID(c)
+	if !ok {
+		return
+	}
+
+	attachment, err := models.GetDealAttachment(period, dealID, id)
+	if err != nil {
+		sendAttachmentError(c, err)
+		return
+	}
+
+	fullPath, err := models.AttachmentFilePath(attachment)
+	if err == nil {
+		_, err = os.Stat(fullPath)
+	}
+	if err != nil {
+		log.Printf("DownloadDealAttachment: Stored file not found: %v", err)
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "file_not_found",
+			"message": "File not found on disk",
+		})
+		return
+	}
+
+	contentType := attachment.MimeType
+	if contentType == "" {
+		contentType = getContentType(strings.ToLower(filepath.Ext(attachment.OriginalName)))
+	}
+	setDownloadHeaders(c, contentType, attachment.OriginalName)
+	c.File(fullPath)
+}
+
+// RemoveDealAttachment handles DELETE /deals/:dealId/attachments/:attachmentId.
+// The attachment is marked as removed; its row and file are kept.
+func RemoveDealAttachment(c *gin.Context) {
+	dealID := c.Param("dealId")
+	period := c.Query("period")
+	if period == "" {
+		sendMissingPeriod(c)
+		return
+	}
+
+	id, ok := getAttachmentID(c)
+	if !ok {
+		return
+	}
+	middleware.SetAuditTarget(c, period, dealID, "")
+
+	if before, err := models.GetDealAttachment(period, dealID, id); err == nil {
+		middleware.SetAuditBefore(c, *before)
+	}
+
+	attachment, err := models.RemoveDealAttachment(period, dealID, id, c.GetString(middleware.ActorKey))
+	if err != nil {
+		sendAttachmentError(c, err)
+		return
+	}
+	middleware.SetAuditAfter(c, *attachment)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":    true,
+		"message":    "Attachment removed successfully",
+		"attachment": attachment,
+	})
+}
+
+// getAttachmentID parses the attachmentId path parameter.
+// On failure the error response has already been written.
+func getAttachmentID(c *gin.Context) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("attachmentId"), 10, 64)
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid_request",
+			"message": "Invalid attachment ID",
+		})
+		return 0, false
+	}
+	return id, true
+}
+
+func sendMissingPeriod(c *gin.Context) {
+	c.JSON(http.StatusBadRequest, gin.H{
+		"success": false,
+		"error":   "missing_period",
+		"message": "Period is required",
+	})
+}
+
+// sendAttachmentError writes the response for an error of the attachment models
+func sendAttachmentError(c *gin.Context, err error) {
+	status, code := http.StatusInternalServerError, "database_error"
+	message := err.Error()
+	switch {
+	case strings.Contains(message, "attachment not found"):
+		status, code = http.StatusNotFound, "attachment_not_found"
+	case strings.Contains(message, "not found"), strings.Contains(message, "does not exist"):
+		status, code = http.StatusNotFound, "deal_not_found"
+	case strings.Contains(message, "not the current version"):
+		status, code = http.StatusConflict, "deal_not_current"
+	case strings.Contains(message, "already removed"):
+		status, code = http.StatusConflict, "already_removed"
+	}
+
+	c.JSON(status, gin.H{
+		"success": false,
+		"error":   code,
+		"message": message,
+	})
+}
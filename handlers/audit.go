@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"denchokun-api/models"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetAuditLog handles GET /audit
+func GetAuditLog(c *gin.Context) {
+	var filter models.AuditFilter
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid_request",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	if err := models.ValidateAuditFilter(&filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid_request",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	entries, count, err := models.GetAuditEntries(&filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "database_error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"count":   count,
+		"entries": entries,
+	})
+}
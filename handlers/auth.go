@@ -0,0 +1,404 @@
+package handlers
+
+import (
+	"denchokun-api/middleware"
+	"denchokun-api/models"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// loginTokenTTL is the lifetime of tokens issued by POST /auth/login
+var loginTokenTTL = 12 * time.Hour
+
+// SetLoginTokenTTL sets the lifetime of tokens issued by POST /auth/login
+func SetLoginTokenTTL(ttl time.Duration) {
+	loginTokenTTL = ttl
+}
+
+type LoginRequest struct {
+	Username string `json:"username" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+type TokenRequest struct {
+	Name    string `json:"name" binding:"required"`
+	TTLDays int    `json:"ttlDays"` // 0 issues a token that does not expire
+}
+
+// Login handles POST /auth/login
+func Login(c *gin.Context) {
+	var req LoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid_request",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	// Failed attempts are recorded in the audit log under the given username
+	c.Set(middleware.ActorKey, req.Username)
+
+	user, err := models.AuthenticateUser(req.Username, req.Password)
+	if err != nil {
+		if strings.Contains(err.Error(), "invalid username or password") || strings.Contains(err.Error(), "disabled") {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"success": false,
+				"error":   "unauthorized",
+				"message": err.Error(),
+			})
+			return
+		}
+
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "database_error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	token, apiToken, err := models.CreateAPIToken(user.ID, "login", loginTokenTTL)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "database_error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	middleware.SetAuditTarget(c, "", user.Username, "")
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"token":   token,
+		"expires": apiToken.Expires,
+		"user":    user,
+	})
+}
+
+// Logout handles POST /auth/logout by revoking the token used for the request
+func Logout(c *gin.Context) {
+	user := middleware.CurrentUser(c)
+	apiToken := middleware.CurrentToken(c)
+	if user == nil || apiToken == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"success": false,
+			"error":   "unauthorized",
+			"message": "Authentication required",
+		})
+		return
+	}
+
+	if err := models.RevokeAPIToken(user.ID, apiToken.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "database_error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	middleware.SetAuditTarget(c, "", user.Username, "")
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Logged out successfully",
+	})
+}
+
+// GetCurrentUser handles GET /auth/me
+func GetCurrentUser(c *gin.Context) {
+	user := middleware.CurrentUser(c)
+	if user == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"success": false,
+			"error":   "unauthorized",
+			"message": "Authentication required",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"user":    user,
+	})
+}
+
+// GetUsers handles GET /users
+func GetUsers(c *gin.Context) {
+	users, err := models.GetUsers()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "database_error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"users":   users,
+	})
+}
+
+// CreateUser handles POST /users
+func CreateUser(c *gin.Context) {
+	var req models.UserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid_request",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	if err := models.ValidateUserRequest(&req, true); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid_request",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	user, err := models.CreateUser(&req)
+	if err != nil {
+		if strings.Contains(err.Error(), "already exists") {
+			c.JSON(http.StatusConflict, gin.H{
+				"success": false,
+				"error":   "resource_conflict",
+				"message": err.Error(),
+			})
+			return
+		}
+
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "database_error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	middleware.SetAuditTarget(c, "", strconv.FormatInt(user.ID, 10), "")
+	middleware.SetAuditAfter(c, user)
+
+	c.JSON(http.StatusCreated, gin.H{
+		"success": true,
+		"user":    user,
+	})
+}
+
+// UpdateUser handles PUT /users/:id
+func UpdateUser(c *gin.Context) {
+	id, ok := parseUserID(c)
+	if !ok {
+		return
+	}
+
+	var req models.UserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid_request",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	if err := models.ValidateUserRequest(&req, false); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid_request",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	// An admin cannot lock themselves out
+	if current := middleware.CurrentUser(c); current != nil && current.ID == id {
+		if (req.Role != "" && req.Role != models.RoleAdmin) || (req.Disabled != nil && *req.Disabled) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"success": false,
+				"error":   "invalid_request",
+				"message": "You cannot demote or disable your own account",
+			})
+			return
+		}
+	}
+
+	middleware.SetAuditTarget(c, "", strconv.FormatInt(id, 10), "")
+	if before, err := models.GetUserByID(id); err == nil {
+		middleware.SetAuditBefore(c, before)
+	}
+
+	user, err := models.UpdateUser(id, &req)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			c.JSON(http.StatusNotFound, gin.H{
+				"success": false,
+				"error":   "not_found",
+				"message": err.Error(),
+			})
+			return
+		}
+
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "database_error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	middleware.SetAuditAfter(c, user)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"user":    user,
+	})
+}
+
+// GetUserTokens handles GET /users/:id/tokens
+func GetUserTokens(c *gin.Context) {
+	id, ok := parseUserID(c)
+	if !ok {
+		return
+	}
+
+	tokens, err := models.GetAPITokens(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "database_error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"tokens":  tokens,
+	})
+}
+
+// CreateUserToken handles POST /users/:id/tokens.
+// The token is only shown in this response; the server keeps its hash.
+func CreateUserToken(c *gin.Context) {
+	id, ok := parseUserID(c)
+	if !ok {
+		return
+	}
+
+	var req TokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid_request",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	if req.TTLDays < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid_request",
+			"message": "ttlDays must not be negative",
+		})
+		return
+	}
+
+	if _, err := models.GetUserByID(id); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "not_found",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	token, apiToken, err := models.CreateAPIToken(id, req.Name, time.Duration(req.TTLDays)*24*time.Hour)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "database_error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	middleware.SetAuditTarget(c, "", strconv.FormatInt(id, 10), "")
+	middleware.SetAuditAfter(c, apiToken)
+
+	c.JSON(http.StatusCreated, gin.H{
+		"success":  true,
+		"token":    token,
+		"apiToken": apiToken,
+	})
+}
+
+// RevokeUserToken handles DELETE /users/:id/tokens/:tokenId
+func RevokeUserToken(c *gin.Context) {
+	id, ok := parseUserID(c)
+	if !ok {
+		return
+	}
+
+	tokenID, err := strconv.ParseInt(c.Param("tokenId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid_request",
+			"message": "Invalid token ID",
+		})
+		return
+	}
+
+	middleware.SetAuditTarget(c, "", strconv.FormatInt(id, 10), "")
+
+	if err := models.RevokeAPIToken(id, tokenID); err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			c.JSON(http.StatusNotFound, gin.H{
+				"success": false,
+				"error":   "not_found",
+				"message": err.Error(),
+			})
+			return
+		}
+
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "database_error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Token revoked successfully",
+	})
+}
+
+func parseUserID(c *gin.Context) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid_request",
+			"message": "Invalid user ID",
+		})
+		return 0, false
+	}
+	return id, true
+}
@@ -0,0 +1,575 @@
+package handlers
+
+import (
+	"denchokun-api/middleware"
+	"denchokun-api/models"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxBatchOperations is the limit of operations in one batch request
+const maxBatchOperations = 500
+
+// BatchOperation is one operation of POST /batch
+type BatchOperation struct {
+	Op         string       `json:"op"`                   // "create", "update", "delete" or "move"
+	Ref        string       `json:"ref,omitempty"`        // label by which later operations refer to the resulting deal
+	Period     string       `json:"period,omitempty"`     // period of the deal (source period for move)
+	FromPeriod string       `json:"fromPeriod,omitempty"` // move: same as period
+	ToPeriod   string       `json:"toPeriod,omitempty"`   // move: target period
+	DealID     string       `json:"dealId,omitempty"`     // update, delete, move
+	DealRef    string       `json:"dealRef,omitempty"`    // instead of dealId and period: the deal resulting from an earlier operation
+	DealData   *models.Deal `json:"dealData,omitempty"`   // create, update
+	FileData   *FileRequest `json:"fileData,omitempty"`   // create, update: base64Data or uploadId
+	Force      bool         `json:"force,omitempty"`      // register the file even if it is a duplicate
+}
+
+// BatchRequest is the body of POST /batch
+type BatchRequest struct {
+	Operations []BatchOperation `json:"operations"`
+}
+
+// batchStep is an operation being planned and run
+type batchStep struct {
+	op         *BatchOperation
+	period     string // period of the deal the operation works on
+	target     string // period of the resulting deal
+	ref        int    // index of the step named by dealRef, or -1
+	dealID     string
+	newNO      string
+	upload     *models.BlobWriter
+	fileName   string
+	clientPath string
+	result     gin.H
+}
+
+// batchError is the failure of one operation
+type batchError struct {
+	status  int
+	code    string
+	message string
+	extra   gin.H
+}
+
+// ExecuteBatch handles POST /batch.
+// The operations run in order, all or nothing: every period they touch has one
+// transaction and nothing is committed unless all of them succeed. A later operation can
+// work on the deal created by an earlier one through dealRef. Files are sent as
+// fileData.base64Data (within the same body limit as POST /deals) or, for larger or many
+// files, as fileData.uploadId of completed uploads. Upload sessions are only used up when
+// the batch is committed.
+func ExecuteBatch(c *gin.Context) {
+	limitRequestBody(c, true)
+
+	var req BatchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		if sendUploadTooLarge(c, err) {
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid_request",
+			"message": err.Error(),
+		})
+		return
+	}
+	if len(req.Operations) == 0 || len(req.Operations) > maxBatchOperations {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid_request",
+			"message": fmt.Sprintf("operations must have 1 to %d entries", maxBatchOperations),
+		})
+		return
+	}
+
+	steps := make([]*batchStep, len(req.Operations))
+	defer func() {
+		for _, step := range steps {
+			if step != nil {
+				abortUpload(step.upload)
+			}
+		}
+	}()
+
+	// Check every operation before anything is run
+	refs := map[string]int{}
+	user := middleware.CurrentUser(c)
+	for i := range req.Operations {
+		step, failure := planBatchStep(&req.Operations[i], steps[:i], refs, user)
+		if failure != nil {
+			sendBatchFailure(c, req.Operations, steps, i, failure)
+			return
+		}
+		steps[i] = step
+		if step.op.Ref != "" {
+			refs[step.op.Ref] = i
+		}
+	}
+
+	// Receive the files and check them for duplicates, within the batch and against all periods
+	forceAll := c.Query("force") == "true"
+	firstStep := map[string]int{}
+	for i, step := range steps {
+		if !readBatchFile(c, step) {
+			return
+		}
+		if step.upload == nil {
+			continue
+		}
+
+		hash := step.upload.Hash()
+		var duplicates []gin.H
+		if j, exists := firstStep[hash]; exists {
+			duplicates = append(duplicates, gin.H{"operation": j})
+		} else {
+			firstStep[hash] = i
+		}
+		existing, err := models.GetDealsByHashAllPeriods(hash)
+		if err != nil {
+			log.Printf("ExecuteBatch: Failed to check duplicate hash: %v", err)
+		}
+		for _, dup := range existing {
+			duplicates = append(duplicates, gin.H{
+				"NO":          dup.NO,
+				"DealDate":    dup.DealDate,
+				"DealPartner": dup.DealPartner,
+				"DealPrice":   dup.DealPrice,
+				"DealPeriod":  dup.Period,
+			})
+		}
+		if len(duplicates) == 0 {
+			continue
+		}
+		if !forceAll && !step.op.Force {
+			sendBatchFailure(c, req.Operations, steps, i, &batchError{http.StatusConflict, "duplicate_file",
+				"このファイルは既に登録されています。強制登録する場合は?force=trueか操作のforceを付けてください",
+				gin.H{"duplicates": duplicates}})
+			return
+		}
+		step.result["warning"] = "duplicate_file"
+		step.result["duplicates"] = duplicates
+	}
+
+	// New deals may create their period, as POST /deals does; other periods must exist
+	var periods []string
+	for i, step := range steps {
+		var err error
+		if step.op.Op == "create" || step.op.Op == "move" {
+			_, err = models.ConnectToPeriod(step.target)
+		}
+		if err == nil {
+			_, err = models.ConnectPeriodDB(step.period)
+		}
+		if err != nil {
+			sendBatchFailure(c, req.Operations, steps, i, batchErrorFrom(err))
+			return
+		}
+		periods = append(periods, step.period, step.target)
+	}
+
+	batch, err := models.BeginDealBatch(periods)
+	if err != nil {
+		log.Printf("ExecuteBatch: %v", err)
+		sendBatchFailure(c, req.Operations, steps, -1, batchErrorFrom(err))
+		return
+	}
+	defer batch.Rollback()
+
+	run := &batchRun{
+		batch:   batch,
+		numbers: newDealNumbers(c),
+		actor:   c.GetString(middleware.ActorKey),
+		pending: map[string]bool{},
+	}
+	for _, step := range steps {
+		if step.upload != nil {
+			run.pending[step.upload.Hash()] = true
+		}
+	}
+	for i, step := range steps {
+		if step.ref >= 0 {
+			step.dealID = steps[step.ref].newNO
+		}
+		if failure := run.step(step); failure != nil {
+			log.Printf("ExecuteBatch: Operation %d (%s) failed: %s", i, step.op.Op, failure.message)
+			sendBatchFailure(c, req.Operations, steps, i, failure)
+			return
+		}
+	}
+
+	// The files go into the blob store only now that every operation has succeeded
+	for i, step := range steps {
+		if step.upload == nil {
+			continue
+		}
+		if _, err := step.upload.Commit(filepath.Ext(step.fileName)); err != nil {
+			log.Printf("ExecuteBatch: Failed to save file of operation %d: %v", i, err)
+			sendBatchFailure(c, req.Operations, steps, i, &batchError{http.StatusInternalServerError, "file_save_error", err.Error(), nil})
+			return
+		}
+	}
+
+	committed, err := batch.Commit()
+	if err != nil {
+		log.Printf("ExecuteBatch: %v", err)
+		failure := batchErrorFrom(err)
+		if len(committed) > 0 {
+			failure.code = "partially_committed"
+			failure.message = fmt.Sprintf("%v; periods %s were committed", err, strings.Join(committed, ", "))
+			failure.extra = gin.H{"committedPeriods": committed}
+		}
+		sendBatchFailure(c, req.Operations, steps, -1, failure)
+		return
+	}
+
+	results := make([]gin.H, len(steps))
+	for i, step := range steps {
+		switch step.op.Op {
+		case "create", "update":
+			if hash, ok := step.result["fileHash"].(string); ok {
+				addTimestampToResponse(step.result, step.target, step.newNO, hash)
+			}
+		case "move":
+			if err := copyDealTimestamp(step.period, step.dealID, step.target, step.newNO); err != nil {
+				log.Printf("ExecuteBatch: Warning - could not copy timestamp token: %v", err)
+			}
+		}
+		results[i] = step.result
+	}
+
+	middleware.SetAuditTarget(c, "", fmt.Sprintf("%d operations", len(steps)), "")
+	middleware.SetAuditAfter(c, results)
+
+	log.Printf("ExecuteBatch: Committed %d operations on periods %s", len(steps), strings.Join(committed, ", "))
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Batch completed successfully",
+		"results": results,
+	})
+}
+
+// planBatchStep checks an operation without touching any data. done are the steps before it.
+func planBatchStep(op *BatchOperation, done []*batchStep, refs map[string]int, user *models.User) (*batchStep, *batchError) {
+	invalid := func(message string) *batchError {
+		return &batchError{http.StatusBadRequest, "invalid_request", message, nil}
+	}
+
+	step := &batchStep{op: op, period: op.Period, dealID: op.DealID, ref: -1,
+		result: gin.H{"index": len(done), "op": op.Op, "status": "ok"}}
+	if op.Ref != "" {
+		if _, exists := refs[op.Ref]; exists {
+			return nil, invalid("ref is used by an earlier operation: " + op.Ref)
+		}
+		step.result["ref"] = op.Ref
+	}
+	if op.Op == "move" && step.period == "" {
+		step.period = op.FromPeriod
+	}
+
+	switch op.Op {
+	case "create":
+		if op.DealRef != "" || op.DealID != "" {
+			return nil, invalid("create does not take dealId or dealRef")
+		}
+	case "update", "delete", "move":
+		if op.DealRef != "" {
+			j, exists := refs[op.DealRef]
+			if !exists {
+				return nil, invalid("dealRef does not name an earlier operation: " + op.DealRef)
+			}
+			step.ref = j
+			step.period = done[j].target
+			step.dealID = ""
+		} else if op.DealID == "" {
+			return nil, invalid("dealId or dealRef is required")
+		}
+	default:
+		return nil, invalid("op must be create, update, delete or move")
+	}
+
+	if step.period == "" {
+		return nil, invalid("period is required")
+	}
+	step.target = step.period
+
+	switch op.Op {
+	case "create", "update":
+		if op.DealData == nil {
+			return nil, invalid("dealData is required")
+		}
+		op.DealData.InvoiceNumber = models.NormalizeRegistrationNumber(op.DealData.InvoiceNumber)
+		if op.DealData.InvoiceNumber != "" {
+			if err := models.ValidateRegistrationNumber(op.DealData.InvoiceNumber); err != nil {
+				return nil, &batchError{http.StatusBadRequest, "validation_error", err.Error(), nil}
+			}
+		}
+		if err := models.NormalizeDealTax(op.DealData); err != nil {
+			return nil, &batchError{http.StatusBadRequest, "validation_error", err.Error(), nil}
+		}
+
+	case "delete", "move":
+		// Deleting and moving deals is for accountants, as DELETE /deals/:dealId and PUT /deals/:dealId/to-otherperiod
+		if user.Role != models.RoleAccountant && user.Role != models.RoleAdmin {
+			return nil, &batchError{http.StatusForbidden, "forbidden", "Role " + user.Role + " is not allowed to " + op.Op + " deals", nil}
+		}
+		if op.Op == "move" {
+			if op.ToPeriod == "" {
+				return nil, invalid("toPeriod is required")
+			}
+			if op.ToPeriod == step.period {
+				return nil, invalid("Source and target periods must be different")
+			}
+			step.target = op.ToPeriod
+		}
+	}
+
+	return step, nil
+}
+
+// readBatchFile receives the file of a create or update operation.
+// On failure the error response has already been written.
+func readBatchFile(c *gin.Context, step *batchStep) bool {
+	file := step.op.FileData
+	if file == nil || (step.op.Op != "create" && step.op.Op != "update") {
+		return true
+	}
+
+	if file.Base64Data != "" {
+		upload, ok := readBase64Upload(c, "ExecuteBatch", file.Base64Data)
+		if !ok {
+			return false
+		}
+		step.upload = upload
+		file.Base64Data = ""
+		step.fileName = file.Name
+	} else if file.UploadID != "" {
+		upload, uploadName, ok := readSessionUpload(c, "ExecuteBatch", file.UploadID)
+		if !ok {
+			return false
+		}
+		step.upload = upload
+		step.fileName = file.Name
+		if step.fileName == "" {
+			step.fileName = uploadName
+		}
+	}
+
+	step.clientPath = file.Path
+	if filepath.Ext(step.fileName) == "" && filepath.Ext(file.Path) != "" {
+		step.fileName = clientFileName(file.Path)
+	}
+	return true
+}
+
+// batchRun holds what the operations of a batch share while they run
+type batchRun struct {
+	batch   *models.DealBatch
+	numbers *dealNumbers
+	actor   string
+	pending map[string]bool // hashes of the files of the batch, which enter the blob store on commit
+}
+
+// step runs one operation in the batch
+func (r *batchRun) step(step *batchStep) *batchError {
+	op := step.op
+	batch, numbers, actor := r.batch, r.numbers, r.actor
+	now := time.Now().Format("2006-01-02T15:04:05Z")
+
+	switch op.Op {
+	case "create":
+		deal := batchDealData(op.DealData)
+		deal.NO = numbers.allocate(step.target)
+		deal.RegUser = actor
+		r.setDealFile(step, &deal, nil)
+
+		if err := batch.CreateDeal(step.target, &deal); err != nil {
+			return batchErrorFrom(err)
+		}
+		step.newNO = deal.NO
+		step.result["period"] = step.target
+		step.result["dealNo"] = deal.NO
+
+	case "update":
+		oldDeal, err := batch.GetDeal(step.period, step.dealID)
+		if err != nil {
+			return batchErrorFrom(err)
+		}
+
+		deal := batchDealData(op.DealData)
+		deal.NO = generateBranchNumber(step.dealID)
+		prevNO := step.dealID
+		deal.PrevNO = &prevNO
+		deal.RecUpdate = now
+		deal.RegDate = now
+		deal.RegUser = actor
+		if err := r.setDealFile(step, &deal, oldDeal); err != nil {
+			return err
+		}
+
+		if err := batch.UpdateDeal(step.period, step.dealID, &deal); err != nil {
+			return batchErrorFrom(err)
+		}
+		step.newNO = deal.NO
+		step.result["period"] = step.period
+		step.result["dealNo"] = deal.NO
+		step.result["previousNo"] = step.dealID
+
+	case "delete":
+		if err := batch.DeleteDeal(step.period, step.dealID); err != nil {
+			return batchErrorFrom(err)
+		}
+		step.newNO = step.dealID
+		step.result["period"] = step.period
+		step.result["dealNo"] = step.dealID
+
+	case "move":
+		original, err := batch.GetDeal(step.period, step.dealID)
+		if err != nil {
+			return batchErrorFrom(err)
+		}
+
+		deal := batchDealData(original)
+		deal.NO = numbers.allocate(step.target)
+		deal.PartnerID = original.PartnerID
+		deal.RegUser = actor
+		if err := r.setDealFile(step, &deal, original); err != nil {
+			return err
+		}
+
+		if err := batch.MoveDeal(step.period, step.dealID, step.target, &deal); err != nil {
+			return batchErrorFrom(err)
+		}
+		step.newNO = deal.NO
+		step.result["originalNo"] = step.dealID
+		step.result["fromPeriod"] = step.period
+		step.result["toPeriod"] = step.target
+		step.result["dealNo"] = deal.NO
+		step.result["fileMoved"] = deal.FilePath != ""
+	}
+
+	return nil
+}
+
+// batchDealData copies the fields of a deal that clients enter; numbers, status, file
+// and registration details are always set by the server
+func batchDealData(from *models.Deal) models.Deal {
+	return models.Deal{
+		DealType:          from.DealType,
+		DealDate:          from.DealDate,
+		DealName:          from.DealName,
+		DealPartner:       from.DealPartner,
+		DealPrice:         from.DealPrice,
+		DealRemark:        from.DealRemark,
+		InvoiceNumber:     from.InvoiceNumber,
+		TaxRate:           from.TaxRate,
+		PriceExcludingTax: from.PriceExcludingTax,
+		TaxAmount:         from.TaxAmount,
+		TaxLines:          from.TaxLines,
+		RecStatus:         "NEW",
+	}
+}
+
+// setDealFile sets the file of a new deal record: the file received for the step,
+// or else the file of previous, the record it replaces
+func (r *batchRun) setDealFile(step *batchStep, deal *models.Deal, previous *models.Deal) *batchError {
+	var ext string
+	switch {
+	case step.upload != nil:
+		ext = filepath.Ext(step.fileName)
+		deal.Hash = step.upload.Hash()
+		setUploadedFileInfo(deal, step.fileName, step.clientPath)
+		step.result["fileSize"] = step.upload.Size()
+	case previous != nil && previous.FilePath != "":
+		// A file still in the period folder is moved into the blob store first;
+		// a file received earlier in the batch is stored on commit
+		if previous.FileStore != models.FileStoreBlob || !r.pending[previous.Hash] {
+			if _, err := models.StoreDealBlob(step.period, previous); err != nil {
+				return &batchError{http.StatusInternalServerError, "file_error",
+					fmt.Sprintf("Could not keep the attached file of deal %s: %v", previous.NO, err), nil}
+			}
+		}
+		ext = filepath.Ext(previous.FilePath)
+		deal.Hash = previous.Hash
+		copyUploadedFileInfo(deal, previous)
+	default:
+		return nil
+	}
+
+	deal.FilePath = fmt.Sprintf("%s_%s_%s_%d%s",
+		deal.NO,
+		deal.DealDate,
+		strings.ReplaceAll(deal.DealPartner, "/", "_"),
+		deal.DealPrice,
+		ext)
+	deal.FileStore = models.FileStoreBlob
+	step.result["filePath"] = deal.FilePath
+	step.result["fileHash"] = deal.Hash
+	return nil
+}
+
+// batchErrorFrom maps an error of the models to the failure of an operation
+func batchErrorFrom(err error) *batchError {
+	message := err.Error()
+	switch {
+	case strings.Contains(message, "not found"), strings.Contains(message, "does not exist"):
+		return &batchError{http.StatusNotFound, "not_found", message, nil}
+	case strings.Contains(message, "already"), strings.Contains(message, "not the current version"):
+		return &batchError{http.StatusConflict, "resource_conflict", message, nil}
+	}
+	return &batchError{http.StatusInternalServerError, "database_error", message, nil}
+}
+
+// sendBatchFailure writes the response of a batch that was not committed. failed is the
+// index of the operation that failed, or -1 if the batch as a whole failed.
+// Operations before it were rolled back and those after it were not run; if a commit
+// failed after some periods were committed, the operations on those periods are reported
+// as committed.
+func sendBatchFailure(c *gin.Context, ops []BatchOperation, steps []*batchStep, failed int, failure *batchError) {
+	committed := map[string]bool{}
+	if periods, ok := failure.extra["committedPeriods"].([]string); ok {
+		for _, period := range periods {
+			committed[period] = true
+		}
+	}
+
+	results := make([]gin.H, len(ops))
+	for i := range ops {
+		result := gin.H{"index": i, "op": ops[i].Op, "status": "not_run"}
+		if step := steps[i]; step != nil && step.newNO != "" {
+			switch {
+			case committed[step.period] && committed[step.target]:
+				result["status"] = "committed"
+				result["dealNo"] = step.newNO
+			case committed[step.period] || committed[step.target]:
+				result["status"] = "partially_committed"
+				result["dealNo"] = step.newNO
+			default:
+				result["status"] = "rolled_back"
+			}
+		}
+		if i == failed {
+			result["status"] = "failed"
+			result["error"] = failure.code
+			result["message"] = failure.message
+		}
+		results[i] = result
+	}
+
+	response := gin.H{
+		"success":     false,
+		"error":       failure.code,
+		"message":     failure.message,
+		"failedIndex": failed,
+		"results":     results,
+	}
+	for key, value := range failure.extra {
+		response[key] = value
+	}
+	c.JSON(failure.status, response)
+}
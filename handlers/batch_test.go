@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"denchokun-api/middleware"
+	"denchokun-api/models"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// batchResponse is the body of POST /batch
+type batchResponse struct {
+	Success     bool                     `json:"success"`
+	Error       string                   `json:"error"`
+	Message     string                   `json:"message"`
+	FailedIndex *int                     `json:"failedIndex"`
+	Results     []map[string]interface{} `json:"results"`
+}
+
+// postBatch runs ExecuteBatch with body as a user of role
+func postBatch(t *testing.T, role, body string) (int, batchResponse) {
+	t.Helper()
+	router := gin.New()
+	router.POST("/batch", func(c *gin.Context) {
+		c.Set(middleware.UserKey, &models.User{Username: "tester", Role: role})
+		c.Set(middleware.ActorKey, "tester")
+	}, ExecuteBatch)
+
+	req := httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var response batchResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("status %d, body %s: %v", w.Code, w.Body, err)
+	}
+	return w.Code, response
+}
+
+// periodDeals returns the deals of a period in the history view, by number
+func periodDeals(t *testing.T, period string) map[string]models.Deal {
+	t.Helper()
+	deals, _, err := models.GetDeals(&models.DealFilter{Period: period, View: "history"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	byNO := map[string]models.Deal{}
+	for _, deal := range deals {
+		byNO[deal.NO] = deal
+	}
+	return byNO
+}
+
+func TestExecuteBatchResolvesDealRef(t *testing.T) {
+	setupTestDB(t)
+
+	code, response := postBatch(t, models.RoleAccountant, `{"operations": [
+		{"op": "create", "ref": "a", "period": "2025",
+		 "dealData": {"DealType": "領収書", "DealDate": "2025-04-01", "DealName": "文房具", "DealPartner": "テスト商店", "DealPrice": 1100}},
+		{"op": "update", "ref": "b", "dealRef": "a",
+		 "dealData": {"DealType": "領収書", "DealDate": "2025-04-01", "DealName": "文房具", "DealPartner": "テスト商店", "DealPrice": 2200}},
+		{"op": "move", "dealRef": "b", "toPeriod": "2026"}
+	]}`)
+	if code != http.StatusOK || !response.Success {
+		t.Fatalf("status %d, %+v", code, response)
+	}
+
+	created := response.Results[0]["dealNo"].(string)
+	updated := response.Results[1]["dealNo"].(string)
+	if got := response.Results[1]["previousNo"]; got != created {
+		t.Errorf("update replaced %v, want the created deal %s", got, created)
+	}
+	if got := response.Results[2]["originalNo"]; got != updated {
+		t.Errorf("move moved %v, want the updated deal %s", got, updated)
+	}
+	if got := response.Results[2]["fromPeriod"]; got != "2025" {
+		t.Errorf("move fromPeriod = %v, want the period of the updated deal", got)
+	}
+
+	deals := periodDeals(t, "2025")
+	if deal := deals[created]; deal.RecStatus != "UPDATE" || deal.NextNO == nil || *deal.NextNO != updated {
+		t.Errorf("created deal: %+v", deal)
+	}
+	if deal := deals[updated]; deal.RecStatus != "DELETE" || deal.DealPrice != 2200 {
+		t.Errorf("updated deal: %+v", deal)
+	}
+	moved := periodDeals(t, "2026")[response.Results[2]["dealNo"].(string)]
+	if moved.RecStatus != "NEW" || moved.DealPrice != 2200 {
+		t.Errorf("moved deal: %+v", moved)
+	}
+}
+
+func TestExecuteBatchChecksRoleOfEachOperation(t *testing.T) {
+	setupTestDB(t)
+	if _, err := models.ConnectToPeriod("2025"); err != nil {
+		t.Fatal(err)
+	}
+	deal := &models.Deal{NO: "20250401_000001", DealType: "領収書", DealDate: "2025-04-01",
+		DealName: "文房具", DealPartner: "テスト商店", DealPrice: 1100, RecStatus: "NEW"}
+	if err := models.CreateDeal("2025", deal); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, op := range []string{
+		`{"op": "delete", "period": "2025", "dealId": "20250401_000001"}`,
+		`{"op": "move", "period": "2025", "dealId": "20250401_000001", "toPeriod": "2026"}`,
+	} {
+		code, response := postBatch(t, models.RoleClerk, `{"operations": [
+			{"op": "create", "period": "2025",
+			 "dealData": {"DealType": "領収書", "DealDate": "2025-04-02", "DealName": "切手", "DealPartner": "郵便局", "DealPrice": 84}},
+			`+op+`
+		]}`)
+		if code != http.StatusForbidden || response.Error != "forbidden" {
+			t.Errorf("%s: status %d, %+v", op, code, response)
+			continue
+		}
+		if response.FailedIndex == nil || *response.FailedIndex != 1 {
+			t.Errorf("%s: failedIndex %v, want 1", op, response.FailedIndex)
+		}
+		if got := response.Results[0]["status"]; got != "not_run" {
+			t.Errorf("%s: create status %v, want not_run", op, got)
+		}
+	}
+
+	if deals := periodDeals(t, "2025"); len(deals) != 1 || deals[deal.NO].RecStatus != "NEW" {
+		t.Errorf("deals after refused batches: %+v", deals)
+	}
+
+	// Accountants may delete in a batch
+	code, response := postBatch(t, models.RoleAccountant,
+		`{"operations": [{"op": "delete", "period": "2025", "dealId": "20250401_000001"}]}`)
+	if code != http.StatusOK || !response.Success {
+		t.Errorf("accountant: status %d, %+v", code, response)
+	}
+}
+
+func TestExecuteBatchRollsBackOnFailure(t *testing.T) {
+	setupTestDB(t)
+
+	code, response := postBatch(t, models.RoleAccountant, `{"operations": [
+		{"op": "create", "ref": "a", "period": "2025",
+		 "dealData": {"DealType": "領収書", "DealDate": "2025-04-01", "DealName": "文房具", "DealPartner": "テスト商店", "DealPrice": 1100}},
+		{"op": "delete", "dealRef": "a"},
+		{"op": "update", "period": "2025", "dealId": "20250401_999999",
+		 "dealData": {"DealType": "領収書", "DealDate": "2025-04-01", "DealName": "文房具", "DealPartner": "テスト商店", "DealPrice": 2200}},
+		{"op": "create", "period": "2025",
+		 "dealData": {"DealType": "領収書", "DealDate": "2025-04-02", "DealName": "切手", "DealPartner": "郵便局", "DealPrice": 84}}
+	]}`)
+	if code != http.StatusNotFound || response.Success || response.Error != "not_found" || response.Message == "" {
+		t.Fatalf("status %d, %+v", code, response)
+	}
+	if response.FailedIndex == nil || *response.FailedIndex != 2 {
+		t.Errorf("failedIndex %v, want 2", response.FailedIndex)
+	}
+
+	want := []string{"rolled_back", "rolled_back", "failed", "not_run"}
+	if len(response.Results) != len(want) {
+		t.Fatalf("%d results, want %d", len(response.Results), len(want))
+	}
+	for i, result := range response.Results {
+		if result["index"] != float64(i) || result["status"] != want[i] {
+			t.Errorf("result %d: %v, want status %s", i, result, want[i])
+		}
+		if _, hasNO := result["dealNo"]; hasNO {
+			t.Errorf("result %d reports a deal number that was not committed: %v", i, result)
+		}
+	}
+	if failed := response.Results[2]; failed["error"] != "not_found" || failed["message"] != response.Message {
+		t.Errorf("failed result: %v", failed)
+	}
+
+	if deals := periodDeals(t, "2025"); len(deals) != 0 {
+		t.Errorf("deals after rollback: %+v", deals)
+	}
+}
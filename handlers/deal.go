@@ -1,17 +1,12 @@
 package handlers
 
 import (
-	"crypto/sha256"
+	"denchokun-api/middleware"
 	"denchokun-api/models"
-	"denchokun-api/utils"
-	"encoding/base64"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
-	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
@@ -33,36 +28,33 @@ type FileRequest struct {
 	Size       int64  `json:"size"`
 	Hash       string `json:"hash"`
 	Base64Data string `json:"base64Data,omitempty"`
+	UploadID   string `json:"uploadId,omitempty"` // completed upload of POST /uploads
 }
 
 func CreateDeal(c *gin.Context) {
 	log.Println("CreateDeal: Starting request processing")
-	
+
 	// Check content type to determine how to parse the request
 	contentType := c.GetHeader("Content-Type")
 	log.Printf("CreateDeal: Content-Type = %s", contentType)
-	
+
 	var req DealRequest
-	var fileData []byte
+	var upload *models.BlobWriter
 	var fileName string
+	var clientPath string
 	var fileSize int64
-	
+	defer func() { abortUpload(upload) }()
+
 	if strings.Contains(contentType, "multipart/form-data") {
 		log.Println("CreateDeal: Processing multipart/form-data request")
-		// Handle multipart/form-data request
-		form, err := c.MultipartForm()
-		if err != nil {
-			log.Printf("CreateDeal: Failed to parse multipart form: %v", err)
-			c.JSON(http.StatusBadRequest, gin.H{
-				"success": false,
-				"error":   "invalid_request",
-				"message": "Failed to parse multipart form",
-			})
+		// Handle multipart/form-data request; the file is streamed to a temp file while it is hashed
+		dealDataStr, uploadPath, fileUpload, uploadName, ok := readMultipartDeal(c, "CreateDeal")
+		if !ok {
 			return
 		}
-		
+		upload, fileName, clientPath = fileUpload, uploadName, uploadPath
+
 		// Parse JSON dealData from form
-		dealDataStr := c.PostForm("dealData")
 		log.Printf("CreateDeal: dealData = %s", dealDataStr)
 		if dealDataStr == "" {
 			log.Println("CreateDeal: dealData is empty")
@@ -73,19 +65,24 @@ func CreateDeal(c *gin.Context) {
 			})
 			return
 		}
-		
+
 		// Create a temporary structure for parsing multipart data
 		type MultipartDealData struct {
-			Period      string `json:"period"`
-			DealType    string `json:"DealType"`
-			DealDate    string `json:"DealDate"`
-			DealName    string `json:"DealName"`
-			DealPartner string `json:"DealPartner"`
-			DealPrice   int    `json:"DealPrice"`
-			DealRemark  string `json:"DealRemark"`
-			RecStatus   string `json:"RecStatus"`
+			Period            string           `json:"period"`
+			DealType          string           `json:"DealType"`
+			DealDate          string           `json:"DealDate"`
+			DealName          string           `json:"DealName"`
+			DealPartner       string           `json:"DealPartner"`
+			DealPrice         int              `json:"DealPrice"`
+			DealRemark        string           `json:"DealRemark"`
+			RecStatus         string           `json:"RecStatus"`
+			InvoiceNumber     string           `json:"InvoiceNumber"`
+			TaxRate           string           `json:"TaxRate"`
+			PriceExcludingTax int              `json:"PriceExcludingTax"`
+			TaxAmount         int              `json:"TaxAmount"`
+			TaxLines          []models.TaxLine `json:"TaxLines"`
 		}
-		
+
 		var multipartData MultipartDealData
 		if err := json.Unmarshal([]byte(dealDataStr), &multipartData); err != nil {
 			log.Printf("CreateDeal: Failed to unmarshal dealData JSON: %v", err)
@@ -97,7 +94,7 @@ func CreateDeal(c *gin.Context) {
 			return
 		}
 		log.Printf("CreateDeal: Parsed multipartData: %+v", multipartData)
-		
+
 		// Convert to DealRequest
 		req.Period = multipartData.Period
 		// If period is still empty, try to get it from query parameter
@@ -116,60 +113,26 @@ func CreateDeal(c *gin.Context) {
 			return
 		}
 		req.DealData = models.Deal{
-			DealType:    multipartData.DealType,
-			DealDate:    multipartData.DealDate,
-			DealName:    multipartData.DealName,
-			DealPartner: multipartData.DealPartner,
-			DealPrice:   multipartData.DealPrice,
-			DealRemark:  multipartData.DealRemark,
-			RecStatus:   multipartData.RecStatus,
-		}
-		
-		// Handle file upload if present
-		files := form.File["file"]
-		if len(files) > 0 {
-			file := files[0]
-			fileName = file.Filename
-			fileSize = file.Size
-			
-			// Check file size (max 100MB)
-			const maxFileSize = 100 * 1024 * 1024 // 100MB
-			if fileSize > maxFileSize {
-				c.JSON(http.StatusBadRequest, gin.H{
-					"success": false,
-					"error":   "file_too_large",
-					"message": "ファイルサイズが100MBを超えています",
-					"maxSize": maxFileSize,
-				})
-				return
-			}
-			
-			// Read file content
-			f, err := file.Open()
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{
-					"success": false,
-					"error":   "file_read_error",
-					"message": "Failed to open uploaded file",
-				})
-				return
-			}
-			defer f.Close()
-			
-			// Use io.ReadAll to read the entire file
-			fileData, err = io.ReadAll(f)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{
-					"success": false,
-					"error":   "file_read_error",
-					"message": "Failed to read uploaded file",
-				})
-				return
-			}
+			DealType:          multipartData.DealType,
+			DealDate:          multipartData.DealDate,
+			DealName:          multipartData.DealName,
+			DealPartner:       multipartData.DealPartner,
+			DealPrice:         multipartData.DealPrice,
+			DealRemark:        multipartData.DealRemark,
+			RecStatus:         multipartData.RecStatus,
+			InvoiceNumber:     multipartData.InvoiceNumber,
+			TaxRate:           multipartData.TaxRate,
+			PriceExcludingTax: multipartData.PriceExcludingTax,
+			TaxAmount:         multipartData.TaxAmount,
+			TaxLines:          multipartData.TaxLines,
 		}
 	} else {
 		// Handle JSON request (existing code)
+		limitRequestBody(c, true)
 		if err := c.ShouldBindJSON(&req); err != nil {
+			if sendUploadTooLarge(c, err) {
+				return
+			}
 			c.JSON(http.StatusBadRequest, gin.H{
 				"success": false,
 				"error":   "invalid_request",
@@ -181,7 +144,7 @@ func CreateDeal(c *gin.Context) {
 		// Validate file data consistency
 		if req.FileData != nil {
 			// Check if size is declared but no data provided
-			if req.FileData.Size > 0 && req.FileData.Base64Data == "" {
+			if req.FileData.Size > 0 && req.FileData.Base64Data == "" && req.FileData.UploadID == "" {
 				c.JSON(http.StatusBadRequest, gin.H{
 					"success": false,
 					"error":   "invalid_file_data",
@@ -193,23 +156,31 @@ func CreateDeal(c *gin.Context) {
 
 		// If base64 file data is provided in JSON
 		if req.FileData != nil && req.FileData.Base64Data != "" {
-			var err error
-			fileData, err = base64.StdEncoding.DecodeString(req.FileData.Base64Data)
-			if err != nil {
-				c.JSON(http.StatusBadRequest, gin.H{
-					"success": false,
-					"error":   "invalid_file_data",
-					"message": "Failed to decode base64 file data",
-				})
+			fileUpload, ok := readBase64Upload(c, "CreateDeal", req.FileData.Base64Data)
+			if !ok {
 				return
 			}
+			upload = fileUpload
 			fileName = req.FileData.Name
-			fileSize = int64(len(fileData))
+			clientPath = req.FileData.Path
+			req.FileData.Base64Data = ""
+		} else if req.FileData != nil && req.FileData.UploadID != "" {
+			// A file sent in chunks with the upload API
+			fileUpload, uploadName, ok := readSessionUpload(c, "CreateDeal", req.FileData.UploadID)
+			if !ok {
+				return
+			}
+			upload = fileUpload
+			fileName = req.FileData.Name
+			clientPath = req.FileData.Path
+			if fileName == "" {
+				fileName = uploadName
+			}
 		}
 	}
 
 	log.Printf("CreateDeal: Connecting to period: %s", req.Period)
-	if err := models.ConnectToPeriod(req.Period); err != nil {
+	if _, err := models.ConnectToPeriod(req.Period); err != nil {
 		log.Printf("CreateDeal: Failed to connect to period %s: %v", req.Period, err)
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"success": false,
@@ -219,13 +190,17 @@ func CreateDeal(c *gin.Context) {
 		return
 	}
 
+	if !validateDealInvoiceNumber(c, &req.DealData) || !validateDealTax(c, &req.DealData) {
+		return
+	}
+
 	// Always generate deal number on server side
 	log.Println("CreateDeal: Generating deal number on server")
 	req.DealData.NO = generateDealNumber(c, "")
 	log.Printf("CreateDeal: Generated deal number: %s", req.DealData.NO)
-	
+
 	// Check if the generated deal number already exists (extremely rare)
-	existingDeal, err := models.GetDealByID(req.DealData.NO)
+	existingDeal, err := models.GetDealByID(req.Period, req.DealData.NO)
 	if err == nil && existingDeal != nil {
 		// If it exists, generate a sequence number
 		req.DealData.NO = generateSequenceNumber(req.DealData.NO)
@@ -233,11 +208,11 @@ func CreateDeal(c *gin.Context) {
 	}
 
 	// Process file if present (from either multipart or JSON base64)
-	if len(fileData) > 0 {
-		log.Printf("CreateDeal: Processing file data, size: %d bytes", len(fileData))
-		// Calculate hash
-		hash := sha256.Sum256(fileData)
-		req.DealData.Hash = hex.EncodeToString(hash[:])
+	if upload != nil {
+		log.Printf("CreateDeal: Processing file data, size: %d bytes", upload.Size())
+		// The hash was calculated while the file was received
+		req.DealData.Hash = upload.Hash()
+		fileSize = upload.Size()
 		log.Printf("CreateDeal: File hash calculated: %s", req.DealData.Hash)
 
 		// Always generate file path with server-generated deal number
@@ -257,35 +232,6 @@ func CreateDeal(c *gin.Context) {
 		filePath = generatedFileName
 		log.Printf("CreateDeal: Generated file path: %s", filePath)
 
-		// Ensure period directory exists
-		periodDir := filepath.Join(models.GetBasePath(), req.Period)
-		log.Printf("CreateDeal: Creating directory: %s", periodDir)
-		if err := os.MkdirAll(periodDir, 0755); err != nil {
-			log.Printf("CreateDeal: Failed to create directory: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"success": false,
-				"error":   "directory_create_error",
-				"message": "Failed to create period directory",
-			})
-			return
-		}
-
-		// Save file
-		fullPath := filepath.Join(periodDir, filePath)
-		log.Printf("CreateDeal: Saving file to: %s", fullPath)
-		if err := utils.SaveFileAtomic(fullPath, fileData); err != nil {
-			log.Printf("CreateDeal: Failed to save file: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"success": false,
-				"error":   "file_save_error",
-				"message": err.Error(),
-			})
-			return
-		}
-
-		req.DealData.FilePath = filePath
-		log.Println("CreateDeal: File processing completed")
-
 		// Check for duplicate hash across all periods (unless force flag is set)
 		forceUpload := c.Query("force") == "true"
 		log.Printf("CreateDeal: Checking for duplicate hash across all periods, force=%v", forceUpload)
@@ -321,18 +267,25 @@ func CreateDeal(c *gin.Context) {
 			log.Printf("CreateDeal: Duplicate file detected but force flag is set, proceeding with registration")
 		}
 
-		// After duplicate check, connect back to the target period for actual registration
-		log.Printf("CreateDeal: Reconnecting to target period: %s", req.Period)
-		if err := models.ConnectToPeriod(req.Period); err != nil {
-			log.Printf("CreateDeal: Failed to reconnect to period %s: %v", req.Period, err)
+		// Store the file in the blob store; the same content is kept only once
+		log.Printf("CreateDeal: Storing file in blob store: %s", filePath)
+		if _, err := upload.Commit(ext); err != nil {
+			log.Printf("CreateDeal: Failed to save file: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{
 				"success": false,
-				"error":   "connection_error",
+				"error":   "file_save_error",
 				"message": err.Error(),
 			})
 			return
 		}
+
+		req.DealData.FilePath = filePath
+		req.DealData.FileStore = models.FileStoreBlob
+		setUploadedFileInfo(&req.DealData, fileName, clientPath)
+		log.Println("CreateDeal: File processing completed")
 	} else {
+		// File details are only recorded by the server
+		copyUploadedFileInfo(&req.DealData, &models.Deal{})
 		log.Println("CreateDeal: No file data to process")
 	}
 
@@ -345,9 +298,11 @@ func CreateDeal(c *gin.Context) {
 	if req.DealData.RecUpdate == "" {
 		req.DealData.RecUpdate = now
 	}
+	// The registrant is always the authenticated user, never the request body
+	req.DealData.RegUser = c.GetString(middleware.ActorKey)
 
 	log.Printf("CreateDeal: Creating deal in database: %+v", req.DealData)
-	if err := models.CreateDeal(&req.DealData); err != nil {
+	if err := models.CreateDeal(req.Period, &req.DealData); err != nil {
 		log.Printf("CreateDeal: Database create failed: %v", err)
 		if strings.Contains(err.Error(), "already exists") {
 			c.JSON(http.StatusConflict, gin.H{
@@ -366,6 +321,9 @@ func CreateDeal(c *gin.Context) {
 		return
 	}
 
+	middleware.SetAuditTarget(c, req.Period, req.DealData.NO, req.DealData.NO)
+	middleware.SetAuditAfter(c, req.DealData)
+
 	// Build response
 	response := gin.H{
 		"success": true,
@@ -378,16 +336,17 @@ func CreateDeal(c *gin.Context) {
 		response["filePath"] = req.DealData.FilePath
 		response["fileSize"] = fileSize
 		response["fileHash"] = req.DealData.Hash
+		addTimestampToResponse(response, req.Period, req.DealData.NO, req.DealData.Hash)
 
 		// Add warning if duplicate was found but force flag was used
-		if forceUpload := c.Query("force") == "true"; forceUpload && len(fileData) > 0 {
+		if forceUpload := c.Query("force") == "true"; forceUpload && upload != nil {
 			allDuplicates, _ := models.GetDealsByHashAllPeriods(req.DealData.Hash)
 			if len(allDuplicates) > 0 {
 				var duplicateWarnings []gin.H
 				for _, dup := range allDuplicates {
 					// Include all duplicates from all periods
 					duplicateWarnings = append(duplicateWarnings, gin.H{
-						"NO": dup.NO,
+						"NO":     dup.NO,
 						"Period": dup.Period,
 					})
 				}
@@ -413,15 +372,19 @@ func GetDeals(c *gin.Context) {
 		return
 	}
 
-	if err := models.ConnectToPeriod(filter.Period); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
+	if err := models.ValidateDealFilter(&filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
 			"success": false,
-			"error":   "connection_error",
+			"error":   "invalid_request",
 			"message": err.Error(),
 		})
 		return
 	}
 
+	if !connectExistingPeriod(c, filter.Period) {
+		return
+	}
+
 	// Default to "flat" view if not specified
 	if filter.View == "" {
 		filter.View = "flat"
@@ -478,19 +441,22 @@ func GetDeal(c *gin.Context) {
 		return
 	}
 
+	// The period must be given explicitly; deal numbers are only unique within a period
 	period := c.Query("period")
-	if period != "" {
-		if err := models.ConnectToPeriod(period); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"success": false,
-				"error":   "connection_error",
-				"message": err.Error(),
-			})
-			return
-		}
+	if period == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid_request",
+			"message": "Period is required",
+		})
+		return
 	}
 
-	deal, err := models.GetDealByID(dealID)
+	if !connectExistingPeriod(c, period) {
+		return
+	}
+
+	deal, err := models.GetDealByID(period, dealID)
 	if err != nil {
 		if strings.Contains(err.Error(), "not found") {
 			c.JSON(http.StatusNotFound, gin.H{
@@ -527,32 +493,28 @@ func UpdateDeal(c *gin.Context) {
 	}
 
 	log.Printf("UpdateDeal: Starting request processing for dealId: %s", dealID)
-	
+
 	// Check content type to determine how to parse the request
 	contentType := c.GetHeader("Content-Type")
 	log.Printf("UpdateDeal: Content-Type = %s", contentType)
-	
+
 	var req DealRequest
-	var fileData []byte
+	var upload *models.BlobWriter
 	var fileName string
+	var clientPath string
 	var fileSize int64
-	
+	defer func() { abortUpload(upload) }()
+
 	if strings.Contains(contentType, "multipart/form-data") {
 		log.Println("UpdateDeal: Processing multipart/form-data request")
-		// Handle multipart/form-data request
-		form, err := c.MultipartForm()
-		if err != nil {
-			log.Printf("UpdateDeal: Failed to parse multipart form: %v", err)
-			c.JSON(http.StatusBadRequest, gin.H{
-				"success": false,
-				"error":   "invalid_request",
-				"message": "Failed to parse multipart form",
-			})
+		// Handle multipart/form-data request; the file is streamed to a temp file while it is hashed
+		dealDataStr, uploadPath, fileUpload, uploadName, ok := readMultipartDeal(c, "UpdateDeal")
+		if !ok {
 			return
 		}
-		
+		upload, fileName, clientPath = fileUpload, uploadName, uploadPath
+
 		// Parse JSON dealData from form
-		dealDataStr := c.PostForm("dealData")
 		log.Printf("UpdateDeal: dealData = %s", dealDataStr)
 		if dealDataStr == "" {
 			log.Println("UpdateDeal: dealData is empty")
@@ -563,19 +525,24 @@ func UpdateDeal(c *gin.Context) {
 			})
 			return
 		}
-		
+
 		// Create a temporary structure for parsing multipart data
 		type MultipartDealData struct {
-			Period      string `json:"period"`
-			DealType    string `json:"DealType"`
-			DealDate    string `json:"DealDate"`
-			DealName    string `json:"DealName"`
-			DealPartner string `json:"DealPartner"`
-			DealPrice   int    `json:"DealPrice"`
-			DealRemark  string `json:"DealRemark"`
-			RecStatus   string `json:"RecStatus"`
+			Period            string           `json:"period"`
+			DealType          string           `json:"DealType"`
+			DealDate          string           `json:"DealDate"`
+			DealName          string           `json:"DealName"`
+			DealPartner       string           `json:"DealPartner"`
+			DealPrice         int              `json:"DealPrice"`
+			DealRemark        string           `json:"DealRemark"`
+			RecStatus         string           `json:"RecStatus"`
+			InvoiceNumber     string           `json:"InvoiceNumber"`
+			TaxRate           string           `json:"TaxRate"`
+			PriceExcludingTax int              `json:"PriceExcludingTax"`
+			TaxAmount         int              `json:"TaxAmount"`
+			TaxLines          []models.TaxLine `json:"TaxLines"`
 		}
-		
+
 		var multipartData MultipartDealData
 		if err := json.Unmarshal([]byte(dealDataStr), &multipartData); err != nil {
 			log.Printf("UpdateDeal: Failed to unmarshal dealData JSON: %v", err)
@@ -587,7 +554,7 @@ func UpdateDeal(c *gin.Context) {
 			return
 		}
 		log.Printf("UpdateDeal: Parsed multipartData: %+v", multipartData)
-		
+
 		// Convert to DealRequest
 		req.Period = multipartData.Period
 		// If period is empty in multipart data, try to get it from query parameter
@@ -605,59 +572,25 @@ func UpdateDeal(c *gin.Context) {
 			return
 		}
 		req.DealData = models.Deal{
-			DealType:    multipartData.DealType,
-			DealDate:    multipartData.DealDate,
-			DealName:    multipartData.DealName,
-			DealPartner: multipartData.DealPartner,
-			DealPrice:   multipartData.DealPrice,
-			DealRemark:  multipartData.DealRemark,
-		}
-		
-		// Handle file upload if present
-		files := form.File["file"]
-		if len(files) > 0 {
-			file := files[0]
-			fileName = file.Filename
-			fileSize = file.Size
-			
-			// Check file size (max 100MB)
-			const maxFileSize = 100 * 1024 * 1024 // 100MB
-			if fileSize > maxFileSize {
-				c.JSON(http.StatusBadRequest, gin.H{
-					"success": false,
-					"error":   "file_too_large",
-					"message": "ファイルサイズが100MBを超えています",
-					"maxSize": maxFileSize,
-				})
-				return
-			}
-			
-			// Read file content
-			f, err := file.Open()
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{
-					"success": false,
-					"error":   "file_read_error",
-					"message": "Failed to open uploaded file",
-				})
-				return
-			}
-			defer f.Close()
-			
-			// Use io.ReadAll to read the entire file
-			fileData, err = io.ReadAll(f)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{
-					"success": false,
-					"error":   "file_read_error",
-					"message": "Failed to read uploaded file",
-				})
-				return
-			}
+			DealType:          multipartData.DealType,
+			DealDate:          multipartData.DealDate,
+			DealName:          multipartData.DealName,
+			DealPartner:       multipartData.DealPartner,
+			DealPrice:         multipartData.DealPrice,
+			DealRemark:        multipartData.DealRemark,
+			InvoiceNumber:     multipartData.InvoiceNumber,
+			TaxRate:           multipartData.TaxRate,
+			PriceExcludingTax: multipartData.PriceExcludingTax,
+			TaxAmount:         multipartData.TaxAmount,
+			TaxLines:          multipartData.TaxLines,
 		}
 	} else {
 		// Handle JSON request (existing code)
+		limitRequestBody(c, true)
 		if err := c.ShouldBindJSON(&req); err != nil {
+			if sendUploadTooLarge(c, err) {
+				return
+			}
 			c.JSON(http.StatusBadRequest, gin.H{
 				"success": false,
 				"error":   "invalid_request",
@@ -669,7 +602,7 @@ func UpdateDeal(c *gin.Context) {
 		// Validate file data consistency
 		if req.FileData != nil {
 			// Check if size is declared but no data provided
-			if req.FileData.Size > 0 && req.FileData.Base64Data == "" {
+			if req.FileData.Size > 0 && req.FileData.Base64Data == "" && req.FileData.UploadID == "" {
 				c.JSON(http.StatusBadRequest, gin.H{
 					"success": false,
 					"error":   "invalid_file_data",
@@ -693,26 +626,34 @@ func UpdateDeal(c *gin.Context) {
 			})
 			return
 		}
-		
+
 		// If base64 file data is provided in JSON
 		if req.FileData != nil && req.FileData.Base64Data != "" {
-			var err error
-			fileData, err = base64.StdEncoding.DecodeString(req.FileData.Base64Data)
-			if err != nil {
-				c.JSON(http.StatusBadRequest, gin.H{
-					"success": false,
-					"error":   "invalid_file_data",
-					"message": "Failed to decode base64 file data",
-				})
+			fileUpload, ok := readBase64Upload(c, "UpdateDeal", req.FileData.Base64Data)
+			if !ok {
 				return
 			}
+			upload = fileUpload
 			fileName = req.FileData.Name
-			fileSize = int64(len(fileData))
+			clientPath = req.FileData.Path
+			req.FileData.Base64Data = ""
+		} else if req.FileData != nil && req.FileData.UploadID != "" {
+			// A file sent in chunks with the upload API
+			fileUpload, uploadName, ok := readSessionUpload(c, "UpdateDeal", req.FileData.UploadID)
+			if !ok {
+				return
+			}
+			upload = fileUpload
+			fileName = req.FileData.Name
+			clientPath = req.FileData.Path
+			if fileName == "" {
+				fileName = uploadName
+			}
 		}
 	}
 
 	log.Printf("UpdateDeal: Connecting to period: %s", req.Period)
-	if err := models.ConnectToPeriod(req.Period); err != nil {
+	if _, err := models.ConnectToPeriod(req.Period); err != nil {
 		log.Printf("UpdateDeal: Failed to connect to period %s: %v", req.Period, err)
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"success": false,
@@ -722,8 +663,12 @@ func UpdateDeal(c *gin.Context) {
 		return
 	}
 
+	if !validateDealInvoiceNumber(c, &req.DealData) || !validateDealTax(c, &req.DealData) {
+		return
+	}
+
 	// Get the original deal
-	oldDeal, err := models.GetDealByID(dealID)
+	oldDeal, err := models.GetDealByID(req.Period, dealID)
 	if err != nil {
 		if strings.Contains(err.Error(), "not found") {
 			c.JSON(http.StatusNotFound, gin.H{
@@ -740,17 +685,19 @@ func UpdateDeal(c *gin.Context) {
 		})
 		return
 	}
+	middleware.SetAuditTarget(c, req.Period, dealID, "")
+	middleware.SetAuditBefore(c, *oldDeal)
 
 	// Generate new deal number with branch suffix
 	newDealNo := generateBranchNumber(dealID)
 	log.Printf("UpdateDeal: Generated new deal number: %s", newDealNo)
 
 	// Process file if present (from either multipart or JSON base64)
-	if len(fileData) > 0 {
-		log.Printf("UpdateDeal: Processing file data, size: %d bytes", len(fileData))
-		// Calculate hash
-		hash := sha256.Sum256(fileData)
-		req.DealData.Hash = hex.EncodeToString(hash[:])
+	if upload != nil {
+		log.Printf("UpdateDeal: Processing file data, size: %d bytes", upload.Size())
+		// The hash was calculated while the file was received
+		req.DealData.Hash = upload.Hash()
+		fileSize = upload.Size()
 		log.Printf("UpdateDeal: File hash calculated: %s", req.DealData.Hash)
 
 		// Always generate file path with server-generated deal number
@@ -770,35 +717,6 @@ func UpdateDeal(c *gin.Context) {
 		filePath = generatedFileName
 		log.Printf("UpdateDeal: Generated file path: %s", filePath)
 
-		// Ensure period directory exists
-		periodDir := filepath.Join(models.GetBasePath(), req.Period)
-		log.Printf("UpdateDeal: Creating directory: %s", periodDir)
-		if err := os.MkdirAll(periodDir, 0755); err != nil {
-			log.Printf("UpdateDeal: Failed to create directory: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"success": false,
-				"error":   "directory_create_error",
-				"message": "Failed to create period directory",
-			})
-			return
-		}
-
-		// Save new file
-		fullPath := filepath.Join(periodDir, filePath)
-		log.Printf("UpdateDeal: Saving file to: %s", fullPath)
-		if err := utils.SaveFileAtomic(fullPath, fileData); err != nil {
-			log.Printf("UpdateDeal: Failed to save file: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"success": false,
-				"error":   "file_save_error",
-				"message": err.Error(),
-			})
-			return
-		}
-
-		req.DealData.FilePath = filePath
-		log.Println("UpdateDeal: File processing completed")
-
 		// Check for duplicate hash across all periods (only checks RecStatus='NEW' records)
 		forceUpload := c.Query("force") == "true"
 		log.Printf("UpdateDeal: Checking for duplicate hash across all periods, force=%v", forceUpload)
@@ -834,22 +752,25 @@ func UpdateDeal(c *gin.Context) {
 			log.Printf("UpdateDeal: Duplicate file detected but force flag is set, proceeding with update")
 		}
 
-		// After duplicate check, connect back to the target period for actual update
-		log.Printf("UpdateDeal: Reconnecting to target period: %s", req.Period)
-		if err := models.ConnectToPeriod(req.Period); err != nil {
-			log.Printf("UpdateDeal: Failed to reconnect to period %s: %v", req.Period, err)
+		// Store the file in the blob store; the same content is kept only once
+		log.Printf("UpdateDeal: Storing file in blob store: %s", filePath)
+		if _, err := upload.Commit(ext); err != nil {
+			log.Printf("UpdateDeal: Failed to save file: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{
 				"success": false,
-				"error":   "connection_error",
+				"error":   "file_save_error",
 				"message": err.Error(),
 			})
 			return
 		}
+
+		req.DealData.FilePath = filePath
+		req.DealData.FileStore = models.FileStoreBlob
+		setUploadedFileInfo(&req.DealData, fileName, clientPath)
+		log.Println("UpdateDeal: File processing completed")
 	} else {
-		// No new file, but update the file path for the new deal number if exists
+		// No new file: the new record points to the same stored file under a name for the new deal number
 		if oldDeal.FilePath != "" {
-			// Copy old file with new name
-			oldFilePath := filepath.Join(models.GetBasePath(), req.Period, oldDeal.FilePath)
 			ext := filepath.Ext(oldDeal.FilePath)
 			newFileName := fmt.Sprintf("%s_%s_%s_%d%s",
 				newDealNo,
@@ -857,14 +778,15 @@ func UpdateDeal(c *gin.Context) {
 				strings.ReplaceAll(req.DealData.DealPartner, "/", "_"),
 				req.DealData.DealPrice,
 				ext)
-			newFilePath := filepath.Join(models.GetBasePath(), req.Period, newFileName)
-			
-			// Read old file and save as new file
-			if fileContent, err := os.ReadFile(oldFilePath); err == nil {
-				if err := utils.SaveFileAtomic(newFilePath, fileContent); err == nil {
-					req.DealData.FilePath = newFileName
-					req.DealData.Hash = oldDeal.Hash
-				}
+
+			// A file still in the period folder is moved into the blob store first
+			if _, err := models.StoreDealBlob(req.Period, oldDeal); err != nil {
+				log.Printf("UpdateDeal: Could not keep the attached file: %v", err)
+			} else {
+				req.DealData.FilePath = newFileName
+				req.DealData.Hash = oldDeal.Hash
+				req.DealData.FileStore = models.FileStoreBlob
+				copyUploadedFileInfo(&req.DealData, oldDeal)
 			}
 		}
 		log.Println("UpdateDeal: No new file data to process")
@@ -879,10 +801,11 @@ func UpdateDeal(c *gin.Context) {
 	req.DealData.RecStatus = "NEW"
 	req.DealData.RecUpdate = now
 	req.DealData.RegDate = now
+	req.DealData.RegUser = c.GetString(middleware.ActorKey)
 
 	// Use single transaction to update old record and create new record
 	log.Printf("UpdateDeal: Creating new deal record with history: old=%s, new=%s", dealID, newDealNo)
-	if err := models.CreateDealWithHistory(dealID, &req.DealData); err != nil {
+	if err := models.CreateDealWithHistory(req.Period, dealID, &req.DealData); err != nil {
 		log.Printf("UpdateDeal: Failed to create deal with history: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"success": false,
@@ -892,6 +815,9 @@ func UpdateDeal(c *gin.Context) {
 		return
 	}
 
+	middleware.SetAuditTarget(c, req.Period, dealID, newDealNo)
+	middleware.SetAuditAfter(c, req.DealData)
+
 	// Build response
 	response := gin.H{
 		"success":    true,
@@ -899,22 +825,23 @@ func UpdateDeal(c *gin.Context) {
 		"dealNo":     newDealNo,
 		"previousNo": dealID,
 	}
-	
+
 	// Add file information if file was uploaded
 	if req.DealData.FilePath != "" {
 		response["filePath"] = req.DealData.FilePath
 		response["fileSize"] = fileSize
 		response["fileHash"] = req.DealData.Hash
+		addTimestampToResponse(response, req.Period, req.DealData.NO, req.DealData.Hash)
 
 		// Add warning if duplicate was found but force flag was used
-		if forceUpload := c.Query("force") == "true"; forceUpload && len(fileData) > 0 {
+		if forceUpload := c.Query("force") == "true"; forceUpload && upload != nil {
 			allDuplicates, _ := models.GetDealsByHashAllPeriods(req.DealData.Hash)
 			if len(allDuplicates) > 0 {
 				var duplicateWarnings []gin.H
 				for _, dup := range allDuplicates {
 					// Include all duplicates from all periods
 					duplicateWarnings = append(duplicateWarnings, gin.H{
-						"NO": dup.NO,
+						"NO":     dup.NO,
 						"Period": dup.Period,
 					})
 				}
@@ -932,7 +859,8 @@ func UpdateDeal(c *gin.Context) {
 
 // generateBranchNumber generates a branch number for update history
 // Example: D240115001 -> D240115001-1
-//          D240115001-1 -> D240115001-2
+//
+//	D240115001-1 -> D240115001-2
 func generateBranchNumber(baseNo string) string {
 	// Check if already has branch suffix
 	if idx := strings.LastIndex(baseNo, "-"); idx != -1 {
@@ -945,20 +873,55 @@ func generateBranchNumber(baseNo string) string {
 	return fmt.Sprintf("%s-1", baseNo)
 }
 
+// AllDealsFilter is the search condition of POST /all-deals.
+// It is DealFilter without the required Period field.
+type AllDealsFilter struct {
+	FromDate     string   `json:"from_date"`
+	ToDate       string   `json:"to_date"`
+	MinPrice     *int     `json:"min_price"`
+	MaxPrice     *int     `json:"max_price"`
+	TaxRate      string   `json:"tax_rate"`
+	Partner      string   `json:"partner"`
+	PartnerMatch string   `json:"partner_match"` // "partial" or "exact"
+	PartnerID    *int64   `json:"partner_id"`
+	Type         string   `json:"type"`
+	Keyword      string   `json:"keyword"`
+	Operator     string   `json:"operator"` // "and" or "or"
+	Limit        int      `json:"limit"`
+	Offset       int      `json:"offset"`
+	Periods      []string `json:"periods"` // New: array of period names to search
+	View         string   `json:"view"`    // "flat" or "history"
+}
+
+// dealFilter converts the search condition to a models.DealFilter without a period
+func (f *AllDealsFilter) dealFilter() models.DealFilter {
+	return models.DealFilter{
+		FromDate:     f.FromDate,
+		ToDate:       f.ToDate,
+		MinPrice:     f.MinPrice,
+		MaxPrice:     f.MaxPrice,
+		TaxRate:      f.TaxRate,
+		Partner:      f.Partner,
+		PartnerMatch: f.PartnerMatch,
+		PartnerID:    f.PartnerID,
+		Type:         f.Type,
+		Keyword:      f.Keyword,
+		Operator:     f.Operator,
+		Limit:        f.Limit,
+		Offset:       f.Offset,
+		View:         f.View,
+	}
+}
+
+// periods returns the periods to search: the requested ones, or all available periods
+func (f *AllDealsFilter) periods() ([]string, error) {
+	if len(f.Periods) > 0 {
+		return f.Periods, nil
+	}
+	return models.GetAvailablePeriods()
+}
+
 func GetAllDeals(c *gin.Context) {
-	// Create a custom filter struct without the required Period field
-	type AllDealsFilter struct {
-		FromDate  string   `json:"from_date"`
-		ToDate    string   `json:"to_date"`
-		Partner   string   `json:"partner"`
-		Type      string   `json:"type"`
-		Keyword   string   `json:"keyword"`
-		Limit     int      `json:"limit"`
-		Offset    int      `json:"offset"`
-		Periods   []string `json:"periods"`  // New: array of period names to search
-		View      string   `json:"view"`      // "flat" or "history"
-	}
-	
 	var queryFilter AllDealsFilter
 	if err := c.ShouldBindJSON(&queryFilter); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
@@ -968,12 +931,12 @@ func GetAllDeals(c *gin.Context) {
 		})
 		return
 	}
-	
+
 	// Set default view if not specified
 	if queryFilter.View == "" {
 		queryFilter.View = "flat"
 	}
-	
+
 	// Validate view parameter
 	if queryFilter.View != "flat" && queryFilter.View != "history" {
 		c.JSON(http.StatusBadRequest, gin.H{
@@ -983,21 +946,21 @@ func GetAllDeals(c *gin.Context) {
 		})
 		return
 	}
-	
+
 	// Convert to models.DealFilter for use with existing GetDeals function
-	filter := models.DealFilter{
-		FromDate: queryFilter.FromDate,
-		ToDate:   queryFilter.ToDate,
-		Partner:  queryFilter.Partner,
-		Type:     queryFilter.Type,
-		Keyword:  queryFilter.Keyword,
-		Limit:    queryFilter.Limit,
-		Offset:   queryFilter.Offset,
-		View:     queryFilter.View,
+	filter := queryFilter.dealFilter()
+
+	if err := models.ValidateDealFilter(&filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid_request",
+			"message": err.Error(),
+		})
+		return
 	}
 
 	var periodsToSearch []string
-	
+
 	// If periods are specified, use them. Otherwise, get all available periods
 	if len(queryFilter.Periods) > 0 {
 		// Use specified periods
@@ -1037,7 +1000,7 @@ func GetAllDeals(c *gin.Context) {
 
 		for _, periodName := range periodsToSearch {
 			// Connect to the period database
-			if err := models.ConnectToPeriod(periodName); err != nil {
+			if _, err := models.ConnectPeriodDB(periodName); err != nil {
 				// Log error but continue with other periods
 				log.Printf("Failed to connect to period %s: %v", periodName, err)
 				continue
@@ -1063,7 +1026,7 @@ func GetAllDeals(c *gin.Context) {
 				} else {
 					dealsWithHistory[i].DealRemark = fmt.Sprintf("[%s]", periodName)
 				}
-				
+
 				// Add to children if exists
 				for j := range dealsWithHistory[i].Children {
 					if dealsWithHistory[i].Children[j].DealRemark != "" {
@@ -1097,7 +1060,7 @@ func GetAllDeals(c *gin.Context) {
 
 		for _, periodName := range periodsToSearch {
 			// Connect to the period database
-			if err := models.ConnectToPeriod(periodName); err != nil {
+			if _, err := models.ConnectPeriodDB(periodName); err != nil {
 				// Log error but continue with other periods
 				log.Printf("Failed to connect to period %s: %v", periodName, err)
 				continue
@@ -1154,29 +1117,33 @@ func DeleteDeal(c *gin.Context) {
 		return
 	}
 
+	// The period must be given explicitly; deal numbers are only unique within a period
 	period := c.Query("period")
-	if period != "" {
-		if err := models.ConnectToPeriod(period); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"success": false,
-				"error":   "connection_error",
-				"message": err.Error(),
-			})
-			return
-		}
+	if period == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid_request",
+			"message": "Period is required",
+		})
+		return
+	}
+
+	if _, err := models.ConnectToPeriod(period); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "connection_error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	middleware.SetAuditTarget(c, period, dealID, dealID)
+	if deal, err := models.GetDealByID(period, dealID); err == nil {
+		middleware.SetAuditBefore(c, *deal)
 	}
 
 	// Logical delete: Keep the file, don't physically delete it
-	// deal, err := models.GetDealByID(dealID)
-	// if err == nil && deal.FilePath != "" {
-	// 	currentPeriod := models.GetCurrentPeriod()
-	// 	if currentPeriod != "" {
-	// 		filePath := filepath.Join("./data", currentPeriod, deal.FilePath)
-	// 		os.Remove(filePath)
-	// 	}
-	// }
-
-	if err := models.DeleteDeal(dealID); err != nil {
+	if err := models.DeleteDeal(period, dealID); err != nil {
 		if strings.Contains(err.Error(), "not found") {
 			c.JSON(http.StatusNotFound, gin.H{
 				"success": false,
@@ -1194,12 +1161,49 @@ func DeleteDeal(c *gin.Context) {
 		return
 	}
 
+	if deal, err := models.GetDealByID(period, dealID); err == nil {
+		middleware.SetAuditAfter(c, *deal)
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"message": "Deal deleted successfully",
 	})
 }
 
+// validateDealInvoiceNumber checks a registration number entered for a deal before any file is saved.
+// Partners with a registration in the master record that number instead.
+func validateDealInvoiceNumber(c *gin.Context, deal *models.Deal) bool {
+	deal.InvoiceNumber = models.NormalizeRegistrationNumber(deal.InvoiceNumber)
+	if deal.InvoiceNumber == "" {
+		return true
+	}
+
+	if err := models.ValidateRegistrationNumber(deal.InvoiceNumber); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "validation_error",
+			"message": err.Error(),
+		})
+		return false
+	}
+	return true
+}
+
+// validateDealTax checks the tax breakdown of a deal and fills in the derived amounts
+// before any file is saved, so that the generated file name carries the final DealPrice.
+func validateDealTax(c *gin.Context, deal *models.Deal) bool {
+	if err := models.NormalizeDealTax(deal); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "validation_error",
+			"message": err.Error(),
+		})
+		return false
+	}
+	return true
+}
+
 // generateDealNumber generates a new deal number with machine ID and optional sequence
 // Format: YYYYMMDDHHmmssPCXXX or YYYYMMDDHHmmssPCXXX-NN
 func generateDealNumber(c *gin.Context, existingNo string) string {
@@ -1231,7 +1235,8 @@ func getMachineID(c *gin.Context) string {
 
 // generateSequenceNumber generates the next sequence number
 // Example: 20240115143025PC01 -> 20240115143025PC01-01
-//          20240115143025PC01-01 -> 20240115143025PC01-02
+//
+//	20240115143025PC01-01 -> 20240115143025PC01-02
 func generateSequenceNumber(baseNo string) string {
 	// Check if already has sequence
 	if strings.Contains(baseNo, "-") {
@@ -1269,6 +1274,10 @@ func isValidDealNumber(dealNo string) bool {
 	if regexp.MustCompile(`^\d{14}PC\d{3}-\d{2}$`).MatchString(dealNo) {
 		return true
 	}
+	// Deals of an import or batch request, optionally updated (20240115143025PC001.0001, 20240115143025PC001.0001-01)
+	if regexp.MustCompile(`^\d{14}PC\d{3}\.\d{4,}(-\d{2})?$`).MatchString(dealNo) {
+		return true
+	}
 	return false
 }
 
@@ -1290,7 +1299,7 @@ func ChangeDealPeriod(c *gin.Context) {
 		FromPeriod string `json:"fromPeriod" binding:"required"`
 		ToPeriod   string `json:"toPeriod" binding:"required"`
 	}
-	
+
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"success": false,
@@ -1299,9 +1308,9 @@ func ChangeDealPeriod(c *gin.Context) {
 		})
 		return
 	}
-	
+
 	log.Printf("ChangeDealPeriod: Moving deal %s from period %s to %s", dealID, req.FromPeriod, req.ToPeriod)
-	
+
 	// Validate that periods are different
 	if req.FromPeriod == req.ToPeriod {
 		c.JSON(http.StatusBadRequest, gin.H{
@@ -1311,9 +1320,9 @@ func ChangeDealPeriod(c *gin.Context) {
 		})
 		return
 	}
-	
-	// Step 1: Connect to source period to get the original deal
-	if err := models.ConnectToPeriod(req.FromPeriod); err != nil {
+
+	// Step 1: Open source period to get the original deal
+	if _, err := models.ConnectToPeriod(req.FromPeriod); err != nil {
 		log.Printf("ChangeDealPeriod: Failed to connect to source period %s: %v", req.FromPeriod, err)
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"success": false,
@@ -1322,9 +1331,9 @@ func ChangeDealPeriod(c *gin.Context) {
 		})
 		return
 	}
-	
+
 	// Get the original deal (but don't modify it yet)
-	originalDeal, err := models.GetDealByID(dealID)
+	originalDeal, err := models.GetDealByID(req.FromPeriod, dealID)
 	if err != nil {
 		if strings.Contains(err.Error(), "not found") {
 			c.JSON(http.StatusNotFound, gin.H{
@@ -1341,9 +1350,12 @@ func ChangeDealPeriod(c *gin.Context) {
 		})
 		return
 	}
-	
-	// Step 2: Connect to target period and create new deal first
-	if err := models.ConnectToPeriod(req.ToPeriod); err != nil {
+
+	middleware.SetAuditTarget(c, req.FromPeriod, dealID, "")
+	middleware.SetAuditBefore(c, *originalDeal)
+
+	// Step 2: Open target period and create new deal first
+	if _, err := models.ConnectToPeriod(req.ToPeriod); err != nil {
 		log.Printf("ChangeDealPeriod: Failed to connect to target period %s: %v", req.ToPeriod, err)
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"success": false,
@@ -1352,143 +1364,104 @@ func ChangeDealPeriod(c *gin.Context) {
 		})
 		return
 	}
-	
+
 	// Create new deal in target period
 	newDeal := models.Deal{
-		NO:          generateDealNumber(c, ""),  // Generate new deal number
-		DealType:    originalDeal.DealType,
-		DealDate:    originalDeal.DealDate,
-		DealName:    originalDeal.DealName,
-		DealPartner: originalDeal.DealPartner,
-		DealPrice:   originalDeal.DealPrice,
-		DealRemark:  originalDeal.DealRemark,
-		RecStatus:   "NEW",
-		RegDate:     time.Now().Format("2006-01-02T15:04:05Z"),
-		RecUpdate:   time.Now().Format("2006-01-02T15:04:05Z"),
-		Hash:        originalDeal.Hash,
-	}
-	
-	// Handle file if exists
-	var fileData []byte
-	var originalFileInfo os.FileInfo
+		NO:            generateDealNumber(c, ""), // Generate new deal number
+		DealType:      originalDeal.DealType,
+		DealDate:      originalDeal.DealDate,
+		DealName:      originalDeal.DealName,
+		DealPartner:   originalDeal.DealPartner,
+		PartnerID:     originalDeal.PartnerID,
+		InvoiceNumber: originalDeal.InvoiceNumber,
+		DealPrice:     originalDeal.DealPrice,
+		TaxLines:      originalDeal.TaxLines,
+		DealRemark:    originalDeal.DealRemark,
+		RecStatus:     "NEW",
+		RegDate:       time.Now().Format("2006-01-02T15:04:05Z"),
+		RecUpdate:     time.Now().Format("2006-01-02T15:04:05Z"),
+		RegUser:       c.GetString(middleware.ActorKey),
+		Hash:          originalDeal.Hash,
+	}
+
+	// The new deal points to the same stored file; nothing is copied
 	if originalDeal.FilePath != "" {
-		// Read the original file from source period
-		originalFilePath := filepath.Join(models.GetBasePath(), req.FromPeriod, originalDeal.FilePath)
-		
-		// Get file info to preserve timestamps
-		originalFileInfo, err = os.Stat(originalFilePath)
-		if err != nil {
-			log.Printf("ChangeDealPeriod: Warning - could not stat original file: %v", err)
-		}
-		
-		fileData, err = os.ReadFile(originalFilePath)
-		if err != nil {
-			log.Printf("ChangeDealPeriod: Warning - could not read original file: %v", err)
+		if _, err := models.StoreDealBlob(req.FromPeriod, originalDeal); err != nil {
+			log.Printf("ChangeDealPeriod: Warning - could not keep the attached file: %v", err)
 			// Continue without file - not a critical error
+		} else {
+			newDeal.FilePath = fmt.Sprintf("%s_%s_%s_%d%s",
+				newDeal.NO,
+				newDeal.DealDate,
+				strings.ReplaceAll(newDeal.DealPartner, "/", "_"),
+				newDeal.DealPrice,
+				filepath.Ext(originalDeal.FilePath))
+			newDeal.FileStore = models.FileStoreBlob
+			copyUploadedFileInfo(&newDeal, originalDeal)
 		}
 	}
-	
-	// Save file in new period if exists
-	if len(fileData) > 0 && originalDeal.FilePath != "" {
-		// Generate new file path
-		ext := filepath.Ext(originalDeal.FilePath)
-		newFileName := fmt.Sprintf("%s_%s_%s_%d%s",
-			newDeal.NO,
-			newDeal.DealDate,
-			strings.ReplaceAll(newDeal.DealPartner, "/", "_"),
-			newDeal.DealPrice,
-			ext)
-		
-		// Ensure target period directory exists
-		targetPeriodDir := filepath.Join(models.GetBasePath(), req.ToPeriod)
-		if err := os.MkdirAll(targetPeriodDir, 0755); err != nil {
-			log.Printf("ChangeDealPeriod: Failed to create target directory: %v", err)
-			
-			// Rollback: restore original deal status
-			models.ConnectToPeriod(req.FromPeriod)
-			originalDeal.RecStatus = "NEW"
-			models.UpdateDeal(dealID, originalDeal)
-			
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"success": false,
-				"error":   "directory_create_error",
-				"message": "Failed to create target period directory",
-			})
-			return
-		}
-		
-		// Save file in new location
-		newFilePath := filepath.Join(targetPeriodDir, newFileName)
-		if err := utils.SaveFileAtomic(newFilePath, fileData); err != nil {
-			log.Printf("ChangeDealPeriod: Failed to save file in new period: %v", err)
-			
-			// Rollback: restore original deal status
-			models.ConnectToPeriod(req.FromPeriod)
-			originalDeal.RecStatus = "NEW"
-			models.UpdateDeal(dealID, originalDeal)
-			
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"success": false,
-				"error":   "file_save_error",
-				"message": "Failed to save file in target period",
-			})
-			return
-		}
-		
-		// Preserve original file timestamps if we have the info
-		if originalFileInfo != nil {
-			modTime := originalFileInfo.ModTime()
-			// For Windows, we need to preserve both access time and modified time
-			// Using the modified time for both since Go's os.Chtimes doesn't expose creation time
-			if err := os.Chtimes(newFilePath, modTime, modTime); err != nil {
-				log.Printf("ChangeDealPeriod: Warning - could not preserve file timestamps: %v", err)
-				// Not a critical error, continue
-			}
-		}
-		
-		newDeal.FilePath = newFileName
-	}
-	
-	// Step 3: Create the new deal in target period
-	if err := models.CreateDeal(&newDeal); err != nil {
-		log.Printf("ChangeDealPeriod: Failed to create deal in target period: %v", err)
-		
-		// Rollback: delete copied file if it was created
-		if newDeal.FilePath != "" {
-			os.Remove(filepath.Join(models.GetBasePath(), req.ToPeriod, newDeal.FilePath))
-		}
-		
+
+	// Step 3: Create the new deal in the target period and mark the original as DELETE
+	// in one batch, as a move operation of POST /deals/batch does; the additional
+	// attachments go with the deal
+	batch, err := models.BeginDealBatch([]string{req.FromPeriod, req.ToPeriod})
+	if err != nil {
+		log.Printf("ChangeDealPeriod: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"success": false,
 			"error":   "database_error",
-			"message": "Failed to create deal in target period",
+			"message": err.Error(),
 		})
 		return
 	}
-	
-	// Step 4: Now mark the original deal as DELETE (only after successful creation in new period)
-	if err := models.ConnectToPeriod(req.FromPeriod); err != nil {
-		log.Printf("ChangeDealPeriod: Warning - could not reconnect to source period to mark as DELETE: %v", err)
-		// New deal is already created, so we continue but log the warning
-	} else {
-		originalDeal.RecStatus = "DELETE"
-		originalDeal.RecUpdate = time.Now().Format("2006-01-02T15:04:05Z")
-		
-		if err := models.UpdateDeal(dealID, originalDeal); err != nil {
-			log.Printf("ChangeDealPeriod: Warning - could not mark original deal as DELETE: %v", err)
-			// New deal is already created, so this is not critical
+	defer batch.Rollback()
+
+	if err := batch.MoveDeal(req.FromPeriod, dealID, req.ToPeriod, &newDeal); err != nil {
+		log.Printf("ChangeDealPeriod: Failed to move deal: %v", err)
+		failure := batchErrorFrom(err)
+		c.JSON(failure.status, gin.H{
+			"success": false,
+			"error":   failure.code,
+			"message": failure.message,
+		})
+		return
+	}
+
+	if committed, err := batch.Commit(); err != nil {
+		log.Printf("ChangeDealPeriod: %v", err)
+		message := err.Error()
+		if len(committed) > 0 {
+			message = fmt.Sprintf("%v; periods %s were committed", err, strings.Join(committed, ", "))
 		}
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "database_error",
+			"message": message,
+		})
+		return
 	}
-	
+
+	// Carry the timestamp tokens over so the original time of existence is kept
+	if err := copyDealTimestamp(req.FromPeriod, dealID, req.ToPeriod, newDeal.NO); err != nil {
+		log.Printf("ChangeDealPeriod: Warning - could not copy timestamp token: %v", err)
+	}
+
+	middleware.SetAuditTarget(c, req.FromPeriod, dealID, newDeal.NO)
+	middleware.SetAuditAfter(c, gin.H{
+		"fromPeriod": req.FromPeriod,
+		"toPeriod":   req.ToPeriod,
+		"deal":       newDeal,
+	})
+
 	log.Printf("ChangeDealPeriod: Successfully moved deal %s to period %s with new ID %s", dealID, req.ToPeriod, newDeal.NO)
-	
+
 	c.JSON(http.StatusOK, gin.H{
-		"success":      true,
-		"message":      "Deal period changed successfully",
-		"originalNo":   dealID,
-		"newNo":        newDeal.NO,
-		"fromPeriod":   req.FromPeriod,
-		"toPeriod":     req.ToPeriod,
-		"fileMoved":    newDeal.FilePath != "",
+		"success":    true,
+		"message":    "Deal period changed successfully",
+		"originalNo": dealID,
+		"newNo":      newDeal.NO,
+		"fromPeriod": req.FromPeriod,
+		"toPeriod":   req.ToPeriod,
+		"fileMoved":  newDeal.FilePath != "",
 	})
-}
\ No newline at end of file
+}
@@ -41,7 +41,7 @@ func DownloadDealFile(c *gin.Context) {
 	}
 
 	// Connect to the period database
-	db, err := models.ConnectPeriodDB(period)
+	_, err := models.ConnectPeriodDB(period)
 	if err != nil {
 		log.Printf("DownloadDealFile: Failed to connect to period %s: %v", period, err)
 		c.JSON(http.StatusInternalServerError, gin.H{
@@ -53,19 +53,7 @@ func DownloadDealFile(c *gin.Context) {
 	}
 
 	// Get deal from database
-	var deal models.Deal
-	query := `SELECT NO, DealType, DealDate, DealName, DealPartner, DealPrice,
-	          DealRemark, RecUpdate, RegDate, RecStatus, FilePath, Hash,
-	          nextNO, prevNO
-	          FROM Deals WHERE NO = ?`
-
-	err = db.QueryRow(query, dealId).Scan(
-		&deal.NO, &deal.DealType, &deal.DealDate, &deal.DealName,
-		&deal.DealPartner, &deal.DealPrice, &deal.DealRemark,
-		&deal.RecUpdate, &deal.RegDate, &deal.RecStatus,
-		&deal.FilePath, &deal.Hash, &deal.NextNO, &deal.PrevNO,
-	)
-
+	deal, err := models.GetDealByID(period, dealId)
 	if err != nil {
 		log.Printf("DownloadDealFile: Deal not found: %v", err)
 		c.JSON(http.StatusNotFound, gin.H{
@@ -87,9 +75,17 @@ func DownloadDealFile(c *gin.Context) {
 		return
 	}
 
-	// Build full file path
-	basePath := models.GetBasePath()
-	fullPath := filepath.Join(basePath, period, deal.FilePath)
+	// Resolve the stored file (blob store or period folder)
+	fullPath, err := models.AttachmentPath(period, deal)
+	if err != nil {
+		log.Printf("DownloadDealFile: Stored file not found: %v", err)
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "file_not_found",
+			"message": "File not found on disk",
+		})
+		return
+	}
 	log.Printf("DownloadDealFile: Attempting to serve file: %s", fullPath)
 
 	// Check if file exists
@@ -103,24 +99,91 @@ func DownloadDealFile(c *gin.Context) {
 		return
 	}
 
-	// Get file extension to determine content type
-	ext := strings.ToLower(filepath.Ext(deal.FilePath))
-	contentType := getContentType(ext)
-
-	// Set appropriate headers
-	c.Header("Content-Type", contentType)
-	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filepath.Base(deal.FilePath)))
+	// The file is offered under the name it was uploaded with, if known
+	fileName := deal.OriginalFileName
+	if fileName == "" {
+		fileName = filepath.Base(deal.FilePath)
+	}
 
-	// If it's a PDF or image that might be displayed inline, also allow inline display
-	if contentType == "application/pdf" || strings.HasPrefix(contentType, "image/") {
-		c.Header("Content-Disposition", fmt.Sprintf("inline; filename=\"%s\"", filepath.Base(deal.FilePath)))
+	// Get file extension to determine content type
+	contentType := deal.MimeType
+	if contentType == "" {
+		contentType = getContentType(strings.ToLower(filepath.Ext(deal.FilePath)))
 	}
 
+	setDownloadHeaders(c, contentType, fileName)
+
 	// Serve the file
 	c.File(fullPath)
 	log.Printf("DownloadDealFile: Successfully served file for deal %s", dealId)
 }
 
+// inlineContentTypes are the types of stored files shown in the browser.
+// They cannot carry script, unlike SVG or HTML.
+var inlineContentTypes = map[string]bool{
+	"application/pdf": true,
+	"image/png":       true,
+	"image/jpeg":      true,
+	"image/gif":       true,
+	"image/webp":      true,
+}
+
+// setDownloadHeaders sets the headers for serving a stored file. Files of the inline
+// types are shown in the browser; every other file is downloaded as
+// application/octet-stream, so that uploaded content is never rendered on this origin.
+func setDownloadHeaders(c *gin.Context, contentType, name string) {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+
+	c.Header("X-Content-Type-Options", "nosniff")
+	if inlineContentTypes[mediaType] {
+		c.Header("Content-Type", mediaType)
+		c.Header("Content-Disposition", contentDisposition("inline", name))
+		return
+	}
+	c.Header("Content-Type", "application/octet-stream")
+	c.Header("Content-Disposition", contentDisposition("attachment", name))
+}
+
+// contentDisposition returns a Content-Disposition value for a file name. A name that is
+// not plain ASCII, such as a Japanese name, is also given RFC 5987 encoded in filename*,
+// with an ASCII fallback in filename for old clients.
+func contentDisposition(disposition, name string) string {
+	fallback := make([]rune, 0, len(name))
+	plain := true
+	for _, r := range name {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			r = '_'
+			plain = false
+		}
+		fallback = append(fallback, r)
+	}
+
+	value := fmt.Sprintf("%s; filename=\"%s\"", disposition, string(fallback))
+	if plain {
+		return value
+	}
+	return value + "; filename*=UTF-8''" + encodeRFC5987(name)
+}
+
+// encodeRFC5987 percent-encodes every byte of s that is not an attr-char of RFC 5987
+func encodeRFC5987(s string) string {
+	const hexDigits = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			strings.IndexByte("!#$&+-.^_`|~", c) >= 0:
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(hexDigits[c>>4])
+			b.WriteByte(hexDigits[c&0x0f])
+		}
+	}
+	return b.String()
+}
+
 // getContentType returns the appropriate content type based on file extension
 func getContentType(ext string) string {
 	switch ext {
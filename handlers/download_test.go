@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"mime"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSetDownloadHeaders(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		contentType string
+		wantType    string
+		disposition string
+	}{
+		{"application/pdf", "application/pdf", "inline"},
+		{"image/png", "image/png", "inline"},
+		{"image/jpeg", "image/jpeg", "inline"},
+		{"IMAGE/GIF", "image/gif", "inline"},
+		{"image/webp", "image/webp", "inline"},
+		{"image/svg+xml", "application/octet-stream", "attachment"},
+		{"text/html; charset=utf-8", "application/octet-stream", "attachment"},
+		{"application/xhtml+xml", "application/octet-stream", "attachment"},
+		{"image/bmp", "application/octet-stream", "attachment"},
+		{"text/plain; charset=utf-8", "application/octet-stream", "attachment"},
+		{"", "application/octet-stream", "attachment"},
+	}
+
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		setDownloadHeaders(c, tt.contentType, "receipt")
+
+		header := recorder.Header()
+		if got := header.Get("Content-Type"); got != tt.wantType {
+			t.Errorf("%q: Content-Type = %q, want %q", tt.contentType, got, tt.wantType)
+		}
+		if got := header.Get("Content-Disposition"); !strings.HasPrefix(got, tt.disposition+";") {
+			t.Errorf("%q: Content-Disposition = %q, want %s", tt.contentType, got, tt.disposition)
+		}
+		if got := header.Get("X-Content-Type-Options"); got != "nosniff" {
+			t.Errorf("%q: X-Content-Type-Options = %q", tt.contentType, got)
+		}
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"receipt-2025.pdf", `attachment; filename="receipt-2025.pdf"`},
+		{"請求書.pdf", `attachment; filename="___.pdf"; filename*=UTF-8''%E8%AB%8B%E6%B1%82%E6%9B%B8.pdf`},
+		{`a"b.pdf`, `attachment; filename="a_b.pdf"; filename*=UTF-8''a%22b.pdf`},
+		{`a\b.pdf`, `attachment; filename="a_b.pdf"; filename*=UTF-8''a%5Cb.pdf`},
+		{"my file.pdf", `attachment; filename="my file.pdf"`},
+	}
+
+	for _, tt := range tests {
+		got := contentDisposition("attachment", tt.name)
+		if got != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.name, got, tt.want)
+		}
+
+		// Clients that read filename* get the original name back
+		_, params, err := mime.ParseMediaType(got)
+		if err != nil {
+			t.Errorf("%q: %v", tt.name, err)
+			continue
+		}
+		if params["filename"] != tt.name {
+			t.Errorf("%q: parsed filename %q", tt.name, params["filename"])
+		}
+	}
+}
+
+func TestEncodeRFC5987(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"abcXYZ019", "abcXYZ019"},
+		{"!#$&+-.^_`|~", "!#$&+-.^_`|~"},
+		{"a b;c%d'e", "a%20b%3Bc%25d%27e"},
+		{"領収書", "%E9%A0%98%E5%8F%8E%E6%9B%B8"},
+	}
+
+	for _, tt := range tests {
+		if got := encodeRFC5987(tt.in); got != tt.want {
+			t.Errorf("encodeRFC5987(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,418 @@
+package handlers
+
+import (
+	"denchokun-api/models"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/transform"
+)
+
+// ExportOptions are the output options of GET /deals/export and POST /all-deals/export
+type ExportOptions struct {
+	Format   string   `form:"format" json:"format"`     // "csv" (default) or "tsv"
+	Encoding string   `form:"encoding" json:"encoding"` // "utf-8" (default, with BOM) or "shift_jis"
+	Columns  []string `form:"columns" json:"columns"`   // column keys, comma-separated or repeated; default is all columns
+	Header   string   `form:"header" json:"header"`     // "en" (default, column keys), "ja" or "none"
+}
+
+// exportColumn is a column of the export file
+type exportColumn struct {
+	Key      string
+	Japanese string
+	Value    func(period string, deal *models.Deal) string
+}
+
+// exportColumns lists the columns in the default order
+var exportColumns = []exportColumn{
+	{"period", "期間", func(period string, deal *models.Deal) string { return period }},
+	{"NO", "取引番号", func(period string, deal *models.Deal) string { return deal.NO }},
+	{"prevNO", "変更前取引番号", func(period string, deal *models.Deal) string { return stringValue(deal.PrevNO) }},
+	{"nextNO", "変更後取引番号", func(period string, deal *models.Deal) string { return stringValue(deal.NextNO) }},
+	{"RecStatus", "状態", func(period string, deal *models.Deal) string { return deal.RecStatus }},
+	{"DealType", "取引種別", freeText(func(period string, deal *models.Deal) string { return deal.DealType })},
+	{"DealDate", "取引日", func(period string, deal *models.Deal) string { return deal.DealDate }},
+	{"DealName", "取引名", freeText(func(period string, deal *models.Deal) string { return deal.DealName })},
+	{"DealPartner", "取引先", freeText(func(period string, deal *models.Deal) string { return deal.DealPartner })},
+	{"PartnerID", "取引先ID", func(period string, deal *models.Deal) string {
+		if deal.PartnerID == nil {
+			return ""
+		}
+		return strconv.FormatInt(*deal.PartnerID, 10)
+	}},
+	{"InvoiceNumber", "登録番号", func(period string, deal *models.Deal) string { return deal.InvoiceNumber }},
+	{"DealPrice", "金額（税込）", func(period string, deal *models.Deal) string { return strconv.Itoa(deal.DealPrice) }},
+	{"PriceExcludingTax", "金額（税抜）", func(period string, deal *models.Deal) string { return taxValue(deal, deal.PriceExcludingTax) }},
+	{"TaxAmount", "消費税額", func(period string, deal *models.Deal) string { return taxValue(deal, deal.TaxAmount) }},
+	{"TaxRate", "税率区分", func(period string, deal *models.Deal) string { return deal.TaxRate }},
+	{"Amount10", "10%対象金額（税込）", taxLineValue(models.TaxRateStandard, false)},
+	{"Tax10", "10%消費税額", taxLineValue(models.TaxRateStandard, true)},
+	{"Amount8", "8%対象金額（税込）", taxLineValue(models.TaxRateReduced, false)},
+	{"Tax8", "8%消費税額", taxLineValue(models.TaxRateReduced, true)},
+	{"ExemptAmount", "非課税金額", taxLineValue(models.TaxRateExempt, false)},
+	{"OutOfScopeAmount", "不課税金額", taxLineValue(models.TaxRateOutOfScope, false)},
+	{"DealRemark", "備考", freeText(func(period string, deal *models.Deal) string { return deal.DealRemark })},
+	{"FileName", "添付ファイル名", freeText(func(period string, deal *models.Deal) string {
+		if deal.FilePath == "" {
+			return ""
+		}
+		return filepath.Base(deal.FilePath)
+	})},
+	{"Hash", "ファイルハッシュ（SHA-256）", func(period string, deal *models.Deal) string { return deal.Hash }},
+	{"RegUser", "登録者", freeText(func(period string, deal *models.Deal) string { return deal.RegUser })},
+	{"RegDate", "登録日時", func(period string, deal *models.Deal) string { return deal.RegDate }},
+	{"RecUpdate", "更新日時", func(period string, deal *models.Deal) string { return deal.RecUpdate }},
+}
+
+// freeText wraps the value of a column users can type freely, so that spreadsheets
+// do not evaluate it as a formula
+func freeText(value func(period string, deal *models.Deal) string) func(period string, deal *models.Deal) string {
+	return func(period string, deal *models.Deal) string {
+		return escapeFormula(value(period, deal))
+	}
+}
+
+// escapeFormula prefixes ' to a cell that a spreadsheet would read as a formula (CSV injection).
+// A value that already looks escaped gets one more ', so that unescapeFormula restores it.
+func escapeFormula(value string) string {
+	if startsFormula(value) || looksEscaped(value) {
+		return "'" + value
+	}
+	return value
+}
+
+// unescapeFormula removes the ' that escapeFormula added
+func unescapeFormula(value string) string {
+	if looksEscaped(value) {
+		return value[1:]
+	}
+	return value
+}
+
+func startsFormula(value string) bool {
+	return value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0]))
+}
+
+// looksEscaped reports whether value is one or more ' followed by a formula
+func looksEscaped(value string) bool {
+	return strings.HasPrefix(value, "'") && startsFormula(strings.TrimLeft(value, "'"))
+}
+
+func stringValue(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
+}
+
+// taxValue leaves tax amounts empty for deals without a tax breakdown
+func taxValue(deal *models.Deal, amount int) string {
+	if deal.TaxRate == "" {
+		return ""
+	}
+	return strconv.Itoa(amount)
+}
+
+// taxLineValue returns a column value of the tax line of the given rate
+func taxLineValue(rate string, tax bool) func(period string, deal *models.Deal) string {
+	return func(period string, deal *models.Deal) string {
+		for _, line := range deal.TaxLines {
+			if line.Rate != rate {
+				continue
+			}
+			if tax {
+				return strconv.Itoa(line.TaxAmount)
+			}
+			return strconv.Itoa(line.AmountIncludingTax)
+		}
+		return ""
+	}
+}
+
+// dealExporter writes deals as CSV or TSV
+type dealExporter struct {
+	options ExportOptions
+	columns []exportColumn
+}
+
+// newDealExporter validates the export options
+func newDealExporter(options ExportOptions) (*dealExporter, error) {
+	switch options.Format {
+	case "":
+		options.Format = "csv"
+	case "csv", "tsv":
+	default:
+		return nil, fmt.Errorf("invalid format parameter. Must be 'csv' or 'tsv'")
+	}
+
+	switch strings.ToLower(options.Encoding) {
+	case "", "utf-8", "utf8":
+		options.Encoding = "utf-8"
+	case "shift_jis", "sjis", "cp932":
+		options.Encoding = "shift_jis"
+	default:
+		return nil, fmt.Errorf("invalid encoding parameter. Must be 'utf-8' or 'shift_jis'")
+	}
+
+	switch options.Header {
+	case "":
+		options.Header = "en"
+	case "en", "ja", "none":
+	default:
+		return nil, fmt.Errorf("invalid header parameter. Must be 'en', 'ja' or 'none'")
+	}
+
+	exporter := &dealExporter{options: options}
+	for _, value := range options.Columns {
+		for _, key := range strings.Split(value, ",") {
+			key = strings.TrimSpace(key)
+			if key == "" {
+				continue
+			}
+			column, ok := findExportColumn(key)
+			if !ok {
+				return nil, fmt.Errorf("unknown column: %s", key)
+			}
+			exporter.columns = append(exporter.columns, column)
+		}
+	}
+	if len(exporter.columns) == 0 {
+		exporter.columns = exportColumns
+	}
+
+	return exporter, nil
+}
+
+func findExportColumn(key string) (exportColumn, bool) {
+	for _, column := range exportColumns {
+		if strings.EqualFold(column.Key, key) {
+			return column, true
+		}
+	}
+	return exportColumn{}, false
+}
+
+// fileName returns the download file name for the given base name
+func (e *dealExporter) fileName(base string) string {
+	return base + "." + e.options.Format
+}
+
+// start writes the response headers, the BOM and the header row, and returns the writer for the rows.
+// The returned flush function must be called when all rows are written.
+func (e *dealExporter) start(c *gin.Context, fileName string) (*csv.Writer, func() error, error) {
+	contentType := "text/csv"
+	if e.options.Format == "tsv" {
+		contentType = "text/tab-separated-values"
+	}
+
+	var out io.Writer = c.Writer
+	var encoder *transform.Writer
+	if e.options.Encoding == "shift_jis" {
+		// Characters without a Shift_JIS code (e.g. emoji) become the substitute character instead of failing the export
+		encoder = transform.NewWriter(c.Writer, encoding.ReplaceUnsupported(japanese.ShiftJIS.NewEncoder()))
+		out = encoder
+		c.Header("Content-Type", contentType+"; charset=Shift_JIS")
+	} else {
+		c.Header("Content-Type", contentType+"; charset=utf-8")
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", fileName))
+	c.Status(http.StatusOK)
+
+	if e.options.Encoding == "utf-8" {
+		// Excel needs the BOM to open UTF-8 CSV files without garbling Japanese text
+		if _, err := c.Writer.Write([]byte("\xEF\xBB\xBF")); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	writer := csv.NewWriter(out)
+	writer.UseCRLF = true
+	if e.options.Format == "tsv" {
+		writer.Comma = '\t'
+	}
+
+	if e.options.Header != "none" {
+		header := make([]string, len(e.columns))
+		for i, column := range e.columns {
+			header[i] = column.Key
+			if e.options.Header == "ja" {
+				header[i] = column.Japanese
+			}
+		}
+		if err := writer.Write(header); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	flush := func() error {
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			return err
+		}
+		if encoder != nil {
+			if err := encoder.Close(); err != nil {
+				return err
+			}
+		}
+		c.Writer.Flush()
+		return nil
+	}
+
+	return writer, flush, nil
+}
+
+// writeDeals streams the deals of one period matching filter
+func (e *dealExporter) writeDeals(c *gin.Context, writer *csv.Writer, filter *models.DealFilter) (int, error) {
+	count := 0
+	record := make([]string, len(e.columns))
+	err := models.ForEachDeal(filter, func(deal *models.Deal) error {
+		for i, column := range e.columns {
+			record[i] = column.Value(filter.Period, deal)
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+
+		count++
+		if count%500 == 0 {
+			writer.Flush()
+			c.Writer.Flush()
+		}
+		return writer.Error()
+	})
+	return count, err
+}
+
+// ExportDeals handles GET /deals/export.
+// It accepts the same search conditions as GET /deals, without the 1000 row limit.
+func ExportDeals(c *gin.Context) {
+	var req struct {
+		models.DealFilter
+		ExportOptions
+	}
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid_request",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	exporter, err := newDealExporter(req.ExportOptions)
+	if err == nil {
+		err = validateExportFilter(&req.DealFilter)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid_request",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	// Fail before the headers are written if the period does not exist
+	if _, err := models.ConnectPeriodDB(req.Period); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "period_not_found",
+			"message": "Period not found: " + req.Period,
+		})
+		return
+	}
+
+	writer, flush, err := exporter.start(c, exporter.fileName("deals_"+req.Period))
+	if err != nil {
+		log.Printf("ExportDeals: Failed to start export: %v", err)
+		return
+	}
+
+	count, err := exporter.writeDeals(c, writer, &req.DealFilter)
+	if err != nil {
+		// The status is already sent; the truncated file is the only signal left to the client
+		log.Printf("ExportDeals: Export of period %s aborted after %d rows: %v", req.Period, count, err)
+	}
+	if err := flush(); err != nil {
+		log.Printf("ExportDeals: Failed to flush export: %v", err)
+	}
+}
+
+// ExportAllDeals handles POST /all-deals/export.
+// It accepts the same body as POST /all-deals plus the export options; limit and offset apply per period.
+func ExportAllDeals(c *gin.Context) {
+	var req struct {
+		AllDealsFilter
+		ExportOptions
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid_request",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	filter := req.dealFilter()
+	exporter, err := newDealExporter(req.ExportOptions)
+	if err == nil {
+		err = validateExportFilter(&filter)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid_request",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	periods, err := req.periods()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "database_error",
+			"message": "Failed to get available periods: " + err.Error(),
+		})
+		return
+	}
+
+	writer, flush, err := exporter.start(c, exporter.fileName("all-deals_"+time.Now().Format("20060102")))
+	if err != nil {
+		log.Printf("ExportAllDeals: Failed to start export: %v", err)
+		return
+	}
+
+	for _, period := range periods {
+		filter.Period = period
+		count, err := exporter.writeDeals(c, writer, &filter)
+		if err != nil {
+			// Skip periods that cannot be read, like POST /all-deals does
+			log.Printf("ExportAllDeals: Export of period %s stopped after %d rows: %v", period, count, err)
+		}
+	}
+	if err := flush(); err != nil {
+		log.Printf("ExportAllDeals: Failed to flush export: %v", err)
+	}
+}
+
+// validateExportFilter validates the search conditions and the view of an export
+func validateExportFilter(filter *models.DealFilter) error {
+	switch filter.View {
+	case "", "flat", "history":
+	default:
+		return fmt.Errorf("invalid view parameter. Must be 'flat' or 'history'")
+	}
+	return models.ValidateDealFilter(filter)
+}
@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"testing"
+)
+
+func TestEscapeFormula(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"文房具", "文房具"},
+		{"", ""},
+		{"=HYPERLINK(\"http://example.com\")", "'=HYPERLINK(\"http://example.com\")"},
+		{"+1+1", "'+1+1"},
+		{"-1+1", "'-1+1"},
+		{"@SUM(A1)", "'@SUM(A1)"},
+		{"\t=1", "'\t=1"},
+		{"\r=1", "'\r=1"},
+		{"a=1", "a=1"},
+		{"'quoted", "'quoted"},
+		{"'=1", "''=1"},
+		{"''+1", "'''+1"},
+	}
+
+	for _, tt := range tests {
+		if got := escapeFormula(tt.in); got != tt.want {
+			t.Errorf("escapeFormula(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+		if got := unescapeFormula(escapeFormula(tt.in)); got != tt.in {
+			t.Errorf("unescapeFormula(escapeFormula(%q)) = %q", tt.in, got)
+		}
+	}
+}
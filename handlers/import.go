@@ -0,0 +1,813 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"denchokun-api/middleware"
+	"denchokun-api/models"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/transform"
+)
+
+// DefaultMaxImportSize is the default limit of an import request (data file and ZIP together)
+const DefaultMaxImportSize = 2048 * 1024 * 1024
+
+// maxImportDataSize is the limit of the CSV or JSON lines file of an import
+const maxImportDataSize = 64 * 1024 * 1024
+
+// maxImportSize is the limit of an import request in bytes
+var maxImportSize int64 = DefaultMaxImportSize
+
+// SetMaxImportSize sets the limit of an import request in bytes
+func SetMaxImportSize(size int64) {
+	maxImportSize = size
+}
+
+// importRow is one deal of an import file. CSV columns use the same keys (or Japanese
+// headers) as the CSV export; FileName is the path of the attachment in the ZIP.
+type importRow struct {
+	Period            string           `json:"period"`
+	DealType          string           `json:"DealType"`
+	DealDate          string           `json:"DealDate"`
+	DealName          string           `json:"DealName"`
+	DealPartner       string           `json:"DealPartner"`
+	DealPrice         *int             `json:"DealPrice"`
+	DealRemark        string           `json:"DealRemark"`
+	InvoiceNumber     string           `json:"InvoiceNumber"`
+	TaxRate           string           `json:"TaxRate"`
+	PriceExcludingTax int              `json:"PriceExcludingTax"`
+	TaxAmount         int              `json:"TaxAmount"`
+	TaxLines          []models.TaxLine `json:"TaxLines"`
+	FileName          string           `json:"FileName"`
+	RecStatus         string           `json:"RecStatus"` // rows of an export other than NEW are skipped
+
+	line int // line of the row in the file, for messages
+}
+
+// importIssue is a problem found in one row of an import
+type importIssue struct {
+	Row        int     `json:"row"`
+	Field      string  `json:"field,omitempty"`
+	Error      string  `json:"error"`
+	Message    string  `json:"message"`
+	Duplicates []gin.H `json:"duplicates,omitempty"`
+}
+
+// importItem is a row that passed validation
+type importItem struct {
+	row    int
+	period string
+	deal   models.Deal
+	file   *zip.File
+	hash   string
+}
+
+// importColumnSetters sets the field of an importRow for each CSV column key
+var importColumnSetters = map[string]func(row *importRow, value string) error{
+	"period":      func(row *importRow, value string) error { row.Period = value; return nil },
+	"DealType":    func(row *importRow, value string) error { row.DealType = value; return nil },
+	"DealDate":    func(row *importRow, value string) error { row.DealDate = value; return nil },
+	"DealName":    func(row *importRow, value string) error { row.DealName = value; return nil },
+	"DealPartner": func(row *importRow, value string) error { row.DealPartner = value; return nil },
+	"DealPrice": func(row *importRow, value string) error {
+		if value == "" {
+			return nil
+		}
+		price, err := parseImportAmount(value)
+		if err != nil {
+			return err
+		}
+		row.DealPrice = &price
+		return nil
+	},
+	"DealRemark":    func(row *importRow, value string) error { row.DealRemark = value; return nil },
+	"InvoiceNumber": func(row *importRow, value string) error { row.InvoiceNumber = value; return nil },
+	"TaxRate":       func(row *importRow, value string) error { row.TaxRate = value; return nil },
+	"PriceExcludingTax": func(row *importRow, value string) error {
+		var err error
+		row.PriceExcludingTax, err = parseImportAmount(value)
+		return err
+	},
+	"TaxAmount": func(row *importRow, value string) error {
+		var err error
+		row.TaxAmount, err = parseImportAmount(value)
+		return err
+	},
+	"FileName":  func(row *importRow, value string) error { row.FileName = value; return nil },
+	"RecStatus": func(row *importRow, value string) error { row.RecStatus = value; return nil },
+}
+
+// importFreeTextColumns are the imported columns that the CSV export escapes with freeText
+var importFreeTextColumns = map[string]bool{
+	"DealType":    true,
+	"DealName":    true,
+	"DealPartner": true,
+	"DealRemark":  true,
+	"FileName":    true,
+}
+
+// parseImportAmount parses an amount as written in spreadsheets, e.g. "¥1,080"
+func parseImportAmount(value string) (int, error) {
+	value = strings.NewReplacer(",", "", "¥", "", "￥", "", "円", "", " ", "").Replace(value)
+	if value == "" {
+		return 0, nil
+	}
+	amount, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("must be a whole number")
+	}
+	return amount, nil
+}
+
+// importColumnKey returns the column key of a CSV header, which may be a key or the
+// Japanese header of the CSV export
+func importColumnKey(header string) (string, bool) {
+	header = strings.TrimSpace(header)
+	for _, column := range exportColumns {
+		if strings.EqualFold(column.Key, header) || column.Japanese == header {
+			return column.Key, true
+		}
+	}
+	return "", false
+}
+
+// parseImportCSV reads the rows of a CSV or TSV file with a header row.
+// Columns of the export that are not imported are ignored; unknown columns are returned.
+func parseImportCSV(data []byte, comma rune, shiftJIS bool) ([]importRow, []string, []importIssue, error) {
+	var r io.Reader = bytes.NewReader(bytes.TrimPrefix(data, []byte("\xEF\xBB\xBF")))
+	if shiftJIS {
+		r = transform.NewReader(r, japanese.ShiftJIS.NewDecoder())
+	}
+
+	reader := csv.NewReader(r)
+	reader.Comma = comma
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil, nil, fmt.Errorf("the file is empty")
+	}
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to read header: %v", err)
+	}
+
+	keys := make([]string, len(header))
+	var unknown []string
+	for i, name := range header {
+		key, ok := importColumnKey(name)
+		if !ok {
+			unknown = append(unknown, name)
+			continue
+		}
+		if _, imported := importColumnSetters[key]; imported {
+			keys[i] = key
+		}
+	}
+
+	var rows []importRow
+	var issues []importIssue
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to read CSV: %v", err)
+		}
+		if len(record) == 1 && strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+		line, _ := reader.FieldPos(0)
+
+		row := importRow{line: line}
+		for i, value := range record {
+			if i >= len(keys) || keys[i] == "" {
+				continue
+			}
+			value = strings.TrimSpace(value)
+			if importFreeTextColumns[keys[i]] {
+				value = unescapeFormula(value)
+			}
+			if err := importColumnSetters[keys[i]](&row, value); err != nil {
+				issues = append(issues, importIssue{Row: line, Field: keys[i], Error: "invalid_value", Message: err.Error()})
+			}
+		}
+		rows = append(rows, row)
+	}
+
+	return rows, unknown, issues, nil
+}
+
+// parseImportJSONLines reads one JSON object per line
+func parseImportJSONLines(data []byte) ([]importRow, []importIssue) {
+	var rows []importRow
+	var issues []importIssue
+	for i, line := range bytes.Split(bytes.TrimPrefix(data, []byte("\xEF\xBB\xBF")), []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		row := importRow{line: i + 1}
+		if err := json.Unmarshal(line, &row); err != nil {
+			issues = append(issues, importIssue{Row: i + 1, Error: "invalid_json", Message: err.Error()})
+			continue
+		}
+		rows = append(rows, row)
+	}
+	return rows, issues
+}
+
+// importZip holds the attachments of an import by path and by file name
+type importZip struct {
+	byPath map[string]*zip.File
+	byName map[string]*zip.File // nil when the name is not unique
+}
+
+func newImportZip(reader *zip.Reader) *importZip {
+	z := &importZip{byPath: map[string]*zip.File{}, byName: map[string]*zip.File{}}
+	for _, file := range reader.File {
+		if file.FileInfo().IsDir() {
+			continue
+		}
+		name := path.Clean(strings.ReplaceAll(file.Name, `\`, "/"))
+		z.byPath[name] = file
+		base := path.Base(name)
+		if _, exists := z.byName[base]; exists {
+			z.byName[base] = nil
+		} else {
+			z.byName[base] = file
+		}
+	}
+	return z
+}
+
+// find returns the entry for a FileName of a row: its path in the ZIP, or its file
+// name if only one entry has it
+func (z *importZip) find(name string) *zip.File {
+	name = path.Clean(strings.ReplaceAll(name, `\`, "/"))
+	if file, ok := z.byPath[strings.TrimPrefix(name, "/")]; ok {
+		return file
+	}
+	return z.byName[path.Base(name)]
+}
+
+// validateImportRow checks a row and returns the deal to create.
+// skip is set for rows of an export that are not the current version of a deal.
+func validateImportRow(row *importRow, defaultPeriod string, attachments *importZip) (item importItem, issues []importIssue, skip bool) {
+	if row.RecStatus != "" && row.RecStatus != "NEW" {
+		return item, nil, true
+	}
+
+	issue := func(field, code, message string) {
+		issues = append(issues, importIssue{Row: row.line, Field: field, Error: code, Message: message})
+	}
+
+	item.row = row.line
+	item.period = row.Period
+	if item.period == "" {
+		item.period = defaultPeriod
+	}
+	if item.period == "" {
+		issue("period", "required", "period is required (column or ?period=)")
+	}
+
+	dealDate, err := time.Parse("2006-1-2", strings.ReplaceAll(row.DealDate, "/", "-"))
+	if err != nil {
+		issue("DealDate", "invalid_value", "DealDate must be a date (YYYY-MM-DD)")
+	}
+	if row.DealPrice == nil {
+		issue("DealPrice", "required", "DealPrice is required")
+	}
+
+	item.deal = models.Deal{
+		DealType:          row.DealType,
+		DealDate:          dealDate.Format("2006-01-02"),
+		DealName:          row.DealName,
+		DealPartner:       row.DealPartner,
+		DealRemark:        row.DealRemark,
+		InvoiceNumber:     models.NormalizeRegistrationNumber(row.InvoiceNumber),
+		TaxRate:           row.TaxRate,
+		PriceExcludingTax: row.PriceExcludingTax,
+		TaxAmount:         row.TaxAmount,
+		TaxLines:          row.TaxLines,
+		RecStatus:         "NEW",
+	}
+	if row.DealPrice != nil {
+		item.deal.DealPrice = *row.DealPrice
+	}
+
+	if item.deal.InvoiceNumber != "" {
+		if err := models.ValidateRegistrationNumber(item.deal.InvoiceNumber); err != nil {
+			issue("InvoiceNumber", "validation_error", err.Error())
+		}
+	}
+	if row.DealPrice != nil {
+		if err := models.NormalizeDealTax(&item.deal); err != nil {
+			issue("TaxRate", "validation_error", err.Error())
+		}
+	}
+
+	if row.FileName != "" {
+		switch {
+		case attachments == nil:
+			issue("FileName", "file_not_found", "FileName is set but no attachments ZIP was sent")
+		case attachments.find(row.FileName) == nil:
+			issue("FileName", "file_not_found", "file not found in the ZIP: "+row.FileName)
+		default:
+			item.file = attachments.find(row.FileName)
+			if int64(item.file.UncompressedSize64) > maxUploadSize {
+				issue("FileName", "file_too_large", fmt.Sprintf("ファイルサイズが%sを超えています", formatBytes(maxUploadSize)))
+			}
+		}
+	}
+
+	return item, issues, false
+}
+
+// hashZipFile returns the SHA-256 of an entry; reading it to the end also checks its CRC
+func hashZipFile(file *zip.File) (string, error) {
+	rc, err := file.Open()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, rc); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ImportDeals handles POST /deals/import.
+// The multipart request has a data part (CSV, TSV or JSON lines) and an optional
+// attachments part (ZIP) holding the files named in the FileName column.
+// Every row is validated first, including the same duplicate-hash check as POST /deals
+// (relaxed by force=true); if any row fails nothing is imported. With dry_run=true only
+// the validation result is returned. Otherwise the deals are created in one transaction
+// per period.
+func ImportDeals(c *gin.Context) {
+	dryRun := c.Query("dry_run") == "true"
+	forceUpload := c.Query("force") == "true"
+	defaultPeriod := c.Query("period")
+
+	shiftJIS := false
+	switch strings.ToLower(c.Query("encoding")) {
+	case "", "utf-8", "utf8":
+	case "shift_jis", "sjis", "cp932":
+		shiftJIS = true
+	default:
+		sendImportRequestError(c, "invalid encoding parameter. Must be 'utf-8' or 'shift_jis'")
+		return
+	}
+
+	data, dataName, zipFile, ok := readImportRequest(c)
+	if zipFile != nil {
+		defer func() {
+			zipFile.Close()
+			os.Remove(zipFile.Name())
+		}()
+	}
+	if !ok {
+		return
+	}
+
+	format := c.Query("format")
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(dataName)) {
+		case ".jsonl", ".ndjson", ".json":
+			format = "jsonl"
+		case ".tsv", ".txt":
+			format = "tsv"
+		default:
+			format = "csv"
+		}
+	}
+
+	var rows []importRow
+	var unknownColumns []string
+	var issues []importIssue
+	switch format {
+	case "csv", "tsv":
+		comma := ','
+		if format == "tsv" {
+			comma = '\t'
+		}
+		var err error
+		rows, unknownColumns, issues, err = parseImportCSV(data, comma, shiftJIS)
+		if err != nil {
+			sendImportRequestError(c, err.Error())
+			return
+		}
+	case "jsonl":
+		rows, issues = parseImportJSONLines(data)
+	default:
+		sendImportRequestError(c, "invalid format parameter. Must be 'csv', 'tsv' or 'jsonl'")
+		return
+	}
+
+	var attachments *importZip
+	if zipFile != nil {
+		info, err := zipFile.Stat()
+		var reader *zip.Reader
+		if err == nil {
+			reader, err = zip.NewReader(zipFile, info.Size())
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"success": false,
+				"error":   "invalid_zip",
+				"message": fmt.Sprintf("Failed to read attachments ZIP: %v", err),
+			})
+			return
+		}
+		attachments = newImportZip(reader)
+	}
+
+	// Validate every row before anything is created
+	var items []importItem
+	skipped := 0
+	for i := range rows {
+		item, rowIssues, skip := validateImportRow(&rows[i], defaultPeriod, attachments)
+		if skip {
+			skipped++
+			continue
+		}
+		issues = append(issues, rowIssues...)
+		if len(rowIssues) == 0 {
+			items = append(items, item)
+		}
+	}
+
+	// Hash the attachments and check them for duplicates, within the import and against all periods
+	var warnings []importIssue
+	hashes := map[*zip.File]string{}
+	firstRow := map[string]int{}
+	for i := range items {
+		item := &items[i]
+		if item.file == nil {
+			continue
+		}
+
+		hash, ok := hashes[item.file]
+		if !ok {
+			var err error
+			hash, err = hashZipFile(item.file)
+			if err != nil {
+				issues = append(issues, importIssue{Row: item.row, Field: "FileName", Error: "invalid_zip", Message: err.Error()})
+				continue
+			}
+			hashes[item.file] = hash
+		}
+		item.hash = hash
+
+		var duplicates []gin.H
+		if row, exists := firstRow[hash]; exists {
+			duplicates = append(duplicates, gin.H{"row": row})
+		} else {
+			firstRow[hash] = item.row
+		}
+		existing, err := models.GetDealsByHashAllPeriods(hash)
+		if err != nil {
+			log.Printf("ImportDeals: Failed to check duplicate hash: %v", err)
+		}
+		for _, dup := range existing {
+			duplicates = append(duplicates, gin.H{
+				"NO":          dup.NO,
+				"DealDate":    dup.DealDate,
+				"DealPartner": dup.DealPartner,
+				"DealPrice":   dup.DealPrice,
+				"DealPeriod":  dup.Period,
+			})
+		}
+		if len(duplicates) == 0 {
+			continue
+		}
+
+		duplicate := importIssue{Row: item.row, Field: "FileName", Error: "duplicate_file",
+			Message: "このファイルは既に登録されています", Duplicates: duplicates}
+		if forceUpload {
+			warnings = append(warnings, duplicate)
+		} else {
+			issues = append(issues, duplicate)
+		}
+	}
+
+	// Periods in the order they first appear, and whether they exist
+	existingPeriods := map[string]bool{}
+	if periods, err := models.GetAvailablePeriods(); err == nil {
+		for _, period := range periods {
+			existingPeriods[period] = true
+		}
+	}
+	var periodOrder []string
+	periodItems := map[string][]*importItem{}
+	for i := range items {
+		item := &items[i]
+		if _, seen := periodItems[item.period]; !seen {
+			periodOrder = append(periodOrder, item.period)
+		}
+		periodItems[item.period] = append(periodItems[item.period], item)
+	}
+	var periodSummary []gin.H
+	for _, period := range periodOrder {
+		periodSummary = append(periodSummary, gin.H{
+			"period": period,
+			"count":  len(periodItems[period]),
+			"exists": existingPeriods[period],
+		})
+
+		// The import does not create periods; their dates are set with POST /periods
+		if !existingPeriods[period] {
+			for _, item := range periodItems[period] {
+				issues = append(issues, importIssue{Row: item.row, Field: "period", Error: "period_not_found",
+					Message: "period does not exist: " + period + " (create it with POST /periods first)"})
+			}
+		}
+	}
+
+	if issues == nil {
+		issues = []importIssue{}
+	}
+	if warnings == nil {
+		warnings = []importIssue{}
+	}
+	response := gin.H{
+		"success":        len(issues) == 0,
+		"dryRun":         dryRun,
+		"total":          len(rows),
+		"valid":          len(items),
+		"skipped":        skipped,
+		"errorCount":     len(issues),
+		"errors":         issues,
+		"warnings":       warnings,
+		"unknownColumns": unknownColumns,
+		"periods":        periodSummary,
+	}
+
+	if len(issues) > 0 {
+		status := http.StatusBadRequest
+		if dryRun {
+			status = http.StatusOK
+		} else {
+			response["error"] = "validation_error"
+			response["message"] = "取込データにエラーがあるため登録しませんでした。dry_run=true で内容を確認してください"
+		}
+		c.JSON(status, response)
+		return
+	}
+	if dryRun {
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	// Create the deals, one transaction per period
+	actor := c.GetString(middleware.ActorKey)
+	numbers := newDealNumbers(c)
+	created := []gin.H{}
+	failed := []gin.H{}
+	imported, stamping := 0, 0
+	for _, period := range periodOrder {
+		deals, err := prepareImportDeals(period, periodItems[period], numbers, actor)
+		if err == nil {
+			err = models.CreateDeals(period, deals)
+		}
+		if err != nil {
+			log.Printf("ImportDeals: Failed to import period %s: %v", period, err)
+			failed = append(failed, gin.H{"period": period, "count": len(deals), "message": err.Error()})
+			continue
+		}
+
+		for i, deal := range deals {
+			created = append(created, gin.H{"row": periodItems[period][i].row, "period": period, "dealNo": deal.NO})
+		}
+		imported += len(deals)
+		stamping += stampDealsInBackground(period, deals)
+	}
+
+	summary := gin.H{"imported": imported, "failed": failed, "periods": periodSummary}
+	middleware.SetAuditTarget(c, "", fmt.Sprintf("%d deals", imported), "")
+	middleware.SetAuditAfter(c, summary)
+
+	response["success"] = len(failed) == 0
+	response["imported"] = imported
+	response["deals"] = created
+	response["failed"] = failed
+	response["timestampsPending"] = stamping
+	status := http.StatusOK
+	if len(failed) > 0 {
+		status = http.StatusInternalServerError
+		response["error"] = "import_failed"
+		response["message"] = "一部の期間の登録に失敗しました。failed に表示された期間は登録されていません"
+	}
+	log.Printf("ImportDeals: Imported %d deals in %d periods", imported, len(periodOrder)-len(failed))
+	c.JSON(status, response)
+}
+
+// dealNumbers allocates deal numbers for the deals created by one import or batch request
+type dealNumbers struct {
+	c     *gin.Context
+	used  map[string]bool
+	stamp string // creation time of the request, shared by all its numbers
+	seq   int
+}
+
+// newDealNumbers returns the allocator of a request, numbering its deals with the current time
+func newDealNumbers(c *gin.Context) *dealNumbers {
+	return &dealNumbers{c: c, used: map[string]bool{}, stamp: time.Now().Format("20060102150405")}
+}
+
+// allocate returns a deal number in the format of CreateDeal (creation time and machine
+// ID) that is not used in period. Every deal of the request keeps the request time; the
+// deals after the first get a sequence suffix ".0001", ".0002", ... which, unlike the
+// "-01" suffix of updates, the history view does not read as a version of another deal.
+func (n *dealNumbers) allocate(period string) string {
+	base := n.stamp + getMachineID(n.c)
+	for {
+		no := base
+		if n.seq > 0 {
+			no = fmt.Sprintf("%s.%04d", base, n.seq)
+		}
+		n.seq++
+		if n.used[no] {
+			continue
+		}
+		if _, err := models.GetDealByID(period, no); err == nil {
+			continue
+		}
+		n.used[no] = true
+		return no
+	}
+}
+
+// prepareImportDeals numbers the deals of one period and stores their attachments in the blob store
+func prepareImportDeals(period string, items []*importItem, numbers *dealNumbers, actor string) ([]*models.Deal, error) {
+	if _, err := models.ConnectPeriodDB(period); err != nil {
+		return nil, err
+	}
+
+	deals := make([]*models.Deal, 0, len(items))
+	for _, item := range items {
+		deal := item.deal
+		deal.NO = numbers.allocate(period)
+		deal.RegUser = actor
+
+		if item.file != nil {
+			if err := storeImportFile(item); err != nil {
+				return nil, fmt.Errorf("row %d: %v", item.row, err)
+			}
+			ext := filepath.Ext(item.file.Name)
+			deal.FilePath = fmt.Sprintf("%s_%s_%s_%d%s",
+				deal.NO,
+				deal.DealDate,
+				strings.ReplaceAll(deal.DealPartner, "/", "_"),
+				deal.DealPrice,
+				ext)
+			deal.Hash = item.hash
+			deal.FileStore = models.FileStoreBlob
+			setUploadedFileInfo(&deal, path.Base(strings.ReplaceAll(item.file.Name, `\`, "/")), item.file.Name)
+		}
+
+		deals = append(deals, &deal)
+	}
+	return deals, nil
+}
+
+// storeImportFile copies an attachment from the ZIP into the blob store
+func storeImportFile(item *importItem) error {
+	rc, err := item.file.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	upload, err := models.NewBlobWriter(maxUploadSize)
+	if err != nil {
+		return err
+	}
+	defer upload.Abort()
+
+	if _, err := io.Copy(upload, rc); err != nil {
+		return err
+	}
+	if upload.Hash() != item.hash {
+		return fmt.Errorf("%s changed while importing", item.file.Name)
+	}
+
+	_, err = upload.Commit(filepath.Ext(item.file.Name))
+	return err
+}
+
+// readImportRequest reads the data part into memory and spools the attachments part
+// into a temp file. zipFile, when not nil, must be closed and removed by the caller.
+// On failure the error response has already been written.
+func readImportRequest(c *gin.Context) (data []byte, dataName string, zipFile *os.File, ok bool) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxImportSize)
+
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		sendInvalidMultipart(c)
+		return nil, "", nil, false
+	}
+
+	fail := func(err error) {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"success": false,
+				"error":   "file_too_large",
+				"message": fmt.Sprintf("取込データのサイズが%sを超えています", formatBytes(maxImportSize)),
+				"maxSize": maxImportSize,
+			})
+			return
+		}
+		log.Printf("ImportDeals: Failed to read request: %v", err)
+		sendInvalidMultipart(c)
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fail(err)
+			return nil, "", zipFile, false
+		}
+
+		switch part.FormName() {
+		case "data":
+			data, err = io.ReadAll(io.LimitReader(part, maxImportDataSize+1))
+			if err != nil {
+				fail(err)
+				return nil, "", zipFile, false
+			}
+			if len(data) > maxImportDataSize {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"success": false,
+					"error":   "file_too_large",
+					"message": fmt.Sprintf("取込データのサイズが%sを超えています", formatBytes(maxImportDataSize)),
+					"maxSize": maxImportDataSize,
+				})
+				return nil, "", zipFile, false
+			}
+			dataName = part.FileName()
+
+		case "attachments":
+			if zipFile != nil {
+				break
+			}
+			zipFile, err = os.CreateTemp("", "denchokun-import-*.zip")
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"success": false,
+					"error":   "file_save_error",
+					"message": err.Error(),
+				})
+				return nil, "", nil, false
+			}
+			if _, err := io.Copy(zipFile, part); err != nil {
+				fail(err)
+				return nil, "", zipFile, false
+			}
+		}
+		part.Close()
+	}
+
+	if len(data) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "missing_file",
+			"message": "data (CSV or JSON lines file) is required",
+		})
+		return nil, "", zipFile, false
+	}
+
+	return data, dataName, zipFile, true
+}
+
+func sendImportRequestError(c *gin.Context, message string) {
+	c.JSON(http.StatusBadRequest, gin.H{
+		"success": false,
+		"error":   "invalid_request",
+		"message": message,
+	})
+}
@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"bytes"
+	"denchokun-api/models"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestExportImportRoundTrip(t *testing.T) {
+	setupTestDB(t)
+	const period = "2025"
+	if _, err := models.ConnectToPeriod(period); err != nil {
+		t.Fatal(err)
+	}
+
+	// Free text that the export escapes, and text that only looks escaped
+	originals := map[string]*models.Deal{}
+	for i, deal := range []*models.Deal{
+		{DealType: "-返品", DealName: "=SUM(A1:A2)", DealPartner: "+81 テスト商店", DealRemark: "@備考"},
+		{DealType: "領収書", DealName: "'そのまま", DealPartner: "テスト商店", DealRemark: "'=そのまま"},
+	} {
+		deal.NO = "20250401_00000" + string(rune('1'+i))
+		deal.DealDate = "2025-04-01"
+		deal.DealPrice = 1100
+		deal.RecStatus = "NEW"
+		if err := models.CreateDeal(period, deal); err != nil {
+			t.Fatal(err)
+		}
+		originals[deal.NO] = deal
+	}
+
+	router := gin.New()
+	router.GET("/deals/export", ExportDeals)
+	router.POST("/deals/import", ImportDeals)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deals/export?period="+period, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("export: status %d, body %s", w.Code, w.Body)
+	}
+	exported := w.Body.Bytes()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("data", "deals.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(exported)
+	form.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/deals/import", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("import: status %d, body %s", w.Code, w.Body)
+	}
+
+	deals, _, err := models.GetDeals(&models.DealFilter{Period: period})
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported := map[string]bool{}
+	for _, deal := range deals {
+		if originals[deal.NO] != nil {
+			continue
+		}
+		var original *models.Deal
+		for _, o := range originals {
+			if o.DealName == deal.DealName {
+				original = o
+			}
+		}
+		if original == nil {
+			t.Errorf("imported DealName %q matches no exported deal", deal.DealName)
+			continue
+		}
+		imported[original.NO] = true
+		if deal.DealType != original.DealType || deal.DealPartner != original.DealPartner ||
+			deal.DealRemark != original.DealRemark || deal.DealPrice != original.DealPrice {
+			t.Errorf("imported %+v, exported %+v", deal, *original)
+		}
+	}
+	if len(imported) != len(originals) {
+		t.Errorf("imported %d of %d deals", len(imported), len(originals))
+	}
+}
@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"denchokun-api/middleware"
+	"denchokun-api/models"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// StartIntegrityCheck handles POST /integrity/verify.
+// It starts recomputing the hashes of all attachments in the background and returns
+// the job ID; the report is read with GET /integrity/reports/:id.
+func StartIntegrityCheck(c *gin.Context) {
+	report, err := models.StartIntegrityCheck("manual", c.GetString(middleware.ActorKey))
+	if err != nil {
+		if strings.Contains(err.Error(), "already running") {
+			c.JSON(http.StatusConflict, gin.H{
+				"success": false,
+				"error":   "already_running",
+				"message": err.Error(),
+				"jobId":   report.ID,
+			})
+			return
+		}
+
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "database_error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	middleware.SetAuditTarget(c, "", strconv.FormatInt(report.ID, 10), "")
+
+	c.Header("Location", "/v1/api/integrity/reports/"+strconv.FormatInt(report.ID, 10))
+	c.JSON(http.StatusAccepted, gin.H{
+		"success": true,
+		"jobId":   report.ID,
+		"report":  report,
+	})
+}
+
+// GetIntegrityReports handles GET /integrity/reports (latest first, without issues)
+func GetIntegrityReports(c *gin.Context) {
+	limit, err := getIntParam(c, "limit", 20)
+	if err != nil || limit < 1 || limit > 1000 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid_request",
+			"message": "limit must be between 1 and 1000",
+		})
+		return
+	}
+
+	reports, err := models.GetIntegrityReports(limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "database_error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"reports": reports,
+	})
+}
+
+// GetIntegrityReport handles GET /integrity/reports/:id
+func GetIntegrityReport(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid_request",
+			"message": "Invalid report ID",
+		})
+		return
+	}
+
+	report, err := models.GetIntegrityReport(id)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			c.JSON(http.StatusNotFound, gin.H{
+				"success": false,
+				"error":   "not_found",
+				"message": err.Error(),
+			})
+			return
+		}
+
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "database_error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"report":  report,
+	})
+}
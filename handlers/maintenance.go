@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"denchokun-api/middleware"
+	"denchokun-api/models"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// QuarantineRequest selects the orphaned files to move
+type QuarantineRequest struct {
+	GraceHours *float64 `json:"graceHours"`
+	Paths      []string `json:"paths"` // paths from a dry run; empty moves all files found
+}
+
+// GetOrphanFiles handles GET /maintenance/orphans.
+// It is a dry run: the files that would be quarantined are listed and nothing is changed.
+func GetOrphanFiles(c *gin.Context) {
+	grace := models.DefaultOrphanGracePeriod
+	if value := c.Query("grace_hours"); value != "" {
+		hours, err := strconv.ParseFloat(value, 64)
+		if err != nil || hours < 0 {
+			sendInvalidGracePeriod(c)
+			return
+		}
+		grace = time.Duration(hours * float64(time.Hour))
+	}
+
+	report, err := models.ScanOrphanFiles(grace)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "scan_error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"report":  report,
+	})
+}
+
+// QuarantineOrphanFiles handles POST /maintenance/orphans/quarantine.
+// The orphaned files are moved under .quarantine in the data folder, never deleted.
+func QuarantineOrphanFiles(c *gin.Context) {
+	var req QuarantineRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"success": false,
+				"error":   "invalid_request",
+				"message": err.Error(),
+			})
+			return
+		}
+	}
+
+	grace := models.DefaultOrphanGracePeriod
+	if req.GraceHours != nil {
+		if *req.GraceHours < 0 {
+			sendInvalidGracePeriod(c)
+			return
+		}
+		grace = time.Duration(*req.GraceHours * float64(time.Hour))
+	}
+
+	report, err := models.QuarantineOrphanFiles(grace, req.Paths)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "quarantine_error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	// The moved files are kept in the audit log as well as in the manifest
+	middleware.SetAuditTarget(c, "", report.QuarantineDir, "")
+	middleware.SetAuditAfter(c, report)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"report":  report,
+	})
+}
+
+func sendInvalidGracePeriod(c *gin.Context) {
+	c.JSON(http.StatusBadRequest, gin.H{
+		"success": false,
+		"error":   "invalid_parameters",
+		"message": "grace hours must be a number of 0 or more",
+	})
+}
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"denchokun-api/middleware"
 	"denchokun-api/models"
 	"net/http"
 	"strings"
@@ -11,17 +12,12 @@ import (
 func GetDealPartners(c *gin.Context) {
 	period := c.Query("period")
 	if period != "" {
-		if err := models.ConnectToPeriod(period); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"success": false,
-				"error":   "connection_error",
-				"message": err.Error(),
-			})
+		if !connectExistingPeriod(c, period) {
 			return
 		}
 	}
 
-	partners, err := models.GetDealPartners()
+	details, err := models.GetDealPartnerDetails()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"success": false,
@@ -31,9 +27,15 @@ func GetDealPartners(c *gin.Context) {
 		return
 	}
 
+	partners := make([]string, 0, len(details))
+	for _, partner := range details {
+		partners = append(partners, partner.Name)
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"success":  true,
 		"partners": partners,
+		"details":  details,
 	})
 }
 
@@ -50,17 +52,21 @@ func CreateDealPartner(c *gin.Context) {
 
 	period := c.Query("period")
 	if period != "" {
-		if err := models.ConnectToPeriod(period); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
+		if !connectExistingPeriod(c, period) {
+			return
+		}
+	}
+
+	if err := models.CreateDealPartner(&partner); err != nil {
+		if isRegistrationError(err) {
+			c.JSON(http.StatusBadRequest, gin.H{
 				"success": false,
-				"error":   "connection_error",
+				"error":   "validation_error",
 				"message": err.Error(),
 			})
 			return
 		}
-	}
 
-	if err := models.CreateDealPartner(&partner); err != nil {
 		if strings.Contains(err.Error(), "already exists") {
 			c.JSON(http.StatusConflict, gin.H{
 				"success": false,
@@ -78,10 +84,15 @@ func CreateDealPartner(c *gin.Context) {
 		return
 	}
 
+	middleware.SetAuditTarget(c, "", partner.Name, "")
+	middleware.SetAuditAfter(c, partner)
+
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"message": "Partner created successfully",
+		"id":      partner.ID,
 		"name":    partner.Name,
+		"partner": partner,
 	})
 }
 
@@ -110,16 +121,15 @@ func UpdateDealPartner(c *gin.Context) {
 	}
 
 	if req.Period != "" {
-		if err := models.ConnectToPeriod(req.Period); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"success": false,
-				"error":   "connection_error",
-				"message": err.Error(),
-			})
+		if !connectExistingPeriod(c, req.Period) {
 			return
 		}
 	}
 
+	if before, _, err := models.GetDealPartnerHistory(oldName); err == nil {
+		middleware.SetAuditBefore(c, before)
+	}
+
 	if err := models.UpdateDealPartner(oldName, req.NewName); err != nil {
 		if strings.Contains(err.Error(), "not found") {
 			c.JSON(http.StatusNotFound, gin.H{
@@ -130,6 +140,15 @@ func UpdateDealPartner(c *gin.Context) {
 			return
 		}
 
+		if strings.Contains(err.Error(), "already exists") {
+			c.JSON(http.StatusConflict, gin.H{
+				"success": false,
+				"error":   "resource_conflict",
+				"message": err.Error(),
+			})
+			return
+		}
+
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"success": false,
 			"error":   "database_error",
@@ -138,6 +157,10 @@ func UpdateDealPartner(c *gin.Context) {
 		return
 	}
 
+	if after, _, err := models.GetDealPartnerHistory(req.NewName); err == nil {
+		middleware.SetAuditAfter(c, after)
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"message": "Partner updated successfully",
@@ -157,16 +180,15 @@ func DeleteDealPartner(c *gin.Context) {
 
 	period := c.Query("period")
 	if period != "" {
-		if err := models.ConnectToPeriod(period); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"success": false,
-				"error":   "connection_error",
-				"message": err.Error(),
-			})
+		if !connectExistingPeriod(c, period) {
 			return
 		}
 	}
 
+	if before, _, err := models.GetDealPartnerHistory(name); err == nil {
+		middleware.SetAuditBefore(c, before)
+	}
+
 	if err := models.DeleteDealPartner(name); err != nil {
 		if strings.Contains(err.Error(), "not found") {
 			c.JSON(http.StatusNotFound, gin.H{
@@ -198,4 +220,114 @@ func DeleteDealPartner(c *gin.Context) {
 		"success": true,
 		"message": "Partner deleted successfully",
 	})
+}
+
+// GetDealPartnerHistory returns a partner and the history of its names
+func GetDealPartnerHistory(c *gin.Context) {
+	name := c.Param("name")
+	if name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid_request",
+			"message": "Partner name is required",
+		})
+		return
+	}
+
+	partner, history, err := models.GetDealPartnerHistory(name)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			c.JSON(http.StatusNotFound, gin.H{
+				"success": false,
+				"error":   "not_found",
+				"message": err.Error(),
+			})
+			return
+		}
+
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "database_error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"partner": partner,
+		"history": history,
+	})
+}
+
+// UpdateDealPartnerRegistration handles PUT /deal-partners/:name/registration.
+// An empty registrationNumber clears the registration.
+func UpdateDealPartnerRegistration(c *gin.Context) {
+	name := c.Param("name")
+	if name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid_request",
+			"message": "Partner name is required",
+		})
+		return
+	}
+
+	var req models.InvoiceRegistration
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid_request",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	if before, _, err := models.GetDealPartnerHistory(name); err == nil {
+		middleware.SetAuditBefore(c, before)
+	}
+
+	partner, err := models.UpdateDealPartnerRegistration(name, &req)
+	if err != nil {
+		if isRegistrationError(err) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"success": false,
+				"error":   "validation_error",
+				"message": err.Error(),
+			})
+			return
+		}
+
+		if strings.Contains(err.Error(), "not found") {
+			c.JSON(http.StatusNotFound, gin.H{
+				"success": false,
+				"error":   "not_found",
+				"message": err.Error(),
+			})
+			return
+		}
+
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "database_error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	middleware.SetAuditAfter(c, partner)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Partner registration updated successfully",
+		"partner": partner,
+	})
+}
+
+// isRegistrationError reports whether err is a validation error of an invoice registration
+func isRegistrationError(err error) bool {
+	message := err.Error()
+	return strings.Contains(message, "registration number") ||
+		strings.Contains(message, "registration date") ||
+		strings.Contains(message, "expiry date")
 }
\ No newline at end of file
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"denchokun-api/middleware"
 	"denchokun-api/models"
 	"net/http"
 	"strings"
@@ -71,6 +72,38 @@ func GetPeriod(c *gin.Context) {
 	})
 }
 
+// connectExistingPeriod opens the database of an existing period and answers 400 for an
+// invalid name or 404 for an unknown period. Read routes use it so that they do not create
+// periods; only POST /periods and the deal-writing routes do.
+func connectExistingPeriod(c *gin.Context, period string) bool {
+	if err := models.ValidatePeriodName(period); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid_request",
+			"message": err.Error(),
+		})
+		return false
+	}
+
+	if _, err := models.ConnectPeriodDB(period); err != nil {
+		if strings.Contains(err.Error(), "does not exist") {
+			c.JSON(http.StatusNotFound, gin.H{
+				"success": false,
+				"error":   "period_not_found",
+				"message": "Period not found: " + period,
+			})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"success": false,
+				"error":   "connection_error",
+				"message": err.Error(),
+			})
+		}
+		return false
+	}
+	return true
+}
+
 func ConnectPeriod(c *gin.Context) {
 	period := c.Query("period")
 	if period == "" {
@@ -82,16 +115,12 @@ func ConnectPeriod(c *gin.Context) {
 		return
 	}
 
-	err := models.ConnectToPeriod(period)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"success": false,
-			"error":   "connection_error",
-			"message": err.Error(),
-		})
+	if !connectExistingPeriod(c, period) {
 		return
 	}
 
+	middleware.SetAuditTarget(c, period, period, "")
+
 	c.JSON(http.StatusOK, gin.H{
 		"success":      true,
 		"message":      "Connected to period " + period,
@@ -130,6 +159,9 @@ func CreatePeriod(c *gin.Context) {
 		return
 	}
 
+	middleware.SetAuditTarget(c, period.Name, period.Name, "")
+	middleware.SetAuditAfter(c, period)
+
 	c.JSON(http.StatusCreated, gin.H{
 		"success": true,
 		"message": "Period created successfully",
@@ -159,6 +191,9 @@ func UpdatePeriodDates(c *gin.Context) {
 		return
 	}
 
+	middleware.SetAuditTarget(c, periodName, periodName, "")
+	middleware.SetAuditBefore(c, periodSnapshot(periodName))
+
 	period, err := models.UpdatePeriod(periodName, &req)
 	if err != nil {
 		if strings.Contains(err.Error(), "not found") {
@@ -189,6 +224,8 @@ func UpdatePeriodDates(c *gin.Context) {
 		return
 	}
 
+	middleware.SetAuditAfter(c, period)
+
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"message": "Period updated successfully",
@@ -219,6 +256,9 @@ func UpdatePeriodName(c *gin.Context) {
 		return
 	}
 
+	middleware.SetAuditTarget(c, periodName, periodName, "")
+	middleware.SetAuditBefore(c, periodSnapshot(periodName))
+
 	period, err := models.RenamePeriod(periodName, req.NewName)
 	if err != nil {
 		if strings.Contains(err.Error(), "not found") {
@@ -249,6 +289,8 @@ func UpdatePeriodName(c *gin.Context) {
 		return
 	}
 
+	middleware.SetAuditAfter(c, period)
+
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"message": "Period renamed successfully",
@@ -268,6 +310,9 @@ func DeletePeriod(c *gin.Context) {
 		return
 	}
 
+	middleware.SetAuditTarget(c, periodName, periodName, "")
+	middleware.SetAuditBefore(c, periodSnapshot(periodName))
+
 	err := models.DeletePeriod(periodName)
 	if err != nil {
 		if strings.Contains(err.Error(), "period_has_deals") {
@@ -298,3 +343,57 @@ func DeletePeriod(c *gin.Context) {
 	})
 }
 
+// VerifyPeriodChain verifies the tamper-evident hash chain of a period's deals
+func VerifyPeriodChain(c *gin.Context) {
+	periodName := c.Query("period")
+	if periodName == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid_request",
+			"message": "Period parameter is required",
+		})
+		return
+	}
+
+	result, err := models.VerifyDealChain(periodName)
+	if err != nil {
+		if strings.Contains(err.Error(), "does not exist") {
+			c.JSON(http.StatusNotFound, gin.H{
+				"success": false,
+				"error":   "period_not_found",
+				"message": "Period not found: " + periodName,
+			})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"success": false,
+				"error":   "database_error",
+				"message": err.Error(),
+			})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":      true,
+		"verification": result,
+	})
+}
+
+// periodSnapshot returns the current settings of a period for the audit log.
+// It returns nil for a period that does not exist, without creating it.
+func periodSnapshot(name string) *models.Period {
+	periods, err := models.GetAvailablePeriods()
+	if err != nil {
+		return nil
+	}
+	for _, period := range periods {
+		if period == name {
+			snapshot, err := models.GetPeriodByName(name)
+			if err != nil {
+				return nil
+			}
+			return snapshot
+		}
+	}
+	return nil
+}
@@ -1,10 +1,14 @@
 package handlers
 
 import (
+	"crypto/sha256"
+	"database/sql"
 	"denchokun-api/models"
 	"denchokun-api/preview"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"log"
 	"net/http"
 	"net/url"
 	"os"
@@ -24,17 +28,15 @@ type PreviewHandler struct {
 }
 
 // NewPreviewHandler は新しいプレビューハンドラーを作成
-func NewPreviewHandler(dataBasePath string) (*PreviewHandler, error) {
+// generator は preview.NewGenerator で設定に応じて作成したもの
+func NewPreviewHandler(dataBasePath string, generator preview.Generator, cacheOptions preview.CacheOptions) (*PreviewHandler, error) {
 	// キャッシュディレクトリの作成
 	cacheDir := filepath.Join(dataBasePath, ".cache", "previews")
-	cache, err := preview.NewCache(cacheDir)
+	cache, err := preview.NewCache(cacheDir, cacheOptions)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create cache: %w", err)
 	}
-	
-	// Windows用のプレビュージェネレータを作成
-	generator := preview.NewWindowsPreviewGenerator()
-	
+
 	return &PreviewHandler{
 		generator:    generator,
 		cache:        cache,
@@ -42,223 +44,312 @@ func NewPreviewHandler(dataBasePath string) (*PreviewHandler, error) {
 	}, nil
 }
 
+// Close はキャッシュの定期的なクリーンアップを止める（サーバーの終了時に呼ぶ）
+func (h *PreviewHandler) Close() {
+	h.cache.Close()
+}
+
+// プレビュー画像の大きさ（ピクセル）
+const (
+	defaultPreviewSize = 300
+	minPreviewSize     = 16
+	maxPreviewSize     = 1000
+)
+
+// previewParams はプレビュー取得APIの共通パラメータ
+type previewParams struct {
+	width    int
+	height   int
+	page     int
+	format   string // jpeg または png
+	response string // binary または base64
+}
+
+// parsePreviewParams はクエリパラメータを検証して previewParams を返す
+func parsePreviewParams(c *gin.Context) (*previewParams, error) {
+	params := &previewParams{}
+	var err error
+
+	if params.width, err = getIntParam(c, "width", defaultPreviewSize); err != nil {
+		return nil, err
+	}
+	if params.height, err = getIntParam(c, "height", defaultPreviewSize); err != nil {
+		return nil, err
+	}
+	if params.width < minPreviewSize || params.width > maxPreviewSize ||
+		params.height < minPreviewSize || params.height > maxPreviewSize {
+		return nil, fmt.Errorf("width and height must be between %d and %d", minPreviewSize, maxPreviewSize)
+	}
+
+	if params.page, err = getIntParam(c, "page", 1); err != nil {
+		return nil, err
+	}
+	// どちらのジェネレータも先頭ページのサムネイルしか作れないので、他のページは受け付けない
+	if params.page != 1 {
+		return nil, fmt.Errorf("page must be 1; previews of other pages are not supported")
+	}
+
+	switch format := strings.ToLower(c.DefaultQuery("format", "jpeg")); format {
+	case "jpeg", "jpg":
+		params.format = "jpeg"
+	case "png":
+		params.format = "png"
+	default:
+		return nil, fmt.Errorf("invalid format %q. Must be 'jpeg' or 'png'", format)
+	}
+
+	switch params.response = c.DefaultQuery("response", "binary"); params.response {
+	case "binary", "base64":
+	default:
+		return nil, fmt.Errorf("invalid response %q. Must be 'binary' or 'base64'", params.response)
+	}
+
+	return params, nil
+}
+
 // GetDealPreview は取引に紐づくファイルのプレビューを取得
+// GET /preview/deals/:dealId?period=
 func (h *PreviewHandler) GetDealPreview(c *gin.Context) {
-	period := c.Param("period")
+	period := c.Query("period")
 	dealId := c.Param("dealId")
-	
+
 	// パラメータの検証
 	if period == "" || dealId == "" {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"success": false,
 			"error":   "invalid_parameters",
-			"message": "Period and dealId are required",
+			"message": "period and dealId are required",
 		})
 		return
 	}
-	
-	// オプションパラメータの取得
-	width := h.getIntParam(c, "width", 300)
-	height := h.getIntParam(c, "height", 300)
-	page := h.getIntParam(c, "page", 1)
-	format := c.DefaultQuery("format", "jpeg")
-	responseFormat := c.DefaultQuery("response", "binary") // binary or base64
-	
-	// サイズの制限
-	if width > 1000 {
-		width = 1000
-	}
-	if height > 1000 {
-		height = 1000
-	}
-	
-	// データベースから取引情報を取得してファイルパスを特定
-	filePath, err := h.getFilePathFromDeal(period, dealId)
+
+	params, err := parsePreviewParams(c)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{
+		c.JSON(http.StatusBadRequest, gin.H{
 			"success": false,
-			"error":   "file_not_found",
-			"message": "File not found for the specified deal",
+			"error":   "invalid_parameters",
+			"message": err.Error(),
 		})
 		return
 	}
-	
-	// キャッシュをチェック
-	if cachedData, exists := h.cache.Get(filePath, width, height, page); exists {
-		if responseFormat == "base64" {
-			h.sendBase64Response(c, cachedData, format)
-		} else {
-			h.sendImageResponse(c, cachedData, format)
-		}
-		return
-	}
-	
-	// プレビューを生成
-	fmt.Printf("DEBUG: Attempting to generate preview for: %s\n", filePath)
-	if _, err := os.Stat(filePath); err != nil {
-		fmt.Printf("DEBUG: File stat error: %v\n", err)
-	} else {
-		fmt.Printf("DEBUG: File exists at path\n")
-	}
-	imageData, contentType, err := h.generator.GeneratePreviewBytes(filePath, width, height, format)
+
+	// データベースから取引情報を取得してファイルパスを特定
+	source, err := h.getFilePathFromDeal(period, dealId)
 	if err != nil {
-		// エラーログ
-		fmt.Printf("ERROR: Failed to generate preview for %s: %v\n", filePath, err)
-		fmt.Printf("ERROR: Full error details: %+v\n", err)
-		
-		// デフォルトアイコンを返す
-		fmt.Printf("DEBUG: Returning default icon for extension: %s\n", filepath.Ext(filePath))
-		imageData, contentType = h.getDefaultIcon(filepath.Ext(filePath))
-	} else {
-		fmt.Printf("DEBUG: Preview generated successfully, size: %d bytes\n", len(imageData))
-	}
-	
-	// キャッシュに保存
-	if err := h.cache.Put(filePath, width, height, page, imageData); err != nil {
-		// キャッシュエラーは無視（ログのみ）
-		fmt.Printf("Failed to cache preview: %v\n", err)
-	}
-	
-	// レスポンスを送信
-	if responseFormat == "base64" {
-		h.sendBase64Response(c, imageData, contentType)
-	} else {
-		h.sendImageResponse(c, imageData, contentType)
+		h.sendLookupError(c, period, err)
+		return
 	}
+
+	h.sendPreview(c, source, params)
 }
 
-// GetFilePreview はファイルIDを指定してプレビューを取得
+// GetFilePreview はファイル名を指定してプレビューを取得
+// GET /preview/files/:fileId?period= と、プレビューリンク形式の GET /preview?period=&filename= の両方を受け付ける
+// 期間の取引に添付されたファイルのみ対象とする
 func (h *PreviewHandler) GetFilePreview(c *gin.Context) {
 	fileId := c.Param("fileId")
+	if fileId == "" {
+		fileId = c.Query("filename")
+	}
 	period := c.Query("period")
-	
+
 	// パラメータの検証
 	if fileId == "" || period == "" {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"success": false,
 			"error":   "invalid_parameters",
-			"message": "FileId and period are required",
+			"message": "file name and period are required",
 		})
 		return
 	}
-	
-	// オプションパラメータの取得
-	width := h.getIntParam(c, "width", 300)
-	height := h.getIntParam(c, "height", 300)
-	page := h.getIntParam(c, "page", 1)
-	format := c.DefaultQuery("format", "jpeg")
-	responseFormat := c.DefaultQuery("response", "binary") // binary or base64
-	
-	// サイズの制限
-	if width > 1000 {
-		width = 1000
-	}
-	if height > 1000 {
-		height = 1000
-	}
-	
-	// ファイルパスを構築
-	filePath := filepath.Join(h.dataBasePath, period, fileId)
-	
-	// ファイルの存在確認
-	if _, err := os.Stat(filePath); err != nil {
-		c.JSON(http.StatusNotFound, gin.H{
+
+	// 期間フォルダの外を指定できないようにする
+	if !isPlainFileName(fileId) || !isPlainFileName(period) {
+		c.JSON(http.StatusBadRequest, gin.H{
 			"success": false,
-			"error":   "file_not_found",
-			"message": "File not found or not accessible",
+			"error":   "invalid_parameters",
+			"message": "file name and period must not contain path separators",
 		})
 		return
 	}
-	
-	// キャッシュをチェック
-	if cachedData, exists := h.cache.Get(filePath, width, height, page); exists {
-		if responseFormat == "base64" {
-			h.sendBase64Response(c, cachedData, format)
-		} else {
-			h.sendImageResponse(c, cachedData, format)
-		}
+
+	params, err := parsePreviewParams(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid_parameters",
+			"message": err.Error(),
+		})
 		return
 	}
-	
-	// プレビューを生成
-	fmt.Printf("DEBUG: Attempting to generate preview for: %s\n", filePath)
-	if _, err := os.Stat(filePath); err != nil {
-		fmt.Printf("DEBUG: File stat error: %v\n", err)
-	} else {
-		fmt.Printf("DEBUG: File exists at path\n")
-	}
-	imageData, contentType, err := h.generator.GeneratePreviewBytes(filePath, width, height, format)
+
+	source, err := h.getAttachedFilePath(period, fileId)
 	if err != nil {
-		// エラーログ
-		fmt.Printf("ERROR: Failed to generate preview for %s: %v\n", filePath, err)
-		fmt.Printf("ERROR: Full error details: %+v\n", err)
-		
-		// デフォルトアイコンを返す
-		fmt.Printf("DEBUG: Returning default icon for extension: %s\n", filepath.Ext(filePath))
-		imageData, contentType = h.getDefaultIcon(filepath.Ext(filePath))
-	} else {
-		fmt.Printf("DEBUG: Preview generated successfully, size: %d bytes\n", len(imageData))
+		h.sendLookupError(c, period, err)
+		return
 	}
-	
-	// キャッシュに保存
-	if err := h.cache.Put(filePath, width, height, page, imageData); err != nil {
-		// キャッシュエラーは無視（ログのみ）
-		fmt.Printf("Failed to cache preview: %v\n", err)
+
+	h.sendPreview(c, source, params)
+}
+
+// sendPreview はキャッシュまたは生成したプレビューを返す
+func (h *PreviewHandler) sendPreview(c *gin.Context, source *previewSource, params *previewParams) {
+	filePath := source.path
+
+	// キャッシュをチェック
+	imageData, exists := h.cache.Get(source.hash, params.width, params.height, params.page, params.format)
+	contentType := "image/" + params.format
+
+	if !exists {
+		var err error
+		imageData, contentType, err = h.generator.GeneratePreviewBytes(filePath, params.width, params.height, params.format)
+		if err != nil {
+			log.Printf("Failed to generate preview for %s: %v", filePath, err)
+
+			// デフォルトアイコンを返す
+			if imageData, contentType = h.getDefaultIcon(filepath.Ext(filePath)); len(imageData) == 0 {
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"success": false,
+					"error":   "preview_failed",
+					"message": "Failed to generate preview",
+				})
+				return
+			}
+		} else if err := h.cache.Put(source.hash, params.width, params.height, params.page, params.format, imageData); err != nil {
+			// キャッシュエラーは無視（ログのみ）
+			log.Printf("Failed to cache preview: %v", err)
+		}
 	}
-	
+
 	// レスポンスを送信
-	if responseFormat == "base64" {
+	if params.response == "base64" {
 		h.sendBase64Response(c, imageData, contentType)
 	} else {
 		h.sendImageResponse(c, imageData, contentType)
 	}
 }
 
+// sendLookupError はファイルの特定に失敗したときのエラーレスポンスを返す
+func (h *PreviewHandler) sendLookupError(c *gin.Context, period string, err error) {
+	if strings.Contains(err.Error(), "does not exist") {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "period_not_found",
+			"message": "Period not found: " + period,
+		})
+		return
+	}
+	if strings.Contains(err.Error(), "not found") {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "file_not_found",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusInternalServerError, gin.H{
+		"success": false,
+		"error":   "database_error",
+		"message": err.Error(),
+	})
+}
+
+// previewSource はプレビューの元になる添付ファイル
+type previewSource struct {
+	path string // 絶対パス
+	hash string // 内容のSHA-256（キャッシュのキー）
+}
+
 // getFilePathFromDeal はデータベースから取引のファイルパスを取得
-func (h *PreviewHandler) getFilePathFromDeal(period, dealId string) (string, error) {
-	// データベース接続を取得
-	fmt.Printf("DEBUG: Connecting to period database: %s\n", period)
+func (h *PreviewHandler) getFilePathFromDeal(period, dealId string) (*previewSource, error) {
+	db, err := models.ConnectPeriodDB(period)
+	if err != nil {
+		return nil, err
+	}
+
+	deal := &models.Deal{NO: dealId}
+	var filePath, hash sql.NullString
+	err = db.QueryRow("SELECT FilePath, Hash, COALESCE(FileStore, '') FROM Deals WHERE NO = ?", dealId).Scan(
+		&filePath, &hash, &deal.FileStore)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("deal not found: %s", dealId)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get deal: %v", err)
+	}
+	if filePath.String == "" {
+		return nil, fmt.Errorf("file not found: no file associated with deal %s", dealId)
+	}
+	deal.FilePath, deal.Hash = filePath.String, hash.String
+
+	return h.resolveFilePath(period, deal)
+}
+
+// getAttachedFilePath は期間の取引に添付されたファイルのパスを返す
+func (h *PreviewHandler) getAttachedFilePath(period, fileName string) (*previewSource, error) {
 	db, err := models.ConnectPeriodDB(period)
 	if err != nil {
-		fmt.Printf("DEBUG: Database connection failed: %v\n", err)
-		return "", err
-	}
-	
-	var filePath string
-	query := "SELECT FilePath FROM Deals WHERE NO = ?"
-	fmt.Printf("DEBUG: Executing query: %s with dealId: %s\n", query, dealId)
-	err = db.QueryRow(query, dealId).Scan(&filePath)
+		return nil, err
+	}
+
+	deal := &models.Deal{FilePath: fileName}
+	var hash sql.NullString
+	err = db.QueryRow("SELECT NO, Hash, COALESCE(FileStore, '') FROM Deals WHERE FilePath = ? LIMIT 1", fileName).Scan(
+		&deal.NO, &hash, &deal.FileStore)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("file not found: %s", fileName)
+	}
 	if err != nil {
-		fmt.Printf("DEBUG: Query failed: %v\n", err)
-		return "", err
-	}
-	
-	fmt.Printf("DEBUG: Retrieved filePath from DB: %s\n", filePath)
-	
-	// 相対パスの場合は絶対パスに変換
-	if !filepath.IsAbs(filePath) {
-		filePath = filepath.Join(h.dataBasePath, period, filePath)
-	}
-	
-	fmt.Printf("DEBUG: Final filePath: %s\n", filePath)
-	
-	// ファイルの存在確認
-	if _, err := os.Stat(filePath); err != nil {
-		fmt.Printf("DEBUG: File not found at path: %s, error: %v\n", filePath, err)
-		return "", fmt.Errorf("file not found: %s", filePath)
-	}
-	
-	return filePath, nil
+		return nil, fmt.Errorf("failed to check file: %v", err)
+	}
+	deal.Hash = hash.String
+
+	return h.resolveFilePath(period, deal)
 }
 
-// getIntParam はクエリパラメータから整数値を取得
-func (h *PreviewHandler) getIntParam(c *gin.Context, name string, defaultValue int) int {
-	if value := c.Query(name); value != "" {
-		if intValue, err := strconv.Atoi(value); err == nil {
-			return intValue
+// resolveFilePath は取引の添付ファイルの保存場所（ブロブストアまたは期間フォルダ）を確認する
+// ハッシュ値が記録されていない古い取引はファイルから計算する
+func (h *PreviewHandler) resolveFilePath(period string, deal *models.Deal) (*previewSource, error) {
+	filePath, err := models.AttachmentPath(period, deal)
+	if err != nil {
+		return nil, fmt.Errorf("file not found: %s", filepath.Base(deal.FilePath))
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil || info.IsDir() {
+		return nil, fmt.Errorf("file not found: %s", filepath.Base(deal.FilePath))
+	}
+
+	hash := deal.Hash
+	if hash == "" {
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file: %v", err)
 		}
+		sum := sha256.Sum256(data)
+		hash = hex.EncodeToString(sum[:])
 	}
-	return defaultValue
+
+	return &previewSource{path: filePath, hash: hash}, nil
+}
+
+// isPlainFileName はパス区切りや親フォルダの指定を含まない名前かどうかを返す
+func isPlainFileName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\:`)
+}
+
+// getIntParam はクエリパラメータから整数値を取得
+func getIntParam(c *gin.Context, name string, defaultValue int) (int, error) {
+	value := c.Query(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	intValue, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be an integer", name)
+	}
+	return intValue, nil
 }
 
 // sendImageResponse は画像レスポンスを送信
@@ -267,11 +358,11 @@ func (h *PreviewHandler) sendImageResponse(c *gin.Context, data []byte, contentT
 	if contentType == "" || !strings.HasPrefix(contentType, "image/") {
 		contentType = "image/jpeg"
 	}
-	
+
 	// キャッシュヘッダーを設定
-	c.Header("Cache-Control", "public, max-age=86400") // 24時間
+	c.Header("Cache-Control", "private, max-age=86400") // 24時間（認証が必要なので共有キャッシュには置かない）
 	c.Header("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
-	
+
 	// 画像データを送信
 	c.Data(http.StatusOK, contentType, data)
 }
@@ -282,10 +373,10 @@ func (h *PreviewHandler) sendBase64Response(c *gin.Context, data []byte, content
 	if contentType == "" || !strings.HasPrefix(contentType, "image/") {
 		contentType = "image/jpeg"
 	}
-	
+
 	// Base64エンコード
 	encodedData := base64.StdEncoding.EncodeToString(data)
-	
+
 	// JSONレスポンスとして送信
 	c.JSON(http.StatusOK, gin.H{
 		"success":     true,
@@ -299,33 +390,44 @@ func (h *PreviewHandler) getDefaultIcon(ext string) ([]byte, string) {
 	// 拡張子に応じたデフォルトアイコンを返す
 	// 実際の実装では、事前に用意したアイコンファイルを読み込む
 	iconPath := filepath.Join(h.dataBasePath, "assets", "icons", "default.png")
-	
+
 	// 拡張子別のアイコンがある場合
 	ext = strings.ToLower(strings.TrimPrefix(ext, "."))
 	specificIconPath := filepath.Join(h.dataBasePath, "assets", "icons", ext+".png")
 	if _, err := os.Stat(specificIconPath); err == nil {
 		iconPath = specificIconPath
 	}
-	
+
 	// アイコンファイルを読み込み
 	data, err := os.ReadFile(iconPath)
 	if err != nil {
 		// 読み込みエラーの場合は空の画像を返す
 		return []byte{}, "image/png"
 	}
-	
+
 	return data, "image/png"
 }
 
 // GetCacheStats はキャッシュの統計情報を取得
 func (h *PreviewHandler) GetCacheStats(c *gin.Context) {
-	count, totalSize := h.cache.GetStats()
-	
+	stats := h.cache.GetStats()
+
+	hitRate := 0.0
+	if requests := stats.Hits + stats.Misses; requests > 0 {
+		hitRate = float64(stats.Hits) / float64(requests)
+	}
+
 	c.JSON(http.StatusOK, gin.H{
-		"success":   true,
-		"count":     count,
-		"totalSize": totalSize,
-		"sizeText":  formatBytes(totalSize),
+		"success":     true,
+		"count":       stats.Count,
+		"totalSize":   stats.TotalSize,
+		"sizeText":    formatBytes(stats.TotalSize),
+		"maxBytes":    stats.MaxBytes,
+		"maxSizeText": formatBytes(stats.MaxBytes),
+		"ttlSeconds":  int64(stats.TTL / time.Second),
+		"hits":        stats.Hits,
+		"misses":      stats.Misses,
+		"hitRate":     hitRate,
 	})
 }
 
@@ -339,7 +441,7 @@ func (h *PreviewHandler) ClearCache(c *gin.Context) {
 		})
 		return
 	}
-	
+
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"message": "Cache cleared successfully",
@@ -350,7 +452,7 @@ func (h *PreviewHandler) ClearCache(c *gin.Context) {
 func (h *PreviewHandler) GetDealPreviewLink(c *gin.Context) {
 	period := c.Query("period")
 	dealId := c.Query("dealId")
-	
+
 	// パラメータの検証
 	if period == "" || dealId == "" {
 		c.JSON(http.StatusBadRequest, gin.H{
@@ -360,18 +462,9 @@ func (h *PreviewHandler) GetDealPreviewLink(c *gin.Context) {
 		})
 		return
 	}
-	
-	// データベースから取引情報を取得してファイル名を取得
-	if err := models.ConnectToPeriod(period); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"success": false,
-			"error":   "connection_error",
-			"message": fmt.Sprintf("Failed to connect to period: %v", err),
-		})
-		return
-	}
-	
-	deal, err := models.GetDealByID(dealId)
+
+	// 取引情報を取得してファイル名を取得
+	deal, err := models.GetDealByID(period, dealId)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{
 			"success": false,
@@ -380,7 +473,7 @@ func (h *PreviewHandler) GetDealPreviewLink(c *gin.Context) {
 		})
 		return
 	}
-	
+
 	// ファイルパスが存在しない場合
 	if deal.FilePath == "" {
 		c.JSON(http.StatusNotFound, gin.H{
@@ -390,20 +483,22 @@ func (h *PreviewHandler) GetDealPreviewLink(c *gin.Context) {
 		})
 		return
 	}
-	
-	// 環境変数からプレビューホストを取得（デフォルト値あり）
-	previewHost := os.Getenv("DENCHOKUN_PREVIEW_HOST")
-	if previewHost == "" {
-		previewHost = "http://localhost:8081"
-	}
-	
-	// プレビューURLを構築（修正版）
-	// http://localhost:8081/v1/api/preview?period={period}&filename={filename}
-	previewURL := fmt.Sprintf("%s/v1/api/preview?period=%s&filename=%s", 
-		previewHost, 
-		url.QueryEscape(period), 
-		url.QueryEscape(deal.FilePath))
-	
+
+	// DENCHOKUN_PREVIEW_HOST が設定されていれば別のプレビューサーバーへのリンク、
+	// 未設定ならこのサーバーの GET /preview/deals/:dealId へのリンク（ホストを含まないパス）を返す
+	var previewURL string
+	if previewHost := os.Getenv("DENCHOKUN_PREVIEW_HOST"); previewHost != "" {
+		// http://localhost:8081/v1/api/preview?period={period}&filename={filename}
+		previewURL = fmt.Sprintf("%s/v1/api/preview?period=%s&filename=%s",
+			previewHost,
+			url.QueryEscape(period),
+			url.QueryEscape(deal.FilePath))
+	} else {
+		previewURL = fmt.Sprintf("/v1/api/preview/deals/%s?period=%s",
+			url.PathEscape(deal.NO),
+			url.QueryEscape(period))
+	}
+
 	// 元のリクエストから width, height などの追加パラメータを取得して追加
 	for key, values := range c.Request.URL.Query() {
 		// period と dealId は除外（既に処理済み）
@@ -413,11 +508,11 @@ func (h *PreviewHandler) GetDealPreviewLink(c *gin.Context) {
 			}
 		}
 	}
-	
+
 	// レスポンスを返す
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
-		"url": previewURL,
+		"url":     previewURL,
 	})
 }
 
@@ -433,4 +528,4 @@ func formatBytes(bytes int64) string {
 		exp++
 	}
 	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
-}
\ No newline at end of file
+}
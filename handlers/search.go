@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"denchokun-api/middleware"
+	"denchokun-api/models"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SearchDeals handles GET /deals/search.
+// q is searched in DealName, DealRemark and DealPartner through the full-text index; the
+// other parameters of GET /deals narrow the results. Results are ranked by relevance and
+// carry snippets with the matches between highlight_start and highlight_end.
+func SearchDeals(c *gin.Context) {
+	var filter models.DealFilter
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid_request",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	options := models.SearchOptions{
+		Query:          c.Query("q"),
+		HighlightStart: c.DefaultQuery("highlight_start", "<mark>"),
+		HighlightEnd:   c.DefaultQuery("highlight_end", "</mark>"),
+	}
+	if options.Query == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid_request",
+			"message": "q is required",
+		})
+		return
+	}
+	if options.HighlightStart == "" || options.HighlightEnd == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid_request",
+			"message": "highlight_start and highlight_end must not be empty",
+		})
+		return
+	}
+
+	if err := models.ValidateDealFilter(&filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid_request",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	if !connectExistingPeriod(c, filter.Period) {
+		return
+	}
+
+	results, count, err := models.SearchDeals(&filter, options)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "database_error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"query":   options.Query,
+		"count":   count,
+		"deals":   results,
+	})
+}
+
+// GetDealTexts handles GET /deals/:dealId/texts.
+// It returns the text extracted in the background from the deal's file and active
+// attachments; files not processed yet have the status "pending".
+func GetDealTexts(c *gin.Context) {
+	dealID := c.Param("dealId")
+	period := c.Query("period")
+	if period == "" {
+		sendMissingPeriod(c)
+		return
+	}
+
+	if _, err := models.GetDealByID(period, dealID); err != nil {
+		sendAttachmentError(c, err)
+		return
+	}
+
+	texts, err := models.GetDealTexts(period, dealID)
+	if err != nil {
+		sendAttachmentError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"dealNo":  dealID,
+		"texts":   texts,
+	})
+}
+
+// RebuildSearchIndex handles POST /maintenance/search-index/rebuild.
+// The index of the given period, or of every period if none is given, is rebuilt from the deals.
+// With reextract=true the text of the files is also extracted again in the background.
+func RebuildSearchIndex(c *gin.Context) {
+	periods := []string{c.Query("period")}
+	if periods[0] == "" {
+		var err error
+		if periods, err = models.GetAvailablePeriods(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"success": false,
+				"error":   "database_error",
+				"message": err.Error(),
+			})
+			return
+		}
+	}
+
+	results := []models.SearchIndexResult{}
+	failed := 0
+	reextract := c.Query("reextract") == "true"
+	for _, period := range periods {
+		result, err := models.RebuildDealSearchIndex(period, reextract)
+		if err != nil {
+			log.Printf("RebuildSearchIndex: %v", err)
+			result = &models.SearchIndexResult{Period: period, Error: err.Error()}
+			failed++
+		}
+		results = append(results, *result)
+	}
+
+	middleware.SetAuditTarget(c, c.Query("period"), "", "")
+	middleware.SetAuditAfter(c, results)
+
+	status := http.StatusOK
+	response := gin.H{
+		"success": failed == 0,
+		"periods": results,
+	}
+	if failed > 0 {
+		status = http.StatusInternalServerError
+		response["error"] = "rebuild_error"
+		response["message"] = "Failed to rebuild the search index of some periods"
+	}
+	c.JSON(status, response)
+}
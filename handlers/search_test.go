@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"denchokun-api/models"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSearchDealsUnknownPeriod(t *testing.T) {
+	setupTestDB(t)
+	router := gin.New()
+	router.GET("/deals/search", SearchDeals)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deals/search?period=2099&q=test", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("status %d, body %s", w.Code, w.Body)
+	}
+
+	// Searching must not create the period
+	periods, err := models.GetAvailablePeriods()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, period := range periods {
+		if period == "2099" {
+			t.Error("search created period 2099")
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"denchokun-api/middleware"
 	"denchokun-api/models"
 	"net/http"
 
@@ -43,6 +44,13 @@ func UpdateSystemInfo(c *gin.Context) {
 		return
 	}
 
+	if appVersion, sqliteVersion, err := models.GetSystemInfo(); err == nil {
+		middleware.SetAuditBefore(c, SystemInfo{
+			AppVersion:           appVersion,
+			SQLiteLibraryVersion: sqliteVersion,
+		})
+	}
+
 	if err := models.UpdateSystemInfo(systemInfo.AppVersion, systemInfo.SQLiteLibraryVersion); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"success": false,
@@ -51,6 +59,8 @@ func UpdateSystemInfo(c *gin.Context) {
 		return
 	}
 
+	middleware.SetAuditAfter(c, systemInfo)
+
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"message": "System info updated successfully",
@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"denchokun-api/models"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetTaxSummary handles GET /periods/tax-summary.
+// It accepts the same search conditions as GET /deals.
+func GetTaxSummary(c *gin.Context) {
+	var filter models.DealFilter
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid_request",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	if err := models.ValidateDealFilter(&filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid_request",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	summary, err := models.GetTaxSummary(&filter)
+	if err != nil {
+		if strings.Contains(err.Error(), "does not exist") {
+			c.JSON(http.StatusNotFound, gin.H{
+				"success": false,
+				"error":   "period_not_found",
+				"message": "Period not found: " + filter.Period,
+			})
+			return
+		}
+
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "database_error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"summary": summary,
+	})
+}
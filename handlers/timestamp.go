@@ -0,0 +1,410 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"denchokun-api/models"
+	"denchokun-api/tsa"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// timestampAuthority issues timestamp tokens for attached files (nil when disabled)
+var timestampAuthority tsa.Authority
+
+// timestampRoots are the TSA certificates whose tokens are accepted by verification
+var timestampRoots *x509.CertPool
+
+// SetTimestampAuthority sets the TSA used to timestamp attached files
+func SetTimestampAuthority(authority tsa.Authority) {
+	timestampAuthority = authority
+}
+
+// SetTimestampRoots sets the trusted TSA certificates. Tokens signed by any other
+// certificate fail verification even if their signature is correct.
+func SetTimestampRoots(roots *x509.CertPool) {
+	timestampRoots = roots
+}
+
+// stampDealFile requests a timestamp token over the file hash of a deal and stores it.
+// If the same file was already timestamped in the period, that token is reused.
+func stampDealFile(period, dealNO, fileHash string) (*models.DealTimestamp, error) {
+	ts, err := issueTimestamp(period, dealNO, fileHash)
+	if ts == nil || err != nil {
+		return nil, err
+	}
+	if err := models.SaveDealTimestamp(period, ts); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+// stampAttachmentFile requests a timestamp token over the file hash of an attachment
+// and stores it, reusing a token of the same file like stampDealFile.
+func stampAttachmentFile(period string, a *models.Attachment) (*models.DealTimestamp, error) {
+	ts, err := issueTimestamp(period, a.DealNO, a.Hash)
+	if ts == nil || err != nil {
+		return nil, err
+	}
+	if err := models.SaveAttachmentTimestamp(period, a.ID, ts); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+// issueTimestamp returns a timestamp token over fileHash for dealNO without storing it.
+// A token already issued over the same hash in the period is reused; nil is returned
+// when timestamping is disabled.
+func issueTimestamp(period, dealNO, fileHash string) (*models.DealTimestamp, error) {
+	if timestampAuthority == nil || fileHash == "" {
+		return nil, nil
+	}
+
+	if existing, err := models.FindTimestampByHash(period, fileHash); err == nil {
+		existing.DealNO = dealNO
+		existing.Created = ""
+		return existing, nil
+	}
+
+	digest, err := hex.DecodeString(fileHash)
+	if err != nil {
+		return nil, fmt.Errorf("invalid file hash: %v", err)
+	}
+
+	token, err := timestampAuthority.Timestamp(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.DealTimestamp{
+		DealNO:        dealNO,
+		Hash:          fileHash,
+		HashAlgorithm: "SHA-256",
+		Token:         token.DER,
+		GenTime:       token.GenTime.UTC().Format(time.RFC3339),
+		SerialNumber:  token.SerialNumber,
+		Policy:        token.Policy,
+		Authority:     timestampAuthority.Name(),
+	}, nil
+}
+
+// stampDealsInBackground timestamps the files of deals created together, one after
+// another in a background goroutine, so that the request does not wait for a TSA round
+// trip per deal. It returns the number of deals that will be timestamped; failures are
+// only logged, and the deals are left without a token.
+func stampDealsInBackground(period string, deals []*models.Deal) int {
+	if timestampAuthority == nil {
+		return 0
+	}
+
+	var pending []*models.Deal
+	for _, deal := range deals {
+		if deal.FilePath != "" && deal.Hash != "" {
+			pending = append(pending, deal)
+		}
+	}
+	if len(pending) == 0 {
+		return 0
+	}
+
+	go func() {
+		stamped := 0
+		for _, deal := range pending {
+			if _, err := stampDealFile(period, deal.NO, deal.Hash); err != nil {
+				log.Printf("Timestamp: Failed to timestamp deal %s: %v", deal.NO, err)
+				continue
+			}
+			stamped++
+		}
+		log.Printf("Timestamp: Timestamped %d of %d deals of period %s", stamped, len(pending), period)
+	}()
+	return len(pending)
+}
+
+// addTimestampToResponse timestamps the file of a deal and adds the result to the response.
+// A TSA failure does not fail the request; the deal is saved and a warning is returned.
+func addTimestampToResponse(response gin.H, period, dealNO, fileHash string) {
+	ts, err := stampDealFile(period, dealNO, fileHash)
+	if err != nil {
+		log.Printf("Timestamp: Failed to timestamp deal %s: %v", dealNO, err)
+		response["timestampWarning"] = fmt.Sprintf("Failed to obtain timestamp: %v", err)
+		return
+	}
+	if ts != nil {
+		response["timestamp"] = ts
+	}
+}
+
+// addAttachmentTimestampToResponse is addTimestampToResponse for an added attachment
+func addAttachmentTimestampToResponse(response gin.H, period string, a *models.Attachment) {
+	ts, err := stampAttachmentFile(period, a)
+	if err != nil {
+		log.Printf("Timestamp: Failed to timestamp attachment %d of deal %s: %v", a.ID, a.DealNO, err)
+		response["timestampWarning"] = fmt.Sprintf("Failed to obtain timestamp: %v", err)
+		return
+	}
+	if ts != nil {
+		response["timestamp"] = ts
+	}
+}
+
+// copyDealTimestamp copies the timestamp tokens of a deal and its attachments to a deal
+// in another period
+func copyDealTimestamp(fromPeriod, fromNO, toPeriod, toNO string) error {
+	ts, err := models.GetDealTimestamp(fromPeriod, fromNO)
+	if err == nil {
+		ts.DealNO = toNO
+		ts.Created = ""
+		err = models.SaveDealTimestamp(toPeriod, ts)
+	}
+	if err != nil && !strings.Contains(err.Error(), "not found") {
+		return err
+	}
+	return copyAttachmentTimestamps(fromPeriod, toPeriod, toNO)
+}
+
+// copyAttachmentTimestamps gives the attachments of toNO the tokens issued over their
+// files in fromPeriod, for attachments moved with their deal to another period
+func copyAttachmentTimestamps(fromPeriod, toPeriod, toNO string) error {
+	attachments, err := models.GetDealAttachments(toPeriod, toNO, false)
+	if err != nil {
+		return err
+	}
+
+	for i := range attachments {
+		a := &attachments[i]
+		ts, err := models.FindTimestampByHash(fromPeriod, a.Hash)
+		if err != nil {
+			if strings.Contains(err.Error(), "not found") {
+				continue
+			}
+			return err
+		}
+		ts.DealNO = toNO
+		ts.Created = ""
+		if err := models.SaveAttachmentTimestamp(toPeriod, a.ID, ts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getDealForTimestamp loads the deal and its timestamp token, writing an error response on failure
+func getDealForTimestamp(c *gin.Context, handler string) (string, *models.Deal, *models.DealTimestamp, bool) {
+	dealId := c.Param("dealId")
+	period := c.Query("period")
+
+	if period == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "missing_period",
+			"message": "Period is required",
+		})
+		return "", nil, nil, false
+	}
+
+	db, err := models.ConnectPeriodDB(period)
+	if err != nil {
+		log.Printf("%s: Failed to connect to period %s: %v", handler, period, err)
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "period_not_found",
+			"message": err.Error(),
+		})
+		return "", nil, nil, false
+	}
+
+	var deal models.Deal
+	var filePath, fileHash *string
+	err = db.QueryRow("SELECT NO, FilePath, Hash, COALESCE(FileStore, '') FROM Deals WHERE NO = ?", dealId).Scan(
+		&deal.NO, &filePath, &fileHash, &deal.FileStore)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "deal_not_found",
+			"message": "Deal not found",
+		})
+		return "", nil, nil, false
+	}
+	if filePath != nil {
+		deal.FilePath = *filePath
+	}
+	if fileHash != nil {
+		deal.Hash = *fileHash
+	}
+
+	ts, err := models.GetDealTimestamp(period, dealId)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			c.JSON(http.StatusNotFound, gin.H{
+				"success": false,
+				"error":   "timestamp_not_found",
+				"message": "No timestamp token for this deal",
+			})
+			return "", nil, nil, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "database_error",
+			"message": err.Error(),
+		})
+		return "", nil, nil, false
+	}
+
+	return period, &deal, ts, true
+}
+
+// DownloadDealTimestamp returns the timestamp token of a deal as a .tsr file
+func DownloadDealTimestamp(c *gin.Context) {
+	_, deal, ts, ok := getDealForTimestamp(c, "DownloadDealTimestamp")
+	if !ok {
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.tsr\"", deal.NO))
+	c.Data(http.StatusOK, "application/timestamp-reply", ts.Token)
+}
+
+// VerifyDealTimestamp checks the timestamp token of a deal against the attached file on disk
+func VerifyDealTimestamp(c *gin.Context) {
+	period, deal, ts, ok := getDealForTimestamp(c, "VerifyDealTimestamp")
+	if !ok {
+		return
+	}
+
+	if deal.FilePath == "" {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "no_file",
+			"message": "No file associated with this deal",
+		})
+		return
+	}
+
+	path, err := models.AttachmentPath(period, deal)
+	if err != nil {
+		sendTimestampFileNotFound(c)
+		return
+	}
+
+	response, ok := verifyFileTimestamp(c, path, ts, deal.Hash)
+	if !ok {
+		return
+	}
+	response["dealNo"] = deal.NO
+	c.JSON(http.StatusOK, response)
+}
+
+// VerifyAttachmentTimestamp checks the timestamp token of an attachment against its
+// file in the blob store
+func VerifyAttachmentTimestamp(c *gin.Context) {
+	dealID := c.Param("dealId")
+	period := c.Query("period")
+	if period == "" {
+		sendMissingPeriod(c)
+		return
+	}
+
+	id, ok := getAttachmentID(c)
+	if !ok {
+		return
+	}
+
+	attachment, err := models.GetDealAttachment(period, dealID, id)
+	if err != nil {
+		sendAttachmentError(c, err)
+		return
+	}
+
+	ts, err := models.GetAttachmentTimestamp(period, attachment)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			c.JSON(http.StatusNotFound, gin.H{
+				"success": false,
+				"error":   "timestamp_not_found",
+				"message": "No timestamp token for this attachment",
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "database_error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	path, err := models.AttachmentFilePath(attachment)
+	if err != nil {
+		sendTimestampFileNotFound(c)
+		return
+	}
+
+	response, ok := verifyFileTimestamp(c, path, ts, attachment.Hash)
+	if !ok {
+		return
+	}
+	response["dealNo"] = attachment.DealNO
+	response["attachmentId"] = attachment.ID
+	c.JSON(http.StatusOK, response)
+}
+
+// verifyFileTimestamp hashes the file at path and verifies ts against it. It returns
+// the fields of the verification response, or writes an error response and returns false.
+func verifyFileTimestamp(c *gin.Context, path string, ts *models.DealTimestamp, recordedHash string) (gin.H, bool) {
+	file, err := os.Open(path)
+	if err != nil {
+		sendTimestampFileNotFound(c)
+		return nil, false
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "file_read_error",
+			"message": err.Error(),
+		})
+		return nil, false
+	}
+	digest := hasher.Sum(nil)
+	fileHash := hex.EncodeToString(digest)
+
+	result, err := tsa.Verify(ts.Token, digest, timestampRoots)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"success": false,
+			"error":   "invalid_timestamp",
+			"message": err.Error(),
+		})
+		return nil, false
+	}
+
+	hashMatchesRecord := strings.EqualFold(fileHash, recordedHash)
+	return gin.H{
+		"success":           true,
+		"valid":             result.Verified && hashMatchesRecord,
+		"fileHash":          fileHash,
+		"recordedHash":      recordedHash,
+		"hashMatchesRecord": hashMatchesRecord,
+		"authority":         ts.Authority,
+		"verification":      result,
+	}, true
+}
+
+func sendTimestampFileNotFound(c *gin.Context) {
+	c.JSON(http.StatusNotFound, gin.H{
+		"success": false,
+		"error":   "file_not_found",
+		"message": "File not found on server",
+	})
+}
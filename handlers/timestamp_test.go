@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"crypto/x509"
+	"denchokun-api/models"
+	"denchokun-api/tsa"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// useLocalTimestampAuthority timestamps with a local TSA for the rest of the test
+func useLocalTimestampAuthority(t *testing.T) {
+	t.Helper()
+	authority, err := tsa.NewLocalAuthority(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(authority.Certificate())
+	SetTimestampAuthority(authority)
+	SetTimestampRoots(roots)
+	t.Cleanup(func() {
+		SetTimestampAuthority(nil)
+		SetTimestampRoots(nil)
+	})
+}
+
+func TestAttachmentTimestamp(t *testing.T) {
+	setupTestDB(t)
+	useLocalTimestampAuthority(t)
+	const period = "2025"
+	if _, err := models.ConnectToPeriod(period); err != nil {
+		t.Fatal(err)
+	}
+	deal := &models.Deal{
+		NO:          "20250401_000001",
+		DealType:    "領収書",
+		DealDate:    "2025-04-01",
+		DealName:    "文房具",
+		DealPartner: "テスト商店",
+		DealPrice:   1100,
+		RecStatus:   "NEW",
+	}
+	if err := models.CreateDeal(period, deal); err != nil {
+		t.Fatal(err)
+	}
+
+	router := gin.New()
+	router.POST("/deals/:dealId/attachments", AddDealAttachment)
+	router.GET("/deals/:dealId/attachments/:attachmentId/timestamp/verify", VerifyAttachmentTimestamp)
+
+	body := `{"period":"2025","role":"receipt","fileData":{"name":"receipt.pdf","base64Data":"` +
+		base64.StdEncoding.EncodeToString([]byte("%PDF-1.4 receipt")) + `"}}`
+	req := httptest.NewRequest(http.MethodPost, "/deals/"+deal.NO+"/attachments", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("add: status %d, body %s", w.Code, w.Body)
+	}
+	var added struct {
+		Attachment models.Attachment     `json:"attachment"`
+		Timestamp  *models.DealTimestamp `json:"timestamp"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &added); err != nil {
+		t.Fatal(err)
+	}
+	if added.Timestamp == nil || added.Timestamp.Hash != added.Attachment.Hash {
+		t.Fatalf("attachment was not timestamped: %s", w.Body)
+	}
+
+	verify := func() (int, map[string]interface{}) {
+		t.Helper()
+		url := "/deals/" + deal.NO + "/attachments/" + strconv.FormatInt(added.Attachment.ID, 10) + "/timestamp/verify?period=" + period
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+		var response map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, response
+	}
+
+	code, response := verify()
+	if code != http.StatusOK || response["valid"] != true {
+		t.Fatalf("verify: status %d, %v", code, response)
+	}
+
+	// A changed file no longer matches the token
+	path, err := models.AttachmentFilePath(&added.Attachment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("%PDF-1.4 RECEIPT"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	code, response = verify()
+	if code != http.StatusOK || response["valid"] != false || response["hashMatchesRecord"] != false {
+		t.Errorf("verify changed file: status %d, %v", code, response)
+	}
+}
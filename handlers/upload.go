@@ -0,0 +1,427 @@
+package handlers
+
+import (
+	"denchokun-api/middleware"
+	"denchokun-api/models"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultMaxUploadSize is the default limit of an attached file
+const DefaultMaxUploadSize = 100 * 1024 * 1024
+
+// maxDealDataSize is the limit of the dealData field of a multipart request
+const maxDealDataSize = 1024 * 1024
+
+// maxUploadSize is the limit of an attached file in bytes
+var maxUploadSize int64 = DefaultMaxUploadSize
+
+// SetMaxUploadSize sets the limit of an attached file in bytes
+func SetMaxUploadSize(size int64) {
+	maxUploadSize = size
+}
+
+// limitRequestBody caps the size of a request body carrying a file of at most
+// maxUploadSize bytes, so that oversized requests fail while they are being read
+func limitRequestBody(c *gin.Context, base64Encoded bool) {
+	limit := maxUploadSize
+	if base64Encoded {
+		limit = (limit + 2) / 3 * 4
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit+maxDealDataSize)
+}
+
+// readMultipartDeal reads a multipart request with a dealData field, a file part and an
+// optional path field holding the path of the file on the client. See readMultipartUpload.
+func readMultipartDeal(c *gin.Context, handler string) (dealData string, clientPath string, upload *models.BlobWriter, fileName string, ok bool) {
+	fields, upload, fileName, ok := readMultipartUpload(c, handler, "dealData", "path")
+	return fields["dealData"], fields["path"], upload, fileName, ok
+}
+
+// readMultipartUpload reads a multipart request part by part. The named text fields
+// are returned by name and the file part is streamed into the blob temp area while
+// it is hashed. upload is nil when no file (or an empty file) was sent; otherwise
+// the caller must Commit or Abort it.
+// On failure the error response has already been written.
+func readMultipartUpload(c *gin.Context, handler string, fieldNames ...string) (fields map[string]string, upload *models.BlobWriter, fileName string, ok bool) {
+	limitRequestBody(c, false)
+
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		log.Printf("%s: Failed to parse multipart form: %v", handler, err)
+		sendInvalidMultipart(c)
+		return nil, nil, "", false
+	}
+
+	isField := map[string]bool{}
+	for _, name := range fieldNames {
+		isField[name] = true
+	}
+
+	fields = map[string]string{}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("%s: Failed to parse multipart form: %v", handler, err)
+			abortUpload(upload)
+			if !sendUploadTooLarge(c, err) {
+				sendInvalidMultipart(c)
+			}
+			return nil, nil, "", false
+		}
+
+		switch name := part.FormName(); {
+		case isField[name]:
+			data, err := io.ReadAll(io.LimitReader(part, maxDealDataSize+1))
+			if err != nil || len(data) > maxDealDataSize {
+				log.Printf("%s: Failed to read %s: %v", handler, name, err)
+				abortUpload(upload)
+				if !sendUploadTooLarge(c, err) {
+					c.JSON(http.StatusBadRequest, gin.H{
+						"success": false,
+						"error":   "invalid_request",
+						"message": "Invalid " + name,
+					})
+				}
+				return nil, nil, "", false
+			}
+			fields[name] = string(data)
+
+		case name == "file":
+			// Only the first file is attached
+			if upload != nil || part.FileName() == "" {
+				break
+			}
+			upload, err = spoolUpload(c, handler, part)
+			if err != nil {
+				return nil, nil, "", false
+			}
+			fileName = part.FileName()
+		}
+		part.Close()
+	}
+
+	if upload != nil && upload.Size() == 0 {
+		upload.Abort()
+		upload = nil
+	}
+
+	return fields, upload, fileName, true
+}
+
+// readBase64Upload streams base64 file data of a JSON request into the blob temp area.
+// It returns nil when data is empty. On failure the error response has already been written.
+func readBase64Upload(c *gin.Context, handler string, data string) (*models.BlobWriter, bool) {
+	if data == "" {
+		return nil, true
+	}
+
+	upload, err := spoolUpload(c, handler, base64.NewDecoder(base64.StdEncoding, strings.NewReader(data)))
+	if err != nil {
+		return nil, false
+	}
+	if upload.Size() == 0 {
+		upload.Abort()
+		return nil, true
+	}
+	return upload, true
+}
+
+// spoolUpload copies r into a new BlobWriter limited to maxUploadSize.
+// On failure the writer is discarded and the error response has already been written.
+func spoolUpload(c *gin.Context, handler string, r io.Reader) (*models.BlobWriter, error) {
+	upload, err := models.NewBlobWriter(maxUploadSize)
+	if err != nil {
+		log.Printf("%s: Failed to create upload file: %v", handler, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "file_save_error",
+			"message": err.Error(),
+		})
+		return nil, err
+	}
+
+	if _, err := io.Copy(upload, r); err != nil {
+		upload.Abort()
+		log.Printf("%s: Failed to read uploaded file: %v", handler, err)
+		if sendUploadTooLarge(c, err) {
+			return nil, err
+		}
+
+		var corrupt base64.CorruptInputError
+		if errors.As(err, &corrupt) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"success": false,
+				"error":   "invalid_file_data",
+				"message": "Failed to decode base64 file data",
+			})
+			return nil, err
+		}
+
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "file_read_error",
+			"message": "Failed to read uploaded file",
+		})
+		return nil, err
+	}
+
+	log.Printf("%s: Received file, size: %d bytes", handler, upload.Size())
+	return upload, nil
+}
+
+// sendUploadTooLarge writes the file_too_large response if err was caused by a
+// file or request body over the limit
+func sendUploadTooLarge(c *gin.Context, err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	if err == nil || (!errors.As(err, &maxBytesErr) && !strings.Contains(err.Error(), "file too large")) {
+		return false
+	}
+
+	c.JSON(http.StatusBadRequest, gin.H{
+		"success": false,
+		"error":   "file_too_large",
+		"message": fmt.Sprintf("ファイルサイズが%sを超えています", formatBytes(maxUploadSize)),
+		"maxSize": maxUploadSize,
+	})
+	return true
+}
+
+func sendInvalidMultipart(c *gin.Context) {
+	c.JSON(http.StatusBadRequest, gin.H{
+		"success": false,
+		"error":   "invalid_request",
+		"message": "Failed to parse multipart form",
+	})
+}
+
+// clientFileName returns the last element of a file name or path sent by a client,
+// which may use Windows separators
+func clientFileName(name string) string {
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
+
+// setUploadedFileInfo records where a file just stored for deal came from: the name it
+// was uploaded with, the path on the client, the upload time and the detected MIME type
+func setUploadedFileInfo(deal *models.Deal, fileName, clientPath string) {
+	deal.OriginalFileName = clientFileName(fileName)
+	if deal.OriginalFileName == "" {
+		deal.OriginalFileName = clientFileName(clientPath)
+	}
+	deal.ClientPath = clientPath
+	deal.FileUploaded = time.Now().Format("2006-01-02T15:04:05Z")
+	deal.MimeType = models.BlobMimeType(deal.Hash, deal.OriginalFileName)
+}
+
+// copyUploadedFileInfo carries the file details of from over to a record pointing to the same file
+func copyUploadedFileInfo(deal *models.Deal, from *models.Deal) {
+	deal.OriginalFileName = from.OriginalFileName
+	deal.ClientPath = from.ClientPath
+	deal.FileUploaded = from.FileUploaded
+	deal.MimeType = from.MimeType
+}
+
+// abortUpload discards upload if it is not nil
+func abortUpload(upload *models.BlobWriter) {
+	if upload != nil {
+		upload.Abort()
+	}
+}
+
+// UploadRequest starts a resumable upload
+type UploadRequest struct {
+	Name string `json:"name"`
+	Size int64  `json:"size" binding:"required"`
+}
+
+// CreateUpload handles POST /uploads.
+// It starts a resumable upload; the file is then sent with PATCH /uploads/:uploadId
+// and attached with fileData.uploadId of POST /deals or PUT /deals/:dealId.
+func CreateUpload(c *gin.Context) {
+	var req UploadRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid_request",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	if req.Size <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid_request",
+			"message": "size must be greater than 0",
+		})
+		return
+	}
+	if req.Size > maxUploadSize {
+		sendUploadTooLarge(c, fmt.Errorf("file too large: %d bytes", req.Size))
+		return
+	}
+
+	session, err := models.CreateUploadSession(c.GetString(middleware.ActorKey), req.Name, req.Size)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "database_error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	middleware.SetAuditTarget(c, "", session.ID, "")
+	middleware.SetAuditAfter(c, session)
+
+	setUploadHeaders(c, session)
+	c.Header("Location", "/v1/api/uploads/"+session.ID)
+	c.JSON(http.StatusCreated, gin.H{
+		"success": true,
+		"upload":  session,
+	})
+}
+
+// GetUpload handles GET and HEAD /uploads/:uploadId.
+// The current offset is also returned in the Upload-Offset header.
+func GetUpload(c *gin.Context) {
+	session, err := models.GetUploadSession(c.Param("uploadId"), c.GetString(middleware.ActorKey))
+	if err != nil {
+		sendUploadSessionError(c, nil, err)
+		return
+	}
+
+	setUploadHeaders(c, session)
+	if c.Request.Method == http.MethodHead {
+		c.Status(http.StatusOK)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"upload":  session,
+	})
+}
+
+// UploadChunk handles PATCH /uploads/:uploadId.
+// The request body is appended at the offset given in the Upload-Offset header, which
+// must be the current offset of the upload. When the connection drops, the bytes
+// received so far are kept and the client resumes from the offset of GET /uploads/:uploadId.
+func UploadChunk(c *gin.Context) {
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid_request",
+			"message": "Upload-Offset header is required",
+		})
+		return
+	}
+
+	// Chunks are raw bytes as in tus; form bodies would be parsed by other middleware
+	if contentType := c.ContentType(); contentType != "application/offset+octet-stream" && contentType != "application/octet-stream" {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{
+			"success": false,
+			"error":   "unsupported_media_type",
+			"message": "Content-Type must be application/offset+octet-stream",
+		})
+		return
+	}
+
+	session, err := models.WriteUploadChunk(c.Param("uploadId"), c.GetString(middleware.ActorKey), offset, c.Request.Body)
+	if err != nil {
+		sendUploadSessionError(c, session, err)
+		return
+	}
+
+	setUploadHeaders(c, session)
+	c.JSON(http.StatusOK, gin.H{
+		"success":  true,
+		"upload":   session,
+		"complete": session.Complete(),
+	})
+}
+
+// DeleteUpload handles DELETE /uploads/:uploadId and discards the received bytes
+func DeleteUpload(c *gin.Context) {
+	uploadID := c.Param("uploadId")
+	middleware.SetAuditTarget(c, "", uploadID, "")
+
+	if err := models.DeleteUploadSession(uploadID, c.GetString(middleware.ActorKey)); err != nil {
+		sendUploadSessionError(c, nil, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Upload cancelled",
+	})
+}
+
+// readSessionUpload opens a completed upload session for attaching to a deal.
+// On failure the error response has already been written.
+func readSessionUpload(c *gin.Context, handler string, uploadID string) (*models.BlobWriter, string, bool) {
+	upload, session, err := models.OpenUploadBlob(uploadID, c.GetString(middleware.ActorKey))
+	if err != nil {
+		log.Printf("%s: Failed to open upload %s: %v", handler, uploadID, err)
+		sendUploadSessionError(c, session, err)
+		return nil, "", false
+	}
+
+	log.Printf("%s: Attaching upload %s, size: %d bytes", handler, uploadID, upload.Size())
+	return upload, session.Name, true
+}
+
+// setUploadHeaders sets the offset and length of an upload session in the response headers
+func setUploadHeaders(c *gin.Context, session *models.UploadSession) {
+	c.Header("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(session.Size, 10))
+	c.Header("Upload-Expires", session.Expires)
+	c.Header("Cache-Control", "no-store")
+}
+
+// sendUploadSessionError writes the response for an error of an upload session.
+// session, when known, is returned so that the client can resume from its offset.
+func sendUploadSessionError(c *gin.Context, session *models.UploadSession, err error) {
+	status, code := http.StatusInternalServerError, "upload_error"
+	message := err.Error()
+	switch {
+	case strings.Contains(message, "not found"):
+		status, code = http.StatusNotFound, "upload_not_found"
+	case strings.Contains(message, "busy"):
+		status, code = http.StatusConflict, "upload_busy"
+	case strings.Contains(message, "offset mismatch"):
+		status, code = http.StatusConflict, "offset_mismatch"
+	case strings.Contains(message, "not complete"):
+		status, code = http.StatusConflict, "upload_incomplete"
+	case strings.Contains(message, "exceeds its declared size"):
+		status, code = http.StatusBadRequest, "upload_size_exceeded"
+	case strings.Contains(message, "failed to receive"):
+		status, code = http.StatusBadRequest, "upload_interrupted"
+	}
+
+	response := gin.H{
+		"success": false,
+		"error":   code,
+		"message": message,
+	}
+	if session != nil {
+		setUploadHeaders(c, session)
+		response["upload"] = session
+	}
+	c.JSON(status, response)
+}
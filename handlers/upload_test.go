@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"bytes"
+	"denchokun-api/models"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// setupTestDB initializes the databases in a temporary directory for a handler test
+func setupTestDB(t *testing.T) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	if err := models.InitDB(t.TempDir()); err != nil {
+		t.Fatalf("InitDB: %v", err)
+	}
+	t.Cleanup(models.CloseAllConnections)
+}
+
+// countingReader counts the bytes read from r
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func TestReadMultipartUploadStopsAtSizeLimit(t *testing.T) {
+	setupTestDB(t)
+	defer SetMaxUploadSize(maxUploadSize)
+	SetMaxUploadSize(64 * 1024)
+
+	// A 16 MB file part; the limit must stop reading long before its end
+	var head bytes.Buffer
+	writer := multipart.NewWriter(&head)
+	if err := writer.WriteField("dealData", `{}`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.CreateFormFile("file", "scan.pdf"); err != nil {
+		t.Fatal(err)
+	}
+	const fileSize = 16 * 1024 * 1024
+	body := &countingReader{r: io.MultiReader(
+		&head,
+		io.LimitReader(zeroReader{}, fileSize),
+		strings.NewReader("\r\n--"+writer.Boundary()+"--\r\n"),
+	)}
+
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/api/deals", body)
+	c.Request.Header.Set("Content-Type", writer.FormDataContentType())
+
+	_, upload, _, ok := readMultipartUpload(c, "test", "dealData")
+	if ok || upload != nil {
+		t.Fatal("an upload over the limit was accepted")
+	}
+
+	var response struct {
+		Error   string `json:"error"`
+		MaxSize int64  `json:"maxSize"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if recorder.Code != http.StatusBadRequest || response.Error != "file_too_large" || response.MaxSize != 64*1024 {
+		t.Errorf("got %d %s", recorder.Code, recorder.Body.String())
+	}
+	if body.n > 1024*1024 {
+		t.Errorf("%d bytes were read before the limit stopped the upload", body.n)
+	}
+
+	// The partial temp file is removed
+	entries, err := os.ReadDir(filepath.Join(models.GetBasePath(), ".blobs", "tmp"))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("temp files left behind: %v", entries)
+	}
+}
+
+// zeroReader is an endless source of zero bytes
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
@@ -1,41 +1,107 @@
 package main
 
 import (
+	"context"
+	"crypto/x509"
 	"denchokun-api/handlers"
 	"denchokun-api/middleware"
 	"denchokun-api/models"
+	"denchokun-api/preview"
+	"denchokun-api/tsa"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 type Config struct {
-	Server   ServerConfig   `json:"server"`
-	Database DatabaseConfig `json:"database"`
+	Server    ServerConfig    `json:"server"`
+	Database  DatabaseConfig  `json:"database"`
+	Integrity IntegrityConfig `json:"integrity"`
+	Timestamp TimestampConfig `json:"timestamp"`
+	Auth      AuthConfig      `json:"auth"`
+	Preview   PreviewConfig   `json:"preview"`
 }
 
 type ServerConfig struct {
 	Port string `json:"port"`
 	Mode string `json:"mode"`
+	// MaxUploadBytes は添付ファイル1件のサイズの上限
+	MaxUploadBytes int64 `json:"maxUploadBytes"`
+	// UploadSessionTTL は分割アップロードを最後の受信から保持する期間
+	UploadSessionTTL time.Duration `json:"uploadSessionTTL"`
+	// MaxImportBytes は一括取込のリクエスト（取引データと添付ファイルのZIP）のサイズの上限
+	MaxImportBytes int64 `json:"maxImportBytes"`
 }
 
 type DatabaseConfig struct {
 	BasePath string `json:"basePath"`
 }
 
+type IntegrityConfig struct {
+	// Interval は添付ファイルの整合性検証を定期実行する間隔（0なら定期実行しない）
+	Interval time.Duration `json:"interval"`
+}
+
+type TimestampConfig struct {
+	// Authority は "local"（自己署名のローカルTSA）、"off"、またはRFC 3161 TSAのURL
+	Authority string `json:"authority"`
+	// TrustedCerts は検証で信頼するTSA証明書（TSAの証明書またはその発行元）のPEMファイル
+	// ローカルTSAの証明書は Authority が "local" のとき自動的に信頼する
+	TrustedCerts string `json:"trustedCerts"`
+}
+
+type AuthConfig struct {
+	// AdminPassword は利用者が一人もいない場合に作成する admin の初期パスワード（空なら自動生成してログに出力）
+	AdminPassword string `json:"-"`
+	// TokenTTL はログインで発行するトークンの有効期間
+	TokenTTL time.Duration `json:"tokenTTL"`
+}
+
+type PreviewConfig struct {
+	// Generator は "auto"（Windowsではシェル機能、それ以外ではGoだけの実装）、"image"、"windows"
+	Generator string `json:"generator"`
+	// FontPath はテキストのプレビューに使うフォント（空なら組み込みの英数字フォント）
+	FontPath string `json:"fontPath"`
+	// CacheMaxBytes はプレビューキャッシュの合計サイズの上限（超えたら使われていないものから削除）
+	CacheMaxBytes int64 `json:"cacheMaxBytes"`
+	// CacheTTL はプレビューキャッシュの有効期間
+	CacheTTL time.Duration `json:"cacheTTL"`
+}
+
 var config Config
 
 func loadConfig() error {
 	// デフォルト設定
 	config = Config{
 		Server: ServerConfig{
-			Port: ":8080",
-			Mode: "debug",
+			Port:             ":8080",
+			Mode:             "debug",
+			MaxUploadBytes:   handlers.DefaultMaxUploadSize,
+			UploadSessionTTL: models.DefaultUploadSessionTTL,
+			MaxImportBytes:   handlers.DefaultMaxImportSize,
 		},
 		Database: DatabaseConfig{
 			BasePath: "./data",
 		},
+		Timestamp: TimestampConfig{
+			Authority: "local",
+		},
+		Auth: AuthConfig{
+			TokenTTL: 12 * time.Hour,
+		},
+		Preview: PreviewConfig{
+			Generator:     "auto",
+			CacheMaxBytes: preview.DefaultCacheMaxBytes,
+			CacheTTL:      preview.DefaultCacheTTL,
+		},
 	}
 
 	// 環境変数から設定を取得
@@ -64,6 +130,110 @@ func loadConfig() error {
 		log.Printf("Using default mode: %s", config.Server.Mode)
 	}
 
+	if maxUpload := os.Getenv("DENCHOKUN_MAX_UPLOAD_MB"); maxUpload != "" {
+		mb, err := strconv.Atoi(maxUpload)
+		if err != nil || mb <= 0 {
+			return fmt.Errorf("invalid DENCHOKUN_MAX_UPLOAD_MB: %s", maxUpload)
+		}
+		config.Server.MaxUploadBytes = int64(mb) * 1024 * 1024
+		log.Printf("Using max upload size from environment variable: %d MB", mb)
+	} else {
+		log.Printf("Using default max upload size: %d MB", config.Server.MaxUploadBytes/(1024*1024))
+	}
+
+	if ttl := os.Getenv("DENCHOKUN_UPLOAD_SESSION_TTL_HOURS"); ttl != "" {
+		hours, err := strconv.Atoi(ttl)
+		if err != nil || hours <= 0 {
+			return fmt.Errorf("invalid DENCHOKUN_UPLOAD_SESSION_TTL_HOURS: %s", ttl)
+		}
+		config.Server.UploadSessionTTL = time.Duration(hours) * time.Hour
+		log.Printf("Using upload session lifetime from environment variable: %s", config.Server.UploadSessionTTL)
+	} else {
+		log.Printf("Using default upload session lifetime: %s", config.Server.UploadSessionTTL)
+	}
+
+	if maxImport := os.Getenv("DENCHOKUN_MAX_IMPORT_MB"); maxImport != "" {
+		mb, err := strconv.Atoi(maxImport)
+		if err != nil || mb <= 0 {
+			return fmt.Errorf("invalid DENCHOKUN_MAX_IMPORT_MB: %s", maxImport)
+		}
+		config.Server.MaxImportBytes = int64(mb) * 1024 * 1024
+		log.Printf("Using max import size from environment variable: %d MB", mb)
+	} else {
+		log.Printf("Using default max import size: %d MB", config.Server.MaxImportBytes/(1024*1024))
+	}
+
+	if interval := os.Getenv("DENCHOKUN_INTEGRITY_CHECK_HOURS"); interval != "" {
+		hours, err := strconv.Atoi(interval)
+		if err != nil || hours < 0 {
+			return fmt.Errorf("invalid DENCHOKUN_INTEGRITY_CHECK_HOURS: %s", interval)
+		}
+		config.Integrity.Interval = time.Duration(hours) * time.Hour
+		log.Printf("Using integrity check interval from environment variable: %s", config.Integrity.Interval)
+	} else {
+		log.Println("Using default integrity check interval: disabled")
+	}
+
+	if authority := os.Getenv("DENCHOKUN_TSA"); authority != "" {
+		config.Timestamp.Authority = authority
+		log.Printf("Using timestamp authority from environment variable: %s", authority)
+	} else {
+		log.Printf("Using default timestamp authority: %s", config.Timestamp.Authority)
+	}
+
+	if certs := os.Getenv("DENCHOKUN_TSA_CERTS"); certs != "" {
+		config.Timestamp.TrustedCerts = certs
+		log.Printf("Using trusted TSA certificates from environment variable: %s", certs)
+	}
+
+	// パスワードはログに出さない
+	config.Auth.AdminPassword = os.Getenv("DENCHOKUN_ADMIN_PASSWORD")
+
+	if ttl := os.Getenv("DENCHOKUN_TOKEN_TTL_HOURS"); ttl != "" {
+		hours, err := strconv.Atoi(ttl)
+		if err != nil || hours <= 0 {
+			return fmt.Errorf("invalid DENCHOKUN_TOKEN_TTL_HOURS: %s", ttl)
+		}
+		config.Auth.TokenTTL = time.Duration(hours) * time.Hour
+		log.Printf("Using token lifetime from environment variable: %s", config.Auth.TokenTTL)
+	} else {
+		log.Printf("Using default token lifetime: %s", config.Auth.TokenTTL)
+	}
+
+	if generator := os.Getenv("DENCHOKUN_PREVIEW_GENERATOR"); generator != "" {
+		config.Preview.Generator = generator
+		log.Printf("Using preview generator from environment variable: %s", generator)
+	} else {
+		log.Printf("Using default preview generator: %s", config.Preview.Generator)
+	}
+
+	if fontPath := os.Getenv("DENCHOKUN_PREVIEW_FONT"); fontPath != "" {
+		config.Preview.FontPath = fontPath
+		log.Printf("Using preview font from environment variable: %s", fontPath)
+	}
+
+	if maxMB := os.Getenv("DENCHOKUN_PREVIEW_CACHE_MAX_MB"); maxMB != "" {
+		mb, err := strconv.Atoi(maxMB)
+		if err != nil || mb <= 0 {
+			return fmt.Errorf("invalid DENCHOKUN_PREVIEW_CACHE_MAX_MB: %s", maxMB)
+		}
+		config.Preview.CacheMaxBytes = int64(mb) * 1024 * 1024
+		log.Printf("Using preview cache size from environment variable: %d MB", mb)
+	} else {
+		log.Printf("Using default preview cache size: %d MB", config.Preview.CacheMaxBytes/(1024*1024))
+	}
+
+	if ttl := os.Getenv("DENCHOKUN_PREVIEW_CACHE_TTL_HOURS"); ttl != "" {
+		hours, err := strconv.Atoi(ttl)
+		if err != nil || hours <= 0 {
+			return fmt.Errorf("invalid DENCHOKUN_PREVIEW_CACHE_TTL_HOURS: %s", ttl)
+		}
+		config.Preview.CacheTTL = time.Duration(hours) * time.Hour
+		log.Printf("Using preview cache lifetime from environment variable: %s", config.Preview.CacheTTL)
+	} else {
+		log.Printf("Using default preview cache lifetime: %s", config.Preview.CacheTTL)
+	}
+
 	return nil
 }
 
@@ -91,13 +261,70 @@ func main() {
 		log.Println("Table migration completed successfully")
 	}
 
-	// プレビューハンドラーの初期化（preview-link API用）
-	previewHandler, err := handlers.NewPreviewHandler(config.Database.BasePath)
-	if err != nil {
+	// 期間フォルダにある添付ファイルをブロブストアへ移し、同じ内容のファイルを1つにまとめる
+	// 完了すると System.db に記録され、次の起動からは実行しない
+	if done, err := models.BlobMigrationDone(); err != nil {
+		log.Printf("Warning: Failed to check attachment migration: %v", err)
+	} else if done {
+		log.Println("Attachments are already in the blob store")
+	} else if result, err := models.MigrateAttachmentsToBlobStore(); err != nil {
+		log.Printf("Warning: Attachment migration failed: %v", err)
+	} else {
+		log.Printf("Attachment migration completed: %d records moved, %d files removed (%d bytes)",
+			result.Migrated, result.FilesRemoved, result.BytesFreed)
+		for _, skipped := range result.Skipped {
+			log.Printf("Warning: Attachment left in the period folder: %s", skipped)
+		}
+	}
+
+	// 利用者が一人もいなければ初期管理者を作成
+	if password, err := models.EnsureAdminUser("admin", config.Auth.AdminPassword); err != nil {
+		log.Fatal("Failed to create initial admin user:", err)
+	} else if password != "" {
+		if config.Auth.AdminPassword == "" {
+			log.Printf("Created initial admin user \"admin\" with password: %s (change it after the first login)", password)
+		} else {
+			log.Println("Created initial admin user \"admin\" with the password from DENCHOKUN_ADMIN_PASSWORD")
+		}
+	}
+	handlers.SetLoginTokenTTL(config.Auth.TokenTTL)
+	handlers.SetMaxUploadSize(config.Server.MaxUploadBytes)
+	handlers.SetMaxImportSize(config.Server.MaxImportBytes)
+	models.SetUploadSessionTTL(config.Server.UploadSessionTTL)
+
+	// プレビューハンドラーの初期化（サムネイル配信とキャッシュ管理）
+	// プレビュー機能は必須ではないので、エラーでも続行
+	var previewHandler *handlers.PreviewHandler
+	if generator, err := preview.NewGenerator(config.Preview.Generator, config.Preview.FontPath); err != nil {
+		log.Printf("Warning: Failed to initialize preview generator: %v", err)
+	} else if previewHandler, err = handlers.NewPreviewHandler(config.Database.BasePath, generator, preview.CacheOptions{
+		MaxBytes: config.Preview.CacheMaxBytes,
+		TTL:      config.Preview.CacheTTL,
+	}); err != nil {
 		log.Printf("Warning: Failed to initialize preview handler: %v", err)
-		// プレビュー機能は必須ではないので、エラーでも続行
 	}
 
+	// タイムスタンプ局の初期化（添付ファイルのハッシュ値に対するRFC 3161タイムスタンプ）
+	authority, err := tsa.NewAuthority(config.Timestamp.Authority, filepath.Join(config.Database.BasePath, ".tsa"))
+	if err != nil {
+		log.Printf("Warning: Failed to initialize timestamp authority: %v", err)
+	} else if authority != nil {
+		handlers.SetTimestampAuthority(authority)
+		log.Printf("Timestamp authority: %s", authority.Name())
+	}
+
+	// 検証ではここで信頼したTSA証明書につながる署名だけを有効とする
+	timestampRoots := x509.NewCertPool()
+	if local, ok := authority.(*tsa.LocalAuthority); ok {
+		timestampRoots.AddCert(local.Certificate())
+	}
+	if config.Timestamp.TrustedCerts != "" {
+		if err := tsa.LoadTrustPool(timestampRoots, config.Timestamp.TrustedCerts); err != nil {
+			log.Printf("Warning: Failed to load trusted TSA certificates: %v", err)
+		}
+	}
+	handlers.SetTimestampRoots(timestampRoots)
+
 	r := gin.New()
 
 	// 信頼するプロキシを設定（ローカル開発用）
@@ -108,46 +335,185 @@ func main() {
 	r.Use(middleware.CORSMiddleware())
 	r.Use(middleware.ErrorMiddleware())
 
+	// ロールごとの利用可能範囲（上位のロールは下位のロールの操作をすべて行える）
+	viewer := middleware.RequireRoles(models.RoleViewer, models.RoleClerk, models.RoleAccountant, models.RoleAdmin)
+	clerk := middleware.RequireRoles(models.RoleClerk, models.RoleAccountant, models.RoleAdmin)
+	accountant := middleware.RequireRoles(models.RoleAccountant, models.RoleAdmin)
+	admin := middleware.RequireRoles(models.RoleAdmin)
+
 	api := r.Group("/v1/api")
 	{
+		// 認証不要
 		api.GET("/health", handlers.HealthCheck)
+		api.POST("/auth/login", middleware.AuditMiddleware("auth", "login"), handlers.Login)
+	}
+
+	// 以降は Authorization: Bearer <token> が必要
+	secured := api.Group("", middleware.AuthMiddleware())
+	{
+		secured.GET("/auth/me", handlers.GetCurrentUser)
+		secured.POST("/auth/logout", middleware.AuditMiddleware("auth", "logout"), handlers.Logout)
+
+		secured.GET("/periods", viewer, handlers.GetPeriods)
+		secured.GET("/periodinfo", viewer, handlers.GetPeriod)
+		secured.POST("/periods", middleware.AuditMiddleware("period", "create"), accountant, handlers.CreatePeriod)
+		secured.PUT("/periods/dates", middleware.AuditMiddleware("period", "update_dates"), accountant, handlers.UpdatePeriodDates)
+		secured.PUT("/periods/name", middleware.AuditMiddleware("period", "rename"), admin, handlers.UpdatePeriodName)
+		secured.DELETE("/periods", middleware.AuditMiddleware("period", "delete"), admin, handlers.DeletePeriod)
+		secured.POST("/periods/connect", middleware.AuditMiddleware("period", "connect"), viewer, handlers.ConnectPeriod)
+		secured.GET("/periods/verify-chain", viewer, handlers.VerifyPeriodChain)
+		secured.GET("/periods/tax-summary", viewer, handlers.GetTaxSummary)
+		secured.GET("/periods/export", viewer, handlers.ExportPeriodArchive)
+
+		secured.POST("/deals", middleware.AuditMiddleware("deal", "create"), clerk, handlers.CreateDeal)
+		secured.GET("/deals", viewer, handlers.GetDeals)
+		secured.GET("/deals/search", viewer, handlers.SearchDeals)
+		secured.GET("/deals/export", viewer, handlers.ExportDeals)
+		secured.POST("/deals/import", middleware.AuditMiddleware("deal", "import"), accountant, handlers.ImportDeals)
+		secured.POST("/batch", middleware.AuditMiddleware("deal", "batch"), clerk, handlers.ExecuteBatch)
+		secured.POST("/all-deals", viewer, handlers.GetAllDeals)
+		secured.POST("/all-deals/export", viewer, handlers.ExportAllDeals)
+		secured.GET("/deals/:dealId", viewer, handlers.GetDeal)
+		secured.PUT("/deals/:dealId", middleware.AuditMiddleware("deal", "update"), clerk, handlers.UpdateDeal)
+		secured.PUT("/deals/:dealId/to-otherperiod", middleware.AuditMiddleware("deal", "change_period"), accountant, handlers.ChangeDealPeriod)
+		secured.DELETE("/deals/:dealId", middleware.AuditMiddleware("deal", "delete"), accountant, handlers.DeleteDeal)
+		secured.GET("/deals/:dealId/download", viewer, handlers.DownloadDealFile)
+		secured.GET("/deals/:dealId/attachments", viewer, handlers.GetDealAttachments)
+		secured.POST("/deals/:dealId/attachments", middleware.AuditMiddleware("attachment", "add"), clerk, handlers.AddDealAttachment)
+		secured.GET("/deals/:dealId/attachments/:attachmentId/download", viewer, handlers.DownloadDealAttachment)
+		secured.DELETE("/deals/:dealId/attachments/:attachmentId", middleware.AuditMiddleware("attachment", "remove"), accountant, handlers.RemoveDealAttachment)
+		secured.GET("/deals/:dealId/texts", viewer, handlers.GetDealTexts)
+		secured.GET("/deals/:dealId/timestamp", viewer, handlers.DownloadDealTimestamp)
+		secured.GET("/deals/:dealId/timestamp/verify", viewer, handlers.VerifyDealTimestamp)
+		secured.GET("/deals/:dealId/attachments/:attachmentId/timestamp/verify", viewer, handlers.VerifyAttachmentTimestamp)
 
-		api.GET("/periods", handlers.GetPeriods)
-		api.GET("/periodinfo", handlers.GetPeriod)
-		api.POST("/periods", handlers.CreatePeriod)
-		api.PUT("/periods/dates", handlers.UpdatePeriodDates)
-		api.PUT("/periods/name", handlers.UpdatePeriodName)
-		api.DELETE("/periods", handlers.DeletePeriod)
-		api.POST("/periods/connect", handlers.ConnectPeriod)
-
-		api.POST("/deals", handlers.CreateDeal)
-		api.GET("/deals", handlers.GetDeals)
-		api.POST("/all-deals", handlers.GetAllDeals)
-		api.GET("/deals/:dealId", handlers.GetDeal)
-		api.PUT("/deals/:dealId", handlers.UpdateDeal)
-		api.PUT("/deals/:dealId/to-otherperiod", handlers.ChangeDealPeriod)
-		api.DELETE("/deals/:dealId", handlers.DeleteDeal)
-		api.GET("/deals/:dealId/download", handlers.DownloadDealFile)
-
-		// プレビューAPI（別サーバーへのリンクを返す）
+		// 分割アップロード（完了したアップロードは取引の登録・更新で fileData.uploadId に指定）
+		secured.POST("/uploads", middleware.AuditMiddleware("upload", "create"), clerk, handlers.CreateUpload)
+		secured.GET("/uploads/:uploadId", clerk, handlers.GetUpload)
+		secured.HEAD("/uploads/:uploadId", clerk, handlers.GetUpload)
+		// チャンクごとには監査ログに記録しない（添付した取引の登録・更新で記録される）
+		secured.PATCH("/uploads/:uploadId", clerk, handlers.UploadChunk)
+		secured.DELETE("/uploads/:uploadId", middleware.AuditMiddleware("upload", "cancel"), clerk, handlers.DeleteUpload)
+
+		// 添付ファイルの整合性検証（全期間の添付ファイルのハッシュ値を再計算）
+		secured.POST("/integrity/verify", middleware.AuditMiddleware("integrity", "verify"), admin, handlers.StartIntegrityCheck)
+		secured.GET("/integrity/reports", admin, handlers.GetIntegrityReports)
+		secured.GET("/integrity/reports/:id", admin, handlers.GetIntegrityReport)
+
+		// どの取引からも参照されていないファイルと残った一時ファイルの検出（削除はせず隔離フォルダへ移動）
+		secured.GET("/maintenance/orphans", admin, handlers.GetOrphanFiles)
+		secured.POST("/maintenance/orphans/quarantine", middleware.AuditMiddleware("maintenance", "quarantine_orphans"), admin, handlers.QuarantineOrphanFiles)
+		secured.POST("/maintenance/search-index/rebuild", middleware.AuditMiddleware("maintenance", "rebuild_search_index"), admin, handlers.RebuildSearchIndex)
+
+		// プレビューAPI（サムネイル画像をこのサーバーで生成して返す）
 		if previewHandler != nil {
+			secured.GET("/preview/deals/:dealId", viewer, previewHandler.GetDealPreview)
+			secured.GET("/preview/files/:fileId", viewer, previewHandler.GetFilePreview)
+			// DENCHOKUN_PREVIEW_HOST にこのサーバーを指定したときのプレビューリンク形式
+			secured.GET("/preview", viewer, previewHandler.GetFilePreview)
 			// 取引のプレビューリンクを取得
-			api.GET("/preview-link", previewHandler.GetDealPreviewLink)
+			secured.GET("/preview-link", viewer, previewHandler.GetDealPreviewLink)
+
+			// プレビューキャッシュの管理
+			secured.GET("/preview/cache", admin, previewHandler.GetCacheStats)
+			secured.DELETE("/preview/cache", middleware.AuditMiddleware("preview_cache", "clear"), admin, previewHandler.ClearCache)
 		}
 
-		api.GET("/deal-partners", handlers.GetDealPartners)
-		api.POST("/deal-partners", handlers.CreateDealPartner)
-		api.PUT("/deal-partners/:name", handlers.UpdateDealPartner)
-		api.DELETE("/deal-partners/:name", handlers.DeleteDealPartner)
+		secured.GET("/deal-partners", viewer, handlers.GetDealPartners)
+		secured.POST("/deal-partners", middleware.AuditMiddleware("partner", "create"), clerk, handlers.CreateDealPartner)
+		secured.PUT("/deal-partners/:name", middleware.AuditMiddleware("partner", "rename"), accountant, handlers.UpdateDealPartner)
+		secured.GET("/deal-partners/:name/history", viewer, handlers.GetDealPartnerHistory)
+		secured.PUT("/deal-partners/:name/registration", middleware.AuditMiddleware("partner", "update_registration"), accountant, handlers.UpdateDealPartnerRegistration)
+		secured.DELETE("/deal-partners/:name", middleware.AuditMiddleware("partner", "delete"), accountant, handlers.DeleteDealPartner)
+
+		secured.GET("/system", viewer, handlers.GetSystemInfo)
+		secured.PUT("/system", middleware.AuditMiddleware("system", "update"), admin, handlers.UpdateSystemInfo)
+
+		// 任意のSELECT文を実行できるため会計担当者以上に限定
+		secured.POST("/query", accountant, handlers.ExecuteQuery)
 
-		api.GET("/system", handlers.GetSystemInfo)
-		api.PUT("/system", handlers.UpdateSystemInfo)
+		// 監査ログ（更新系APIの操作履歴）
+		secured.GET("/audit", accountant, handlers.GetAuditLog)
 
-		api.POST("/query", handlers.ExecuteQuery)
+		// 利用者とAPIトークンの管理
+		secured.GET("/users", admin, handlers.GetUsers)
+		secured.POST("/users", middleware.AuditMiddleware("user", "create"), admin, handlers.CreateUser)
+		secured.PUT("/users/:id", middleware.AuditMiddleware("user", "update"), admin, handlers.UpdateUser)
+		secured.GET("/users/:id/tokens", admin, handlers.GetUserTokens)
+		secured.POST("/users/:id/tokens", middleware.AuditMiddleware("user", "create_token"), admin, handlers.CreateUserToken)
+		secured.DELETE("/users/:id/tokens/:tokenId", middleware.AuditMiddleware("user", "revoke_token"), admin, handlers.RevokeUserToken)
 	}
 
 	log.Printf("Starting server on %s\n", config.Server.Port)
-	if err := r.Run(config.Server.Port); err != nil {
-		log.Fatal("Failed to start server:", err)
+	server := &http.Server{
+		Addr:    config.Server.Port,
+		Handler: r,
 	}
-}
\ No newline at end of file
+
+	// Ctrl+C や SIGTERM で受付中のリクエストを終えてから停止する
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal("Failed to start server:", err)
+		}
+	}()
+
+	// 添付ファイルの整合性検証の定期実行
+	if config.Integrity.Interval > 0 {
+		go func() {
+			ticker := time.NewTicker(config.Integrity.Interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					if _, err := models.StartIntegrityCheck("schedule", "system"); err != nil {
+						log.Printf("Warning: Scheduled integrity check was not started: %v", err)
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	// 期限切れの分割アップロードを定期的に削除
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			cleanupExpiredUploads()
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	<-ctx.Done()
+	log.Println("Shutting down server...")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Warning: Server shutdown did not complete: %v", err)
+	}
+
+	if previewHandler != nil {
+		previewHandler.Close()
+	}
+	models.CloseAllConnections()
+	log.Println("Server stopped")
+}
+
+// cleanupExpiredUploads は期限切れの分割アップロードを削除してログに出す
+func cleanupExpiredUploads() {
+	removed, err := models.CleanupExpiredUploads()
+	if err != nil {
+		log.Printf("Warning: Failed to clean up expired uploads: %v", err)
+	} else if removed > 0 {
+		log.Printf("Removed %d expired upload(s)", removed)
+	}
+}
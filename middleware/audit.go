@@ -0,0 +1,139 @@
+package middleware
+
+import (
+	"bytes"
+	"denchokun-api/models"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ActorKey はリクエストを行った利用者名を格納するコンテキストキー（認証ミドルウェアが設定する）
+const ActorKey = "actor"
+
+const (
+	auditBeforeKey = "audit.before"
+	auditAfterKey  = "audit.after"
+	auditTargetKey = "audit.target"
+)
+
+// auditTarget は監査ログに記録する操作対象
+type auditTarget struct {
+	Period   string
+	EntityID string
+	DealNO   string
+}
+
+// auditResponseWriter - 失敗時のエラーコードを記録するためレスポンスボディをキャプチャ
+type auditResponseWriter struct {
+	gin.ResponseWriter
+	body *bytes.Buffer
+}
+
+func (w auditResponseWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// AuditMiddleware は更新系APIの操作内容を System.db の AuditLog に記録します
+// entityType は操作対象の種類（deal, period, partner, system）、action は操作名
+func AuditMiddleware(entityType, action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		writer := &auditResponseWriter{body: &bytes.Buffer{}, ResponseWriter: c.Writer}
+		c.Writer = writer
+
+		c.Next()
+
+		entry := &models.AuditEntry{
+			Timestamp:  time.Now().Format("2006-01-02T15:04:05Z"),
+			Actor:      c.GetString(ActorKey),
+			ClientIP:   c.ClientIP(),
+			UserAgent:  c.Request.UserAgent(),
+			Method:     c.Request.Method,
+			Path:       c.Request.URL.RequestURI(),
+			Action:     action,
+			EntityType: entityType,
+			Period:     c.Query("period"),
+			EntityID:   c.Param("dealId"),
+			StatusCode: writer.Status(),
+			Success:    writer.Status() < http.StatusBadRequest,
+		}
+		if entry.Actor == "" {
+			entry.Actor = "anonymous"
+		}
+		if entry.EntityID == "" {
+			entry.EntityID = c.Param("name")
+		}
+		if entityType == "deal" {
+			entry.DealNO = entry.EntityID
+		}
+
+		// ハンドラーが設定した操作対象で上書き
+		if value, exists := c.Get(auditTargetKey); exists {
+			target := value.(auditTarget)
+			if target.Period != "" {
+				entry.Period = target.Period
+			}
+			if target.EntityID != "" {
+				entry.EntityID = target.EntityID
+			}
+			if target.DealNO != "" {
+				entry.DealNO = target.DealNO
+			}
+		}
+
+		entry.Before = auditSnapshot(c, auditBeforeKey)
+		entry.After = auditSnapshot(c, auditAfterKey)
+
+		// 失敗した操作はレスポンスのエラー内容を残す
+		if !entry.Success {
+			var response struct {
+				Error   string `json:"error"`
+				Message string `json:"message"`
+			}
+			if err := json.Unmarshal(writer.body.Bytes(), &response); err == nil {
+				entry.Message = response.Error
+				if response.Message != "" {
+					entry.Message += ": " + response.Message
+				}
+			}
+		}
+
+		if err := models.WriteAuditEntry(entry); err != nil {
+			log.Printf("AuditMiddleware: Failed to write audit log: %v", err)
+		}
+	}
+}
+
+// SetAuditBefore は変更前のスナップショットを監査ログ用に設定します
+func SetAuditBefore(c *gin.Context, snapshot interface{}) {
+	c.Set(auditBeforeKey, snapshot)
+}
+
+// SetAuditAfter は変更後のスナップショットを監査ログ用に設定します
+func SetAuditAfter(c *gin.Context, snapshot interface{}) {
+	c.Set(auditAfterKey, snapshot)
+}
+
+// SetAuditTarget は監査ログに記録する期間・対象ID・取引番号を設定します（空文字の項目は既定値のまま）
+func SetAuditTarget(c *gin.Context, period, entityID, dealNO string) {
+	c.Set(auditTargetKey, auditTarget{Period: period, EntityID: entityID, DealNO: dealNO})
+}
+
+// auditSnapshot はコンテキストに設定されたスナップショットをJSONに変換します
+func auditSnapshot(c *gin.Context, key string) json.RawMessage {
+	value, exists := c.Get(key)
+	if !exists || value == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		log.Printf("AuditMiddleware: Failed to encode snapshot: %v", err)
+		return nil
+	}
+	return data
+}
@@ -0,0 +1,96 @@
+package middleware
+
+import (
+	"denchokun-api/models"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// UserKey は認証済みの *models.User を格納するコンテキストキー
+	UserKey = "auth.user"
+	// TokenKey は認証に使われた *models.APIToken を格納するコンテキストキー
+	TokenKey = "auth.token"
+)
+
+// AuthMiddleware は Authorization: Bearer ヘッダーのトークンを検証し、利用者をコンテキストに設定します
+func AuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := c.GetHeader("Authorization")
+		token := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+		if header == "" || token == "" || token == header {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"success": false,
+				"error":   "unauthorized",
+				"message": "Authorization: Bearer <token> header is required",
+			})
+			return
+		}
+
+		user, apiToken, err := models.AuthenticateToken(token)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"success": false,
+				"error":   "unauthorized",
+				"message": err.Error(),
+			})
+			return
+		}
+
+		c.Set(UserKey, user)
+		c.Set(TokenKey, apiToken)
+		c.Set(ActorKey, user.Username)
+		c.Next()
+	}
+}
+
+// RequireRoles は認証済みの利用者のロールが roles のいずれかであることを要求します
+// AuthMiddleware の後に置くこと
+func RequireRoles(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := CurrentUser(c)
+		if user == nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"success": false,
+				"error":   "unauthorized",
+				"message": "Authentication required",
+			})
+			return
+		}
+
+		for _, role := range roles {
+			if user.Role == role {
+				c.Next()
+				return
+			}
+		}
+
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+			"success": false,
+			"error":   "forbidden",
+			"message": "Role " + user.Role + " is not allowed to perform this operation",
+		})
+	}
+}
+
+// CurrentUser は認証済みの利用者を返します（未認証の場合は nil）
+func CurrentUser(c *gin.Context) *models.User {
+	if value, exists := c.Get(UserKey); exists {
+		if user, ok := value.(*models.User); ok {
+			return user
+		}
+	}
+	return nil
+}
+
+// CurrentToken は認証に使われたトークンを返します（未認証の場合は nil）
+func CurrentToken(c *gin.Context) *models.APIToken {
+	if value, exists := c.Get(TokenKey); exists {
+		if token, ok := value.(*models.APIToken); ok {
+			return token
+		}
+	}
+	return nil
+}
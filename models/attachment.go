@@ -0,0 +1,372 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Roles of an additional attachment of a deal
+const (
+	AttachmentRoleInvoice      = "invoice"
+	AttachmentRoleReceipt      = "receipt"
+	AttachmentRoleDeliveryNote = "delivery_note"
+	AttachmentRoleQuote        = "quote"
+	AttachmentRoleContract     = "contract"
+	AttachmentRoleOther        = "other"
+)
+
+// Status of an attachment; removed attachments are kept as history
+const (
+	AttachmentActive  = "ACTIVE"
+	AttachmentRemoved = "REMOVED"
+)
+
+// Attachment is an additional file of a deal record. The primary file stays in
+// Deals.FilePath; attachments are always kept in the blob store.
+type Attachment struct {
+	ID           int64  `json:"id"`
+	DealNO       string `json:"dealNo"`
+	Role         string `json:"role"`
+	OriginalName string `json:"originalName"`
+	StoredPath   string `json:"storedPath"` // blob file, relative to the data folder
+	Hash         string `json:"hash"`
+	Size         int64  `json:"size"`
+	MimeType     string `json:"mimeType"`
+	Uploaded     string `json:"uploaded"`
+	UploadedBy   string `json:"uploadedBy"`
+	Status       string `json:"status"`
+	Removed      string `json:"removed,omitempty"`
+	RemovedBy    string `json:"removedBy,omitempty"`
+}
+
+// attachmentColumns is the column list read by scanAttachment
+const attachmentColumns = `ID, DealNO, Role, OriginalName, StoredPath, Hash, Size, MimeType,
+	COALESCE(Uploaded, ''), UploadedBy, Status, COALESCE(Removed, ''), COALESCE(RemovedBy, '')`
+
+// scanAttachment scans a row selected with attachmentColumns
+func scanAttachment(row rowScanner, a *Attachment) error {
+	return row.Scan(&a.ID, &a.DealNO, &a.Role, &a.OriginalName, &a.StoredPath, &a.Hash, &a.Size,
+		&a.MimeType, &a.Uploaded, &a.UploadedBy, &a.Status, &a.Removed, &a.RemovedBy)
+}
+
+// IsValidAttachmentRole reports whether role is one of the attachment roles
+func IsValidAttachmentRole(role string) bool {
+	switch role {
+	case AttachmentRoleInvoice, AttachmentRoleReceipt, AttachmentRoleDeliveryNote,
+		AttachmentRoleQuote, AttachmentRoleContract, AttachmentRoleOther:
+		return true
+	}
+	return false
+}
+
+// AddDealAttachment records a file already committed to the blob store as an attachment
+// of the current version of a deal. a.Hash and a.OriginalName must be set; the stored
+// path, size, MIME type and upload time are filled in from the blob.
+func AddDealAttachment(period string, a *Attachment) error {
+	db, err := ConnectPeriodDB(period)
+	if err != nil {
+		return err
+	}
+
+	blob, err := GetBlob(a.Hash)
+	if err != nil {
+		return err
+	}
+	path := blobFilePath(blob.Hash, blob.Ext)
+
+	a.StoredPath = relativeDataPath(path)
+	a.Size = blob.Size
+	a.MimeType = detectMimeType(path, filepath.Ext(a.OriginalName))
+	a.Uploaded = time.Now().Format("2006-01-02T15:04:05Z")
+	a.Status = AttachmentActive
+	if a.Role == "" {
+		a.Role = AttachmentRoleOther
+	}
+
+	// The deal is checked in the same transaction so that it cannot be replaced in between
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := checkCurrentDeal(tx, a.DealNO); err != nil {
+		return err
+	}
+
+	if err := retainBlob(a.Hash); err != nil {
+		return err
+	}
+
+	query := `INSERT INTO Attachments (DealNO, Role, OriginalName, StoredPath, Hash, Size, MimeType,
+	          Uploaded, UploadedBy, Status)
+	          VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	result, err := tx.Exec(query, a.DealNO, a.Role, a.OriginalName, a.StoredPath, a.Hash, a.Size,
+		a.MimeType, a.Uploaded, a.UploadedBy, a.Status)
+	if err != nil {
+		releaseBlob(a.Hash)
+		return fmt.Errorf("failed to add attachment: %v", err)
+	}
+
+	a.ID, err = result.LastInsertId()
+	if err != nil {
+		releaseBlob(a.Hash)
+		return fmt.Errorf("failed to get attachment ID: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		releaseBlob(a.Hash)
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	scheduleTextExtraction(period)
+	return nil
+}
+
+// checkCurrentDeal fails unless dealNO is the current version of a deal
+func checkCurrentDeal(tx *sql.Tx, dealNO string) error {
+	var recStatus string
+	err := tx.QueryRow(`SELECT COALESCE(RecStatus, '') FROM Deals WHERE NO = ?`, dealNO).Scan(&recStatus)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("deal not found: %s", dealNO)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get deal: %v", err)
+	}
+	if recStatus != "NEW" {
+		return fmt.Errorf("deal %s is not the current version (%s)", dealNO, recStatus)
+	}
+	return nil
+}
+
+// GetDealAttachments returns the attachments of a deal record in upload order.
+// Removed attachments are included only if includeRemoved is set.
+func GetDealAttachments(period, dealNO string, includeRemoved bool) ([]Attachment, error) {
+	db, err := ConnectPeriodDB(period)
+	if err != nil {
+		return nil, err
+	}
+
+	query := "SELECT " + attachmentColumns + " FROM Attachments WHERE DealNO = ?"
+	if !includeRemoved {
+		query += " AND Status = 'ACTIVE'"
+	}
+	query += " ORDER BY ID"
+
+	rows, err := db.Query(query, dealNO)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query attachments: %v", err)
+	}
+	defer rows.Close()
+
+	attachments := []Attachment{}
+	for rows.Next() {
+		var a Attachment
+		if err := scanAttachment(rows, &a); err != nil {
+			return nil, fmt.Errorf("failed to scan attachment: %v", err)
+		}
+		attachments = append(attachments, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %v", err)
+	}
+
+	return attachments, nil
+}
+
+// GetDealAttachment returns one attachment of a deal record, removed or not
+func GetDealAttachment(period, dealNO string, id int64) (*Attachment, error) {
+	db, err := ConnectPeriodDB(period)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Attachment{}
+	query := "SELECT " + attachmentColumns + " FROM Attachments WHERE ID = ? AND DealNO = ?"
+	err = scanAttachment(db.QueryRow(query, id, dealNO), a)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("attachment not found: %d", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get attachment: %v", err)
+	}
+
+	return a, nil
+}
+
+// GetPeriodAttachments returns the additional attachments of a period, removed ones included
+func GetPeriodAttachments(period string) ([]Attachment, error) {
+	db, err := ConnectPeriodDB(period)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT " + attachmentColumns + " FROM Attachments ORDER BY DealNO, ID")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query attachments of period %s: %v", period, err)
+	}
+	defer rows.Close()
+
+	var attachments []Attachment
+	for rows.Next() {
+		var a Attachment
+		if err := scanAttachment(rows, &a); err != nil {
+			return nil, fmt.Errorf("failed to scan attachment: %v", err)
+		}
+		attachments = append(attachments, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %v", err)
+	}
+
+	return attachments, nil
+}
+
+// RemoveDealAttachment logically removes an attachment of the current version of a deal.
+// The row and its blob are kept so that the removal stays visible in the history.
+func RemoveDealAttachment(period, dealNO string, id int64, removedBy string) (*Attachment, error) {
+	db, err := ConnectPeriodDB(period)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := checkCurrentDeal(tx, dealNO); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Format("2006-01-02T15:04:05Z")
+	result, err := tx.Exec(`UPDATE Attachments SET Status = ?, Removed = ?, RemovedBy = ?
+	                        WHERE ID = ? AND DealNO = ? AND Status = ?`,
+		AttachmentRemoved, now, removedBy, id, dealNO, AttachmentActive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to remove attachment: %v", err)
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		tx.Rollback()
+		a, err := GetDealAttachment(period, dealNO, id)
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("attachment %d is already removed", a.ID)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	return GetDealAttachment(period, dealNO, id)
+}
+
+// AttachmentFilePath returns the blob file of an attachment
+func AttachmentFilePath(a *Attachment) (string, error) {
+	return BlobPath(a.Hash)
+}
+
+// carryOverAttachments copies the active attachments of oldNO to newNO within tx, so
+// that a new version of a deal keeps the files of the version it replaces.
+// It returns the hashes whose blobs were retained, for releasing if tx is not committed.
+func carryOverAttachments(tx *sql.Tx, oldNO, newNO string) ([]string, error) {
+	attachments, err := queryActiveAttachments(tx, oldNO)
+	if err != nil {
+		return nil, err
+	}
+	return insertAttachmentCopies(tx, attachments, newNO)
+}
+
+// queryActiveAttachments returns the active attachments of a deal record within tx
+func queryActiveAttachments(tx *sql.Tx, dealNO string) ([]Attachment, error) {
+	rows, err := tx.Query("SELECT "+attachmentColumns+" FROM Attachments WHERE DealNO = ? AND Status = 'ACTIVE' ORDER BY ID", dealNO)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query attachments: %v", err)
+	}
+	defer rows.Close()
+
+	var attachments []Attachment
+	for rows.Next() {
+		var a Attachment
+		if err := scanAttachment(rows, &a); err != nil {
+			return nil, fmt.Errorf("failed to scan attachment: %v", err)
+		}
+		attachments = append(attachments, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %v", err)
+	}
+	return attachments, nil
+}
+
+// insertAttachmentCopies inserts attachments as attachments of dealNO, keeping their
+// upload time and user, and retains their blobs. On failure the blobs are released.
+func insertAttachmentCopies(tx *sql.Tx, attachments []Attachment, dealNO string) ([]string, error) {
+	var retained []string
+	for _, a := range attachments {
+		if err := retainBlob(a.Hash); err != nil {
+			releaseBlobs(retained)
+			return nil, err
+		}
+		retained = append(retained, a.Hash)
+	}
+
+	if err := insertAttachmentRows(tx, attachments, dealNO); err != nil {
+		releaseBlobs(retained)
+		return nil, err
+	}
+	return retained, nil
+}
+
+// insertAttachmentRows inserts attachments as active attachments of dealNO without
+// taking blob references
+func insertAttachmentRows(tx *sql.Tx, attachments []Attachment, dealNO string) error {
+	for _, a := range attachments {
+		_, err := tx.Exec(`INSERT INTO Attachments (DealNO, Role, OriginalName, StoredPath, Hash, Size,
+		                   MimeType, Uploaded, UploadedBy, Status)
+		                   VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			dealNO, a.Role, a.OriginalName, a.StoredPath, a.Hash, a.Size,
+			a.MimeType, a.Uploaded, a.UploadedBy, AttachmentActive)
+		if err != nil {
+			return fmt.Errorf("failed to copy attachment: %v", err)
+		}
+	}
+	return nil
+}
+
+// relativeDataPath returns path relative to the data folder, with forward slashes
+func relativeDataPath(path string) string {
+	rel, err := filepath.Rel(basePath, path)
+	if err != nil {
+		return filepath.ToSlash(path)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// detectMimeType returns the MIME type of a file from its extension, or from its
+// first bytes when the extension is not known
+func detectMimeType(path, ext string) string {
+	if ext != "" {
+		if mimeType := mime.TypeByExtension(strings.ToLower(ext)); mimeType != "" {
+			return mimeType
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer file.Close()
+
+	head := make([]byte, 512)
+	n, _ := file.Read(head)
+	return http.DetectContentType(head[:n])
+}
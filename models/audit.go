@@ -0,0 +1,241 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// AuditEntry is one record of the append-only audit log
+type AuditEntry struct {
+	ID         int64           `json:"id"`
+	Timestamp  string          `json:"timestamp"`
+	Actor      string          `json:"actor"`
+	ClientIP   string          `json:"clientIp"`
+	UserAgent  string          `json:"userAgent"`
+	Method     string          `json:"method"`
+	Path       string          `json:"path"`
+	Action     string          `json:"action"`
+	EntityType string          `json:"entityType"`
+	EntityID   string          `json:"entityId"`
+	Period     string          `json:"period"`
+	DealNO     string          `json:"dealNo"`
+	StatusCode int             `json:"statusCode"`
+	Success    bool            `json:"success"`
+	Before     json.RawMessage `json:"before,omitempty"` // snapshot before the change
+	After      json.RawMessage `json:"after,omitempty"`  // snapshot after the change
+	Message    string          `json:"message,omitempty"`
+}
+
+// AuditFilter holds the search conditions of the audit log
+type AuditFilter struct {
+	From       string `form:"from"` // inclusive, RFC 3339 or YYYY-MM-DD
+	To         string `form:"to"`   // inclusive, RFC 3339 or YYYY-MM-DD
+	EntityType string `form:"entity"`
+	EntityID   string `form:"entity_id"`
+	DealNO     string `form:"deal_no"`
+	Actor      string `form:"actor"`
+	Action     string `form:"action"`
+	Period     string `form:"period"`
+	Limit      int    `form:"limit"`
+	Offset     int    `form:"offset"`
+}
+
+// ValidateAuditFilter validates the time range of an audit log search
+func ValidateAuditFilter(filter *AuditFilter) error {
+	for name, value := range map[string]string{"from": filter.From, "to": filter.To} {
+		if value == "" || IsValidDate(value) {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02T15:04:05Z", value); err != nil {
+			return fmt.Errorf("invalid %s parameter. Must be YYYY-MM-DD or YYYY-MM-DDTHH:MM:SSZ", name)
+		}
+	}
+	return nil
+}
+
+// createAuditLogTable creates the AuditLog table in System.db.
+// Triggers reject UPDATE and DELETE so that recorded entries cannot be altered.
+func createAuditLogTable(db *sql.DB) error {
+	queries := []string{
+		`CREATE TABLE IF NOT EXISTS "AuditLog" (
+			"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+			"timestamp" TEXT NOT NULL,
+			"actor" TEXT,
+			"clientIp" TEXT,
+			"userAgent" TEXT,
+			"method" TEXT,
+			"path" TEXT,
+			"action" TEXT,
+			"entityType" TEXT,
+			"entityId" TEXT,
+			"period" TEXT,
+			"dealNo" TEXT,
+			"statusCode" INTEGER,
+			"success" INTEGER,
+			"before" TEXT,
+			"after" TEXT,
+			"message" TEXT
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_timestamp ON AuditLog(timestamp)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_entity ON AuditLog(entityType, entityId)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_deal ON AuditLog(dealNo)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_actor ON AuditLog(actor)`,
+		`CREATE TRIGGER IF NOT EXISTS audit_log_no_update BEFORE UPDATE ON AuditLog
+		 BEGIN SELECT RAISE(ABORT, 'AuditLog is append-only'); END`,
+		`CREATE TRIGGER IF NOT EXISTS audit_log_no_delete BEFORE DELETE ON AuditLog
+		 BEGIN SELECT RAISE(ABORT, 'AuditLog is append-only'); END`,
+	}
+
+	for _, query := range queries {
+		if _, err := db.Exec(query); err != nil {
+			return fmt.Errorf("failed to create AuditLog table: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// WriteAuditEntry appends an entry to the audit log
+func WriteAuditEntry(entry *AuditEntry) error {
+	db, err := GetSystemDB()
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO AuditLog (timestamp, actor, clientIp, userAgent, method, path, action,
+	          entityType, entityId, period, dealNo, statusCode, success, before, after, message)
+	          VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	result, err := db.Exec(query, entry.Timestamp, entry.Actor, entry.ClientIP, entry.UserAgent,
+		entry.Method, entry.Path, entry.Action, entry.EntityType, entry.EntityID, entry.Period,
+		entry.DealNO, entry.StatusCode, entry.Success, nullableJSON(entry.Before), nullableJSON(entry.After), entry.Message)
+	if err != nil {
+		return fmt.Errorf("failed to write audit log: %v", err)
+	}
+
+	entry.ID, _ = result.LastInsertId()
+	return nil
+}
+
+// GetAuditEntries searches the audit log, newest first
+func GetAuditEntries(filter *AuditFilter) ([]AuditEntry, int, error) {
+	db, err := GetSystemDB()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	conditions := []string{}
+	args := []interface{}{}
+
+	if filter.From != "" {
+		conditions = append(conditions, "timestamp >= ?")
+		args = append(args, filter.From)
+	}
+	if filter.To != "" {
+		// A date-only upper bound includes the whole day
+		to := filter.To
+		if len(to) == len("2006-01-02") {
+			to += "T23:59:59Z"
+		}
+		conditions = append(conditions, "timestamp <= ?")
+		args = append(args, to)
+	}
+	if filter.EntityType != "" {
+		conditions = append(conditions, "entityType = ?")
+		args = append(args, filter.EntityType)
+	}
+	if filter.EntityID != "" {
+		conditions = append(conditions, "entityId = ?")
+		args = append(args, filter.EntityID)
+	}
+	if filter.DealNO != "" {
+		// An update is recorded on the new deal NO; the original NO is the entity ID
+		conditions = append(conditions, "(dealNo = ? OR (entityType = 'deal' AND entityId = ?))")
+		args = append(args, filter.DealNO, filter.DealNO)
+	}
+	if filter.Actor != "" {
+		conditions = append(conditions, "actor = ?")
+		args = append(args, filter.Actor)
+	}
+	if filter.Action != "" {
+		conditions = append(conditions, "action = ?")
+		args = append(args, filter.Action)
+	}
+	if filter.Period != "" {
+		conditions = append(conditions, "period = ?")
+		args = append(args, filter.Period)
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	var totalCount int
+	if err := db.QueryRow("SELECT COUNT(*) FROM AuditLog"+where, args...).Scan(&totalCount); err != nil {
+		return nil, 0, fmt.Errorf("failed to count audit log: %v", err)
+	}
+
+	limit := filter.Limit
+	if limit <= 0 || limit > 1000 {
+		limit = 1000
+	}
+
+	query := `SELECT id, timestamp, actor, clientIp, userAgent, method, path, action, entityType,
+	          entityId, period, dealNo, statusCode, success, before, after, message
+	          FROM AuditLog` + where + " ORDER BY id DESC LIMIT ? OFFSET ?"
+	args = append(args, limit, filter.Offset)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to query audit log: %v", err)
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var entry AuditEntry
+		var actor, clientIP, userAgent, method, path, action, entityType, entityID sql.NullString
+		var period, dealNO, before, after, message sql.NullString
+		err := rows.Scan(&entry.ID, &entry.Timestamp, &actor, &clientIP, &userAgent, &method, &path,
+			&action, &entityType, &entityID, &period, &dealNO, &entry.StatusCode, &entry.Success,
+			&before, &after, &message)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to scan audit entry: %v", err)
+		}
+		entry.Actor = actor.String
+		entry.ClientIP = clientIP.String
+		entry.UserAgent = userAgent.String
+		entry.Method = method.String
+		entry.Path = path.String
+		entry.Action = action.String
+		entry.EntityType = entityType.String
+		entry.EntityID = entityID.String
+		entry.Period = period.String
+		entry.DealNO = dealNO.String
+		if before.String != "" {
+			entry.Before = json.RawMessage(before.String)
+		}
+		if after.String != "" {
+			entry.After = json.RawMessage(after.String)
+		}
+		entry.Message = message.String
+		entries = append(entries, entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("error iterating rows: %v", err)
+	}
+
+	return entries, totalCount, nil
+}
+
+func nullableJSON(value json.RawMessage) interface{} {
+	if len(value) == 0 {
+		return nil
+	}
+	return string(value)
+}
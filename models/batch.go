@@ -0,0 +1,255 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// DealBatch runs deal operations on several periods as one unit.
+// Each period taking part has one transaction, begun in sorted order so that two
+// batches cannot wait on each other. Nothing is visible to other requests until Commit,
+// and Rollback undoes every operation.
+//
+// Blob references are taken by Commit rather than by each operation, so that files of
+// the batch only need to be in the blob store when it is committed.
+type DealBatch struct {
+	periods []string
+	txs     map[string]*sql.Tx
+	blobs   map[string][]string // hashes to retain on commit, by period
+	done    bool
+}
+
+// BeginDealBatch starts a batch on existing periods
+func BeginDealBatch(periods []string) (*DealBatch, error) {
+	b := &DealBatch{txs: map[string]*sql.Tx{}, blobs: map[string][]string{}}
+	for _, period := range periods {
+		if _, seen := b.txs[period]; !seen {
+			b.txs[period] = nil
+			b.periods = append(b.periods, period)
+		}
+	}
+	sort.Strings(b.periods)
+
+	for _, period := range b.periods {
+		db, err := ConnectPeriodDB(period)
+		if err == nil {
+			b.txs[period], err = db.Begin()
+		}
+		if err != nil {
+			b.Rollback()
+			return nil, fmt.Errorf("failed to start transaction on period %s: %v", period, err)
+		}
+	}
+
+	return b, nil
+}
+
+// tx returns the transaction of a period of the batch
+func (b *DealBatch) tx(period string) (*sql.Tx, error) {
+	if b.done {
+		return nil, fmt.Errorf("batch is already finished")
+	}
+	tx := b.txs[period]
+	if tx == nil {
+		return nil, fmt.Errorf("period %s is not part of the batch", period)
+	}
+	return tx, nil
+}
+
+// GetDeal returns a deal record as changed by the operations of the batch so far
+func (b *DealBatch) GetDeal(period, dealID string) (*Deal, error) {
+	tx, err := b.tx(period)
+	if err != nil {
+		return nil, err
+	}
+
+	deal := &Deal{}
+	err = scanDeal(tx.QueryRow("SELECT "+dealColumns+" FROM Deals WHERE NO = ?", dealID), deal)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("deal not found: %s", dealID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get deal: %v", err)
+	}
+	return deal, nil
+}
+
+// CreateDeal inserts a new deal. RegDate and RecUpdate are kept if set.
+func (b *DealBatch) CreateDeal(period string, deal *Deal) error {
+	tx, err := b.tx(period)
+	if err != nil {
+		return err
+	}
+
+	var exists int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM Deals WHERE NO = ?", deal.NO).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to check existence: %v", err)
+	}
+	if exists > 0 {
+		return fmt.Errorf("deal number already exists: %s", deal.NO)
+	}
+
+	now := time.Now().Format("2006-01-02T15:04:05Z")
+	if deal.RegDate == "" {
+		deal.RegDate = now
+	}
+	if deal.RecUpdate == "" {
+		deal.RecUpdate = now
+	}
+
+	if err := insertDeal(tx, deal); err != nil {
+		return fmt.Errorf("failed to insert deal: %v", err)
+	}
+	b.addDealBlob(period, deal)
+	return nil
+}
+
+// UpdateDeal replaces the current version oldDealID with newDeal, as CreateDealWithHistory
+func (b *DealBatch) UpdateDeal(period, oldDealID string, newDeal *Deal) error {
+	tx, err := b.tx(period)
+	if err != nil {
+		return err
+	}
+
+	if err := markDealUpdated(tx, oldDealID, newDeal.NO); err != nil {
+		return err
+	}
+	if err := insertDeal(tx, newDeal); err != nil {
+		return fmt.Errorf("failed to insert new deal: %v", err)
+	}
+	b.addDealBlob(period, newDeal)
+
+	return b.copyAttachments(tx, oldDealID, period, newDeal.NO)
+}
+
+// DeleteDeal marks a deal as deleted, as DeleteDeal
+func (b *DealBatch) DeleteDeal(period, dealID string) error {
+	tx, err := b.tx(period)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := markDealDeleted(tx, dealID, "NEW", "UPDATE")
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return fmt.Errorf("deal not found or already deleted: %s", dealID)
+	}
+	return nil
+}
+
+// MoveDeal creates newDeal in toPeriod as the continuation of the current version dealID
+// of fromPeriod, which is marked as deleted. Its active attachments go with it.
+func (b *DealBatch) MoveDeal(fromPeriod, dealID, toPeriod string, newDeal *Deal) error {
+	fromTx, err := b.tx(fromPeriod)
+	if err != nil {
+		return err
+	}
+	toTx, err := b.tx(toPeriod)
+	if err != nil {
+		return err
+	}
+
+	moved, err := markDealDeleted(fromTx, dealID, "NEW")
+	if err != nil {
+		return fmt.Errorf("failed to mark original deal: %v", err)
+	}
+	if !moved {
+		return fmt.Errorf("deal %s is not the current version", dealID)
+	}
+
+	if err := b.CreateDeal(toPeriod, newDeal); err != nil {
+		return err
+	}
+
+	attachments, err := queryActiveAttachments(fromTx, dealID)
+	if err != nil {
+		return err
+	}
+	if err := insertAttachmentRows(toTx, attachments, newDeal.NO); err != nil {
+		return err
+	}
+	for _, a := range attachments {
+		b.blobs[toPeriod] = append(b.blobs[toPeriod], a.Hash)
+	}
+	return nil
+}
+
+// copyAttachments copies the active attachments of oldNO to newNO in the same period
+func (b *DealBatch) copyAttachments(tx *sql.Tx, oldNO, period, newNO string) error {
+	attachments, err := queryActiveAttachments(tx, oldNO)
+	if err != nil {
+		return err
+	}
+	if err := insertAttachmentRows(tx, attachments, newNO); err != nil {
+		return err
+	}
+	for _, a := range attachments {
+		b.blobs[period] = append(b.blobs[period], a.Hash)
+	}
+	return nil
+}
+
+// addDealBlob records the blob reference of an inserted deal record
+func (b *DealBatch) addDealBlob(period string, deal *Deal) {
+	if deal.FileStore == FileStoreBlob {
+		b.blobs[period] = append(b.blobs[period], deal.Hash)
+	}
+}
+
+// Commit takes the blob references of the batch and commits the periods in order.
+// SQLite cannot commit several databases as one, so if a commit itself fails the
+// periods committed before it stay committed; they are returned with the error.
+func (b *DealBatch) Commit() (committed []string, err error) {
+	if b.done {
+		return nil, fmt.Errorf("batch is already finished")
+	}
+
+	var retained []string
+	for _, period := range b.periods {
+		for _, hash := range b.blobs[period] {
+			if err := retainBlob(hash); err != nil {
+				releaseBlobs(retained)
+				b.Rollback()
+				return nil, err
+			}
+			retained = append(retained, hash)
+		}
+	}
+
+	b.done = true
+	for i, period := range b.periods {
+		if err := b.txs[period].Commit(); err != nil {
+			for _, rest := range b.periods[i:] {
+				b.txs[rest].Rollback()
+				releaseBlobs(b.blobs[rest])
+			}
+			if len(committed) > 0 {
+				log.Printf("DealBatch: Commit of period %s failed after %v were committed: %v", period, committed, err)
+			}
+			return committed, fmt.Errorf("failed to commit period %s: %v", period, err)
+		}
+		committed = append(committed, period)
+		anchorChainHead(period)
+		scheduleTextExtraction(period)
+	}
+
+	return committed, nil
+}
+
+// Rollback discards every operation of the batch. It does nothing after Commit.
+func (b *DealBatch) Rollback() {
+	if b.done {
+		return
+	}
+	b.done = true
+	for _, tx := range b.txs {
+		if tx != nil {
+			tx.Rollback()
+		}
+	}
+}
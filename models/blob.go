@@ -0,0 +1,686 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Where the attachment of a deal is stored (Deals.FileStore)
+const (
+	FileStorePeriod = ""     // legacy: a file named FilePath in the period folder
+	FileStoreBlob   = "blob" // the blob store, keyed by Hash
+)
+
+// blobDirName is the folder under basePath that holds the blob store
+const blobDirName = ".blobs"
+
+// blobTempDirName is the folder under the blob store where uploads are written
+// until they are committed
+const blobTempDirName = "tmp"
+
+// blobStoreMutex serializes storing blobs with moving them out of the blob store,
+// so that a blob in the Blobs table always has its file
+var blobStoreMutex sync.Mutex
+
+var blobHashPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// Blob is one stored attachment content
+type Blob struct {
+	Hash     string `json:"hash"`
+	Ext      string `json:"ext"` // extension of the first file stored with this content
+	Size     int64  `json:"size"`
+	RefCount int    `json:"refCount"` // number of deal records and attachments that point to the blob
+	Created  string `json:"created"`
+}
+
+func createBlobTable(db *sql.DB) error {
+	query := `CREATE TABLE IF NOT EXISTS "Blobs" (
+		"hash" TEXT PRIMARY KEY,
+		"ext" TEXT NOT NULL DEFAULT '',
+		"size" INTEGER NOT NULL,
+		"refCount" INTEGER NOT NULL DEFAULT 0,
+		"created" TEXT
+	)`
+	if _, err := db.Exec(query); err != nil {
+		return fmt.Errorf("failed to create Blobs table: %v", err)
+	}
+	return nil
+}
+
+// blobFilePath returns where the content with hash is stored.
+// Blobs keep an extension so that preview generators can tell the file type.
+func blobFilePath(hash, ext string) string {
+	return filepath.Join(basePath, blobDirName, hash[:2], hash+ext)
+}
+
+// normalizeBlobExt returns a lower-case extension that is safe to use in a file name
+func normalizeBlobExt(ext string) string {
+	ext = strings.ToLower(ext)
+	if len(ext) > 16 || strings.ContainsAny(ext, `/\:`) || strings.Count(ext, ".") != 1 {
+		return ""
+	}
+	return ext
+}
+
+// PutBlob stores data in the blob store and returns its SHA-256.
+// Content that is already stored is not written again. The blob has no reference
+// until a deal pointing to it is inserted.
+func PutBlob(data []byte, ext string) (string, error) {
+	writer, err := NewBlobWriter(0)
+	if err != nil {
+		return "", err
+	}
+	defer writer.Abort()
+
+	if _, err := writer.Write(data); err != nil {
+		return "", err
+	}
+	return writer.Commit(ext)
+}
+
+// BlobWriter streams content into a temporary file under the blob store while
+// computing its SHA-256, so that large attachments are never held in memory.
+// Commit moves the file into the store; Abort discards it.
+type BlobWriter struct {
+	file    *os.File
+	hash    hash.Hash
+	size    int64
+	limit   int64
+	session string // upload session that holds the file (see OpenUploadBlob)
+}
+
+// NewBlobWriter creates a BlobWriter. Writes beyond limit bytes fail with a
+// "file too large" error; 0 means no limit.
+func NewBlobWriter(limit int64) (*BlobWriter, error) {
+	dir := filepath.Join(basePath, blobDirName, blobTempDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create blob temp directory: %v", err)
+	}
+
+	file, err := os.CreateTemp(dir, "upload-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file: %v", err)
+	}
+
+	return &BlobWriter{file: file, hash: sha256.New(), limit: limit}, nil
+}
+
+// Write writes p to the temp file and adds it to the hash
+func (w *BlobWriter) Write(p []byte) (int, error) {
+	if w.file == nil {
+		return 0, fmt.Errorf("blob writer is closed")
+	}
+	if w.limit > 0 && w.size+int64(len(p)) > w.limit {
+		return 0, fmt.Errorf("file too large: the limit is %d bytes", w.limit)
+	}
+
+	n, err := w.file.Write(p)
+	w.hash.Write(p[:n])
+	w.size += int64(n)
+	if err != nil {
+		return n, fmt.Errorf("failed to write temp file: %v", err)
+	}
+	return n, nil
+}
+
+// Size returns the number of bytes written so far
+func (w *BlobWriter) Size() int64 {
+	return w.size
+}
+
+// Hash returns the SHA-256 of the bytes written so far
+func (w *BlobWriter) Hash() string {
+	return hex.EncodeToString(w.hash.Sum(nil))
+}
+
+// Commit moves the written content into the blob store and returns its hash.
+// Content that is already stored is not written again.
+func (w *BlobWriter) Commit(ext string) (string, error) {
+	if w.file == nil {
+		return "", fmt.Errorf("blob writer is closed")
+	}
+	file := w.file
+	w.file = nil
+	if w.session != "" {
+		defer releaseUpload(w.session)
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		w.discard(file.Name())
+		return "", fmt.Errorf("failed to write temp file: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		w.discard(file.Name())
+		return "", fmt.Errorf("failed to write temp file: %v", err)
+	}
+
+	hash, err := storeBlobFile(file.Name(), w.Hash(), w.size, ext)
+	if err != nil {
+		w.discard(file.Name())
+		return "", err
+	}
+
+	if w.session != "" {
+		if err := removeUploadSession(w.session); err != nil {
+			log.Printf("Failed to end upload session %s: %v", w.session, err)
+		}
+	}
+	return hash, nil
+}
+
+// Abort discards the written content. It does nothing after Commit.
+// The content of an upload session is kept so that it can be attached again.
+func (w *BlobWriter) Abort() {
+	if w.file == nil {
+		return
+	}
+	w.file.Close()
+	w.discard(w.file.Name())
+	if w.session != "" {
+		releaseUpload(w.session)
+	}
+	w.file = nil
+}
+
+// discard removes the temp file unless it belongs to an upload session
+func (w *BlobWriter) discard(path string) {
+	if w.session == "" {
+		os.Remove(path)
+	}
+}
+
+// storeBlobFile moves the file at tempPath into the blob store and registers it.
+// If the content is already stored the file is removed instead.
+func storeBlobFile(tempPath, hash string, size int64, ext string) (string, error) {
+	db, err := GetSystemDB()
+	if err != nil {
+		return "", err
+	}
+
+	blobStoreMutex.Lock()
+	defer blobStoreMutex.Unlock()
+
+	blob, err := GetBlob(hash)
+	if err != nil && !strings.Contains(err.Error(), "not found") {
+		return "", err
+	}
+	if blob == nil {
+		blob = &Blob{Hash: hash, Ext: normalizeBlobExt(ext), Size: size}
+	}
+
+	path := blobFilePath(hash, blob.Ext)
+	if info, err := os.Stat(path); err == nil && info.Size() == size {
+		os.Remove(tempPath)
+		// Keep the file out of orphan scans until the caller takes its reference
+		now := time.Now()
+		os.Chtimes(path, now, now)
+	} else {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return "", fmt.Errorf("failed to store blob: %v", err)
+		}
+		if err := os.Rename(tempPath, path); err != nil {
+			return "", fmt.Errorf("failed to store blob: %v", err)
+		}
+	}
+
+	_, err = db.Exec(`INSERT OR IGNORE INTO Blobs (hash, ext, size, refCount, created) VALUES (?, ?, ?, 0, ?)`,
+		hash, blob.Ext, blob.Size, time.Now().Format("2006-01-02T15:04:05Z"))
+	if err != nil {
+		return "", fmt.Errorf("failed to register blob: %v", err)
+	}
+
+	return hash, nil
+}
+
+// GetBlob returns the blob with the given hash
+func GetBlob(hash string) (*Blob, error) {
+	if !isBlobHash(hash) {
+		return nil, fmt.Errorf("blob not found: %s", hash)
+	}
+
+	db, err := GetSystemDB()
+	if err != nil {
+		return nil, err
+	}
+
+	blob := &Blob{}
+	err = db.QueryRow(`SELECT hash, ext, size, refCount, created FROM Blobs WHERE hash = ?`, hash).Scan(
+		&blob.Hash, &blob.Ext, &blob.Size, &blob.RefCount, &blob.Created)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("blob not found: %s", hash)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get blob: %v", err)
+	}
+
+	return blob, nil
+}
+
+// BlobPath returns the path of a stored blob
+func BlobPath(hash string) (string, error) {
+	blob, err := GetBlob(hash)
+	if err != nil {
+		return "", err
+	}
+	return blobFilePath(blob.Hash, blob.Ext), nil
+}
+
+// retainDealBlob adds the reference of a deal record to its blob.
+// It is called before the record is inserted so that a crash can only leave a
+// reference count that is too high, never one that is too low.
+func retainDealBlob(deal *Deal) error {
+	if deal.FileStore != FileStoreBlob {
+		return nil
+	}
+	return retainBlob(deal.Hash)
+}
+
+// releaseDealBlob removes the reference added by retainDealBlob when the record was not inserted
+func releaseDealBlob(deal *Deal) {
+	if deal.FileStore != FileStoreBlob {
+		return
+	}
+	releaseBlob(deal.Hash)
+}
+
+// retainBlob adds one reference to a blob
+func retainBlob(hash string) error {
+	db, err := GetSystemDB()
+	if err != nil {
+		return err
+	}
+
+	result, err := db.Exec(`UPDATE Blobs SET refCount = refCount + 1 WHERE hash = ?`, hash)
+	if err != nil {
+		return fmt.Errorf("failed to add blob reference: %v", err)
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		return fmt.Errorf("blob not found: %s", hash)
+	}
+
+	return nil
+}
+
+// releaseBlob removes a reference added by retainBlob
+func releaseBlob(hash string) {
+	db, err := GetSystemDB()
+	if err != nil {
+		return
+	}
+
+	if _, err := db.Exec(`UPDATE Blobs SET refCount = refCount - 1 WHERE hash = ? AND refCount > 0`, hash); err != nil {
+		log.Printf("Failed to release blob reference %s: %v", hash, err)
+	}
+}
+
+// releaseBlobs releases one reference of each hash
+func releaseBlobs(hashes []string) {
+	for _, hash := range hashes {
+		releaseBlob(hash)
+	}
+}
+
+// AttachmentPath returns the file that holds the attachment of a deal.
+// Deals registered before the blob store keep their file in the period folder.
+func AttachmentPath(period string, deal *Deal) (string, error) {
+	if deal.FilePath == "" {
+		return "", fmt.Errorf("no file associated with deal %s", deal.NO)
+	}
+
+	if deal.FileStore == FileStoreBlob {
+		return BlobPath(deal.Hash)
+	}
+
+	if filepath.IsAbs(deal.FilePath) {
+		return deal.FilePath, nil
+	}
+	return filepath.Join(basePath, period, deal.FilePath), nil
+}
+
+// BlobMimeType returns the MIME type of a stored blob, using the extension of name
+// when it is a known type
+func BlobMimeType(hash, name string) string {
+	path, err := BlobPath(hash)
+	if err != nil {
+		return ""
+	}
+	return detectMimeType(path, filepath.Ext(name))
+}
+
+// StoreDealBlob makes sure the attachment of a deal is in the blob store so that a new
+// record can point to it, and returns its hash. An attachment in the period folder is
+// copied into the blob store after checking it against the recorded hash; the record
+// itself is left for MigrateAttachmentsToBlobStore.
+func StoreDealBlob(period string, deal *Deal) (string, error) {
+	if deal.FileStore == FileStoreBlob {
+		if _, err := GetBlob(deal.Hash); err != nil {
+			return "", err
+		}
+		return deal.Hash, nil
+	}
+
+	path, err := AttachmentPath(period, deal)
+	if err != nil {
+		return "", err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read attachment: %v", err)
+	}
+	defer file.Close()
+
+	writer, err := NewBlobWriter(0)
+	if err != nil {
+		return "", err
+	}
+	defer writer.Abort()
+
+	if _, err := io.Copy(writer, file); err != nil {
+		return "", fmt.Errorf("failed to read attachment: %v", err)
+	}
+	if deal.Hash != "" && writer.Hash() != deal.Hash {
+		return "", fmt.Errorf("attachment of deal %s does not match its hash", deal.NO)
+	}
+
+	return writer.Commit(filepath.Ext(deal.FilePath))
+}
+
+// BlobMigrationResult reports what MigrateAttachmentsToBlobStore did
+type BlobMigrationResult struct {
+	Migrated     int      `json:"migrated"`     // deal records moved to the blob store
+	FilesRemoved int      `json:"filesRemoved"` // period folder files removed after moving
+	BytesFreed   int64    `json:"bytesFreed"`   // size of the removed files
+	Skipped      []string `json:"skipped"`      // "period/NO: reason" for records left in place
+}
+
+// migratedAttachment is a period folder file whose records were moved to the blob store
+type migratedAttachment struct {
+	period   string
+	filePath string
+	hash     string
+}
+
+// systemColumnMigrations lists the columns added to System after the original schema
+var systemColumnMigrations = []columnDef{
+	{"BlobMigrated", "TEXT"}, // when MigrateAttachmentsToBlobStore completed
+}
+
+// BlobMigrationDone reports whether MigrateAttachmentsToBlobStore has completed
+func BlobMigrationDone() (bool, error) {
+	db, err := GetSystemDB()
+	if err != nil {
+		return false, err
+	}
+
+	var migrated sql.NullString
+	if err := db.QueryRow(`SELECT BlobMigrated FROM System LIMIT 1`).Scan(&migrated); err != nil {
+		return false, fmt.Errorf("failed to check blob migration: %v", err)
+	}
+	return migrated.Valid && migrated.String != "", nil
+}
+
+// MigrateAttachmentsToBlobStore moves the attachments kept in period folders into the
+// blob store, so that copies of the same content made by updates and period changes
+// are folded into one blob, recounts all blob references and records in System.db that
+// the migration is done. Only then are the period folder files removed, each after the
+// blob that replaces it is checked against the recorded hash.
+// Files that are missing or do not match the recorded hash are left as they are.
+// It is safe to run again; only records still in the period folders are processed.
+func MigrateAttachmentsToBlobStore() (*BlobMigrationResult, error) {
+	periods, err := GetAvailablePeriods()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list periods: %v", err)
+	}
+
+	result := &BlobMigrationResult{Skipped: []string{}}
+	var migrated []migratedAttachment
+	for _, period := range periods {
+		if err := migratePeriodAttachments(period, result, &migrated); err != nil {
+			return result, err
+		}
+	}
+
+	if err := RecountBlobRefs(); err != nil {
+		return result, err
+	}
+
+	db, err := GetSystemDB()
+	if err != nil {
+		return result, err
+	}
+	if _, err := db.Exec(`UPDATE System SET BlobMigrated = ?`, time.Now().Format("2006-01-02T15:04:05Z")); err != nil {
+		return result, fmt.Errorf("failed to record blob migration: %v", err)
+	}
+
+	for _, attachment := range migrated {
+		removeMigratedAttachment(attachment, result)
+	}
+
+	return result, nil
+}
+
+// migratePeriodAttachments moves the attachment records of one period into the blob store
+// and adds the period folder files they no longer need to migrated
+func migratePeriodAttachments(period string, result *BlobMigrationResult, migrated *[]migratedAttachment) error {
+	db, err := ConnectPeriodDB(period)
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.Query(`SELECT NO, FilePath, COALESCE(Hash, '') FROM Deals
+	                       WHERE COALESCE(FileStore, '') = '' AND COALESCE(FilePath, '') != ''`)
+	if err != nil {
+		return fmt.Errorf("failed to query attachments of period %s: %v", period, err)
+	}
+
+	var deals []Deal
+	for rows.Next() {
+		var deal Deal
+		if err := rows.Scan(&deal.NO, &deal.FilePath, &deal.Hash); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan deal: %v", err)
+		}
+		deals = append(deals, deal)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating rows: %v", err)
+	}
+	if len(deals) == 0 {
+		return nil
+	}
+
+	// Store the blobs first; the records are switched in one transaction afterwards
+	var moved []Deal
+	for i := range deals {
+		deal := &deals[i]
+		if deal.Hash == "" {
+			result.Skipped = append(result.Skipped, fmt.Sprintf("%s/%s: no hash recorded", period, deal.NO))
+			continue
+		}
+		if _, err := StoreDealBlob(period, deal); err != nil {
+			result.Skipped = append(result.Skipped, fmt.Sprintf("%s/%s: %v", period, deal.NO, err))
+			continue
+		}
+		moved = append(moved, *deal)
+	}
+	if len(moved) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	for _, deal := range moved {
+		if _, err := tx.Exec(`UPDATE Deals SET FileStore = ? WHERE NO = ?`, FileStoreBlob, deal.NO); err != nil {
+			return fmt.Errorf("failed to update deal %s: %v", deal.NO, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	result.Migrated += len(moved)
+
+	seen := map[string]bool{}
+	for _, deal := range moved {
+		if !seen[deal.FilePath] {
+			seen[deal.FilePath] = true
+			*migrated = append(*migrated, migratedAttachment{period: period, filePath: deal.FilePath, hash: deal.Hash})
+		}
+	}
+	return nil
+}
+
+// removeMigratedAttachment removes a period folder file that no record points to any more,
+// after checking that its blob is stored with the same content
+func removeMigratedAttachment(attachment migratedAttachment, result *BlobMigrationResult) {
+	db, err := ConnectPeriodDB(attachment.period)
+	if err != nil {
+		return
+	}
+	var remaining int
+	err = db.QueryRow(`SELECT COUNT(*) FROM Deals WHERE COALESCE(FileStore, '') = '' AND FilePath = ?`,
+		attachment.filePath).Scan(&remaining)
+	if err != nil || remaining > 0 {
+		return
+	}
+
+	if err := verifyBlob(attachment.hash); err != nil {
+		log.Printf("Keeping migrated attachment %s/%s: %v", attachment.period, attachment.filePath, err)
+		return
+	}
+
+	path, err := AttachmentPath(attachment.period, &Deal{FilePath: attachment.filePath})
+	if err != nil {
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	if err := os.Remove(path); err != nil {
+		log.Printf("Failed to remove migrated attachment %s: %v", path, err)
+		return
+	}
+	result.FilesRemoved++
+	result.BytesFreed += info.Size()
+}
+
+// verifyBlob checks that the stored blob file has the content of hash
+func verifyBlob(hash string) error {
+	path, err := BlobPath(hash)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to read blob: %v", err)
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return fmt.Errorf("failed to read blob: %v", err)
+	}
+	if hex.EncodeToString(h.Sum(nil)) != hash {
+		return fmt.Errorf("blob %s does not match its hash", hash)
+	}
+	return nil
+}
+
+// RecountBlobRefs sets the reference count of every blob to the number of deal records
+// and attachments in all periods that point to it
+func RecountBlobRefs() error {
+	periods, err := GetAvailablePeriods()
+	if err != nil {
+		return fmt.Errorf("failed to list periods: %v", err)
+	}
+
+	counts := map[string]int{}
+	for _, period := range periods {
+		db, err := ConnectPeriodDB(period)
+		if err != nil {
+			return err
+		}
+
+		rows, err := db.Query(`SELECT Hash, COUNT(*) FROM Deals WHERE FileStore = ? GROUP BY Hash`, FileStoreBlob)
+		if err != nil {
+			return fmt.Errorf("failed to count blob references of period %s: %v", period, err)
+		}
+		if err := addBlobRefCounts(rows, counts); err != nil {
+			return err
+		}
+
+		// Removed attachments keep their files as history, so every row counts
+		rows, err = db.Query(`SELECT Hash, COUNT(*) FROM Attachments GROUP BY Hash`)
+		if err != nil {
+			return fmt.Errorf("failed to count attachment references of period %s: %v", period, err)
+		}
+		if err := addBlobRefCounts(rows, counts); err != nil {
+			return err
+		}
+	}
+
+	db, err := GetSystemDB()
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE Blobs SET refCount = 0`); err != nil {
+		return fmt.Errorf("failed to reset blob references: %v", err)
+	}
+	for hash, count := range counts {
+		if _, err := tx.Exec(`UPDATE Blobs SET refCount = ? WHERE hash = ?`, count, hash); err != nil {
+			return fmt.Errorf("failed to update blob references: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	return nil
+}
+
+// addBlobRefCounts adds the (hash, count) rows to counts and closes rows
+func addBlobRefCounts(rows *sql.Rows, counts map[string]int) error {
+	defer rows.Close()
+	for rows.Next() {
+		var hash string
+		var count int
+		if err := rows.Scan(&hash, &count); err != nil {
+			return fmt.Errorf("failed to scan blob reference: %v", err)
+		}
+		counts[hash] += count
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating rows: %v", err)
+	}
+	return nil
+}
+
+// isBlobHash reports whether hash is a lower-case hex SHA-256
+func isBlobHash(hash string) bool {
+	return blobHashPattern.MatchString(hash)
+}
@@ -0,0 +1,157 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// newLegacyDeal registers a deal whose attachment is kept in the period folder,
+// as deals registered before the blob store
+func newLegacyDeal(t *testing.T, period, name string, content []byte) *Deal {
+	t.Helper()
+	sum := sha256.Sum256(content)
+	deal := newTestDeal("文房具", 1100)
+	deal.FilePath = name
+	deal.Hash = hex.EncodeToString(sum[:])
+	if err := os.WriteFile(filepath.Join(basePath, period, name), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateDeal(period, deal); err != nil {
+		t.Fatal(err)
+	}
+	return deal
+}
+
+func TestMigrateAttachmentsToBlobStore(t *testing.T) {
+	setupTestDB(t)
+	const period = "2025"
+	db, err := ConnectToPeriod(period)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done, err := BlobMigrationDone()
+	if err != nil || done {
+		t.Fatalf("fresh database: done %v, %v", done, err)
+	}
+
+	deal := newLegacyDeal(t, period, "receipt.pdf", []byte("%PDF-1.4 receipt"))
+	source := filepath.Join(basePath, period, "receipt.pdf")
+
+	result, err := MigrateAttachmentsToBlobStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Migrated != 1 || result.FilesRemoved != 1 || len(result.Skipped) != 0 {
+		t.Errorf("got %+v", result)
+	}
+	if _, err := os.Stat(source); !os.IsNotExist(err) {
+		t.Errorf("source file was not removed: %v", err)
+	}
+
+	var store string
+	if err := db.QueryRow(`SELECT FileStore FROM Deals WHERE NO = ?`, deal.NO).Scan(&store); err != nil {
+		t.Fatal(err)
+	}
+	if store != FileStoreBlob {
+		t.Errorf("FileStore = %q, want %q", store, FileStoreBlob)
+	}
+	if err := verifyBlob(deal.Hash); err != nil {
+		t.Error(err)
+	}
+
+	done, err = BlobMigrationDone()
+	if err != nil || !done {
+		t.Errorf("after migration: done %v, %v", done, err)
+	}
+}
+
+func TestMigrateAttachmentsKeepsSourceOfCorruptBlob(t *testing.T) {
+	setupTestDB(t)
+	const period = "2025"
+	if _, err := ConnectToPeriod(period); err != nil {
+		t.Fatal(err)
+	}
+
+	content := []byte("%PDF-1.4 receipt")
+	deal := newLegacyDeal(t, period, "receipt.pdf", content)
+	source := filepath.Join(basePath, period, "receipt.pdf")
+
+	// A blob of the same size but other content is already in the store
+	corrupt := []byte("%PDF-1.4 RECEIPT")
+	if _, err := storeBlobFileFromBytes(t, corrupt, deal.Hash, ".pdf"); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := MigrateAttachmentsToBlobStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.FilesRemoved != 0 {
+		t.Errorf("removed %d files, want 0", result.FilesRemoved)
+	}
+	kept, err := os.ReadFile(source)
+	if err != nil || string(kept) != string(content) {
+		t.Errorf("source file was not kept: %q, %v", kept, err)
+	}
+	if err := verifyBlob(deal.Hash); err == nil {
+		t.Error("corrupt blob verified")
+	}
+}
+
+func TestQuarantineWhileStoringBlob(t *testing.T) {
+	setupTestDB(t)
+	content := []byte("%PDF-1.4 receipt")
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+
+	const rounds = 50
+	dir := t.TempDir()
+	temps := make([]string, rounds)
+	for i := range temps {
+		temps[i] = filepath.Join(dir, fmt.Sprintf("upload-%d", i))
+		if err := os.WriteFile(temps[i], content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each round stores the blob again while the unused blob is quarantined
+	for i, temp := range temps {
+		var wg sync.WaitGroup
+		var storeErr, quarantineErr error
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, storeErr = storeBlobFile(temp, hash, int64(len(content)), ".pdf")
+		}()
+		go func() {
+			defer wg.Done()
+			_, quarantineErr = QuarantineOrphanFiles(0, nil)
+		}()
+		wg.Wait()
+		if storeErr != nil || quarantineErr != nil {
+			t.Fatalf("round %d: store %v, quarantine %v", i, storeErr, quarantineErr)
+		}
+
+		if _, err := GetBlob(hash); err == nil {
+			if err := verifyBlob(hash); err != nil {
+				t.Fatalf("round %d: registered blob: %v", i, err)
+			}
+		}
+	}
+}
+
+// storeBlobFileFromBytes registers data in the blob store under hash, whatever its content
+func storeBlobFileFromBytes(t *testing.T, data []byte, hash, ext string) (string, error) {
+	t.Helper()
+	temp := filepath.Join(t.TempDir(), "blob")
+	if err := os.WriteFile(temp, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return storeBlobFile(temp, hash, int64(len(data)), ext)
+}
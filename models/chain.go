@@ -0,0 +1,472 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"log"
+	"strconv"
+	"time"
+)
+
+// ChainVerification is the result of verifying the hash chain of a period
+type ChainVerification struct {
+	Period     string      `json:"period"`
+	Valid      bool        `json:"valid"`
+	Checked    int         `json:"checked"`
+	Unchained  int         `json:"unchained"` // rows written before the chain was introduced
+	Events     int         `json:"events"`    // status changes among the checked links
+	LastSeq    int64       `json:"lastSeq"`
+	LastDigest string      `json:"lastDigest"`
+	HeadSeq    int64       `json:"headSeq"` // last link recorded in System.db; 0 if none yet
+	BrokenLink *ChainBreak `json:"brokenLink,omitempty"`
+}
+
+// ChainBreak describes the first broken link found in a hash chain
+type ChainBreak struct {
+	Seq    int64  `json:"seq"`
+	NO     string `json:"NO"`
+	Reason string `json:"reason"`
+}
+
+// chainLink holds the chain columns of a deal row
+type chainLink struct {
+	Seq    int64
+	Prev   string
+	Digest string
+}
+
+// nextChainLink computes the chain columns for a deal about to be inserted in tx.
+// The digest covers the previous row's digest and the contents of the new row.
+func nextChainLink(tx *sql.Tx, deal *Deal) (*chainLink, error) {
+	lastSeq, lastDigest, err := lastChainLink(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	link := &chainLink{
+		Seq:  lastSeq + 1,
+		Prev: lastDigest,
+	}
+	link.Digest = computeDealDigest(link.Seq, link.Prev, deal)
+
+	return link, nil
+}
+
+// chainQuerier is a database or transaction the hash chain is read from
+type chainQuerier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// lastChainLink returns the sequence number and digest of the last link of the chain,
+// which is either a deal record or a status event. Both are 0 and "" for an empty chain.
+func lastChainLink(q chainQuerier) (int64, string, error) {
+	var seq int64
+	var digest string
+	err := q.QueryRow(`SELECT ChainSeq, ChainDigest FROM (
+	                     SELECT ChainSeq, ChainDigest FROM Deals WHERE ChainSeq IS NOT NULL
+	                     UNION ALL SELECT ChainSeq, ChainDigest FROM DealEvents)
+	                   ORDER BY ChainSeq DESC LIMIT 1`).Scan(&seq, &digest)
+	if err == sql.ErrNoRows {
+		return 0, "", nil
+	}
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to get last chain link: %v", err)
+	}
+	return seq, digest, nil
+}
+
+// recordDealEvent appends a status change of a deal record to the hash chain in tx.
+// recStatus and nextNO are the values the record has after the change.
+func recordDealEvent(tx *sql.Tx, dealNO, recStatus string, nextNO *string, recorded string) error {
+	lastSeq, lastDigest, err := lastChainLink(tx)
+	if err != nil {
+		return err
+	}
+
+	seq := lastSeq + 1
+	digest := computeEventDigest(seq, lastDigest, dealNO, recStatus, nextNO, recorded)
+	_, err = tx.Exec(`INSERT INTO DealEvents (ChainSeq, ChainPrev, ChainDigest, DealNO, RecStatus, nextNO, Recorded)
+	                  VALUES (?, ?, ?, ?, ?, ?, ?)`, seq, lastDigest, digest, dealNO, recStatus, nextNO, recorded)
+	if err != nil {
+		return fmt.Errorf("failed to record deal event: %v", err)
+	}
+	return nil
+}
+
+// computeDealDigest returns the SHA-256 digest of a chain link.
+// Only the fields fixed at insert time are covered: RecStatus and nextNO change by
+// design when a deal is updated or logically deleted and are chained as status events
+// (see computeEventDigest), RecUpdate is only the time of that change, FilePath is a
+// storage location whose content is already covered by Hash, and PartnerID is a link
+// to the partner master that is filled in later for deals registered before it existed.
+func computeDealDigest(seq int64, prev string, deal *Deal) string {
+	prevNO := ""
+	if deal.PrevNO != nil {
+		prevNO = *deal.PrevNO
+	}
+
+	h := sha256.New()
+	writeDigestField(h, strconv.FormatInt(seq, 10))
+	writeDigestField(h, prev)
+	writeDigestField(h, deal.NO)
+	writeDigestField(h, prevNO)
+	writeDigestField(h, deal.DealType)
+	writeDigestField(h, deal.DealDate)
+	writeDigestField(h, deal.DealName)
+	writeDigestField(h, deal.DealPartner)
+	writeDigestField(h, strconv.Itoa(deal.DealPrice))
+	writeDigestField(h, deal.DealRemark)
+	writeDigestField(h, deal.RegDate)
+	writeDigestField(h, deal.Hash)
+	// Fields added after the chain was introduced are only covered when set, so that
+	// digests of earlier rows stay valid. They are tagged so that they cannot be
+	// mistaken for one another.
+	if deal.RegUser != "" {
+		writeDigestField(h, "user:"+deal.RegUser)
+	}
+	if deal.InvoiceNumber != "" {
+		writeDigestField(h, "invoice:"+deal.InvoiceNumber)
+	}
+	if len(deal.TaxLines) > 0 {
+		writeDigestField(h, "tax:"+taxDigestValue(deal.TaxLines))
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// computeEventDigest returns the SHA-256 digest of a status event link.
+// The leading tag keeps an event from being read as a deal record.
+func computeEventDigest(seq int64, prev, dealNO, recStatus string, nextNO *string, recorded string) string {
+	next := ""
+	if nextNO != nil {
+		next = *nextNO
+	}
+
+	h := sha256.New()
+	writeDigestField(h, "event")
+	writeDigestField(h, strconv.FormatInt(seq, 10))
+	writeDigestField(h, prev)
+	writeDigestField(h, dealNO)
+	writeDigestField(h, recStatus)
+	writeDigestField(h, next)
+	writeDigestField(h, recorded)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writeDigestField writes a length-prefixed field so that field boundaries are unambiguous
+func writeDigestField(h hash.Hash, value string) {
+	fmt.Fprintf(h, "%d:%s;", len(value), value)
+}
+
+// createChainHeadTable creates the table of the last chain link of each period.
+// The chain alone cannot show that records were removed from its end, so the head is
+// also kept outside the period database and compared when the chain is verified.
+func createChainHeadTable(db *sql.DB) error {
+	query := `CREATE TABLE IF NOT EXISTS "ChainHeads" (
+		"period" TEXT PRIMARY KEY,
+		"seq" INTEGER NOT NULL,
+		"digest" TEXT NOT NULL,
+		"updated" TEXT
+	)`
+	if _, err := db.Exec(query); err != nil {
+		return fmt.Errorf("failed to create ChainHeads table: %v", err)
+	}
+	return nil
+}
+
+// anchorChainHead records the head of the hash chain of a period after deals were
+// inserted or changed. The deals are already committed, so a failure is only logged; the head
+// is recorded again the next time the period database is opened.
+func anchorChainHead(period string) {
+	system, err := GetSystemDB()
+	if err == nil {
+		var db *sql.DB
+		if db, err = ConnectPeriodDB(period); err == nil {
+			err = recordChainHead(system, db, period)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to record chain head of period %s: %v", period, err)
+	}
+}
+
+// recordChainHead stores the last link of the chain of a period in System.db.
+// The stored head only moves forward, so a chain shortened while the server was
+// down is still reported by VerifyDealChain.
+func recordChainHead(system, db *sql.DB, period string) error {
+	seq, digest, err := lastChainLink(db)
+	if err != nil {
+		return err
+	}
+	if seq == 0 {
+		return nil
+	}
+
+	_, err = system.Exec(`INSERT INTO ChainHeads (period, seq, digest, updated) VALUES (?, ?, ?, ?)
+	                      ON CONFLICT(period) DO UPDATE SET seq = excluded.seq, digest = excluded.digest,
+	                      updated = excluded.updated WHERE excluded.seq > ChainHeads.seq`,
+		period, seq, digest, time.Now().Format("2006-01-02T15:04:05Z"))
+	if err != nil {
+		return fmt.Errorf("failed to record chain head: %v", err)
+	}
+	return nil
+}
+
+// renameChainHead moves the recorded chain head of a renamed period
+func renameChainHead(oldName, newName string) error {
+	system, err := GetSystemDB()
+	if err != nil {
+		return err
+	}
+	if _, err := system.Exec(`UPDATE ChainHeads SET period = ? WHERE period = ?`, newName, oldName); err != nil {
+		return fmt.Errorf("failed to rename chain head: %v", err)
+	}
+	return nil
+}
+
+// deleteChainHead removes the recorded chain head of a deleted period
+func deleteChainHead(period string) error {
+	system, err := GetSystemDB()
+	if err != nil {
+		return err
+	}
+	if _, err := system.Exec(`DELETE FROM ChainHeads WHERE period = ?`, period); err != nil {
+		return fmt.Errorf("failed to delete chain head: %v", err)
+	}
+	return nil
+}
+
+// VerifyDealChain walks the hash chain of a period and reports the first broken link.
+// The chain must also reach the head recorded in System.db, so that removing the
+// last records is detected. The status of each deal record must be the one its
+// chained status events lead to, and a superseded record must name a chained
+// successor that points back to it.
+func VerifyDealChain(period string) (*ChainVerification, error) {
+	db, err := ConnectPeriodDB(period)
+	if err != nil {
+		return nil, err
+	}
+	system, err := GetSystemDB()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ChainVerification{
+		Period: period,
+		Valid:  true,
+	}
+
+	var headDigest string
+	err = system.QueryRow(`SELECT seq, digest FROM ChainHeads WHERE period = ?`, period).Scan(&result.HeadSeq, &headDigest)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to get chain head: %v", err)
+	}
+
+	err = db.QueryRow("SELECT COUNT(*) FROM Deals WHERE ChainSeq IS NULL").Scan(&result.Unchained)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count unchained deals: %v", err)
+	}
+
+	// Deal records and status events share one sequence; event rows carry EventStatus
+	query := `SELECT ChainSeq, ChainPrev, ChainDigest, NO, prevNO, DealType, DealDate, DealName, DealPartner,
+	          DealPrice, DealRemark, RegDate, Hash, RegUser, InvoiceNumber, TaxBreakdown,
+	          NULL AS EventStatus, NULL AS EventNext, NULL AS EventRecorded
+	          FROM Deals WHERE ChainSeq IS NOT NULL
+	          UNION ALL
+	          SELECT ChainSeq, ChainPrev, ChainDigest, DealNO, NULL, NULL, NULL, NULL, NULL,
+	          NULL, NULL, NULL, NULL, NULL, NULL, NULL, RecStatus, nextNO, Recorded
+	          FROM DealEvents
+	          ORDER BY ChainSeq`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query hash chain: %v", err)
+	}
+	defer rows.Close()
+
+	// Status of each deal record according to its last status event
+	statuses := make(map[string]dealStatus)
+
+	expectedSeq := int64(1)
+	expectedPrev := ""
+	for rows.Next() {
+		var deal Deal
+		var dealType, dealDate, dealName, dealPartner, dealRemark, regDate, fileHash, regUser, invoiceNumber, taxBreakdown sql.NullString
+		var eventStatus, eventNext, eventRecorded sql.NullString
+		var dealPrice sql.NullInt64
+		var link chainLink
+		var chainPrev, chainDigest sql.NullString
+		err := rows.Scan(&link.Seq, &chainPrev, &chainDigest, &deal.NO, &deal.PrevNO, &dealType, &dealDate, &dealName, &dealPartner,
+			&dealPrice, &dealRemark, &regDate, &fileHash, &regUser, &invoiceNumber, &taxBreakdown,
+			&eventStatus, &eventNext, &eventRecorded)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan chain link: %v", err)
+		}
+		link.Prev = chainPrev.String
+		link.Digest = chainDigest.String
+
+		var digest string
+		var taxErr error
+		if eventStatus.Valid {
+			var nextNO *string
+			if eventNext.Valid {
+				nextNO = &eventNext.String
+			}
+			digest = computeEventDigest(link.Seq, link.Prev, deal.NO, eventStatus.String, nextNO, eventRecorded.String)
+		} else {
+			deal.DealType = dealType.String
+			deal.DealDate = dealDate.String
+			deal.DealName = dealName.String
+			deal.DealPartner = dealPartner.String
+			deal.DealPrice = int(dealPrice.Int64)
+			deal.DealRemark = dealRemark.String
+			deal.RegDate = regDate.String
+			deal.Hash = fileHash.String
+			deal.RegUser = regUser.String
+			deal.InvoiceNumber = invoiceNumber.String
+			deal.TaxLines, taxErr = decodeTaxLines(taxBreakdown.String)
+			digest = computeDealDigest(link.Seq, link.Prev, &deal)
+		}
+
+		var reason string
+		switch {
+		case link.Seq != expectedSeq:
+			reason = fmt.Sprintf("sequence gap: expected %d, found %d (a record was removed)", expectedSeq, link.Seq)
+		case link.Prev != expectedPrev:
+			reason = "previous digest does not match the preceding record"
+		case taxErr != nil:
+			reason = "tax breakdown is not readable"
+		case link.Digest != digest && eventStatus.Valid:
+			reason = "status event digest does not match the event contents"
+		case link.Digest != digest:
+			reason = "record digest does not match the record contents"
+		case link.Seq == result.HeadSeq && link.Digest != headDigest:
+			reason = "record digest does not match the recorded chain head"
+		}
+
+		if reason != "" {
+			result.Valid = false
+			result.BrokenLink = &ChainBreak{
+				Seq:    link.Seq,
+				NO:     deal.NO,
+				Reason: reason,
+			}
+			return result, nil
+		}
+
+		if eventStatus.Valid {
+			statuses[deal.NO] = dealStatus{RecStatus: eventStatus.String, NextNO: eventNext.String}
+			result.Events++
+		}
+		result.Checked++
+		result.LastSeq = link.Seq
+		result.LastDigest = link.Digest
+		expectedSeq = link.Seq + 1
+		expectedPrev = link.Digest
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %v", err)
+	}
+
+	if result.LastSeq < result.HeadSeq {
+		result.Valid = false
+		result.BrokenLink = &ChainBreak{
+			Seq:    result.LastSeq + 1,
+			Reason: fmt.Sprintf("chain ends at %d but its head was recorded at %d (records were removed from the end)", result.LastSeq, result.HeadSeq),
+		}
+		return result, nil
+	}
+
+	if err := verifyDealStatuses(db, statuses, result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// dealStatus holds the columns of a deal record that change after it is inserted
+type dealStatus struct {
+	RecStatus string
+	NextNO    string // "" if not superseded
+}
+
+// verifyDealStatuses compares the status of each deal record with its chained status.
+// A chained record without status events must still be NEW; unchained records written
+// before the chain was introduced are only checked once they have events.
+func verifyDealStatuses(db *sql.DB, statuses map[string]dealStatus, result *ChainVerification) error {
+	type dealRecord struct {
+		dealStatus
+		NO     string
+		PrevNO string
+		Seq    int64
+	}
+
+	rows, err := db.Query(`SELECT NO, COALESCE(RecStatus, ''), COALESCE(nextNO, ''), COALESCE(prevNO, ''),
+	                       COALESCE(ChainSeq, 0) FROM Deals ORDER BY ChainSeq`)
+	if err != nil {
+		return fmt.Errorf("failed to query deal statuses: %v", err)
+	}
+	defer rows.Close()
+
+	var records []dealRecord
+	byNO := make(map[string]*dealRecord)
+	for rows.Next() {
+		var r dealRecord
+		if err := rows.Scan(&r.NO, &r.RecStatus, &r.NextNO, &r.PrevNO, &r.Seq); err != nil {
+			return fmt.Errorf("failed to scan deal status: %v", err)
+		}
+		records = append(records, r)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating rows: %v", err)
+	}
+	for i := range records {
+		byNO[records[i].NO] = &records[i]
+	}
+
+	for _, r := range records {
+		expected, hasEvents := statuses[r.NO]
+		if !hasEvents {
+			if r.Seq == 0 {
+				continue
+			}
+			expected = dealStatus{RecStatus: "NEW"}
+		}
+
+		var reason string
+		if r.dealStatus != expected {
+			reason = fmt.Sprintf("status %s does not match the chained status %s (changed outside the chain)",
+				describeDealStatus(r.dealStatus), describeDealStatus(expected))
+		} else if r.RecStatus == "UPDATE" {
+			next, exists := byNO[r.NextNO]
+			if !exists || next.Seq == 0 || next.PrevNO != r.NO {
+				reason = fmt.Sprintf("superseding record %s is missing or does not point back", r.NextNO)
+			}
+		}
+
+		if reason != "" {
+			result.Valid = false
+			result.BrokenLink = &ChainBreak{
+				Seq:    r.Seq,
+				NO:     r.NO,
+				Reason: reason,
+			}
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// describeDealStatus formats a deal status for a ChainBreak reason
+func describeDealStatus(status dealStatus) string {
+	if status.NextNO == "" {
+		return status.RecStatus
+	}
+	return status.RecStatus + " -> " + status.NextNO
+}
@@ -0,0 +1,248 @@
+package models
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVerifyDealChainDetectsRemovedHead(t *testing.T) {
+	setupTestDB(t)
+	const period = "2025"
+	db, err := ConnectToPeriod(period)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := CreateDeal(period, newTestDeal("文房具", 1100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := VerifyDealChain(period)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Valid || result.Checked != 3 || result.HeadSeq != 3 {
+		t.Fatalf("intact chain: got %+v", result)
+	}
+
+	// Dropping the last records leaves a chain that is consistent in itself
+	if _, err := db.Exec(`DELETE FROM Deals WHERE ChainSeq >= 2`); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopening the period must not move the recorded head back
+	if err := ClosePeriodDB(period); err != nil {
+		t.Fatal(err)
+	}
+	result, err = VerifyDealChain(period)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Valid || result.BrokenLink == nil || !strings.Contains(result.BrokenLink.Reason, "removed from the end") {
+		t.Fatalf("truncated chain: got %+v", result)
+	}
+	if result.HeadSeq != 3 || result.LastSeq != 1 {
+		t.Errorf("truncated chain: head %d, last %d", result.HeadSeq, result.LastSeq)
+	}
+}
+
+func TestVerifyDealChainDetectsReplacedHead(t *testing.T) {
+	setupTestDB(t)
+	const period = "2025"
+	db, err := ConnectToPeriod(period)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := CreateDeal(period, newTestDeal("交通費", 500)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Replacing the last record with a consistently rechained one is caught by the head
+	deal := newTestDeal("交通費", 50000)
+	deal.RegDate = "2025-04-01T00:00:00Z"
+	var prev string
+	if err := db.QueryRow(`SELECT ChainPrev FROM Deals WHERE ChainSeq = 2`).Scan(&prev); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`DELETE FROM Deals WHERE ChainSeq = 2`); err != nil {
+		t.Fatal(err)
+	}
+	digest := computeDealDigest(2, prev, deal)
+	if _, err := db.Exec(`INSERT INTO Deals (NO, DealType, DealDate, DealName, DealPartner, DealPrice, DealRemark,
+		RegDate, RecStatus, Hash, ChainSeq, ChainPrev, ChainDigest) VALUES (?, ?, ?, ?, ?, ?, '', ?, 'NEW', '', 2, ?, ?)`,
+		deal.NO, deal.DealType, deal.DealDate, deal.DealName, deal.DealPartner, deal.DealPrice, deal.RegDate, prev, digest); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := VerifyDealChain(period)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Valid || result.BrokenLink == nil || result.BrokenLink.Seq != 2 {
+		t.Fatalf("replaced head: got %+v", result)
+	}
+}
+
+func TestVerifyDealChainCoversStatusChanges(t *testing.T) {
+	setupTestDB(t)
+	const period = "2025"
+	db, err := ConnectToPeriod(period)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original := newTestDeal("文房具", 1100)
+	deleted := newTestDeal("交通費", 500)
+	for _, deal := range []*Deal{original, deleted} {
+		if err := CreateDeal(period, deal); err != nil {
+			t.Fatal(err)
+		}
+	}
+	updated := newTestDeal("文房具", 1210)
+	updated.PrevNO = &original.NO
+	if err := CreateDealWithHistory(period, original.NO, updated); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteDeal(period, deleted.NO); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := VerifyDealChain(period)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two records, the update event, the new version and the deletion event
+	if !result.Valid || result.Checked != 5 || result.Events != 2 || result.HeadSeq != 5 {
+		t.Fatalf("intact chain: got %+v", result)
+	}
+
+	tests := []struct {
+		name   string
+		tamper string
+		args   []interface{}
+		seq    int64
+		reason string
+	}{
+		{"undeleted", `UPDATE Deals SET RecStatus='NEW' WHERE NO=?`, []interface{}{deleted.NO}, 2, "changed outside the chain"},
+		{"deleted without event", `UPDATE Deals SET RecStatus='DELETE' WHERE NO=?`, []interface{}{updated.NO}, 4, "changed outside the chain"},
+		{"successor relinked", `UPDATE Deals SET nextNO=? WHERE NO=?`, []interface{}{deleted.NO, original.NO}, 1, "changed outside the chain"},
+		{"event removed", `DELETE FROM DealEvents WHERE DealNO=?`, []interface{}{original.NO}, 4, "sequence gap"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := db.Exec(tt.tamper, tt.args...); err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				// Restore the intact rows for the next case
+				if _, err := db.Exec(`UPDATE Deals SET RecStatus='UPDATE', nextNO=? WHERE NO=?`, updated.NO, original.NO); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := db.Exec(`UPDATE Deals SET RecStatus='NEW' WHERE NO=?`, updated.NO); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := db.Exec(`UPDATE Deals SET RecStatus='DELETE' WHERE NO=?`, deleted.NO); err != nil {
+					t.Fatal(err)
+				}
+			}()
+
+			result, err := VerifyDealChain(period)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Valid || result.BrokenLink == nil || result.BrokenLink.Seq != tt.seq ||
+				!strings.Contains(result.BrokenLink.Reason, tt.reason) {
+				t.Fatalf("got %+v, broken link %+v", result, result.BrokenLink)
+			}
+		})
+	}
+}
+
+func TestVerifyDealChainChecksSuccessor(t *testing.T) {
+	setupTestDB(t)
+	const period = "2025"
+	if _, err := ConnectToPeriod(period); err != nil {
+		t.Fatal(err)
+	}
+
+	// A superseding record whose prevNO does not point back, as a batch with a wrong reference could write
+	original := newTestDeal("文房具", 1100)
+	if err := CreateDeal(period, original); err != nil {
+		t.Fatal(err)
+	}
+	other := "20250401_999999"
+	successor := newTestDeal("文房具", 1210)
+	successor.PrevNO = &other
+	if err := CreateDealWithHistory(period, original.NO, successor); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := VerifyDealChain(period)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Valid || result.BrokenLink == nil || result.BrokenLink.NO != original.NO ||
+		!strings.Contains(result.BrokenLink.Reason, "does not point back") {
+		t.Fatalf("got %+v, broken link %+v", result, result.BrokenLink)
+	}
+}
+
+func TestComputeDealDigestKnownAnswer(t *testing.T) {
+	base := func() *Deal {
+		return &Deal{
+			NO:          "20250401_000001",
+			DealType:    "領収書",
+			DealDate:    "2025-04-01",
+			DealName:    "文房具",
+			DealPartner: "テスト商店",
+			DealPrice:   1100,
+			RegDate:     "2025-04-01T09:00:00Z",
+			Hash:        "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+		}
+	}
+
+	full := base()
+	full.RegUser = "alice"
+	full.InvoiceNumber = "T1234567890123"
+	full.TaxLines = []TaxLine{{Rate: "10", AmountIncludingTax: 1100, AmountExcludingTax: 1000, TaxAmount: 100}}
+
+	linked := base()
+	linked.RegUser = "alice"
+
+	// Expected values are SHA-256 over the length-prefixed fields "len:value;" in chain order
+	tests := []struct {
+		name string
+		seq  int64
+		prev string
+		deal *Deal
+		want string
+	}{
+		{"fields of the original chain", 1, "", base(), "4d5df23da60b5d72859398a54863b8100cdb2ef451c216a2f2b368a1ee5c559e"},
+		{"tagged optional fields", 1, "", full, "9f8c3c386f91c666a5f0d9ad0d2d17a278545aa162f775323d7e114e1ccb5e17"},
+		{"previous digest", 2, "9f86", linked, "169ee356ed0b1de67675b0d6df3d68a7d9317fe9e4a77e2947d1dc74be5da3e8"},
+	}
+	for _, tt := range tests {
+		if got := computeDealDigest(tt.seq, tt.prev, tt.deal); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestComputeDealDigestOptionalFieldsAreDistinct(t *testing.T) {
+	asUser := &Deal{NO: "1", RegUser: "invoice:T1234567890123"}
+	asInvoice := &Deal{NO: "1", InvoiceNumber: "T1234567890123"}
+	if computeDealDigest(1, "", asUser) == computeDealDigest(1, "", asInvoice) {
+		t.Error("a user name that looks like a tagged field gives the same digest as that field")
+	}
+
+	taxUser := &Deal{NO: "1", RegUser: "tax:10/1100/1000/100"}
+	taxLine := &Deal{NO: "1", TaxLines: []TaxLine{{Rate: "10", AmountIncludingTax: 1100, AmountExcludingTax: 1000, TaxAmount: 100}}}
+	if computeDealDigest(1, "", taxUser) == computeDealDigest(1, "", taxLine) {
+		t.Error("a user name that looks like a tax breakdown gives the same digest as the breakdown")
+	}
+}
@@ -3,21 +3,28 @@ package models
 import (
 	"database/sql"
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
 	_ "modernc.org/sqlite"
 )
 
+// Period databases are shared by all requests and selected explicitly by period name;
+// there is no "current" period, so requests for different periods cannot interfere.
 var (
 	dbConnections map[string]*sql.DB
-	currentDB     *sql.DB
-	currentPeriod string
-	systemDB      *sql.DB  // System.db connection
+	systemDB      *sql.DB // System.db connection
 	dbMutex       sync.RWMutex
 	basePath      string
+
+	// periodOpenLocks serializes opening each period database, so the schema setup of
+	// one period runs without holding dbMutex and does not block the other periods
+	periodOpenLocks   = map[string]*sync.Mutex{}
+	periodOpenLocksMu sync.Mutex
 )
 
 // GetBasePath returns the base path for data storage
@@ -27,22 +34,20 @@ func GetBasePath() string {
 
 // ClosePeriodDB closes database connection for a specific period
 func ClosePeriodDB(period string) error {
+	// Wait for an open in progress, so it cannot store the connection after the close
+	openLock := periodOpenLock(period)
+	openLock.Lock()
+	defer openLock.Unlock()
+
 	dbMutex.Lock()
 	defer dbMutex.Unlock()
 
 	if db, exists := dbConnections[period]; exists {
 		err := db.Close()
 		delete(dbConnections, period)
-		
-		// If this was the current period, reset current connection
-		if currentPeriod == period {
-			currentDB = nil
-			currentPeriod = ""
-		}
-		
 		return err
 	}
-	
+
 	return nil // No connection to close
 }
 
@@ -52,7 +57,7 @@ func CloseAllPeriodDBs() error {
 	defer dbMutex.Unlock()
 
 	var lastErr error
-	
+
 	// Close all period database connections
 	for period, db := range dbConnections {
 		if err := db.Close(); err != nil {
@@ -60,14 +65,18 @@ func CloseAllPeriodDBs() error {
 		}
 		delete(dbConnections, period)
 	}
-	
-	// Reset current connection
-	currentDB = nil
-	currentPeriod = ""
-	
+
 	return lastErr
 }
 
+// sqliteDSN returns the data source name used for all databases.
+// modernc.org/sqlite applies pragmas through _pragma parameters; every pooled connection
+// waits for locks instead of failing with SQLITE_BUSY, and transactions take the write
+// lock when they begin so that concurrent read-then-write transactions cannot deadlock.
+func sqliteDSN(path string) string {
+	return path + "?_pragma=journal_mode(WAL)&_pragma=busy_timeout(30000)&_txlock=immediate"
+}
+
 func InitDB(path string) error {
 	basePath = path
 	dbConnections = make(map[string]*sql.DB)
@@ -86,8 +95,8 @@ func InitDB(path string) error {
 
 func initSystemDB() error {
 	systemDBPath := filepath.Join(basePath, "System.db")
-	
-	db, err := sql.Open("sqlite", systemDBPath+"?_journal_mode=WAL&_busy_timeout=30000")
+
+	db, err := sql.Open("sqlite", sqliteDSN(systemDBPath))
 	if err != nil {
 		return fmt.Errorf("failed to open system database: %v", err)
 	}
@@ -100,33 +109,97 @@ func initSystemDB() error {
 		"created" TEXT,
 		"updated" TEXT
 	)`
-	
+
 	if _, err := db.Exec(query); err != nil {
 		db.Close()
 		return fmt.Errorf("failed to create Periods table: %v", err)
 	}
 
 	// Create DealPartners table in System.db
+	// Partners have a stable id; renames are recorded in DealPartnerNames
 	partnerQuery := `CREATE TABLE IF NOT EXISTS "DealPartners" (
-		"name" TEXT PRIMARY KEY
+		"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+		"name" TEXT NOT NULL UNIQUE,
+		"created" TEXT,
+		"updated" TEXT
 	)`
-	
+
 	if _, err := db.Exec(partnerQuery); err != nil {
 		db.Close()
 		return fmt.Errorf("failed to create DealPartners table: %v", err)
 	}
 
+	partnerNameQuery := `CREATE TABLE IF NOT EXISTS "DealPartnerNames" (
+		"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+		"partnerId" INTEGER NOT NULL,
+		"name" TEXT NOT NULL,
+		"validFrom" TEXT NOT NULL,
+		"validTo" TEXT
+	)`
+
+	if _, err := db.Exec(partnerNameQuery); err != nil {
+		db.Close()
+		return fmt.Errorf("failed to create DealPartnerNames table: %v", err)
+	}
+
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_partner_name ON DealPartnerNames(name)`); err != nil {
+		db.Close()
+		return fmt.Errorf("failed to create DealPartnerNames index: %v", err)
+	}
+
+	if err := migrateDealPartnersTable(db); err != nil {
+		db.Close()
+		return err
+	}
+
+	if err := addMissingColumns(db, "DealPartners", partnerColumnMigrations); err != nil {
+		db.Close()
+		return err
+	}
+
+	if err := createAuditLogTable(db); err != nil {
+		db.Close()
+		return err
+	}
+
+	if err := createUserTables(db); err != nil {
+		db.Close()
+		return err
+	}
+
+	if err := createBlobTable(db); err != nil {
+		db.Close()
+		return err
+	}
+	if err := createUploadTable(db); err != nil {
+		db.Close()
+		return err
+	}
+	if err := createIntegrityTable(db); err != nil {
+		db.Close()
+		return err
+	}
+	if err := createChainHeadTable(db); err != nil {
+		db.Close()
+		return err
+	}
+
 	// Create System table in System.db (for app version info)
 	systemQuery := `CREATE TABLE IF NOT EXISTS "System" (
 		"AppVersion" TEXT,
 		"SQLiteLibraryVersion" TEXT
 	)`
-	
+
 	if _, err := db.Exec(systemQuery); err != nil {
 		db.Close()
 		return fmt.Errorf("failed to create System table: %v", err)
 	}
 
+	if err := addMissingColumns(db, "System", systemColumnMigrations); err != nil {
+		db.Close()
+		return err
+	}
+
 	// Initialize System table if empty
 	var count int
 	err = db.QueryRow("SELECT COUNT(*) FROM System").Scan(&count)
@@ -159,59 +232,111 @@ func GetSystemDB() (*sql.DB, error) {
 	return systemDB, nil
 }
 
-func ConnectToPeriod(period string) error {
-	fmt.Printf("ConnectToPeriod: Starting connection to period %s\n", period)
-	
-	dbMutex.Lock()
-	defer dbMutex.Unlock()
+// ConnectToPeriod opens the database of a period, creating the period directory and
+// database if they do not exist yet, and returns the connection.
+func ConnectToPeriod(period string) (*sql.DB, error) {
+	return openPeriodDB(period, true)
+}
 
-	if db, exists := dbConnections[period]; exists {
-		fmt.Printf("ConnectToPeriod: Using existing connection for period %s\n", period)
-		currentDB = db
-		currentPeriod = period
-		return nil
+// ConnectPeriodDB returns the connection of an existing period database
+func ConnectPeriodDB(period string) (*sql.DB, error) {
+	return openPeriodDB(period, false)
+}
+
+// periodOpenLock returns the lock that serializes opening the database of a period
+func periodOpenLock(period string) *sync.Mutex {
+	periodOpenLocksMu.Lock()
+	defer periodOpenLocksMu.Unlock()
+
+	lock, exists := periodOpenLocks[period]
+	if !exists {
+		lock = &sync.Mutex{}
+		periodOpenLocks[period] = lock
+	}
+	return lock
+}
+
+// lookupPeriodDB returns the open connection of a period, if any
+func lookupPeriodDB(period string) (*sql.DB, bool) {
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+
+	db, exists := dbConnections[period]
+	return db, exists
+}
+
+// openPeriodDB returns the shared connection of a period database, opening it on first use.
+// The schema setup runs under the lock of the period only; dbMutex is held just to store
+// the connection.
+func openPeriodDB(period string, create bool) (*sql.DB, error) {
+	if err := ValidatePeriodName(period); err != nil {
+		return nil, err
+	}
+
+	if db, exists := lookupPeriodDB(period); exists {
+		return db, nil
+	}
+
+	openLock := periodOpenLock(period)
+	openLock.Lock()
+	defer openLock.Unlock()
+
+	// Another request may have opened the database while this one waited
+	if db, exists := lookupPeriodDB(period); exists {
+		return db, nil
+	}
+
+	system, err := GetSystemDB()
+	if err != nil {
+		return nil, err
 	}
 
 	periodPath := filepath.Join(basePath, period)
-	fmt.Printf("ConnectToPeriod: Period path: %s\n", periodPath)
-	
-	// Create period directory if it doesn't exist
-	if _, err := os.Stat(periodPath); os.IsNotExist(err) {
-		fmt.Printf("ConnectToPeriod: Creating period directory: %s\n", periodPath)
-		if err := os.MkdirAll(periodPath, 0755); err != nil {
-			return fmt.Errorf("failed to create period directory: %v", err)
+	dbPath := filepath.Join(periodPath, "Denchokun.db")
+
+	if create {
+		// Create period directory if it doesn't exist; the database is created by SQLite
+		if _, err := os.Stat(periodPath); os.IsNotExist(err) {
+			log.Printf("Creating period directory: %s", periodPath)
+			if err := os.MkdirAll(periodPath, 0755); err != nil {
+				return nil, fmt.Errorf("failed to create period directory: %v", err)
+			}
 		}
+	} else if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+		return nil, fmt.Errorf("database for period %s does not exist", period)
 	}
 
-	dbPath := filepath.Join(periodPath, "Denchokun.db")
-	fmt.Printf("ConnectToPeriod: Database path: %s\n", dbPath)
-	
-	// Database will be created if it doesn't exist (SQLite behavior)
-	
-	db, err := sql.Open("sqlite", dbPath+"?_journal_mode=WAL&_busy_timeout=30000")
+	db, err := sql.Open("sqlite", sqliteDSN(dbPath))
 	if err != nil {
-		return fmt.Errorf("failed to open database: %v", err)
+		return nil, fmt.Errorf("failed to open database: %v", err)
 	}
 
 	db.SetMaxOpenConns(25)
 	db.SetMaxIdleConns(5)
 	db.SetConnMaxLifetime(time.Hour)
 
-	fmt.Printf("ConnectToPeriod: Setting up database for period %s\n", period)
-	if err := setupDatabase(db); err != nil {
+	if err := setupDatabase(db, system); err != nil {
 		db.Close()
-		return fmt.Errorf("failed to setup database: %v", err)
+		return nil, fmt.Errorf("failed to setup database: %v", err)
 	}
 
+	dbMutex.Lock()
 	dbConnections[period] = db
-	currentDB = db
-	currentPeriod = period
+	dbMutex.Unlock()
 
-	return nil
+	// Record the chain head of deals inserted before it was recorded or while a recording failed
+	if err := recordChainHead(system, db, period); err != nil {
+		log.Printf("Failed to record chain head of period %s: %v", period, err)
+	}
+
+	// Extract the text of files saved before text extraction or while the server was down
+	scheduleTextExtraction(period)
+	return db, nil
 }
 
-func setupDatabase(db *sql.DB) error {
-	fmt.Println("setupDatabase: Starting database setup")
+// setupDatabase creates and migrates the schema of a period database.
+// system is System.db, used to link deals to their partners.
+func setupDatabase(db, system *sql.DB) error {
 	queries := []string{
 		`CREATE TABLE IF NOT EXISTS "Deals" (
 			"NO" TEXT NOT NULL UNIQUE,
@@ -243,71 +368,161 @@ func setupDatabase(db *sql.DB) error {
 		`CREATE INDEX IF NOT EXISTS idx_deal_date ON Deals(DealDate)`,
 		`CREATE INDEX IF NOT EXISTS idx_deal_partner ON Deals(DealPartner)`,
 		`CREATE INDEX IF NOT EXISTS idx_deal_type ON Deals(DealType)`,
+		`CREATE TABLE IF NOT EXISTS "Timestamps" (
+			"DealNO" TEXT NOT NULL,
+			"Hash" TEXT NOT NULL,
+			"HashAlgorithm" TEXT NOT NULL,
+			"Token" BLOB NOT NULL,
+			"GenTime" TEXT,
+			"SerialNumber" TEXT,
+			"Policy" TEXT,
+			"Authority" TEXT,
+			"Created" TEXT,
+			PRIMARY KEY("DealNO")
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_timestamp_hash ON Timestamps(Hash)`,
+		`CREATE TABLE IF NOT EXISTS "AttachmentTimestamps" (
+			"AttachmentID" INTEGER NOT NULL,
+			"DealNO" TEXT NOT NULL,
+			"Hash" TEXT NOT NULL,
+			"HashAlgorithm" TEXT NOT NULL,
+			"Token" BLOB NOT NULL,
+			"GenTime" TEXT,
+			"SerialNumber" TEXT,
+			"Policy" TEXT,
+			"Authority" TEXT,
+			"Created" TEXT,
+			PRIMARY KEY("AttachmentID")
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_attachment_timestamp_hash ON AttachmentTimestamps(Hash)`,
+		`CREATE TABLE IF NOT EXISTS "Attachments" (
+			"ID" INTEGER PRIMARY KEY AUTOINCREMENT,
+			"DealNO" TEXT NOT NULL,
+			"Role" TEXT NOT NULL DEFAULT 'other',
+			"OriginalName" TEXT NOT NULL DEFAULT '',
+			"StoredPath" TEXT NOT NULL,
+			"Hash" TEXT NOT NULL,
+			"Size" INTEGER NOT NULL DEFAULT 0,
+			"MimeType" TEXT NOT NULL DEFAULT '',
+			"Uploaded" TEXT,
+			"UploadedBy" TEXT NOT NULL DEFAULT '',
+			"Status" TEXT NOT NULL DEFAULT 'ACTIVE',
+			"Removed" TEXT,
+			"RemovedBy" TEXT
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_attachment_deal ON Attachments(DealNO)`,
+		`CREATE INDEX IF NOT EXISTS idx_attachment_hash ON Attachments(Hash)`,
+		`CREATE TABLE IF NOT EXISTS "DealEvents" (
+			"ChainSeq" INTEGER PRIMARY KEY,
+			"ChainPrev" TEXT NOT NULL,
+			"ChainDigest" TEXT NOT NULL,
+			"DealNO" TEXT NOT NULL,
+			"RecStatus" TEXT NOT NULL,
+			"nextNO" TEXT,
+			"Recorded" TEXT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_deal_event_no ON DealEvents(DealNO)`,
 	}
 
 	for i, query := range queries {
-		fmt.Printf("setupDatabase: Executing query %d\n", i+1)
 		if _, err := db.Exec(query); err != nil {
-			fmt.Printf("setupDatabase: Query %d failed: %v\n", i+1, err)
+			log.Printf("setupDatabase: Query %d failed: %v", i+1, err)
 			return err
 		}
 	}
 
-	fmt.Println("setupDatabase: Database setup completed successfully")
-	return nil
-}
+	if err := addMissingColumns(db, "Deals", dealsColumnMigrations); err != nil {
+		log.Printf("setupDatabase: Column migration failed: %v", err)
+		return err
+	}
 
-func GetDB() (*sql.DB, error) {
-	dbMutex.RLock()
-	defer dbMutex.RUnlock()
+	// Indexes on migrated columns must be created after the columns exist
+	migratedIndexes := []string{
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_chain_seq ON Deals(ChainSeq)`,
+		`CREATE INDEX IF NOT EXISTS idx_deal_partner_id ON Deals(PartnerID)`,
+	}
+	for _, query := range migratedIndexes {
+		if _, err := db.Exec(query); err != nil {
+			log.Printf("setupDatabase: Index creation failed: %v", err)
+			return err
+		}
+	}
 
-	if currentDB == nil {
-		return nil, fmt.Errorf("no database connection")
+	if err := setupDealSearch(db); err != nil {
+		log.Printf("setupDatabase: Search index setup failed: %v", err)
+		return err
 	}
 
-	return currentDB, nil
-}
+	if err := setupFileTexts(db); err != nil {
+		log.Printf("setupDatabase: File text table setup failed: %v", err)
+		return err
+	}
 
-func GetCurrentPeriod() string {
-	dbMutex.RLock()
-	defer dbMutex.RUnlock()
-	return currentPeriod
-}
+	if err := backfillDealPartnerIDs(db, system); err != nil {
+		log.Printf("setupDatabase: Partner ID backfill failed: %v", err)
+		return err
+	}
 
-func ConnectPeriodDB(period string) (*sql.DB, error) {
-	dbMutex.Lock()
-	defer dbMutex.Unlock()
+	return nil
+}
 
-	// Check if already connected
-	if db, exists := dbConnections[period]; exists {
-		return db, nil
-	}
+// columnDef describes a column added to an existing table by migration
+type columnDef struct {
+	Name       string
+	Definition string
+}
 
-	// Connect to the period database
-	periodPath := filepath.Join(basePath, period)
-	dbPath := filepath.Join(periodPath, "Denchokun.db")
-	
-	// Check if database exists
-	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
-		return nil, fmt.Errorf("database for period %s does not exist", period)
-	}
+// dealsColumnMigrations lists the columns added to Deals after the original schema.
+// Older Denchokun.db files get them through ALTER TABLE when they are opened.
+var dealsColumnMigrations = []columnDef{
+	{"ChainSeq", "INTEGER"},
+	{"ChainPrev", "TEXT"},
+	{"ChainDigest", "TEXT"},
+	{"PartnerID", "INTEGER"},
+	{"RegUser", "TEXT DEFAULT ''"},
+	{"InvoiceNumber", "TEXT DEFAULT ''"},
+	{"TaxRate", "TEXT DEFAULT ''"},
+	{"PriceExcludingTax", "INTEGER DEFAULT 0"},
+	{"TaxAmount", "INTEGER DEFAULT 0"},
+	{"TaxBreakdown", "TEXT DEFAULT ''"},
+	{"FileStore", "TEXT DEFAULT ''"},
+	{"OriginalFileName", "TEXT DEFAULT ''"},
+	{"ClientPath", "TEXT DEFAULT ''"},
+	{"FileUploaded", "TEXT DEFAULT ''"},
+	{"MimeType", "TEXT DEFAULT ''"},
+}
 
-	db, err := sql.Open("sqlite", dbPath+"?_journal_mode=WAL&_busy_timeout=30000")
+// addMissingColumns adds the given columns to a table if they do not exist yet
+func addMissingColumns(db *sql.DB, table string, columns []columnDef) error {
+	rows, err := db.Query(fmt.Sprintf(`PRAGMA table_info("%s")`, table))
 	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %v", err)
+		return fmt.Errorf("failed to read columns of %s: %v", table, err)
 	}
 
-	db.SetMaxOpenConns(25)
-	db.SetMaxIdleConns(5)
-	db.SetConnMaxLifetime(time.Hour)
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan column of %s: %v", table, err)
+		}
+		existing[strings.ToLower(name)] = true
+	}
+	rows.Close()
 
-	if err := setupDatabase(db); err != nil {
-		db.Close()
-		return nil, fmt.Errorf("failed to setup database: %v", err)
+	for _, column := range columns {
+		if existing[strings.ToLower(column.Name)] {
+			continue
+		}
+		query := fmt.Sprintf(`ALTER TABLE "%s" ADD COLUMN "%s" %s`, table, column.Name, column.Definition)
+		if _, err := db.Exec(query); err != nil {
+			return fmt.Errorf("failed to add column %s.%s: %v", table, column.Name, err)
+		}
 	}
 
-	dbConnections[period] = db
-	return db, nil
+	return nil
 }
 
 func GetAvailablePeriods() ([]string, error) {
@@ -340,8 +555,6 @@ func CloseAllConnections() {
 		db.Close()
 	}
 	dbConnections = make(map[string]*sql.DB)
-	currentDB = nil
-	currentPeriod = ""
 }
 
 // MigrateToSystemDB migrates DealPartners and System tables from period DBs to System.db
@@ -415,6 +628,10 @@ func MigrateToSystemDB() error {
 		return fmt.Errorf("failed to commit transaction: %v", err)
 	}
 
+	if err := ensurePartnerNameHistory(systemDB); err != nil {
+		return err
+	}
+
 	// Now migrate System table data (if it exists in any period DB)
 	// We'll take the latest version info from any period DB
 	var latestAppVersion, latestSQLiteVersion string
@@ -496,4 +713,4 @@ func UpdateSystemInfo(appVersion, sqliteVersion string) error {
 	}
 
 	return nil
-}
\ No newline at end of file
+}
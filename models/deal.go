@@ -3,53 +3,92 @@ package models
 import (
 	"database/sql"
 	"fmt"
-	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 )
 
 type Deal struct {
-	NO          string  `json:"NO"`
-	NextNO      *string `json:"nextNO,omitempty"`
-	PrevNO      *string `json:"prevNO,omitempty"`
-	DealType    string  `json:"DealType"`
-	DealDate    string  `json:"DealDate"`
-	DealName    string  `json:"DealName"`
-	DealPartner string  `json:"DealPartner"`
-	DealPrice   int     `json:"DealPrice"`
-	DealRemark  string  `json:"DealRemark"`
-	RecUpdate   string  `json:"RecUpdate"`
-	RegDate     string  `json:"RegDate"`
-	RecStatus   string  `json:"RecStatus"`
-	FilePath    string  `json:"FilePath"`
-	Hash        string  `json:"Hash"`
+	NO                string    `json:"NO"`
+	NextNO            *string   `json:"nextNO,omitempty"`
+	PrevNO            *string   `json:"prevNO,omitempty"`
+	DealType          string    `json:"DealType"`
+	DealDate          string    `json:"DealDate"`
+	DealName          string    `json:"DealName"`
+	DealPartner       string    `json:"DealPartner"`
+	DealPrice         int       `json:"DealPrice"` // tax-inclusive amount
+	DealRemark        string    `json:"DealRemark"`
+	RecUpdate         string    `json:"RecUpdate"`
+	RegDate           string    `json:"RegDate"`
+	RecStatus         string    `json:"RecStatus"`
+	FilePath          string    `json:"FilePath"`
+	Hash              string    `json:"Hash"`
+	FileStore         string    `json:"FileStore,omitempty"` // "blob" when the file is in the blob store, empty for the period folder
+	PartnerID         *int64    `json:"PartnerID,omitempty"` // stable partner ID; DealPartner keeps the name as entered
+	RegUser           string    `json:"RegUser"`             // user who registered this record
+	InvoiceNumber     string    `json:"InvoiceNumber"`       // partner's invoice registration number on the deal date
+	TaxRate           string    `json:"TaxRate"`             // "10", "8", "exempt", "out_of_scope", "mixed", or empty if not broken down
+	PriceExcludingTax int       `json:"PriceExcludingTax"`
+	TaxAmount         int       `json:"TaxAmount"`
+	TaxLines          []TaxLine `json:"TaxLines,omitempty"`         // one line per tax rate
+	OriginalFileName  string    `json:"OriginalFileName,omitempty"` // file name as uploaded; FilePath is generated from the deal
+	ClientPath        string    `json:"ClientPath,omitempty"`       // path of the file on the client, if reported
+	FileUploaded      string    `json:"FileUploaded,omitempty"`     // when the file was uploaded
+	MimeType          string    `json:"MimeType,omitempty"`         // detected MIME type of the file
+}
+
+// dealColumns is the column list read by scanDeal
+const dealColumns = `NO, nextNO, prevNO, DealType, DealDate, DealName, DealPartner,
+	DealPrice, DealRemark, RecUpdate, RegDate, RecStatus, FilePath, Hash, PartnerID, RegUser, InvoiceNumber,
+	TaxRate, PriceExcludingTax, TaxAmount, TaxBreakdown, COALESCE(FileStore, ''),
+	COALESCE(OriginalFileName, ''), COALESCE(ClientPath, ''), COALESCE(FileUploaded, ''), COALESCE(MimeType, '')`
+
+// scanDeal scans a row selected with dealColumns
+func scanDeal(row rowScanner, deal *Deal) error {
+	var breakdown string
+	err := row.Scan(
+		&deal.NO, &deal.NextNO, &deal.PrevNO, &deal.DealType, &deal.DealDate,
+		&deal.DealName, &deal.DealPartner, &deal.DealPrice, &deal.DealRemark,
+		&deal.RecUpdate, &deal.RegDate, &deal.RecStatus, &deal.FilePath, &deal.Hash, &deal.PartnerID, &deal.RegUser, &deal.InvoiceNumber,
+		&deal.TaxRate, &deal.PriceExcludingTax, &deal.TaxAmount, &breakdown, &deal.FileStore,
+		&deal.OriginalFileName, &deal.ClientPath, &deal.FileUploaded, &deal.MimeType)
+	if err != nil {
+		return err
+	}
+
+	deal.TaxLines, err = decodeTaxLines(breakdown)
+	return err
 }
 
 type DealFilter struct {
-	Period    string `form:"period" binding:"required"`
-	FromDate  string `form:"from_date"`
-	ToDate    string `form:"to_date"`
-	Partner   string `form:"partner"`
-	Type      string `form:"type"`
-	Keyword   string `form:"keyword"`
-	View      string `form:"view"`  // "flat" or "history", default is "flat"
-	Limit     int    `form:"limit"`
-	Offset    int    `form:"offset"`
+	Period       string `form:"period" binding:"required"`
+	FromDate     string `form:"from_date"`
+	ToDate       string `form:"to_date"`
+	MinPrice     *int   `form:"min_price"`
+	MaxPrice     *int   `form:"max_price"`
+	TaxRate      string `form:"tax_rate"` // a tax rate, "mixed", or "unspecified" for deals without a breakdown
+	Partner      string `form:"partner"`
+	PartnerMatch string `form:"partner_match"` // "partial" or "exact", default is "partial"
+	PartnerID    *int64 `form:"partner_id"`    // matches deals of the partner under any of its names
+	Type         string `form:"type"`
+	Keyword      string `form:"keyword"`
+	Operator     string `form:"operator"` // "and" or "or", default is "and"
+	View         string `form:"view"`     // "flat" or "history", default is "flat"
+	Limit        int    `form:"limit"`
+	Offset       int    `form:"offset"`
 }
 
 // DealWithHistory represents a deal with its update history
 type DealWithHistory struct {
 	Deal
-	BaseNO      string  `json:"baseNO"`
-	HasChildren bool    `json:"hasChildren"`
-	ChildCount  int     `json:"childCount"`
-	Children    []Deal  `json:"children,omitempty"`
+	BaseNO      string `json:"baseNO"`
+	HasChildren bool   `json:"hasChildren"`
+	ChildCount  int    `json:"childCount"`
+	Children    []Deal `json:"children,omitempty"`
 }
 
-func CreateDeal(deal *Deal) error {
-	db, err := GetDB()
+func CreateDeal(period string, deal *Deal) error {
+	db, err := ConnectPeriodDB(period)
 	if err != nil {
 		return err
 	}
@@ -74,39 +113,148 @@ func CreateDeal(deal *Deal) error {
 	deal.RecUpdate = now
 	deal.RegDate = now
 
-	query := `INSERT INTO Deals (NO, nextNO, prevNO, DealType, DealDate, DealName, 
-			  DealPartner, DealPrice, DealRemark, RecUpdate, RegDate, RecStatus, FilePath, Hash)
-			  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	if err := retainDealBlob(deal); err != nil {
+		return err
+	}
 
-	_, err = tx.Exec(query, deal.NO, deal.NextNO, deal.PrevNO, deal.DealType, deal.DealDate,
-		deal.DealName, deal.DealPartner, deal.DealPrice, deal.DealRemark,
-		deal.RecUpdate, deal.RegDate, deal.RecStatus, deal.FilePath, deal.Hash)
-	if err != nil {
+	if err := insertDeal(tx, deal); err != nil {
+		releaseDealBlob(deal)
 		return fmt.Errorf("failed to insert deal: %v", err)
 	}
 
 	if err = tx.Commit(); err != nil {
+		releaseDealBlob(deal)
 		return fmt.Errorf("failed to commit transaction: %v", err)
 	}
 
+	anchorChainHead(period)
+	scheduleTextExtraction(period)
+	return nil
+}
+
+// CreateDeals creates deals in one period in a single transaction: either all of them
+// are created or none. Their RegDate and RecUpdate are kept if set.
+func CreateDeals(period string, deals []*Deal) error {
+	db, err := ConnectPeriodDB(period)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var retained []*Deal
+	release := func() {
+		for _, deal := range retained {
+			releaseDealBlob(deal)
+		}
+	}
+
+	now := time.Now().Format("2006-01-02T15:04:05Z")
+	for _, deal := range deals {
+		var exists int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM Deals WHERE NO = ?", deal.NO).Scan(&exists); err != nil {
+			release()
+			return fmt.Errorf("failed to check existence: %v", err)
+		}
+		if exists > 0 {
+			release()
+			return fmt.Errorf("deal number already exists: %s", deal.NO)
+		}
+
+		if deal.RegDate == "" {
+			deal.RegDate = now
+		}
+		if deal.RecUpdate == "" {
+			deal.RecUpdate = now
+		}
+
+		if err := retainDealBlob(deal); err != nil {
+			release()
+			return err
+		}
+		retained = append(retained, deal)
+
+		if err := insertDeal(tx, deal); err != nil {
+			release()
+			return fmt.Errorf("failed to insert deal %s: %v", deal.NO, err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		release()
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	anchorChainHead(period)
+	scheduleTextExtraction(period)
+	return nil
+}
+
+// insertDeal inserts a deal record in tx and links it into the period's hash chain
+func insertDeal(tx *sql.Tx, deal *Deal) error {
+	// Link the deal to the partner that currently carries the entered name
+	if deal.PartnerID == nil && deal.DealPartner != "" {
+		partnerID, err := ResolvePartnerID(deal.DealPartner, deal.RegDate)
+		if err != nil {
+			return err
+		}
+		deal.PartnerID = partnerID
+	}
+
+	// Record the registration number that was effective on the deal date
+	if err := resolveInvoiceNumber(deal); err != nil {
+		return err
+	}
+
+	if err := NormalizeDealTax(deal); err != nil {
+		return err
+	}
+	taxBreakdown, err := encodeTaxLines(deal.TaxLines)
+	if err != nil {
+		return err
+	}
+
+	link, err := nextChainLink(tx, deal)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO Deals (NO, nextNO, prevNO, DealType, DealDate, DealName, 
+			  DealPartner, DealPrice, DealRemark, RecUpdate, RegDate, RecStatus, FilePath, Hash,
+			  PartnerID, RegUser, InvoiceNumber, TaxRate, PriceExcludingTax, TaxAmount, TaxBreakdown,
+			  FileStore, ChainSeq, ChainPrev, ChainDigest, OriginalFileName, ClientPath, FileUploaded, MimeType)
+			  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	_, err = tx.Exec(query, deal.NO, deal.NextNO, deal.PrevNO, deal.DealType, deal.DealDate,
+		deal.DealName, deal.DealPartner, deal.DealPrice, deal.DealRemark,
+		deal.RecUpdate, deal.RegDate, deal.RecStatus, deal.FilePath, deal.Hash,
+		deal.PartnerID, deal.RegUser, deal.InvoiceNumber, deal.TaxRate, deal.PriceExcludingTax, deal.TaxAmount, taxBreakdown,
+		deal.FileStore, link.Seq, link.Prev, link.Digest, deal.OriginalFileName, deal.ClientPath, deal.FileUploaded, deal.MimeType)
+	if err != nil {
+		return err
+	}
+
+	// The chain expects a record to start as NEW; any other status is chained as a change
+	if deal.RecStatus != "NEW" || deal.NextNO != nil {
+		return recordDealEvent(tx, deal.NO, deal.RecStatus, deal.NextNO, deal.RecUpdate)
+	}
 	return nil
 }
 
-func GetDealByID(dealID string) (*Deal, error) {
-	db, err := GetDB()
+func GetDealByID(period string, dealID string) (*Deal, error) {
+	db, err := ConnectPeriodDB(period)
 	if err != nil {
 		return nil, err
 	}
 
 	deal := &Deal{}
-	query := `SELECT NO, nextNO, prevNO, DealType, DealDate, DealName, DealPartner, 
-			  DealPrice, DealRemark, RecUpdate, RegDate, RecStatus, FilePath, Hash 
-			  FROM Deals WHERE NO = ?`
+	query := "SELECT " + dealColumns + " FROM Deals WHERE NO = ?"
 
-	err = db.QueryRow(query, dealID).Scan(
-		&deal.NO, &deal.NextNO, &deal.PrevNO, &deal.DealType, &deal.DealDate,
-		&deal.DealName, &deal.DealPartner, &deal.DealPrice, &deal.DealRemark,
-		&deal.RecUpdate, &deal.RegDate, &deal.RecStatus, &deal.FilePath, &deal.Hash)
+	err = scanDeal(db.QueryRow(query, dealID), deal)
 
 	if err == sql.ErrNoRows {
 		return nil, fmt.Errorf("deal not found: %s", dealID)
@@ -119,7 +267,7 @@ func GetDealByID(dealID string) (*Deal, error) {
 }
 
 func GetDeals(filter *DealFilter) ([]Deal, int, error) {
-	db, err := GetDB()
+	db, err := ConnectPeriodDB(filter.Period)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -129,9 +277,8 @@ func GetDeals(filter *DealFilter) ([]Deal, int, error) {
 		filter.View = "flat"
 	}
 
-	query := "SELECT NO, nextNO, prevNO, DealType, DealDate, DealName, DealPartner, DealPrice, DealRemark, RecUpdate, RegDate, RecStatus, FilePath, Hash FROM Deals WHERE 1=1"
+	query := "SELECT " + dealColumns + " FROM Deals WHERE 1=1"
 	countQuery := "SELECT COUNT(*) FROM Deals WHERE 1=1"
-	args := []interface{}{}
 
 	// Add view-specific conditions
 	if filter.View == "flat" {
@@ -140,35 +287,9 @@ func GetDeals(filter *DealFilter) ([]Deal, int, error) {
 		countQuery += " AND (RecStatus = 'NEW' OR RecStatus = 'DELETE') AND nextNO IS NULL"
 	}
 
-	if filter.FromDate != "" {
-		query += " AND DealDate >= ?"
-		countQuery += " AND DealDate >= ?"
-		args = append(args, filter.FromDate)
-	}
-
-	if filter.ToDate != "" {
-		query += " AND DealDate <= ?"
-		countQuery += " AND DealDate <= ?"
-		args = append(args, filter.ToDate)
-	}
-
-	if filter.Partner != "" {
-		query += " AND DealPartner LIKE ?"
-		countQuery += " AND DealPartner LIKE ?"
-		args = append(args, "%"+filter.Partner+"%")
-	}
-
-	if filter.Type != "" {
-		query += " AND DealType = ?"
-		countQuery += " AND DealType = ?"
-		args = append(args, filter.Type)
-	}
-
-	if filter.Keyword != "" {
-		query += " AND (DealName LIKE ? OR DealRemark LIKE ? OR DealPartner LIKE ?)"
-		countQuery += " AND (DealName LIKE ? OR DealRemark LIKE ? OR DealPartner LIKE ?)"
-		args = append(args, "%"+filter.Keyword+"%", "%"+filter.Keyword+"%", "%"+filter.Keyword+"%")
-	}
+	conditions, args := buildDealConditions(filter)
+	query += conditions
+	countQuery += conditions
 
 	var totalCount int
 	countArgs := make([]interface{}, len(args))
@@ -202,10 +323,7 @@ func GetDeals(filter *DealFilter) ([]Deal, int, error) {
 	deals := []Deal{}
 	for rows.Next() {
 		deal := Deal{}
-		err := rows.Scan(
-			&deal.NO, &deal.NextNO, &deal.PrevNO, &deal.DealType, &deal.DealDate,
-			&deal.DealName, &deal.DealPartner, &deal.DealPrice, &deal.DealRemark,
-			&deal.RecUpdate, &deal.RegDate, &deal.RecStatus, &deal.FilePath, &deal.Hash)
+		err := scanDeal(rows, &deal)
 		if err != nil {
 			return nil, 0, fmt.Errorf("failed to scan deal: %v", err)
 		}
@@ -215,88 +333,183 @@ func GetDeals(filter *DealFilter) ([]Deal, int, error) {
 	return deals, totalCount, nil
 }
 
-func UpdateDeal(dealID string, deal *Deal) error {
-	db, err := GetDB()
+// ForEachDeal calls fn for each deal matching filter in date order without loading them all.
+// Unlike GetDeals there is no default row limit; the "history" view includes every
+// version of each deal. It stops at the first error returned by fn.
+func ForEachDeal(filter *DealFilter, fn func(deal *Deal) error) error {
+	db, err := ConnectPeriodDB(filter.Period)
 	if err != nil {
 		return err
 	}
 
-	tx, err := db.Begin()
-	if err != nil {
-		return fmt.Errorf("failed to start transaction: %v", err)
+	query := "SELECT " + dealColumns + " FROM Deals WHERE 1=1"
+	if filter.View != "history" {
+		query += " AND (RecStatus = 'NEW' OR RecStatus = 'DELETE') AND nextNO IS NULL"
 	}
-	defer tx.Rollback()
 
-	var exists int
-	err = tx.QueryRow("SELECT COUNT(*) FROM Deals WHERE NO = ?", dealID).Scan(&exists)
+	conditions, args := buildDealConditions(filter)
+	query += conditions + " ORDER BY DealDate, NO"
+
+	// SQLite only accepts OFFSET after LIMIT; LIMIT -1 is no limit
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, filter.Limit)
+	} else if filter.Offset > 0 {
+		query += " LIMIT -1"
+	}
+	if filter.Offset > 0 {
+		query += " OFFSET ?"
+		args = append(args, filter.Offset)
+	}
+
+	rows, err := db.Query(query, args...)
 	if err != nil {
-		return fmt.Errorf("failed to check existence: %v", err)
+		return fmt.Errorf("failed to query deals: %v", err)
 	}
+	defer rows.Close()
 
-	if exists == 0 {
-		return fmt.Errorf("deal not found: %s", dealID)
+	for rows.Next() {
+		deal := Deal{}
+		if err := scanDeal(rows, &deal); err != nil {
+			return fmt.Errorf("failed to scan deal: %v", err)
+		}
+		if err := fn(&deal); err != nil {
+			return err
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("error iterating rows: %v", err)
 	}
 
-	deal.RecUpdate = time.Now().Format("2006-01-02T15:04:05Z")
-	deal.RecStatus = "UPDATE"
+	return nil
+}
 
-	query := `UPDATE Deals SET nextNO=?, prevNO=?, DealType=?, DealDate=?, DealName=?, 
-			  DealPartner=?, DealPrice=?, DealRemark=?, RecUpdate=?, RecStatus=?, 
-			  FilePath=?, Hash=? WHERE NO=?`
+// ValidateDealFilter validates the search conditions of a deal filter
+func ValidateDealFilter(filter *DealFilter) error {
+	if filter.MinPrice != nil && filter.MaxPrice != nil && *filter.MinPrice > *filter.MaxPrice {
+		return fmt.Errorf("min_price must be less than or equal to max_price")
+	}
 
-	_, err = tx.Exec(query, deal.NextNO, deal.PrevNO, deal.DealType, deal.DealDate,
-		deal.DealName, deal.DealPartner, deal.DealPrice, deal.DealRemark,
-		deal.RecUpdate, deal.RecStatus, deal.FilePath, deal.Hash, dealID)
-	if err != nil {
-		return fmt.Errorf("failed to update deal: %v", err)
+	switch filter.TaxRate {
+	case "", TaxRateMixed, "unspecified":
+	default:
+		if !IsValidTaxRate(filter.TaxRate) {
+			return fmt.Errorf("invalid tax_rate parameter. Must be '10', '8', 'exempt', 'out_of_scope', 'mixed' or 'unspecified'")
+		}
 	}
 
-	if err = tx.Commit(); err != nil {
-		return fmt.Errorf("failed to commit transaction: %v", err)
+	switch strings.ToLower(filter.PartnerMatch) {
+	case "", "partial", "exact":
+	default:
+		return fmt.Errorf("invalid partner_match parameter. Must be 'partial' or 'exact'")
+	}
+
+	switch strings.ToLower(filter.Operator) {
+	case "", "and", "or":
+	default:
+		return fmt.Errorf("invalid operator parameter. Must be 'and' or 'or'")
 	}
 
 	return nil
 }
 
-func UpdateDealLinks(dealID string, recStatus string, nextNO string) error {
-	db, err := GetDB()
-	if err != nil {
-		return err
+// buildDealConditions builds the WHERE clause for the search conditions of a filter.
+// Each condition (date range, amount range, tax rate, partner, type, keyword) forms one group,
+// and the groups are combined with AND or OR according to filter.Operator.
+// The returned clause starts with " AND " so it can be appended to a base query.
+func buildDealConditions(filter *DealFilter) (string, []interface{}) {
+	groups := []string{}
+	args := []interface{}{}
+
+	// Transaction date range
+	dateConds := []string{}
+	if filter.FromDate != "" {
+		dateConds = append(dateConds, "DealDate >= ?")
+		args = append(args, filter.FromDate)
+	}
+	if filter.ToDate != "" {
+		dateConds = append(dateConds, "DealDate <= ?")
+		args = append(args, filter.ToDate)
+	}
+	if len(dateConds) > 0 {
+		groups = append(groups, "("+strings.Join(dateConds, " AND ")+")")
 	}
 
-	query := `UPDATE Deals SET RecStatus=?, nextNO=?, RecUpdate=? WHERE NO=?`
-	now := time.Now().Format("2006-01-02T15:04:05Z")
-	
-	var nextNOPtr *string
-	if nextNO != "" {
-		nextNOPtr = &nextNO
+	// Amount range
+	priceConds := []string{}
+	if filter.MinPrice != nil {
+		priceConds = append(priceConds, "DealPrice >= ?")
+		args = append(args, *filter.MinPrice)
 	}
-	
-	result, err := db.Exec(query, recStatus, nextNOPtr, now, dealID)
-	if err != nil {
-		return fmt.Errorf("failed to update deal links: %v", err)
+	if filter.MaxPrice != nil {
+		priceConds = append(priceConds, "DealPrice <= ?")
+		args = append(args, *filter.MaxPrice)
+	}
+	if len(priceConds) > 0 {
+		groups = append(groups, "("+strings.Join(priceConds, " AND ")+")")
 	}
 
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		return fmt.Errorf("failed to check affected rows: %v", err)
+	// Tax rate; a single rate also matches receipts that mix it with other rates
+	switch filter.TaxRate {
+	case "":
+	case "unspecified":
+		groups = append(groups, "COALESCE(TaxRate, '') = ''")
+	case TaxRateMixed:
+		groups = append(groups, "TaxRate = ?")
+		args = append(args, filter.TaxRate)
+	default:
+		groups = append(groups, "EXISTS (SELECT 1 FROM json_each(NULLIF(Deals.TaxBreakdown, '')) WHERE json_extract(value, '$.rate') = ?)")
+		args = append(args, filter.TaxRate)
 	}
 
-	if rowsAffected == 0 {
-		return fmt.Errorf("deal not found: %s", dealID)
+	// Counterparty
+	if filter.PartnerID != nil {
+		groups = append(groups, "PartnerID = ?")
+		args = append(args, *filter.PartnerID)
+	}
+	if filter.Partner != "" {
+		if strings.EqualFold(filter.PartnerMatch, "exact") {
+			groups = append(groups, "DealPartner = ?")
+			args = append(args, filter.Partner)
+		} else {
+			groups = append(groups, "DealPartner LIKE ?")
+			args = append(args, "%"+filter.Partner+"%")
+		}
 	}
 
-	return nil
+	if filter.Type != "" {
+		groups = append(groups, "DealType = ?")
+		args = append(args, filter.Type)
+	}
+
+	// Keyword: every space-separated term, through the full-text index where possible
+	if cond, keywordArgs := keywordCondition(filter.Keyword); cond != "" {
+		groups = append(groups, cond)
+		args = append(args, keywordArgs...)
+	}
+
+	if len(groups) == 0 {
+		return "", args
+	}
+
+	operator := " AND "
+	if strings.ToLower(filter.Operator) == "or" {
+		operator = " OR "
+	}
+
+	return " AND (" + strings.Join(groups, operator) + ")", args
 }
 
-// GetDealsByHash retrieves all deals with the specified hash value in the current period
+// GetDealsByHash retrieves all deals with the specified hash value in a period,
+// either as their file or as one of their active attachments
 // Only checks records with RecStatus = 'NEW' to avoid duplicate checking on UPDATE/DELETE records
-func GetDealsByHash(hash string) ([]Deal, error) {
+func GetDealsByHash(period string, hash string) ([]Deal, error) {
 	if hash == "" {
 		return []Deal{}, nil
 	}
 
-	db, err := GetDB()
+	db, err := ConnectPeriodDB(period)
 	if err != nil {
 		return nil, err
 	}
@@ -304,9 +517,10 @@ func GetDealsByHash(hash string) ([]Deal, error) {
 	query := `SELECT NO, DealType, DealDate, DealName, DealPartner, DealPrice,
 	          DealRemark, RecUpdate, RegDate, RecStatus, FilePath, Hash,
 	          nextNO, prevNO
-	          FROM Deals WHERE Hash = ? AND RecStatus = 'NEW'`
+	          FROM Deals WHERE RecStatus = 'NEW' AND (Hash = ? OR NO IN (
+	              SELECT DealNO FROM Attachments WHERE Hash = ? AND Status = 'ACTIVE'))`
 
-	rows, err := db.Query(query, hash)
+	rows, err := db.Query(query, hash, hash)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query deals by hash: %v", err)
 	}
@@ -355,30 +569,10 @@ func GetDealsByHashAllPeriods(hash string) ([]DealWithPeriod, error) {
 
 	var allDeals []DealWithPeriod
 
-	// Save current connection state
-	originalDB := currentDB
-	originalPeriod := currentPeriod
-
 	// Check each period
 	for _, period := range periods {
-		// Connect to period database
-		periodPath := filepath.Join(basePath, period)
-		dbPath := filepath.Join(periodPath, "Denchokun.db")
-
-		// Check if database file exists
-		if _, err := os.Stat(dbPath); os.IsNotExist(err) {
-			continue // Skip if database doesn't exist
-		}
-
-		// Connect to this period
-		if err := ConnectToPeriod(period); err != nil {
-			// Log error but continue checking other periods
-			fmt.Printf("Failed to connect to period %s: %v\n", period, err)
-			continue
-		}
-
-		// Get deals with this hash in current period
-		deals, err := GetDealsByHash(hash)
+		// Get deals with this hash in the period
+		deals, err := GetDealsByHash(period, hash)
 		if err != nil {
 			// Log error but continue
 			fmt.Printf("Failed to get deals for period %s: %v\n", period, err)
@@ -394,18 +588,12 @@ func GetDealsByHashAllPeriods(hash string) ([]DealWithPeriod, error) {
 		}
 	}
 
-	// Restore original connection
-	if originalPeriod != "" {
-		currentDB = originalDB
-		currentPeriod = originalPeriod
-	}
-
 	return allDeals, nil
 }
 
 // CreateDealWithHistory creates a new deal record with history tracking in a single transaction
-func CreateDealWithHistory(oldDealID string, newDeal *Deal) error {
-	db, err := GetDB()
+func CreateDealWithHistory(period string, oldDealID string, newDeal *Deal) error {
+	db, err := ConnectPeriodDB(period)
 	if err != nil {
 		return err
 	}
@@ -417,12 +605,46 @@ func CreateDealWithHistory(oldDealID string, newDeal *Deal) error {
 	defer tx.Rollback()
 
 	// Step 1: Update old deal record (set RecStatus to UPDATE and nextNO to new deal number)
-	// Use WHERE clause with RecStatus check to prevent updating already updated records
+	if err := markDealUpdated(tx, oldDealID, newDeal.NO); err != nil {
+		return err
+	}
+
+	// Step 2: Insert new deal record (linked into the hash chain)
+	if err := retainDealBlob(newDeal); err != nil {
+		return err
+	}
+	if err := insertDeal(tx, newDeal); err != nil {
+		releaseDealBlob(newDeal)
+		return fmt.Errorf("failed to insert new deal: %v", err)
+	}
+
+	// Step 3: Carry the attachments of the old record over to the new record
+	carried, err := carryOverAttachments(tx, oldDealID, newDeal.NO)
+	if err != nil {
+		releaseDealBlob(newDeal)
+		return err
+	}
+
+	// Step 4: Commit transaction
+	if err = tx.Commit(); err != nil {
+		releaseDealBlob(newDeal)
+		releaseBlobs(carried)
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	anchorChainHead(period)
+	scheduleTextExtraction(period)
+	return nil
+}
+
+// markDealUpdated marks the current version oldDealID as replaced by newNO within tx.
+// The RecStatus check prevents updating already updated records.
+func markDealUpdated(tx *sql.Tx, oldDealID, newNO string) error {
 	updateQuery := `UPDATE Deals SET RecStatus=?, nextNO=?, RecUpdate=? 
 	                WHERE NO=? AND RecStatus='NEW'`
 	now := time.Now().Format("2006-01-02T15:04:05Z")
-	
-	result, err := tx.Exec(updateQuery, "UPDATE", newDeal.NO, now, oldDealID)
+
+	result, err := tx.Exec(updateQuery, "UPDATE", newNO, now, oldDealID)
 	if err != nil {
 		return fmt.Errorf("failed to update old deal: %v", err)
 	}
@@ -445,69 +667,57 @@ func CreateDealWithHistory(oldDealID string, newDeal *Deal) error {
 		return fmt.Errorf("unable to update deal: %s", oldDealID)
 	}
 
-	// Step 2: Insert new deal record
-	insertQuery := `INSERT INTO Deals (NO, nextNO, prevNO, DealType, DealDate, DealName, 
-			  DealPartner, DealPrice, DealRemark, RecUpdate, RegDate, RecStatus, FilePath, Hash)
-			  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	return recordDealEvent(tx, oldDealID, "UPDATE", &newNO, now)
+}
 
-	_, err = tx.Exec(insertQuery, newDeal.NO, newDeal.NextNO, newDeal.PrevNO, newDeal.DealType, newDeal.DealDate,
-		newDeal.DealName, newDeal.DealPartner, newDeal.DealPrice, newDeal.DealRemark,
-		newDeal.RecUpdate, newDeal.RegDate, newDeal.RecStatus, newDeal.FilePath, newDeal.Hash)
+// markDealDeleted logically deletes dealID within tx if its RecStatus is one of from,
+// and chains the change. It reports false if no such record exists.
+func markDealDeleted(tx *sql.Tx, dealID string, from ...string) (bool, error) {
+	var recStatus sql.NullString
+	var nextNO *string
+	err := tx.QueryRow("SELECT RecStatus, nextNO FROM Deals WHERE NO=?", dealID).Scan(&recStatus, &nextNO)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
 	if err != nil {
-		return fmt.Errorf("failed to insert new deal: %v", err)
+		return false, fmt.Errorf("failed to get deal status: %v", err)
 	}
 
-	// Step 3: Commit transaction
-	if err = tx.Commit(); err != nil {
-		return fmt.Errorf("failed to commit transaction: %v", err)
+	allowed := false
+	for _, status := range from {
+		if recStatus.String == status {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return false, nil
 	}
 
-	return nil
+	now := time.Now().Format("2006-01-02T15:04:05Z")
+	if _, err := tx.Exec(`UPDATE Deals SET RecStatus='DELETE', RecUpdate=? WHERE NO=?`, now, dealID); err != nil {
+		return false, fmt.Errorf("failed to delete deal: %v", err)
+	}
+	if err := recordDealEvent(tx, dealID, "DELETE", nextNO, now); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
 // GetDealsWithHistory retrieves deals with their update history
 func GetDealsWithHistory(filter *DealFilter) ([]DealWithHistory, int, error) {
-	db, err := GetDB()
+	db, err := ConnectPeriodDB(filter.Period)
 	if err != nil {
 		return nil, 0, err
 	}
 
 	// Step 1: Get all NEW and DELETE records (latest versions) with filters
-	query := `SELECT NO, nextNO, prevNO, DealType, DealDate, DealName, DealPartner, 
-	          DealPrice, DealRemark, RecUpdate, RegDate, RecStatus, FilePath, Hash 
+	query := `SELECT ` + dealColumns + `
 	          FROM Deals WHERE (RecStatus = 'NEW' OR RecStatus = 'DELETE') AND nextNO IS NULL`
 	countQuery := `SELECT COUNT(*) FROM Deals WHERE (RecStatus = 'NEW' OR RecStatus = 'DELETE') AND nextNO IS NULL`
-	args := []interface{}{}
 
-	if filter.FromDate != "" {
-		query += " AND DealDate >= ?"
-		countQuery += " AND DealDate >= ?"
-		args = append(args, filter.FromDate)
-	}
-
-	if filter.ToDate != "" {
-		query += " AND DealDate <= ?"
-		countQuery += " AND DealDate <= ?"
-		args = append(args, filter.ToDate)
-	}
-
-	if filter.Partner != "" {
-		query += " AND DealPartner LIKE ?"
-		countQuery += " AND DealPartner LIKE ?"
-		args = append(args, "%"+filter.Partner+"%")
-	}
-
-	if filter.Type != "" {
-		query += " AND DealType = ?"
-		countQuery += " AND DealType = ?"
-		args = append(args, filter.Type)
-	}
-
-	if filter.Keyword != "" {
-		query += " AND (DealName LIKE ? OR DealRemark LIKE ? OR DealPartner LIKE ?)"
-		countQuery += " AND (DealName LIKE ? OR DealRemark LIKE ? OR DealPartner LIKE ?)"
-		args = append(args, "%"+filter.Keyword+"%", "%"+filter.Keyword+"%", "%"+filter.Keyword+"%")
-	}
+	conditions, args := buildDealConditions(filter)
+	query += conditions
+	countQuery += conditions
 
 	// Get count of NEW records
 	var totalCount int
@@ -541,22 +751,19 @@ func GetDealsWithHistory(filter *DealFilter) ([]DealWithHistory, int, error) {
 	defer rows.Close()
 
 	dealsWithHistory := []DealWithHistory{}
-	
+
 	for rows.Next() {
 		deal := Deal{}
-		err := rows.Scan(
-			&deal.NO, &deal.NextNO, &deal.PrevNO, &deal.DealType, &deal.DealDate,
-			&deal.DealName, &deal.DealPartner, &deal.DealPrice, &deal.DealRemark,
-			&deal.RecUpdate, &deal.RegDate, &deal.RecStatus, &deal.FilePath, &deal.Hash)
+		err := scanDeal(rows, &deal)
 		if err != nil {
 			return nil, 0, fmt.Errorf("failed to scan deal: %v", err)
 		}
 
 		// Extract base NO (without branch suffix)
 		baseNO := extractBaseNO(deal.NO)
-		
+
 		// Get history for this deal
-		history, err := getDealHistory(baseNO, deal.NO)
+		history, err := getDealHistory(db, baseNO, deal.NO)
 		if err != nil {
 			return nil, 0, fmt.Errorf("failed to get deal history: %v", err)
 		}
@@ -568,7 +775,7 @@ func GetDealsWithHistory(filter *DealFilter) ([]DealWithHistory, int, error) {
 			ChildCount:  len(history),
 			Children:    history,
 		}
-		
+
 		dealsWithHistory = append(dealsWithHistory, dealWithHistory)
 	}
 
@@ -587,16 +794,10 @@ func extractBaseNO(dealNO string) string {
 }
 
 // getDealHistory retrieves all historical versions of a deal
-func getDealHistory(baseNO string, currentNO string) ([]Deal, error) {
-	db, err := GetDB()
-	if err != nil {
-		return nil, err
-	}
-
+func getDealHistory(db *sql.DB, baseNO string, currentNO string) ([]Deal, error) {
 	// Query to get all versions of this deal except the current one
 	// Using LIKE to match base number and any branch versions
-	query := `SELECT NO, nextNO, prevNO, DealType, DealDate, DealName, DealPartner, 
-	          DealPrice, DealRemark, RecUpdate, RegDate, RecStatus, FilePath, Hash 
+	query := `SELECT ` + dealColumns + `
 	          FROM Deals 
 	          WHERE (NO = ? OR NO LIKE ?) AND NO != ?
 	          ORDER BY RecUpdate DESC`
@@ -610,10 +811,7 @@ func getDealHistory(baseNO string, currentNO string) ([]Deal, error) {
 	history := []Deal{}
 	for rows.Next() {
 		deal := Deal{}
-		err := rows.Scan(
-			&deal.NO, &deal.NextNO, &deal.PrevNO, &deal.DealType, &deal.DealDate,
-			&deal.DealName, &deal.DealPartner, &deal.DealPrice, &deal.DealRemark,
-			&deal.RecUpdate, &deal.RegDate, &deal.RecStatus, &deal.FilePath, &deal.Hash)
+		err := scanDeal(rows, &deal)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan historical deal: %v", err)
 		}
@@ -623,29 +821,31 @@ func getDealHistory(baseNO string, currentNO string) ([]Deal, error) {
 	return history, nil
 }
 
-func DeleteDeal(dealID string) error {
-	db, err := GetDB()
+func DeleteDeal(period string, dealID string) error {
+	db, err := ConnectPeriodDB(period)
 	if err != nil {
 		return err
 	}
 
-	// Logical delete: Update RecStatus to 'DELETE' and update RecUpdate timestamp
-	query := `UPDATE Deals SET RecStatus='DELETE', RecUpdate=? WHERE NO=? AND (RecStatus='NEW' OR RecStatus='UPDATE')`
-	now := time.Now().Format("2006-01-02T15:04:05Z")
-	
-	result, err := db.Exec(query, now, dealID)
+	tx, err := db.Begin()
 	if err != nil {
-		return fmt.Errorf("failed to delete deal: %v", err)
+		return fmt.Errorf("failed to start transaction: %v", err)
 	}
+	defer tx.Rollback()
 
-	rowsAffected, err := result.RowsAffected()
+	// Logical delete: Update RecStatus to 'DELETE' and record the change in the hash chain
+	deleted, err := markDealDeleted(tx, dealID, "NEW", "UPDATE")
 	if err != nil {
-		return fmt.Errorf("failed to check affected rows: %v", err)
+		return err
 	}
-
-	if rowsAffected == 0 {
+	if !deleted {
 		return fmt.Errorf("deal not found or already deleted: %s", dealID)
 	}
 
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	anchorChainHead(period)
 	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,343 @@
+package models
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentDealWritesToOnePeriod(t *testing.T) {
+	setupTestDB(t)
+	const (
+		period  = "2025"
+		writers = 8
+		rounds  = 5
+	)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*rounds*2)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Every writer opens the period itself, so the first open races as well
+			if _, err := ConnectToPeriod(period); err != nil {
+				errs <- err
+				return
+			}
+			for r := 0; r < rounds; r++ {
+				deal := newTestDeal("文房具", 1100)
+				if err := CreateDeal(period, deal); err != nil {
+					errs <- fmt.Errorf("create %s: %v", deal.NO, err)
+					continue
+				}
+				updated := newTestDeal("文房具", 2200)
+				updated.PrevNO = &deal.NO
+				if err := CreateDealWithHistory(period, deal.NO, updated); err != nil {
+					errs <- fmt.Errorf("update %s: %v", deal.NO, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	db, err := ConnectPeriodDB(period)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var current, replaced int
+	if err := db.QueryRow(`SELECT
+		COUNT(CASE WHEN RecStatus = 'NEW' AND nextNO IS NULL THEN 1 END),
+		COUNT(CASE WHEN RecStatus = 'UPDATE' AND nextNO IS NOT NULL THEN 1 END)
+		FROM Deals`).Scan(&current, &replaced); err != nil {
+		t.Fatal(err)
+	}
+	if current != writers*rounds || replaced != writers*rounds {
+		t.Errorf("got %d current and %d replaced deals, want %d of each", current, replaced, writers*rounds)
+	}
+
+	result, err := VerifyDealChain(period)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Valid || result.Checked != 3*writers*rounds || result.Events != writers*rounds {
+		t.Errorf("chain after concurrent writes: got %+v", result)
+	}
+}
+
+func TestConcurrentDealWritesToTwoPeriods(t *testing.T) {
+	setupTestDB(t)
+	const (
+		writers = 4
+		rounds  = 5
+	)
+	periods := []string{"2024", "2025"}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(periods)*writers*rounds*2)
+	for _, period := range periods {
+		for w := 0; w < writers; w++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				if _, err := ConnectToPeriod(period); err != nil {
+					errs <- err
+					return
+				}
+				for r := 0; r < rounds; r++ {
+					// The deal name carries the period, so a deal written to the other period shows
+					if err := CreateDeal(period, newTestDeal("期間"+period, 1100)); err != nil {
+						errs <- fmt.Errorf("create in %s: %v", period, err)
+					}
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				if _, err := ConnectToPeriod(period); err != nil {
+					errs <- err
+					return
+				}
+				for r := 0; r < rounds; r++ {
+					err := ForEachDeal(&DealFilter{Period: period}, func(deal *Deal) error {
+						if deal.DealName != "期間"+period {
+							return fmt.Errorf("deal %s of %s read from %s", deal.NO, deal.DealName, period)
+						}
+						return nil
+					})
+					if err != nil {
+						errs <- err
+					}
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	for _, period := range periods {
+		count := 0
+		err := ForEachDeal(&DealFilter{Period: period}, func(deal *Deal) error {
+			if deal.DealName != "期間"+period {
+				t.Errorf("deal %s of %s found in %s", deal.NO, deal.DealName, period)
+			}
+			count++
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != writers*rounds {
+			t.Errorf("%s: got %d deals, want %d", period, count, writers*rounds)
+		}
+
+		// Each period has its own chain and recorded head
+		result, err := VerifyDealChain(period)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.Valid || result.Checked != writers*rounds || result.HeadSeq != writers*rounds {
+			t.Errorf("%s: chain after concurrent writes: got %+v", period, result)
+		}
+	}
+}
+
+func TestConcurrentDealBatchUpdatesOfOneDeal(t *testing.T) {
+	setupTestDB(t)
+	const period = "2025"
+	if _, err := ConnectToPeriod(period); err != nil {
+		t.Fatal(err)
+	}
+	original := newTestDeal("交通費", 500)
+	if err := CreateDeal(period, original); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only one of the updates of the same version may succeed
+	const writers = 8
+	var wg sync.WaitGroup
+	results := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			batch, err := BeginDealBatch([]string{period})
+			if err != nil {
+				results <- err
+				return
+			}
+			defer batch.Rollback()
+			updated := newTestDeal("交通費", 600)
+			updated.PrevNO = &original.NO
+			if err := batch.UpdateDeal(period, original.NO, updated); err != nil {
+				results <- err
+				return
+			}
+			_, err = batch.Commit()
+			results <- err
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	succeeded := 0
+	for err := range results {
+		if err == nil {
+			succeeded++
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("%d concurrent updates of one version succeeded, want 1", succeeded)
+	}
+
+	result, err := VerifyDealChain(period)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Valid || result.Checked != 3 || result.Events != 1 {
+		t.Errorf("chain after concurrent updates: got %+v", result)
+	}
+}
+
+func TestForEachDealOffsetWithoutLimit(t *testing.T) {
+	setupTestDB(t)
+	const period = "2025"
+	if _, err := ConnectToPeriod(period); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := CreateDeal(period, newTestDeal("文房具", 100*(i+1))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		limit, offset int
+		want          []int
+	}{
+		{0, 0, []int{100, 200, 300, 400, 500}},
+		{0, 3, []int{400, 500}},
+		{2, 0, []int{100, 200}},
+		{2, 1, []int{200, 300}},
+	}
+	for _, tt := range tests {
+		var got []int
+		err := ForEachDeal(&DealFilter{Period: period, Limit: tt.limit, Offset: tt.offset}, func(deal *Deal) error {
+			got = append(got, deal.DealPrice)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("limit %d, offset %d: got %v, want %v", tt.limit, tt.offset, got, tt.want)
+		}
+	}
+}
+
+func TestBuildDealConditions(t *testing.T) {
+	setupTestDB(t)
+	const period = "2025"
+	if _, err := ConnectToPeriod(period); err != nil {
+		t.Fatal(err)
+	}
+	deals := []struct {
+		name, partner, date string
+		price               int
+	}{
+		{"文房具", "テスト商店", "2025-04-01", 1000},
+		{"交通費", "テスト商店本店", "2025-05-01", 5000},
+		{"書籍", "別の商店", "2025-04-15", 3000},
+	}
+	for _, d := range deals {
+		deal := newTestDeal(d.name, d.price)
+		deal.DealPartner = d.partner
+		deal.DealDate = d.date
+		if err := CreateDeal(period, deal); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	minPrice := 4000
+	tests := []struct {
+		name   string
+		filter DealFilter
+		clause string
+		args   []interface{}
+		want   []string // DealName of the matching deals, in ForEachDeal order
+	}{
+		{
+			name:   "no conditions",
+			filter: DealFilter{},
+			clause: "",
+			args:   []interface{}{},
+			want:   []string{"文房具", "書籍", "交通費"},
+		},
+		{
+			name:   "and",
+			filter: DealFilter{ToDate: "2025-04-30", Partner: "テスト商店"},
+			clause: " AND ((DealDate <= ?) AND DealPartner LIKE ?)",
+			args:   []interface{}{"2025-04-30", "%テスト商店%"},
+			want:   []string{"文房具"},
+		},
+		{
+			name:   "or",
+			filter: DealFilter{ToDate: "2025-04-30", MinPrice: &minPrice, Operator: "OR"},
+			clause: " AND ((DealDate <= ?) OR (DealPrice >= ?))",
+			args:   []interface{}{"2025-04-30", 4000},
+			want:   []string{"文房具", "書籍", "交通費"},
+		},
+		{
+			name:   "exact partner, case-insensitive",
+			filter: DealFilter{Partner: "テスト商店", PartnerMatch: "Exact"},
+			clause: " AND (DealPartner = ?)",
+			args:   []interface{}{"テスト商店"},
+			want:   []string{"文房具"},
+		},
+		{
+			name:   "exact partner or type",
+			filter: DealFilter{Partner: "別の商店", PartnerMatch: "exact", Type: "請求書", Operator: "or"},
+			clause: " AND (DealPartner = ? OR DealType = ?)",
+			args:   []interface{}{"別の商店", "請求書"},
+			want:   []string{"書籍"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateDealFilter(&tt.filter); err != nil {
+				t.Fatal(err)
+			}
+			clause, args := buildDealConditions(&tt.filter)
+			if clause != tt.clause {
+				t.Errorf("clause: got %q, want %q", clause, tt.clause)
+			}
+			if fmt.Sprint(args) != fmt.Sprint(tt.args) {
+				t.Errorf("args: got %v, want %v", args, tt.args)
+			}
+
+			filter := tt.filter
+			filter.Period = period
+			var got []string
+			err := ForEachDeal(&filter, func(deal *Deal) error {
+				got = append(got, deal.DealName)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("deals: got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if err := ValidateDealFilter(&DealFilter{PartnerMatch: "prefix"}); err == nil {
+		t.Error("invalid partner_match was accepted")
+	}
+}
@@ -0,0 +1,311 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"denchokun-api/textextract"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Status of the text extracted from a file
+const (
+	FileTextExtracted   = "extracted"
+	FileTextEmpty       = "empty"       // the file has no text, e.g. a scanned PDF
+	FileTextUnsupported = "unsupported" // the file type (or size) is not supported
+	FileTextFailed      = "failed"      // the file could not be read or parsed
+	FileTextPending     = "pending"     // not extracted yet; never stored
+)
+
+// fileTextTimeout is how long the text extraction of one file may take before the
+// file is recorded as failed
+const fileTextTimeout = 2 * time.Minute
+
+// fileTextQueries create the table of text extracted from the attachments of a period
+// and its full-text index. Texts are keyed by file hash, so the versions of a deal and
+// deals sharing a file share one text.
+var fileTextQueries = []string{
+	`CREATE TABLE IF NOT EXISTS "FileTexts" (
+		"Hash" TEXT PRIMARY KEY,
+		"Status" TEXT NOT NULL,
+		"Content" TEXT NOT NULL DEFAULT '',
+		"Error" TEXT NOT NULL DEFAULT '',
+		"Extracted" TEXT
+	)`,
+	`CREATE VIRTUAL TABLE IF NOT EXISTS FileTextsFTS USING fts5(
+		Content, content='FileTexts', content_rowid='rowid', tokenize='trigram'
+	)`,
+	`CREATE TRIGGER IF NOT EXISTS FileTexts_fts_insert AFTER INSERT ON FileTexts BEGIN
+		INSERT INTO FileTextsFTS(rowid, Content) VALUES (new.rowid, new.Content);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS FileTexts_fts_delete AFTER DELETE ON FileTexts BEGIN
+		INSERT INTO FileTextsFTS(FileTextsFTS, rowid, Content) VALUES ('delete', old.rowid, old.Content);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS FileTexts_fts_update AFTER UPDATE OF Content ON FileTexts BEGIN
+		INSERT INTO FileTextsFTS(FileTextsFTS, rowid, Content) VALUES ('delete', old.rowid, old.Content);
+		INSERT INTO FileTextsFTS(rowid, Content) VALUES (new.rowid, new.Content);
+	END`,
+}
+
+// setupFileTexts creates the extracted text table of a period database
+func setupFileTexts(db *sql.DB) error {
+	for _, query := range fileTextQueries {
+		if _, err := db.Exec(query); err != nil {
+			return fmt.Errorf("failed to create file text table: %v", err)
+		}
+	}
+	return nil
+}
+
+// FileText is the text extracted from one file of a deal
+type FileText struct {
+	Hash         string `json:"hash"`
+	Source       string `json:"source"`                 // "primary" or "attachment"
+	AttachmentID int64  `json:"attachmentId,omitempty"` // set for an additional attachment
+	Name         string `json:"name"`
+	Status       string `json:"status"`
+	Content      string `json:"content"`
+	Error        string `json:"error,omitempty"`
+	Extracted    string `json:"extracted,omitempty"`
+}
+
+// GetDealTexts returns the text of the file of a deal record and of its active attachments
+func GetDealTexts(period, dealNO string) ([]FileText, error) {
+	db, err := ConnectPeriodDB(period)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `SELECT 'primary', 0, COALESCE(NULLIF(d.OriginalFileName, ''), d.FilePath), d.Hash,
+	                 COALESCE(t.Status, ''), COALESCE(t.Content, ''), COALESCE(t.Error, ''), COALESCE(t.Extracted, '')
+	          FROM Deals d LEFT JOIN FileTexts t ON t.Hash = d.Hash
+	          WHERE d.NO = ? AND COALESCE(d.FilePath, '') != '' AND COALESCE(d.Hash, '') != ''
+	          UNION ALL
+	          SELECT 'attachment', a.ID, a.OriginalName, a.Hash,
+	                 COALESCE(t.Status, ''), COALESCE(t.Content, ''), COALESCE(t.Error, ''), COALESCE(t.Extracted, '')
+	          FROM Attachments a LEFT JOIN FileTexts t ON t.Hash = a.Hash
+	          WHERE a.DealNO = ? AND a.Status = ?`
+	rows, err := db.Query(query, dealNO, dealNO, AttachmentActive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file texts: %v", err)
+	}
+	defer rows.Close()
+
+	texts := []FileText{}
+	for rows.Next() {
+		var t FileText
+		if err := rows.Scan(&t.Source, &t.AttachmentID, &t.Name, &t.Hash, &t.Status, &t.Content, &t.Error, &t.Extracted); err != nil {
+			return nil, fmt.Errorf("failed to scan file text: %v", err)
+		}
+		if t.Status == "" {
+			t.Status = FileTextPending
+		}
+		texts = append(texts, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %v", err)
+	}
+
+	return texts, nil
+}
+
+// textExtraction is the queue of periods whose new files are waiting for text extraction.
+// A period is queued once however many deals are saved before the worker gets to it.
+var textExtraction = struct {
+	sync.Mutex
+	queue   []string
+	queued  map[string]bool
+	running bool
+}{queued: map[string]bool{}}
+
+// scheduleTextExtraction queues the extraction of the files of a period that have no
+// text yet. It returns at once; the work is done by one background goroutine so that
+// saving deals is not slowed down.
+func scheduleTextExtraction(period string) {
+	textExtraction.Lock()
+	defer textExtraction.Unlock()
+
+	if textExtraction.queued[period] {
+		return
+	}
+	textExtraction.queued[period] = true
+	textExtraction.queue = append(textExtraction.queue, period)
+
+	if !textExtraction.running {
+		textExtraction.running = true
+		go runTextExtraction()
+	}
+}
+
+// runTextExtraction works through the queue until it is empty
+func runTextExtraction() {
+	for {
+		textExtraction.Lock()
+		if len(textExtraction.queue) == 0 {
+			textExtraction.running = false
+			textExtraction.Unlock()
+			return
+		}
+		period := textExtraction.queue[0]
+		textExtraction.queue = textExtraction.queue[1:]
+		// A deal saved while the period is being processed queues it again
+		delete(textExtraction.queued, period)
+		textExtraction.Unlock()
+
+		if err := extractPeriodTexts(period); err != nil {
+			log.Printf("Text extraction of period %s failed: %v", period, err)
+		}
+	}
+}
+
+// fileTextSource is a file of a period whose text has not been extracted
+type fileTextSource struct {
+	hash string
+	deal *Deal // nil for an additional attachment, which is always in the blob store
+}
+
+// extractPeriodTexts extracts the text of every file of a period that has none yet
+func extractPeriodTexts(period string) error {
+	db, err := ConnectPeriodDB(period)
+	if err != nil {
+		return err
+	}
+
+	sources, err := pendingFileTexts(db)
+	if err != nil {
+		return err
+	}
+
+	extracted := 0
+	for _, source := range sources {
+		var path string
+		if source.deal != nil {
+			path, err = AttachmentPath(period, source.deal)
+		} else {
+			path, err = BlobPath(source.hash)
+		}
+
+		status, content, message := FileTextFailed, "", ""
+		if err != nil {
+			message = err.Error()
+		} else {
+			status, content, message = extractFileText(path)
+		}
+
+		if err := saveFileText(db, source.hash, status, content, message); err != nil {
+			return err
+		}
+		if status == FileTextExtracted {
+			extracted++
+		}
+	}
+
+	if len(sources) > 0 {
+		log.Printf("Text extraction of period %s: %d file(s) processed, %d with text", period, len(sources), extracted)
+	}
+	return nil
+}
+
+// pendingFileTexts returns the files of deal records and active attachments without text
+func pendingFileTexts(db *sql.DB) ([]fileTextSource, error) {
+	sources := []fileTextSource{}
+	seen := map[string]bool{}
+
+	rows, err := db.Query(`SELECT NO, COALESCE(FileStore, ''), FilePath, Hash FROM Deals
+	                       WHERE COALESCE(FilePath, '') != '' AND COALESCE(Hash, '') != ''
+	                       AND Hash NOT IN (SELECT Hash FROM FileTexts)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find files without text: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		deal := &Deal{}
+		if err := rows.Scan(&deal.NO, &deal.FileStore, &deal.FilePath, &deal.Hash); err != nil {
+			return nil, fmt.Errorf("failed to scan deal: %v", err)
+		}
+		if !seen[deal.Hash] {
+			seen[deal.Hash] = true
+			sources = append(sources, fileTextSource{hash: deal.Hash, deal: deal})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %v", err)
+	}
+
+	attachmentRows, err := db.Query(`SELECT DISTINCT Hash FROM Attachments
+	                                 WHERE Status = ? AND Hash NOT IN (SELECT Hash FROM FileTexts)`, AttachmentActive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find attachments without text: %v", err)
+	}
+	defer attachmentRows.Close()
+	for attachmentRows.Next() {
+		var hash string
+		if err := attachmentRows.Scan(&hash); err != nil {
+			return nil, fmt.Errorf("failed to scan attachment: %v", err)
+		}
+		if !seen[hash] {
+			seen[hash] = true
+			sources = append(sources, fileTextSource{hash: hash})
+		}
+	}
+	return sources, attachmentRows.Err()
+}
+
+// extractFileText extracts the text of a file and returns its status, the text and
+// the reason it has none. A file that takes longer than fileTextTimeout or makes the
+// extractor panic is recorded as failed, so that it is not tried again on every open.
+func extractFileText(path string) (status, content, message string) {
+	if !textextract.Supported(path) {
+		return FileTextUnsupported, "", fmt.Sprintf("no text extraction for %s files", filepath.Ext(path))
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Text extraction of %s panicked: %v", path, r)
+			status, content, message = FileTextFailed, "", fmt.Sprintf("text extraction failed: %v", r)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), fileTextTimeout)
+	defer cancel()
+
+	content, err := textextract.ExtractContext(ctx, path)
+	switch {
+	case errors.Is(err, textextract.ErrUnsupported), errors.Is(err, textextract.ErrTooLarge):
+		return FileTextUnsupported, "", err.Error()
+	case errors.Is(err, context.DeadlineExceeded):
+		return FileTextFailed, "", fmt.Sprintf("text extraction took longer than %v", fileTextTimeout)
+	case err != nil:
+		return FileTextFailed, "", err.Error()
+	case content == "":
+		return FileTextEmpty, "", ""
+	}
+	return FileTextExtracted, content, ""
+}
+
+// saveFileText stores the text of a file, replacing an earlier one. The old row is
+// deleted rather than replaced so that the delete trigger updates the search index.
+func saveFileText(db *sql.DB, hash, status, content, message string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM FileTexts WHERE Hash = ?`, hash); err != nil {
+		return fmt.Errorf("failed to save file text: %v", err)
+	}
+	if _, err := tx.Exec(`INSERT INTO FileTexts (Hash, Status, Content, Error, Extracted) VALUES (?, ?, ?, ?, ?)`,
+		hash, status, content, message, time.Now().Format("2006-01-02T15:04:05Z")); err != nil {
+		return fmt.Errorf("failed to save file text: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package models
+
+import (
+	"testing"
+)
+
+func TestFailedFileTextIsNotExtractedAgain(t *testing.T) {
+	setupTestDB(t)
+	const period = "2025"
+	db, err := ConnectToPeriod(period)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted := []byte("%PDF-1.4\n1 0 obj << /Type /Catalog >> endobj\ntrailer << /Root 1 0 R /Encrypt 2 0 R >>\n%%EOF")
+	deal := newLegacyDeal(t, period, "encrypted.pdf", encrypted)
+	scheduleTextExtraction(period)
+	waitTextExtraction(t)
+
+	texts, err := GetDealTexts(period, deal.NO)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(texts) != 1 || texts[0].Status != FileTextFailed || texts[0].Error == "" {
+		t.Fatalf("got %+v, want one failed text with its error", texts)
+	}
+
+	pending, err := pendingFileTexts(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("failed file is pending again: %+v", pending)
+	}
+}
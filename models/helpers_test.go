@@ -0,0 +1,57 @@
+package models
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// setupTestDB initializes the databases in a temporary directory. Background text
+// extraction is waited for and the connections are closed when the test ends.
+func setupTestDB(t *testing.T) {
+	t.Helper()
+	if err := InitDB(t.TempDir()); err != nil {
+		t.Fatalf("InitDB: %v", err)
+	}
+	t.Cleanup(func() {
+		waitTextExtraction(t)
+		CloseAllConnections()
+		dbMutex.Lock()
+		systemDB.Close()
+		systemDB = nil
+		dbMutex.Unlock()
+	})
+}
+
+// waitTextExtraction waits until the text extraction queue is empty
+func waitTextExtraction(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		textExtraction.Lock()
+		running := textExtraction.running
+		textExtraction.Unlock()
+		if !running {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("text extraction did not finish")
+}
+
+var testDealSeq int64
+
+// newTestDeal returns a deal without a file with a unique number
+func newTestDeal(name string, price int) *Deal {
+	n := atomic.AddInt64(&testDealSeq, 1)
+	return &Deal{
+		NO:          fmt.Sprintf("20250401_%06d", n),
+		DealType:    "領収書",
+		DealDate:    "2025-04-01",
+		DealName:    name,
+		DealPartner: "テスト商店",
+		DealPrice:   price,
+		RecStatus:   "NEW",
+	}
+}
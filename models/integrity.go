@@ -0,0 +1,432 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Status of an integrity check
+const (
+	IntegrityRunning   = "running"
+	IntegrityCompleted = "completed"
+	IntegrityFailed    = "failed"
+)
+
+// Problems found by an integrity check
+const (
+	IntegrityMismatch   = "mismatch"   // the file content does not match the recorded hash
+	IntegrityMissing    = "missing"    // the file does not exist
+	IntegrityUnreadable = "unreadable" // the file exists but cannot be read
+	IntegrityNoHash     = "no_hash"    // the deal has a file but no recorded hash
+)
+
+// IntegrityIssue is one attachment that failed an integrity check
+type IntegrityIssue struct {
+	Period       string `json:"period"`
+	NO           string `json:"NO"`
+	AttachmentID int64  `json:"attachmentId,omitempty"` // set for an additional attachment
+	RecStatus    string `json:"RecStatus"`
+	FilePath     string `json:"FilePath"`
+	Hash         string `json:"Hash"`
+	Problem      string `json:"problem"`
+	ActualHash   string `json:"actualHash,omitempty"`
+	Message      string `json:"message,omitempty"`
+}
+
+// IntegrityReport is the result of one run of VerifyAttachments
+type IntegrityReport struct {
+	ID         int64            `json:"id"`
+	Status     string           `json:"status"`
+	Trigger    string           `json:"trigger"` // "manual" or "schedule"
+	StartedBy  string           `json:"startedBy"`
+	Started    string           `json:"started"`
+	Finished   string           `json:"finished,omitempty"`
+	Periods    int              `json:"periods"`
+	Checked    int              `json:"checked"`    // deal records with a file, and additional attachments
+	Files      int              `json:"files"`      // distinct files hashed
+	IssueCount int              `json:"issueCount"` // len(Issues)
+	Issues     []IntegrityIssue `json:"issues,omitempty"`
+	Error      string           `json:"error,omitempty"`
+}
+
+// runningIntegrity is the check in progress, if any; only one runs at a time
+var (
+	runningIntegrity      *IntegrityReport
+	runningIntegrityMutex sync.Mutex
+)
+
+// createIntegrityTable creates the IntegrityReports table in System.db.
+// Checks left running by a previous process are marked as failed.
+func createIntegrityTable(db *sql.DB) error {
+	query := `CREATE TABLE IF NOT EXISTS "IntegrityReports" (
+		"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+		"status" TEXT NOT NULL,
+		"trigger" TEXT NOT NULL DEFAULT '',
+		"startedBy" TEXT NOT NULL DEFAULT '',
+		"started" TEXT,
+		"finished" TEXT,
+		"periods" INTEGER NOT NULL DEFAULT 0,
+		"checked" INTEGER NOT NULL DEFAULT 0,
+		"files" INTEGER NOT NULL DEFAULT 0,
+		"issueCount" INTEGER NOT NULL DEFAULT 0,
+		"issues" TEXT,
+		"error" TEXT
+	)`
+	if _, err := db.Exec(query); err != nil {
+		return fmt.Errorf("failed to create IntegrityReports table: %v", err)
+	}
+
+	if _, err := db.Exec(`UPDATE IntegrityReports SET status = ?, error = 'interrupted by server restart' WHERE status = ?`,
+		IntegrityFailed, IntegrityRunning); err != nil {
+		return fmt.Errorf("failed to update IntegrityReports table: %v", err)
+	}
+	return nil
+}
+
+// StartIntegrityCheck starts VerifyAttachments in the background and returns the new report.
+// If a check is already running, its report is returned with an "already running" error.
+func StartIntegrityCheck(trigger, startedBy string) (*IntegrityReport, error) {
+	runningIntegrityMutex.Lock()
+	defer runningIntegrityMutex.Unlock()
+
+	if runningIntegrity != nil {
+		report := *runningIntegrity
+		return &report, fmt.Errorf("integrity check %d is already running", report.ID)
+	}
+
+	db, err := GetSystemDB()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &IntegrityReport{
+		Status:    IntegrityRunning,
+		Trigger:   trigger,
+		StartedBy: startedBy,
+		Started:   time.Now().Format("2006-01-02T15:04:05Z"),
+		Issues:    []IntegrityIssue{},
+	}
+	result, err := db.Exec(`INSERT INTO IntegrityReports (status, trigger, startedBy, started) VALUES (?, ?, ?, ?)`,
+		report.Status, report.Trigger, report.StartedBy, report.Started)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create integrity report: %v", err)
+	}
+	report.ID, _ = result.LastInsertId()
+
+	runningIntegrity = report
+	go runIntegrityCheck(report)
+
+	snapshot := *report
+	return &snapshot, nil
+}
+
+// runIntegrityCheck runs a check and saves its report
+func runIntegrityCheck(report *IntegrityReport) {
+	err := VerifyAttachments(report, &runningIntegrityMutex)
+
+	runningIntegrityMutex.Lock()
+	report.Finished = time.Now().Format("2006-01-02T15:04:05Z")
+	report.Status = IntegrityCompleted
+	if err != nil {
+		report.Status = IntegrityFailed
+		report.Error = err.Error()
+	}
+	runningIntegrityMutex.Unlock()
+
+	if err := saveIntegrityReport(report); err != nil {
+		log.Printf("Failed to save integrity report %d: %v", report.ID, err)
+	}
+
+	runningIntegrityMutex.Lock()
+	runningIntegrity = nil
+	runningIntegrityMutex.Unlock()
+
+	if report.Status == IntegrityFailed {
+		log.Printf("Integrity check %d failed: %s", report.ID, report.Error)
+	} else if report.IssueCount > 0 {
+		log.Printf("Warning: Integrity check %d found %d problem(s) in %d attachment(s)", report.ID, report.IssueCount, report.Checked)
+	} else {
+		log.Printf("Integrity check %d completed: %d attachment(s) in %d period(s) verified", report.ID, report.Checked, report.Periods)
+	}
+}
+
+func saveIntegrityReport(report *IntegrityReport) error {
+	db, err := GetSystemDB()
+	if err != nil {
+		return err
+	}
+
+	issues, err := json.Marshal(report.Issues)
+	if err != nil {
+		return fmt.Errorf("failed to encode issues: %v", err)
+	}
+
+	_, err = db.Exec(`UPDATE IntegrityReports SET status = ?, finished = ?, periods = ?, checked = ?, files = ?,
+	                  issueCount = ?, issues = ?, error = ? WHERE id = ?`,
+		report.Status, report.Finished, report.Periods, report.Checked, report.Files,
+		report.IssueCount, string(issues), report.Error, report.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update integrity report: %v", err)
+	}
+	return nil
+}
+
+// VerifyAttachments recomputes the SHA-256 of the attachment of every deal record in
+// every period, including update history and deleted records, and of every additional
+// attachment, and adds the files that are missing, unreadable or do not match their
+// recorded hash to report.Issues.
+// A file shared by several records is hashed once. mutex guards report while it runs.
+func VerifyAttachments(report *IntegrityReport, mutex *sync.Mutex) error {
+	periods, err := GetAvailablePeriods()
+	if err != nil {
+		return fmt.Errorf("failed to list periods: %v", err)
+	}
+
+	hashed := map[string]fileDigest{}
+	for _, period := range periods {
+		deals, err := getAttachedDeals(period)
+		if err != nil {
+			return err
+		}
+
+		attachments, err := GetPeriodAttachments(period)
+		if err != nil {
+			return err
+		}
+
+		addResult := func(issue *IntegrityIssue) {
+			mutex.Lock()
+			report.Checked++
+			report.Files = len(hashed)
+			if issue != nil {
+				report.Issues = append(report.Issues, *issue)
+				report.IssueCount = len(report.Issues)
+			}
+			mutex.Unlock()
+		}
+		for i := range deals {
+			addResult(verifyDealAttachment(period, &deals[i], hashed))
+		}
+		for i := range attachments {
+			addResult(verifyAdditionalAttachment(period, &attachments[i], hashed))
+		}
+
+		mutex.Lock()
+		report.Periods++
+		mutex.Unlock()
+	}
+
+	return nil
+}
+
+// fileDigest is the result of hashing one file
+type fileDigest struct {
+	hash string
+	err  error
+}
+
+// getAttachedDeals returns the deal records of a period that have an attachment
+func getAttachedDeals(period string) ([]Deal, error) {
+	db, err := ConnectPeriodDB(period)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`SELECT NO, COALESCE(RecStatus, ''), FilePath, COALESCE(Hash, ''), COALESCE(FileStore, '')
+	                       FROM Deals WHERE COALESCE(FilePath, '') != '' ORDER BY NO`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query attachments of period %s: %v", period, err)
+	}
+	defer rows.Close()
+
+	var deals []Deal
+	for rows.Next() {
+		var deal Deal
+		if err := rows.Scan(&deal.NO, &deal.RecStatus, &deal.FilePath, &deal.Hash, &deal.FileStore); err != nil {
+			return nil, fmt.Errorf("failed to scan deal: %v", err)
+		}
+		deals = append(deals, deal)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %v", err)
+	}
+
+	return deals, nil
+}
+
+// verifyDealAttachment checks the attachment of one deal record and returns the problem, if any
+func verifyDealAttachment(period string, deal *Deal, hashed map[string]fileDigest) *IntegrityIssue {
+	issue := &IntegrityIssue{
+		Period:    period,
+		NO:        deal.NO,
+		RecStatus: deal.RecStatus,
+		FilePath:  deal.FilePath,
+		Hash:      deal.Hash,
+	}
+
+	path, err := AttachmentPath(period, deal)
+	if err != nil {
+		// A blob that is not registered has no file to read
+		issue.Problem = IntegrityMissing
+		issue.Message = err.Error()
+		return issue
+	}
+
+	return checkFileDigest(issue, path, hashed)
+}
+
+// verifyAdditionalAttachment checks one additional attachment and returns the problem, if any
+func verifyAdditionalAttachment(period string, a *Attachment, hashed map[string]fileDigest) *IntegrityIssue {
+	issue := &IntegrityIssue{
+		Period:       period,
+		NO:           a.DealNO,
+		AttachmentID: a.ID,
+		RecStatus:    a.Status,
+		FilePath:     a.OriginalName,
+		Hash:         a.Hash,
+	}
+
+	path, err := AttachmentFilePath(a)
+	if err != nil {
+		issue.Problem = IntegrityMissing
+		issue.Message = err.Error()
+		return issue
+	}
+
+	return checkFileDigest(issue, path, hashed)
+}
+
+// checkFileDigest hashes the file at path, once per run, and compares it with issue.Hash.
+// It returns issue with the problem filled in, or nil if the file matches.
+func checkFileDigest(issue *IntegrityIssue, path string, hashed map[string]fileDigest) *IntegrityIssue {
+	digest, ok := hashed[path]
+	if !ok {
+		digest.hash, digest.err = hashFile(path)
+		hashed[path] = digest
+	}
+
+	switch {
+	case os.IsNotExist(digest.err):
+		issue.Problem = IntegrityMissing
+		issue.Message = "file does not exist"
+	case digest.err != nil:
+		issue.Problem = IntegrityUnreadable
+		issue.Message = digest.err.Error()
+	case issue.Hash == "":
+		issue.Problem = IntegrityNoHash
+		issue.ActualHash = digest.hash
+	case digest.hash != issue.Hash:
+		issue.Problem = IntegrityMismatch
+		issue.ActualHash = digest.hash
+	default:
+		return nil
+	}
+	return issue
+}
+
+// hashFile returns the hex SHA-256 of a file
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// GetIntegrityReport returns a report with its issues. The report of a running check
+// shows the progress so far.
+func GetIntegrityReport(id int64) (*IntegrityReport, error) {
+	runningIntegrityMutex.Lock()
+	if runningIntegrity != nil && runningIntegrity.ID == id {
+		report := *runningIntegrity
+		report.Issues = append([]IntegrityIssue{}, runningIntegrity.Issues...)
+		runningIntegrityMutex.Unlock()
+		return &report, nil
+	}
+	runningIntegrityMutex.Unlock()
+
+	db, err := GetSystemDB()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &IntegrityReport{}
+	var issues sql.NullString
+	err = db.QueryRow(`SELECT `+integrityReportColumns+`, issues FROM IntegrityReports WHERE id = ?`, id).
+		Scan(append(report.scanTargets(), &issues)...)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("integrity report not found: %d", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get integrity report: %v", err)
+	}
+
+	report.Issues = []IntegrityIssue{}
+	if issues.String != "" {
+		if err := json.Unmarshal([]byte(issues.String), &report.Issues); err != nil {
+			return nil, fmt.Errorf("failed to decode issues: %v", err)
+		}
+	}
+
+	return report, nil
+}
+
+// GetIntegrityReports returns the latest reports without their issues
+func GetIntegrityReports(limit int) ([]IntegrityReport, error) {
+	db, err := GetSystemDB()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`SELECT `+integrityReportColumns+` FROM IntegrityReports ORDER BY id DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query integrity reports: %v", err)
+	}
+	defer rows.Close()
+
+	reports := []IntegrityReport{}
+	for rows.Next() {
+		var report IntegrityReport
+		if err := rows.Scan(report.scanTargets()...); err != nil {
+			return nil, fmt.Errorf("failed to scan integrity report: %v", err)
+		}
+		reports = append(reports, report)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %v", err)
+	}
+
+	// The running check shows its progress
+	runningIntegrityMutex.Lock()
+	defer runningIntegrityMutex.Unlock()
+	for i := range reports {
+		if runningIntegrity != nil && reports[i].ID == runningIntegrity.ID {
+			reports[i] = *runningIntegrity
+			reports[i].Issues = nil
+		}
+	}
+
+	return reports, nil
+}
+
+const integrityReportColumns = `id, status, trigger, startedBy, COALESCE(started, ''), COALESCE(finished, ''),
+	periods, checked, files, issueCount, COALESCE(error, '')`
+
+func (r *IntegrityReport) scanTargets() []interface{} {
+	return []interface{}{&r.ID, &r.Status, &r.Trigger, &r.StartedBy, &r.Started, &r.Finished,
+		&r.Periods, &r.Checked, &r.Files, &r.IssueCount, &r.Error}
+}
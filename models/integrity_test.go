@@ -0,0 +1,99 @@
+package models
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// waitIntegrityCheck waits until the check of report id has finished and returns its saved report
+func waitIntegrityCheck(t *testing.T, id int64) *IntegrityReport {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		runningIntegrityMutex.Lock()
+		running := runningIntegrity != nil
+		runningIntegrityMutex.Unlock()
+		if !running {
+			report, err := GetIntegrityReport(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return report
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("integrity check did not finish")
+	return nil
+}
+
+func TestIntegrityCheckReportsProblems(t *testing.T) {
+	setupTestDB(t)
+	const period = "2025"
+	if _, err := ConnectToPeriod(period); err != nil {
+		t.Fatal(err)
+	}
+
+	intact := newLegacyDeal(t, period, "intact.pdf", []byte("%PDF-1.4 intact"))
+	altered := newLegacyDeal(t, period, "altered.pdf", []byte("%PDF-1.4 original"))
+	missing := newLegacyDeal(t, period, "missing.pdf", []byte("%PDF-1.4 missing"))
+
+	unhashed := newTestDeal("文房具", 1100)
+	unhashed.FilePath = "unhashed.pdf"
+	if err := os.WriteFile(filepath.Join(basePath, period, unhashed.FilePath), []byte("%PDF-1.4 unhashed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateDeal(period, unhashed); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(basePath, period, altered.FilePath), []byte("%PDF-1.4 altered"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(basePath, period, missing.FilePath)); err != nil {
+		t.Fatal(err)
+	}
+
+	started, err := StartIntegrityCheck("manual", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := waitIntegrityCheck(t, started.ID)
+
+	if report.Status != IntegrityCompleted || report.Trigger != "manual" || report.StartedBy != "admin" || report.Finished == "" {
+		t.Errorf("report: %+v", report)
+	}
+	if report.Periods != 1 || report.Checked != 4 || report.IssueCount != 3 {
+		t.Errorf("got %d periods, %d checked and %d issues; want 1, 4 and 3", report.Periods, report.Checked, report.IssueCount)
+	}
+
+	problems := map[string]string{}
+	for _, issue := range report.Issues {
+		problems[issue.NO] = issue.Problem
+		if issue.Problem == IntegrityMismatch && issue.ActualHash == "" {
+			t.Error("mismatch is reported without the actual hash")
+		}
+	}
+	want := map[string]string{
+		altered.NO:  IntegrityMismatch,
+		missing.NO:  IntegrityMissing,
+		unhashed.NO: IntegrityNoHash,
+	}
+	for no, problem := range want {
+		if problems[no] != problem {
+			t.Errorf("%s: got problem %q, want %q", no, problems[no], problem)
+		}
+	}
+	if _, found := problems[intact.NO]; found {
+		t.Errorf("intact file was reported: %s", problems[intact.NO])
+	}
+
+	reports, err := GetIntegrityReports(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 1 || reports[0].ID != started.ID || reports[0].IssueCount != 3 {
+		t.Errorf("report list: %+v", reports)
+	}
+}
@@ -0,0 +1,186 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// InvoiceRegistration is the qualified invoice issuer registration (適格請求書発行事業者の登録) of a partner
+type InvoiceRegistration struct {
+	RegistrationNumber string `json:"registrationNumber"` // T + 13 digits
+	RegistrationDate   string `json:"registrationDate"`   // YYYY-MM-DD, first day the registration is effective
+	ExpiryDate         string `json:"expiryDate"`         // YYYY-MM-DD, day the registration lost effect; empty while registered
+}
+
+// partnerColumnMigrations lists the columns added to DealPartners after the original schema
+var partnerColumnMigrations = []columnDef{
+	{"registrationNumber", "TEXT"},
+	{"registrationDate", "TEXT"},
+	{"expiryDate", "TEXT"},
+	{"deleted", "TEXT"}, // set when the partner is deleted; its name history is kept
+}
+
+// NormalizeRegistrationNumber removes separators and upper-cases the leading T
+func NormalizeRegistrationNumber(number string) string {
+	number = strings.TrimSpace(number)
+	number = strings.NewReplacer("-", "", " ", "").Replace(number)
+	return strings.ToUpper(number)
+}
+
+// ValidateRegistrationNumber checks that a registration number is "T" followed by 13 digits
+// whose first digit is the check digit of the remaining 12 digits.
+// Registration numbers use the check digit of the corporate number (法人番号) for both
+// corporations and sole proprietors.
+func ValidateRegistrationNumber(number string) error {
+	if len(number) != 14 || number[0] != 'T' {
+		return fmt.Errorf("invalid registration number %s: must be T followed by 13 digits", number)
+	}
+
+	digits := number[1:]
+	for _, r := range digits {
+		if r < '0' || r > '9' {
+			return fmt.Errorf("invalid registration number %s: must be T followed by 13 digits", number)
+		}
+	}
+
+	if int(digits[0]-'0') != registrationCheckDigit(digits[1:]) {
+		return fmt.Errorf("invalid registration number %s: check digit does not match", number)
+	}
+
+	return nil
+}
+
+// registrationCheckDigit computes the check digit of the 12-digit base number:
+// 9 - (Σ Pn × Qn mod 9), where Pn is the n-th digit counted from the right and
+// Qn is 1 for odd n and 2 for even n.
+func registrationCheckDigit(base string) int {
+	sum := 0
+	for n := 1; n <= len(base); n++ {
+		digit := int(base[len(base)-n] - '0')
+		if n%2 == 0 {
+			sum += digit * 2
+		} else {
+			sum += digit
+		}
+	}
+	return 9 - sum%9
+}
+
+// ValidateInvoiceRegistration normalizes and validates a registration and its dates.
+// An empty registration number clears the registration.
+func ValidateInvoiceRegistration(reg *InvoiceRegistration) error {
+	reg.RegistrationNumber = NormalizeRegistrationNumber(reg.RegistrationNumber)
+	if reg.RegistrationNumber == "" {
+		if reg.RegistrationDate != "" || reg.ExpiryDate != "" {
+			return fmt.Errorf("registration number is required when dates are given")
+		}
+		return nil
+	}
+
+	if err := ValidateRegistrationNumber(reg.RegistrationNumber); err != nil {
+		return err
+	}
+
+	if reg.RegistrationDate == "" {
+		return fmt.Errorf("registration date is required")
+	}
+	if !IsValidDate(reg.RegistrationDate) {
+		return fmt.Errorf("invalid registration date format. Must be YYYY-MM-DD")
+	}
+	if reg.ExpiryDate != "" {
+		if !IsValidDate(reg.ExpiryDate) {
+			return fmt.Errorf("invalid expiry date format. Must be YYYY-MM-DD")
+		}
+		if reg.ExpiryDate <= reg.RegistrationDate {
+			return fmt.Errorf("expiry date must be after the registration date")
+		}
+	}
+
+	return nil
+}
+
+// UpdateDealPartnerRegistration sets or clears the invoice registration of a partner.
+// Deals already registered keep the number recorded at that time.
+func UpdateDealPartnerRegistration(name string, reg *InvoiceRegistration) (*DealPartner, error) {
+	if err := ValidateInvoiceRegistration(reg); err != nil {
+		return nil, err
+	}
+
+	db, err := GetSystemDB()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Format("2006-01-02T15:04:05Z")
+	result, err := db.Exec(`UPDATE DealPartners SET registrationNumber = ?, registrationDate = ?,
+	                        expiryDate = ?, updated = ? WHERE name = ? AND deleted IS NULL`,
+		nullIfEmpty(reg.RegistrationNumber), nullIfEmpty(reg.RegistrationDate), nullIfEmpty(reg.ExpiryDate), now, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update partner registration: %v", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("failed to check affected rows: %v", err)
+	}
+	if rowsAffected == 0 {
+		return nil, fmt.Errorf("partner not found: %s", name)
+	}
+
+	partner, _, err := GetDealPartnerHistory(name)
+	return partner, err
+}
+
+// RegistrationNumberAt returns the registration number of a partner that was effective
+// on the given date (YYYY-MM-DD), or an empty string if the partner was not registered.
+func RegistrationNumberAt(partnerID int64, date string) (string, error) {
+	db, err := GetSystemDB()
+	if err != nil {
+		return "", err
+	}
+
+	var number string
+	err = db.QueryRow(`SELECT registrationNumber FROM DealPartners
+	                   WHERE id = ? AND registrationNumber IS NOT NULL AND registrationNumber != ''
+	                   AND registrationDate <= ? AND (expiryDate IS NULL OR expiryDate = '' OR expiryDate > ?)`,
+		partnerID, date, date).Scan(&number)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get partner registration: %v", err)
+	}
+
+	return number, nil
+}
+
+// resolveInvoiceNumber sets the registration number a deal records.
+// The partner master takes precedence; a number entered for a partner without a registration
+// valid on the deal date is kept after validation.
+func resolveInvoiceNumber(deal *Deal) error {
+	if deal.PartnerID != nil && deal.DealDate != "" {
+		number, err := RegistrationNumberAt(*deal.PartnerID, deal.DealDate)
+		if err != nil {
+			return err
+		}
+		if number != "" {
+			deal.InvoiceNumber = number
+			return nil
+		}
+	}
+
+	deal.InvoiceNumber = NormalizeRegistrationNumber(deal.InvoiceNumber)
+	if deal.InvoiceNumber == "" {
+		return nil
+	}
+	return ValidateRegistrationNumber(deal.InvoiceNumber)
+}
+
+func nullIfEmpty(value string) interface{} {
+	if value == "" {
+		return nil
+	}
+	return value
+}
@@ -0,0 +1,81 @@
+package models
+
+import (
+	"testing"
+)
+
+func TestValidateRegistrationNumber(t *testing.T) {
+	tests := []struct {
+		name   string
+		number string
+		valid  bool
+	}{
+		{"National Tax Agency", "T7000012050002", true},
+		{"all zero base", "T9000000000000", true},
+		{"all nine base", "T9999999999999", true},
+		{"sequential base", "T7123456789012", true},
+		{"check digit one", "T1010401089234", true},
+		{"wrong check digit", "T8000012050002", false},
+		{"swapped digits", "T7000012500002", false},
+		{"missing T", "7000012050002", false},
+		{"lower-case t", "t7000012050002", false},
+		{"12 digits", "T700001205000", false},
+		{"14 digits", "T70000120500021", false},
+		{"letter in digits", "T70000120500O2", false},
+		{"full-width digits", "T７000012050002", false},
+		{"empty", "", false},
+	}
+
+	for _, tt := range tests {
+		err := ValidateRegistrationNumber(tt.number)
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: ValidateRegistrationNumber(%q) = %v, want valid %v", tt.name, tt.number, err, tt.valid)
+		}
+	}
+}
+
+func TestNormalizeRegistrationNumber(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"T7000012050002", "T7000012050002"},
+		{" t7000012050002 ", "T7000012050002"},
+		{"T7-0000-1205-0002", "T7000012050002"},
+		{"T 7000 0120 50002", "T7000012050002"},
+	}
+
+	for _, tt := range tests {
+		if got := NormalizeRegistrationNumber(tt.in); got != tt.want {
+			t.Errorf("NormalizeRegistrationNumber(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestValidateInvoiceRegistration(t *testing.T) {
+	tests := []struct {
+		name  string
+		reg   InvoiceRegistration
+		valid bool
+	}{
+		{"registered", InvoiceRegistration{"t7-0000-1205-0002", "2023-10-01", ""}, true},
+		{"expired", InvoiceRegistration{"T7000012050002", "2023-10-01", "2025-03-31"}, true},
+		{"cleared", InvoiceRegistration{"", "", ""}, true},
+		{"dates without number", InvoiceRegistration{"", "2023-10-01", ""}, false},
+		{"wrong check digit", InvoiceRegistration{"T8000012050002", "2023-10-01", ""}, false},
+		{"missing registration date", InvoiceRegistration{"T7000012050002", "", ""}, false},
+		{"invalid registration date", InvoiceRegistration{"T7000012050002", "2023/10/01", ""}, false},
+		{"expiry before registration", InvoiceRegistration{"T7000012050002", "2023-10-01", "2023-09-30"}, false},
+		{"expiry on registration date", InvoiceRegistration{"T7000012050002", "2023-10-01", "2023-10-01"}, false},
+	}
+
+	for _, tt := range tests {
+		reg := tt.reg
+		err := ValidateInvoiceRegistration(&reg)
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: got %v, want valid %v", tt.name, err, tt.valid)
+		}
+		if tt.valid && reg.RegistrationNumber != NormalizeRegistrationNumber(tt.reg.RegistrationNumber) {
+			t.Errorf("%s: number was not normalized: %q", tt.name, reg.RegistrationNumber)
+		}
+	}
+}
@@ -0,0 +1,373 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultOrphanGracePeriod is how old a file must be before it is reported as orphaned,
+// so that files of requests in progress are left alone
+const DefaultOrphanGracePeriod = 24 * time.Hour
+
+// quarantineDirName is the folder under basePath where orphaned files are moved
+const quarantineDirName = ".quarantine"
+
+// Kinds of orphaned files
+const (
+	OrphanUnreferenced     = "unreferenced"      // a file in a period folder that no deal refers to
+	OrphanStaleTemp        = "stale_temp"        // a temp file left by a failed write
+	OrphanUnusedBlob       = "unused_blob"       // a blob that no deal or attachment refers to
+	OrphanUnregisteredBlob = "unregistered_blob" // a file in the blob store that is not in the Blobs table
+	OrphanStaleUpload      = "stale_upload"      // the file of an upload session that no longer exists
+)
+
+// OrphanFile is one file found by ScanOrphanFiles
+type OrphanFile struct {
+	Path     string `json:"path"` // relative to the data folder, with forward slashes
+	Kind     string `json:"kind"`
+	Period   string `json:"period,omitempty"`
+	Size     int64  `json:"size"`
+	Modified string `json:"modified"`
+	hash     string // blob hash of unused and unregistered blobs
+}
+
+// OrphanReport is the result of ScanOrphanFiles or QuarantineOrphanFiles
+type OrphanReport struct {
+	GraceHours    float64      `json:"graceHours"`
+	Files         []OrphanFile `json:"files"`
+	Count         int          `json:"count"`
+	TotalSize     int64        `json:"totalSize"`
+	Recent        int          `json:"recent"` // candidates skipped because they are newer than the grace period
+	DryRun        bool         `json:"dryRun"`
+	QuarantineDir string       `json:"quarantineDir,omitempty"`
+	Quarantined   int          `json:"quarantined"`
+	Errors        []string     `json:"errors"`
+}
+
+// orphanScan collects orphaned files older than the grace period
+type orphanScan struct {
+	report *OrphanReport
+	cutoff time.Time
+}
+
+// add records a candidate; files newer than the grace period are only counted
+func (s *orphanScan) add(path, kind, period, hash string, info fs.FileInfo) {
+	if info.ModTime().After(s.cutoff) {
+		s.report.Recent++
+		return
+	}
+
+	rel, err := filepath.Rel(basePath, path)
+	if err != nil {
+		rel = path
+	}
+	s.report.Files = append(s.report.Files, OrphanFile{
+		Path:     filepath.ToSlash(rel),
+		Kind:     kind,
+		Period:   period,
+		Size:     info.Size(),
+		Modified: info.ModTime().Format("2006-01-02T15:04:05Z"),
+		hash:     hash,
+	})
+	s.report.Count++
+	s.report.TotalSize += info.Size()
+}
+
+// ScanOrphanFiles lists files in the period folders and the blob store that no deal
+// refers to, and temp files left by failed writes. Files modified within grace are
+// skipped because they may belong to a request in progress. Nothing is changed.
+func ScanOrphanFiles(grace time.Duration) (*OrphanReport, error) {
+	scan := &orphanScan{
+		report: &OrphanReport{
+			GraceHours: grace.Hours(),
+			Files:      []OrphanFile{},
+			DryRun:     true,
+			Errors:     []string{},
+		},
+		cutoff: time.Now().Add(-grace),
+	}
+
+	periods, err := GetAvailablePeriods()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list periods: %v", err)
+	}
+
+	blobRefs := map[string]int{}
+	for _, period := range periods {
+		if err := scan.scanPeriod(period, blobRefs); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := scan.scanBlobStore(blobRefs); err != nil {
+		return nil, err
+	}
+
+	return scan.report, nil
+}
+
+// scanPeriod checks the files of a period folder and counts the blob references of its
+// deals and attachments
+func (s *orphanScan) scanPeriod(period string, blobRefs map[string]int) error {
+	db, err := ConnectPeriodDB(period)
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.Query(`SELECT FilePath, COALESCE(FileStore, ''), COALESCE(Hash, '') FROM Deals
+	                       WHERE COALESCE(FilePath, '') != ''`)
+	if err != nil {
+		return fmt.Errorf("failed to query attachments of period %s: %v", period, err)
+	}
+	referenced := map[string]bool{}
+	for rows.Next() {
+		var filePath, fileStore, hash string
+		if err := rows.Scan(&filePath, &fileStore, &hash); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan deal: %v", err)
+		}
+		if fileStore == FileStoreBlob {
+			blobRefs[hash]++
+			continue
+		}
+		path, err := AttachmentPath(period, &Deal{FilePath: filePath})
+		if err == nil {
+			referenced[filepath.Clean(path)] = true
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating rows: %v", err)
+	}
+
+	// Additional attachments are always blobs; removed ones are kept as history
+	rows, err = db.Query(`SELECT Hash, COUNT(*) FROM Attachments GROUP BY Hash`)
+	if err != nil {
+		return fmt.Errorf("failed to query attachments of period %s: %v", period, err)
+	}
+	if err := addBlobRefCounts(rows, blobRefs); err != nil {
+		return err
+	}
+
+	periodPath := filepath.Join(basePath, period)
+	return filepath.WalkDir(periodPath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			s.report.Errors = append(s.report.Errors, fmt.Sprintf("%s: %v", path, err))
+			return nil
+		}
+		if entry.IsDir() {
+			return nil
+		}
+
+		// The period database and its journal files
+		if dir, name := filepath.Split(path); filepath.Clean(dir) == periodPath && strings.HasPrefix(name, "Denchokun.db") {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		switch {
+		case strings.HasSuffix(entry.Name(), ".tmp"):
+			s.add(path, OrphanStaleTemp, period, "", info)
+		case !referenced[filepath.Clean(path)]:
+			s.add(path, OrphanUnreferenced, period, "", info)
+		}
+		return nil
+	})
+}
+
+// scanBlobStore checks the blob files against the Blobs table and the references of
+// all periods, and the temp files of uploads
+func (s *orphanScan) scanBlobStore(blobRefs map[string]int) error {
+	db, err := GetSystemDB()
+	if err != nil {
+		return err
+	}
+
+	registered := map[string]string{} // file name -> hash
+	rows, err := db.Query(`SELECT hash, ext FROM Blobs`)
+	if err != nil {
+		return fmt.Errorf("failed to query blobs: %v", err)
+	}
+	for rows.Next() {
+		var hash, ext string
+		if err := rows.Scan(&hash, &ext); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan blob: %v", err)
+		}
+		registered[hash+ext] = hash
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating rows: %v", err)
+	}
+
+	blobPath := filepath.Join(basePath, blobDirName)
+	tempPath := filepath.Join(blobPath, blobTempDirName)
+	err = filepath.WalkDir(blobPath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if !os.IsNotExist(err) {
+				s.report.Errors = append(s.report.Errors, fmt.Sprintf("%s: %v", path, err))
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+
+		if filepath.Dir(path) == tempPath {
+			// Files of live upload sessions are removed when the session expires
+			if id, ok := strings.CutPrefix(entry.Name(), "session-"); ok {
+				if uploadSessionExists(id) {
+					return nil
+				}
+				s.add(path, OrphanStaleUpload, "", "", info)
+				return nil
+			}
+			s.add(path, OrphanStaleTemp, "", "", info)
+			return nil
+		}
+
+		hash, ok := registered[entry.Name()]
+		switch {
+		case !ok:
+			s.add(path, OrphanUnregisteredBlob, "", strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name())), info)
+		case blobRefs[hash] == 0:
+			s.add(path, OrphanUnusedBlob, "", hash, info)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scan blob store: %v", err)
+	}
+	return nil
+}
+
+// QuarantineOrphanFiles scans like ScanOrphanFiles and moves the files found into
+// .quarantine/<time>/ under the data folder, keeping their relative paths, together with
+// a manifest.json of the report. Files are never deleted. If paths is not empty only
+// the files found whose path is in it are moved.
+// An unused blob is also removed from the Blobs table, unless a deal took a reference
+// to it after the scan.
+func QuarantineOrphanFiles(grace time.Duration, paths []string) (*OrphanReport, error) {
+	report, err := ScanOrphanFiles(grace)
+	if err != nil {
+		return nil, err
+	}
+	report.DryRun = false
+
+	if len(paths) > 0 {
+		selected := map[string]bool{}
+		for _, path := range paths {
+			selected[path] = true
+		}
+		var files []OrphanFile
+		report.Count, report.TotalSize = 0, 0
+		for _, file := range report.Files {
+			if selected[file.Path] {
+				files = append(files, file)
+				report.Count++
+				report.TotalSize += file.Size
+			}
+		}
+		report.Files = files
+	}
+	if len(report.Files) == 0 {
+		report.Files = []OrphanFile{}
+		return report, nil
+	}
+
+	db, err := GetSystemDB()
+	if err != nil {
+		return nil, err
+	}
+
+	// Each run gets its own folder so that manifests are never overwritten
+	if err := os.MkdirAll(filepath.Join(basePath, quarantineDirName), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create quarantine directory: %v", err)
+	}
+	name := time.Now().Format("20060102-150405")
+	quarantinePath := filepath.Join(basePath, quarantineDirName, name)
+	for i := 2; ; i++ {
+		err := os.Mkdir(quarantinePath, 0755)
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("failed to create quarantine directory: %v", err)
+		}
+		name = fmt.Sprintf("%s-%d", time.Now().Format("20060102-150405"), i)
+		quarantinePath = filepath.Join(basePath, quarantineDirName, name)
+	}
+	report.QuarantineDir = quarantineDirName + "/" + name
+
+	moved := []OrphanFile{}
+	for _, file := range report.Files {
+		if err := quarantineFile(db, file, quarantinePath); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", file.Path, err))
+			continue
+		}
+		moved = append(moved, file)
+	}
+	report.Quarantined = len(moved)
+
+	manifest, err := json.MarshalIndent(struct {
+		Created string       `json:"created"`
+		Files   []OrphanFile `json:"files"`
+	}{time.Now().Format("2006-01-02T15:04:05Z"), moved}, "", "  ")
+	if err == nil {
+		err = os.WriteFile(filepath.Join(quarantinePath, "manifest.json"), manifest, 0644)
+	}
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("manifest.json: %v", err))
+	}
+
+	return report, nil
+}
+
+// quarantineFile moves one file found by the scan into quarantinePath.
+// Blobs are checked again and moved while holding blobStoreMutex, so that a blob
+// stored after the scan is neither moved away nor left registered without its file.
+func quarantineFile(db *sql.DB, file OrphanFile, quarantinePath string) error {
+	switch file.Kind {
+	case OrphanUnusedBlob:
+		blobStoreMutex.Lock()
+		defer blobStoreMutex.Unlock()
+		result, err := db.Exec(`DELETE FROM Blobs WHERE hash = ? AND refCount = 0`, file.hash)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return fmt.Errorf("blob is referenced, not moved")
+		}
+	case OrphanUnregisteredBlob:
+		blobStoreMutex.Lock()
+		defer blobStoreMutex.Unlock()
+		var count int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM Blobs WHERE hash = ?`, file.hash).Scan(&count); err != nil {
+			return err
+		}
+		if count > 0 {
+			return fmt.Errorf("blob was stored after the scan, not moved")
+		}
+	}
+
+	source := filepath.Join(basePath, filepath.FromSlash(file.Path))
+	target := filepath.Join(quarantinePath, filepath.FromSlash(file.Path))
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	return os.Rename(source, target)
+}
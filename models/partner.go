@@ -3,10 +3,29 @@ package models
 import (
 	"database/sql"
 	"fmt"
+	"strings"
+	"time"
 )
 
 type DealPartner struct {
-	Name string `json:"name" binding:"required"`
+	ID      int64  `json:"id,omitempty"`
+	Name    string `json:"name" binding:"required"`
+	Created string `json:"created,omitempty"`
+	Updated string `json:"updated,omitempty"`
+	Deleted string `json:"deleted,omitempty"` // set for a deleted partner
+	InvoiceRegistration
+}
+
+// partnerColumns is the column list read by scanDealPartner
+const partnerColumns = `id, name, created, updated, registrationNumber, registrationDate, expiryDate, deleted`
+
+// DealPartnerName is one version of a partner's name.
+// ValidTo is nil for the current name.
+type DealPartnerName struct {
+	PartnerID int64   `json:"partnerId"`
+	Name      string  `json:"name"`
+	ValidFrom string  `json:"validFrom"`
+	ValidTo   *string `json:"validTo,omitempty"`
 }
 
 func GetDealPartners() ([]string, error) {
@@ -15,7 +34,7 @@ func GetDealPartners() ([]string, error) {
 		return nil, err
 	}
 
-	query := "SELECT name FROM DealPartners ORDER BY name"
+	query := "SELECT name FROM DealPartners WHERE deleted IS NULL ORDER BY name"
 	rows, err := db.Query(query)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query partners: %v", err)
@@ -34,23 +53,101 @@ func GetDealPartners() ([]string, error) {
 	return partners, nil
 }
 
+// GetDealPartnerDetails returns all partners with their stable IDs
+func GetDealPartnerDetails() ([]DealPartner, error) {
+	db, err := GetSystemDB()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT " + partnerColumns + " FROM DealPartners WHERE deleted IS NULL ORDER BY name")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query partners: %v", err)
+	}
+	defer rows.Close()
+
+	partners := []DealPartner{}
+	for rows.Next() {
+		partner, err := scanDealPartner(rows)
+		if err != nil {
+			return nil, err
+		}
+		partners = append(partners, *partner)
+	}
+
+	return partners, nil
+}
+
 func CreateDealPartner(partner *DealPartner) error {
+	if err := ValidateInvoiceRegistration(&partner.InvoiceRegistration); err != nil {
+		return err
+	}
+
 	db, err := GetSystemDB()
 	if err != nil {
 		return err
 	}
 
-	_, err = db.Exec("INSERT INTO DealPartners (name) VALUES (?)", partner.Name)
+	tx, err := db.Begin()
 	if err != nil {
-		if err.Error() == "UNIQUE constraint failed: DealPartners.name" {
-			return fmt.Errorf("partner already exists: %s", partner.Name)
+		return fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Format("2006-01-02T15:04:05Z")
+
+	// A deleted partner with the same name is restored, so that it keeps its ID and name history
+	var deletedID int64
+	var created sql.NullString
+	err = tx.QueryRow("SELECT id, created FROM DealPartners WHERE name = ? AND deleted IS NOT NULL", partner.Name).Scan(&deletedID, &created)
+	switch {
+	case err == nil:
+		_, err = tx.Exec(`UPDATE DealPartners SET deleted = NULL, updated = ?, registrationNumber = ?,
+		                  registrationDate = ?, expiryDate = ? WHERE id = ?`,
+			now, nullIfEmpty(partner.RegistrationNumber), nullIfEmpty(partner.RegistrationDate),
+			nullIfEmpty(partner.ExpiryDate), deletedID)
+		if err != nil {
+			return fmt.Errorf("failed to restore partner: %v", err)
 		}
-		return fmt.Errorf("failed to create partner: %v", err)
+		partner.ID = deletedID
+		partner.Created = created.String
+	case err == sql.ErrNoRows:
+		result, err := tx.Exec(`INSERT INTO DealPartners (name, created, updated, registrationNumber, registrationDate, expiryDate)
+		                        VALUES (?, ?, ?, ?, ?, ?)`,
+			partner.Name, now, now, nullIfEmpty(partner.RegistrationNumber),
+			nullIfEmpty(partner.RegistrationDate), nullIfEmpty(partner.ExpiryDate))
+		if err != nil {
+			if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+				return fmt.Errorf("partner already exists: %s", partner.Name)
+			}
+			return fmt.Errorf("failed to create partner: %v", err)
+		}
+
+		partner.ID, err = result.LastInsertId()
+		if err != nil {
+			return fmt.Errorf("failed to get partner id: %v", err)
+		}
+		partner.Created = now
+	default:
+		return fmt.Errorf("failed to check existence: %v", err)
+	}
+	partner.Updated = now
+
+	_, err = tx.Exec("INSERT INTO DealPartnerNames (partnerId, name, validFrom) VALUES (?, ?, ?)",
+		partner.ID, partner.Name, now)
+	if err != nil {
+		return fmt.Errorf("failed to record partner name: %v", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
 	}
 
 	return nil
 }
 
+// UpdateDealPartner renames a partner. The rename is recorded as a new name version;
+// deals keep the partner name as it was entered and stay linked through the partner ID.
 func UpdateDealPartner(oldName string, newName string) error {
 	systemDB, err := GetSystemDB()
 	if err != nil {
@@ -64,67 +161,170 @@ func UpdateDealPartner(oldName string, newName string) error {
 	}
 	defer tx.Rollback()
 
-	var exists int
-	err = tx.QueryRow("SELECT COUNT(*) FROM DealPartners WHERE name = ?", oldName).Scan(&exists)
+	var partnerID int64
+	err = tx.QueryRow("SELECT id FROM DealPartners WHERE name = ? AND deleted IS NULL", oldName).Scan(&partnerID)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("partner not found: %s", oldName)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to check existence: %v", err)
 	}
 
-	if exists == 0 {
-		return fmt.Errorf("partner not found: %s", oldName)
+	if newName == oldName {
+		return nil
 	}
 
-	_, err = tx.Exec("UPDATE DealPartners SET name = ? WHERE name = ?", newName, oldName)
+	now := time.Now().Format("2006-01-02T15:04:05Z")
+	_, err = tx.Exec("UPDATE DealPartners SET name = ?, updated = ? WHERE id = ?", newName, now, partnerID)
 	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return fmt.Errorf("partner already exists: %s", newName)
+		}
 		return fmt.Errorf("failed to update partner: %v", err)
 	}
 
-	if err = tx.Commit(); err != nil {
-		return fmt.Errorf("failed to commit transaction: %v", err)
+	// Close the current name version and open a new one
+	_, err = tx.Exec("UPDATE DealPartnerNames SET validTo = ? WHERE partnerId = ? AND validTo IS NULL", now, partnerID)
+	if err != nil {
+		return fmt.Errorf("failed to close partner name version: %v", err)
 	}
 
-	// Update all period databases that contain deals with this partner
-	if err := updateDealPartnerInAllPeriods(oldName, newName); err != nil {
-		return fmt.Errorf("failed to update deals in period databases: %v", err)
+	_, err = tx.Exec("INSERT INTO DealPartnerNames (partnerId, name, validFrom) VALUES (?, ?, ?)",
+		partnerID, newName, now)
+	if err != nil {
+		return fmt.Errorf("failed to record partner name: %v", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
 	}
 
 	return nil
 }
 
-func updateDealPartnerInAllPeriods(oldName, newName string) error {
-	periods, err := GetAvailablePeriods()
+// GetDealPartnerHistory returns a partner and all versions of its name, oldest first.
+// A deleted partner is returned too, with Deleted set.
+func GetDealPartnerHistory(name string) (*DealPartner, []DealPartnerName, error) {
+	db, err := GetSystemDB()
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	for _, period := range periods {
-		periodDB, err := ConnectPeriodDB(period)
-		if err != nil {
-			continue
-		}
+	row := db.QueryRow("SELECT "+partnerColumns+" FROM DealPartners WHERE name = ?", name)
+	partner, err := scanDealPartner(row)
+	if err == sql.ErrNoRows {
+		return nil, nil, fmt.Errorf("partner not found: %s", name)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
 
-		// Update deals in this period database
-		_, err = periodDB.Exec("UPDATE Deals SET DealPartner = ? WHERE DealPartner = ?", newName, oldName)
-		if err != nil {
-			return fmt.Errorf("failed to update deals in period %s: %v", period, err)
+	rows, err := db.Query(`SELECT partnerId, name, validFrom, validTo FROM DealPartnerNames
+	                       WHERE partnerId = ? ORDER BY validFrom`, partner.ID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query partner names: %v", err)
+	}
+	defer rows.Close()
+
+	history := []DealPartnerName{}
+	for rows.Next() {
+		var version DealPartnerName
+		if err := rows.Scan(&version.PartnerID, &version.Name, &version.ValidFrom, &version.ValidTo); err != nil {
+			return nil, nil, fmt.Errorf("failed to scan partner name: %v", err)
 		}
+		history = append(history, version)
 	}
 
-	return nil
+	return partner, history, nil
+}
+
+func scanDealPartner(row rowScanner) (*DealPartner, error) {
+	var partner DealPartner
+	var created, updated, registrationNumber, registrationDate, expiryDate, deleted sql.NullString
+	err := row.Scan(&partner.ID, &partner.Name, &created, &updated,
+		&registrationNumber, &registrationDate, &expiryDate, &deleted)
+	if err == sql.ErrNoRows {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan partner: %v", err)
+	}
+	partner.Created = created.String
+	partner.Updated = updated.String
+	partner.RegistrationNumber = registrationNumber.String
+	partner.RegistrationDate = registrationDate.String
+	partner.ExpiryDate = expiryDate.String
+	partner.Deleted = deleted.String
+	return &partner, nil
 }
 
+// ResolvePartnerID returns the ID of the partner that carried the given name at the given time.
+// If no partner carried the name at that time, the partner that used it most recently is returned
+// unless that partner has been deleted.
+// It returns nil if the name is not registered.
+func ResolvePartnerID(name string, at string) (*int64, error) {
+	db, err := GetSystemDB()
+	if err != nil {
+		return nil, err
+	}
+
+	return resolvePartnerID(db, name, at)
+}
+
+func resolvePartnerID(db *sql.DB, name string, at string) (*int64, error) {
+	if name == "" {
+		return nil, nil
+	}
+
+	var partnerID int64
+	err := db.QueryRow(`SELECT partnerId FROM DealPartnerNames
+	                    WHERE name = ? AND validFrom <= ? AND (validTo IS NULL OR validTo > ?)
+	                    ORDER BY validFrom DESC LIMIT 1`, name, at, at).Scan(&partnerID)
+	if err == sql.ErrNoRows {
+		err = db.QueryRow(`SELECT partnerId FROM DealPartnerNames
+		                   WHERE name = ? AND partnerId IN (SELECT id FROM DealPartners WHERE deleted IS NULL)
+		                   ORDER BY validFrom DESC LIMIT 1`, name).Scan(&partnerID)
+	}
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve partner: %v", err)
+	}
+
+	return &partnerID, nil
+}
+
+// DeleteDealPartner deletes a partner that no deal uses. The partner is only marked as
+// deleted and its current name closed, so that its ID and name history stay resolvable.
 func DeleteDealPartner(name string) error {
-	// First check if partner is used in any period database
-	if err := checkPartnerUsageInAllPeriods(name); err != nil {
+	systemDB, err := GetSystemDB()
+	if err != nil {
 		return err
 	}
 
-	systemDB, err := GetSystemDB()
+	var partnerID int64
+	err = systemDB.QueryRow("SELECT id FROM DealPartners WHERE name = ? AND deleted IS NULL", name).Scan(&partnerID)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("partner not found: %s", name)
+	}
 	if err != nil {
+		return fmt.Errorf("failed to check existence: %v", err)
+	}
+
+	// First check if partner is used in any period database
+	if err := checkPartnerUsageInAllPeriods(partnerID, name); err != nil {
 		return err
 	}
 
-	result, err := systemDB.Exec("DELETE FROM DealPartners WHERE name = ?", name)
+	tx, err := systemDB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Format("2006-01-02T15:04:05Z")
+	result, err := tx.Exec("UPDATE DealPartners SET deleted = ?, updated = ? WHERE id = ? AND deleted IS NULL", now, now, partnerID)
 	if err != nil {
 		return fmt.Errorf("failed to delete partner: %v", err)
 	}
@@ -138,10 +338,19 @@ func DeleteDealPartner(name string) error {
 		return fmt.Errorf("partner not found: %s", name)
 	}
 
+	_, err = tx.Exec("UPDATE DealPartnerNames SET validTo = ? WHERE partnerId = ? AND validTo IS NULL", now, partnerID)
+	if err != nil {
+		return fmt.Errorf("failed to close partner name version: %v", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
 	return nil
 }
 
-func checkPartnerUsageInAllPeriods(partnerName string) error {
+func checkPartnerUsageInAllPeriods(partnerID int64, partnerName string) error {
 	periods, err := GetAvailablePeriods()
 	if err != nil {
 		return err
@@ -154,7 +363,8 @@ func checkPartnerUsageInAllPeriods(partnerName string) error {
 		}
 
 		var dealCount int
-		err = periodDB.QueryRow("SELECT COUNT(*) FROM Deals WHERE DealPartner = ?", partnerName).Scan(&dealCount)
+		err = periodDB.QueryRow("SELECT COUNT(*) FROM Deals WHERE PartnerID = ? OR (PartnerID IS NULL AND DealPartner = ?)",
+			partnerID, partnerName).Scan(&dealCount)
 		if err != nil && err != sql.ErrNoRows {
 			return fmt.Errorf("failed to check deals in period %s: %v", period, err)
 		}
@@ -165,4 +375,108 @@ func checkPartnerUsageInAllPeriods(partnerName string) error {
 	}
 
 	return nil
-}
\ No newline at end of file
+}
+
+// migrateDealPartnersTable rebuilds a DealPartners table created before partners had stable IDs
+// and records the existing names as the first name versions.
+func migrateDealPartnersTable(db *sql.DB) error {
+	var hasID int
+	err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('DealPartners') WHERE name = 'id'`).Scan(&hasID)
+	if err != nil {
+		return fmt.Errorf("failed to read columns of DealPartners: %v", err)
+	}
+
+	if hasID == 0 {
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to start transaction: %v", err)
+		}
+		defer tx.Rollback()
+
+		now := time.Now().Format("2006-01-02T15:04:05Z")
+		queries := []struct {
+			query string
+			args  []interface{}
+		}{
+			{`CREATE TABLE "DealPartners_new" (
+				"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+				"name" TEXT NOT NULL UNIQUE,
+				"created" TEXT,
+				"updated" TEXT
+			)`, nil},
+			{`INSERT INTO DealPartners_new (name, created, updated)
+			  SELECT name, ?, ? FROM DealPartners ORDER BY name`, []interface{}{now, now}},
+			{`DROP TABLE DealPartners`, nil},
+			{`ALTER TABLE DealPartners_new RENAME TO DealPartners`, nil},
+		}
+		for _, q := range queries {
+			if _, err := tx.Exec(q.query, q.args...); err != nil {
+				return fmt.Errorf("failed to migrate DealPartners: %v", err)
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit transaction: %v", err)
+		}
+	}
+
+	return ensurePartnerNameHistory(db)
+}
+
+// ensurePartnerNameHistory records the current name of partners that have no name version yet.
+// Such names are treated as valid since the beginning so that older deals resolve to them.
+func ensurePartnerNameHistory(db *sql.DB) error {
+	_, err := db.Exec(`INSERT INTO DealPartnerNames (partnerId, name, validFrom)
+	                   SELECT id, name, '' FROM DealPartners
+	                   WHERE id NOT IN (SELECT partnerId FROM DealPartnerNames)`)
+	if err != nil {
+		return fmt.Errorf("failed to record partner names: %v", err)
+	}
+	return nil
+}
+
+// backfillDealPartnerIDs links deals written before partners had IDs to their partner.
+// Each deal is resolved with the name that was valid when it was registered.
+// It only fills the empty PartnerID column and never changes what was entered.
+func backfillDealPartnerIDs(periodDB *sql.DB, sysDB *sql.DB) error {
+	if sysDB == nil {
+		return nil
+	}
+
+	rows, err := periodDB.Query(`SELECT NO, DealPartner, RegDate FROM Deals
+	                             WHERE PartnerID IS NULL AND DealPartner IS NOT NULL AND DealPartner != ''`)
+	if err != nil {
+		return fmt.Errorf("failed to query deals without partner id: %v", err)
+	}
+
+	type pending struct {
+		NO, Partner, RegDate string
+	}
+	var deals []pending
+	for rows.Next() {
+		var deal pending
+		var regDate sql.NullString
+		if err := rows.Scan(&deal.NO, &deal.Partner, &regDate); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan deal: %v", err)
+		}
+		deal.RegDate = regDate.String
+		deals = append(deals, deal)
+	}
+	rows.Close()
+
+	for _, deal := range deals {
+		partnerID, err := resolvePartnerID(sysDB, deal.Partner, deal.RegDate)
+		if err != nil {
+			return err
+		}
+		if partnerID == nil {
+			continue
+		}
+		if _, err := periodDB.Exec("UPDATE Deals SET PartnerID = ? WHERE NO = ?", *partnerID, deal.NO); err != nil {
+			return fmt.Errorf("failed to link deal %s to partner: %v", deal.NO, err)
+		}
+	}
+
+	return nil
+}
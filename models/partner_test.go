@@ -0,0 +1,110 @@
+package models
+
+import (
+	"testing"
+)
+
+func TestDeleteDealPartnerKeepsNameHistory(t *testing.T) {
+	setupTestDB(t)
+
+	partner := &DealPartner{Name: "旧商店"}
+	if err := CreateDealPartner(partner); err != nil {
+		t.Fatal(err)
+	}
+	// Let the first name be valid well before the rename
+	if _, err := systemDB.Exec(`UPDATE DealPartnerNames SET validFrom = '2024-01-01T00:00:00Z' WHERE partnerId = ?`, partner.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpdateDealPartner("旧商店", "新商店"); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteDealPartner("新商店"); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := GetDealPartners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 0 {
+		t.Errorf("deleted partner is listed: %v", names)
+	}
+
+	deleted, history, err := GetDealPartnerHistory("新商店")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted.ID != partner.ID || deleted.Deleted == "" {
+		t.Errorf("deleted partner: got %+v", deleted)
+	}
+	if len(history) != 2 || history[0].Name != "旧商店" || history[1].Name != "新商店" {
+		t.Fatalf("name history: got %+v", history)
+	}
+	for _, version := range history {
+		if version.ValidTo == nil {
+			t.Errorf("name %s is still open after deletion", version.Name)
+		}
+	}
+
+	// Deals registered under the old name still resolve to the partner
+	id, err := ResolvePartnerID("旧商店", "2024-06-01T00:00:00Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id == nil || *id != partner.ID {
+		t.Errorf("historical name resolved to %v, want %d", id, partner.ID)
+	}
+
+	// New deals are not linked to the deleted partner
+	id, err = ResolvePartnerID("新商店", "2999-01-01T00:00:00Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != nil {
+		t.Errorf("name of a deleted partner resolved to %d", *id)
+	}
+
+	if err := DeleteDealPartner("新商店"); err == nil {
+		t.Error("deleting a deleted partner succeeded")
+	}
+	if err := UpdateDealPartner("新商店", "別商店"); err == nil {
+		t.Error("renaming a deleted partner succeeded")
+	}
+
+	// Registering the name again restores the partner with its history
+	restored := &DealPartner{Name: "新商店"}
+	if err := CreateDealPartner(restored); err != nil {
+		t.Fatal(err)
+	}
+	if restored.ID != partner.ID {
+		t.Errorf("restored partner has ID %d, want %d", restored.ID, partner.ID)
+	}
+	current, history, err := GetDealPartnerHistory("新商店")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Deleted != "" || len(history) != 3 || history[2].ValidTo != nil {
+		t.Errorf("restored partner: got %+v with history %+v", current, history)
+	}
+}
+
+func TestDeleteDealPartnerInUse(t *testing.T) {
+	setupTestDB(t)
+	if _, err := ConnectToPeriod("2025"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CreateDealPartner(&DealPartner{Name: "テスト商店"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateDeal("2025", newTestDeal("文房具", 1100)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := DeleteDealPartner("テスト商店"); err == nil {
+		t.Fatal("partner with deals was deleted")
+	}
+	if names, _ := GetDealPartners(); len(names) != 1 {
+		t.Errorf("partners after refused delete: %v", names)
+	}
+}
@@ -71,13 +71,9 @@ func GetAllPeriodsWithDetails() ([]Period, error) {
 // GetPeriodByName returns a specific period by name
 func GetPeriodByName(name string) (*Period, error) {
 	// Connect to the period's database
-	if err := ConnectToPeriod(name); err != nil {
-		return nil, fmt.Errorf("failed to connect to period %s: %v", name, err)
-	}
-	
-	db, err := GetDB()
+	db, err := ConnectToPeriod(name)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to connect to period %s: %v", name, err)
 	}
 
 	query := `SELECT fromDate, toDate, created, updated FROM Period LIMIT 1`
@@ -109,7 +105,7 @@ func CreatePeriod(req *PeriodRequest) (*Period, error) {
 	}
 
 	// Create period database and connect
-	if err := ConnectToPeriod(req.Name); err != nil {
+	if _, err := ConnectToPeriod(req.Name); err != nil {
 		return nil, fmt.Errorf("failed to create period database: %v", err)
 	}
 
@@ -133,13 +129,9 @@ func CreatePeriod(req *PeriodRequest) (*Period, error) {
 // CreatePeriodRecord inserts a period record into the database
 func CreatePeriodRecord(period *Period) error {
 	// Connect to the period's database
-	if err := ConnectToPeriod(period.Name); err != nil {
-		return fmt.Errorf("failed to connect to period %s: %v", period.Name, err)
-	}
-	
-	db, err := GetDB()
+	db, err := ConnectToPeriod(period.Name)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to connect to period %s: %v", period.Name, err)
 	}
 
 	// First delete any existing record (should be only one)
@@ -218,13 +210,9 @@ func UpdatePeriod(periodName string, req *PeriodUpdateRequest) (*Period, error)
 	existing.Updated = time.Now().Format(time.RFC3339)
 
 	// Update in database
-	if err := ConnectToPeriod(periodName); err != nil {
-		return nil, fmt.Errorf("failed to connect to period %s: %v", periodName, err)
-	}
-	
-	db, err := GetDB()
+	db, err := ConnectToPeriod(periodName)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to connect to period %s: %v", periodName, err)
 	}
 
 	_, err = db.Exec(`UPDATE Period SET fromDate = ?, toDate = ?, updated = ?`,
@@ -238,17 +226,12 @@ func UpdatePeriod(periodName string, req *PeriodUpdateRequest) (*Period, error)
 
 // RenamePeriod renames a period (changes its directory name)
 func RenamePeriod(oldName string, newName string) (*Period, error) {
-	// Validate new name - allow any non-empty string
+	// Validate new name
 	if newName == "" {
 		return nil, fmt.Errorf("new period name cannot be empty")
 	}
-	
-	// Check for invalid file system characters
-	invalidChars := []string{"/", "\\", ":", "*", "?", "\"", "<", ">", "|"}
-	for _, char := range invalidChars {
-		if strings.Contains(newName, char) {
-			return nil, fmt.Errorf("period name cannot contain special characters: %s", char)
-		}
+	if err := ValidatePeriodName(newName); err != nil {
+		return nil, err
 	}
 
 	// Check if new name already exists
@@ -277,6 +260,10 @@ func RenamePeriod(oldName string, newName string) (*Period, error) {
 		}
 	}
 
+	if err := renameChainHead(oldName, newName); err != nil {
+		return nil, err
+	}
+
 	// Update period record with new name
 	existing.Name = newName
 	existing.Updated = time.Now().Format(time.RFC3339)
@@ -290,13 +277,9 @@ func RenamePeriod(oldName string, newName string) (*Period, error) {
 // DeletePeriod deletes a period if it has no deals
 func DeletePeriod(name string) error {
 	// Check if period exists and has deals
-	if err := ConnectToPeriod(name); err != nil {
-		return fmt.Errorf("failed to connect to period: %v", err)
-	}
-
-	periodDB, err := GetDB()
+	periodDB, err := ConnectToPeriod(name)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to connect to period: %v", err)
 	}
 
 	// Check if period has deals
@@ -321,23 +304,36 @@ func DeletePeriod(name string) error {
 		return fmt.Errorf("failed to delete period directory: %v", err)
 	}
 
-	return nil
+	return deleteChainHead(name)
 }
 
-// ValidatePeriodRequest validates a period request
-func ValidatePeriodRequest(req *PeriodRequest) error {
-	if req.Name == "" {
+// ValidatePeriodName checks that a period name can be used as the name of its directory.
+// Separators and the names "." and ".." would place the database outside the base path.
+func ValidatePeriodName(name string) error {
+	if name == "" {
 		return fmt.Errorf("period name is required")
 	}
+	if name == "." || name == ".." {
+		return fmt.Errorf("period name cannot be %s", name)
+	}
 
 	// Check for invalid file system characters
 	invalidChars := []string{"/", "\\", ":", "*", "?", "\"", "<", ">", "|"}
 	for _, char := range invalidChars {
-		if strings.Contains(req.Name, char) {
+		if strings.Contains(name, char) {
 			return fmt.Errorf("period name cannot contain special characters: %s", char)
 		}
 	}
 
+	return nil
+}
+
+// ValidatePeriodRequest validates a period request
+func ValidatePeriodRequest(req *PeriodRequest) error {
+	if err := ValidatePeriodName(req.Name); err != nil {
+		return err
+	}
+
 	// Validate date formats
 	if req.FromDate != "" && req.FromDate != "未設定" {
 		if !IsValidDate(req.FromDate) {
@@ -0,0 +1,41 @@
+package models
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConnectPeriodDBDoesNotCreatePeriods(t *testing.T) {
+	setupTestDB(t)
+
+	if _, err := ConnectPeriodDB("2030"); err == nil {
+		t.Fatal("ConnectPeriodDB opened a period that does not exist")
+	}
+	if _, err := os.Stat(filepath.Join(GetBasePath(), "2030")); !os.IsNotExist(err) {
+		t.Errorf("ConnectPeriodDB created the period directory: %v", err)
+	}
+
+	if _, err := ConnectToPeriod("2030"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ConnectPeriodDB("2030"); err != nil {
+		t.Errorf("ConnectPeriodDB after ConnectToPeriod: %v", err)
+	}
+}
+
+func TestOpenPeriodDBRejectsPathNames(t *testing.T) {
+	setupTestDB(t)
+
+	for _, name := range []string{"", ".", "..", "../2025", "2025/..", `..\2025`, "C:2025"} {
+		if _, err := ConnectToPeriod(name); err == nil {
+			t.Errorf("ConnectToPeriod(%q) was accepted", name)
+		}
+		if _, err := ConnectPeriodDB(name); err == nil {
+			t.Errorf("ConnectPeriodDB(%q) was accepted", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(GetBasePath(), "..", "Denchokun.db")); !os.IsNotExist(err) {
+		t.Errorf("a database was created outside the base path: %v", err)
+	}
+}
@@ -0,0 +1,535 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"html"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// dealSearchQueries create the full-text index of the text columns of Deals.
+// DealsFTS is an external content FTS5 table over Deals kept in sync by triggers; the
+// trigram tokenizer indexes every three characters, so Japanese text without spaces
+// can be searched by any part of it.
+var dealSearchQueries = []string{
+	`CREATE VIRTUAL TABLE IF NOT EXISTS DealsFTS USING fts5(
+		DealName, DealRemark, DealPartner,
+		content='Deals', content_rowid='rowid', tokenize='trigram'
+	)`,
+	`CREATE TRIGGER IF NOT EXISTS Deals_fts_insert AFTER INSERT ON Deals BEGIN
+		INSERT INTO DealsFTS(rowid, DealName, DealRemark, DealPartner)
+		VALUES (new.rowid, new.DealName, new.DealRemark, new.DealPartner);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS Deals_fts_delete AFTER DELETE ON Deals BEGIN
+		INSERT INTO DealsFTS(DealsFTS, rowid, DealName, DealRemark, DealPartner)
+		VALUES ('delete', old.rowid, old.DealName, old.DealRemark, old.DealPartner);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS Deals_fts_update AFTER UPDATE OF DealName, DealRemark, DealPartner ON Deals BEGIN
+		INSERT INTO DealsFTS(DealsFTS, rowid, DealName, DealRemark, DealPartner)
+		VALUES ('delete', old.rowid, old.DealName, old.DealRemark, old.DealPartner);
+		INSERT INTO DealsFTS(rowid, DealName, DealRemark, DealPartner)
+		VALUES (new.rowid, new.DealName, new.DealRemark, new.DealPartner);
+	END`,
+}
+
+// minSearchTermLength is the shortest term the trigram index can find; shorter terms
+// are matched with LIKE
+const minSearchTermLength = 3
+
+// setupDealSearch creates the search index of a period database. An index created for
+// a database that already has deals is filled from them.
+func setupDealSearch(db *sql.DB) error {
+	var exists int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE name = 'DealsFTS'`).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to check search index: %v", err)
+	}
+
+	for _, query := range dealSearchQueries {
+		if _, err := db.Exec(query); err != nil {
+			return fmt.Errorf("failed to create search index: %v", err)
+		}
+	}
+
+	if exists == 0 {
+		if _, err := db.Exec(`INSERT INTO DealsFTS(DealsFTS) VALUES ('rebuild')`); err != nil {
+			return fmt.Errorf("failed to build search index: %v", err)
+		}
+	}
+	return nil
+}
+
+// SearchIndexResult is the result of rebuilding the search index of one period
+type SearchIndexResult struct {
+	Period  string  `json:"period"`
+	Deals   int     `json:"deals"`
+	Files   int     `json:"files"` // files with extracted text
+	Seconds float64 `json:"seconds"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// RebuildDealSearchIndex rebuilds the search indexes of the deals and the extracted file
+// texts of a period, for databases whose index is out of date (e.g. after rows were
+// changed with the triggers missing, or the database was vacuumed).
+// With reextract the texts are removed and extracted again in the background, e.g. after
+// the extractor has been improved.
+func RebuildDealSearchIndex(period string, reextract bool) (*SearchIndexResult, error) {
+	db, err := ConnectPeriodDB(period)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	result := &SearchIndexResult{Period: period}
+	if reextract {
+		if _, err := db.Exec(`DELETE FROM FileTexts`); err != nil {
+			return nil, fmt.Errorf("failed to reset file texts of period %s: %v", period, err)
+		}
+		defer scheduleTextExtraction(period)
+	}
+	for _, index := range []string{"DealsFTS", "FileTextsFTS"} {
+		if _, err := db.Exec(`INSERT INTO ` + index + `(` + index + `) VALUES ('rebuild')`); err != nil {
+			return nil, fmt.Errorf("failed to rebuild search index of period %s: %v", period, err)
+		}
+	}
+	if err := db.QueryRow(`SELECT COUNT(*) FROM Deals`).Scan(&result.Deals); err != nil {
+		return nil, fmt.Errorf("failed to count deals: %v", err)
+	}
+	if err := db.QueryRow(`SELECT COUNT(*) FROM FileTexts WHERE Status = ?`, FileTextExtracted).Scan(&result.Files); err != nil {
+		return nil, fmt.Errorf("failed to count file texts: %v", err)
+	}
+	result.Seconds = time.Since(start).Seconds()
+
+	return result, nil
+}
+
+// splitSearchTerms splits a search text on spaces into terms that the trigram index
+// can find and shorter terms
+func splitSearchTerms(text string) (long []string, short []string) {
+	for _, term := range strings.Fields(text) {
+		if utf8.RuneCountInString(term) >= minSearchTermLength {
+			long = append(long, term)
+		} else {
+			short = append(short, term)
+		}
+	}
+	return long, short
+}
+
+// matchExpression builds an FTS5 query matching every term as a literal string
+func matchExpression(terms []string) string {
+	return strings.Join(quoteMatchTerms(terms), " ")
+}
+
+// matchAnyExpression builds an FTS5 query matching any of the terms, for ranking and
+// snippets when the terms may be spread over a deal and its files
+func matchAnyExpression(terms []string) string {
+	return strings.Join(quoteMatchTerms(terms), " OR ")
+}
+
+// quoteMatchTerms quotes terms as FTS5 strings
+func quoteMatchTerms(terms []string) []string {
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = `"` + strings.ReplaceAll(term, `"`, `""`) + `"`
+	}
+	return quoted
+}
+
+// keywordCondition returns the condition for the keyword filter: every space-separated
+// term must appear in DealName, DealRemark or DealPartner. Terms of three or more
+// characters use the search index.
+func keywordCondition(keyword string) (string, []interface{}) {
+	long, short := splitSearchTerms(keyword)
+
+	conds := []string{}
+	args := []interface{}{}
+	if len(long) > 0 {
+		conds = append(conds, "Deals.rowid IN (SELECT rowid FROM DealsFTS WHERE DealsFTS MATCH ?)")
+		args = append(args, matchExpression(long))
+	}
+	for _, term := range short {
+		pattern := likeContains(term)
+		conds = append(conds, "(DealName LIKE ? ESCAPE '\\' OR DealRemark LIKE ? ESCAPE '\\' OR DealPartner LIKE ? ESCAPE '\\')")
+		args = append(args, pattern, pattern, pattern)
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return "(" + strings.Join(conds, " AND ") + ")", args
+}
+
+// DealSearchResult is a deal found by SearchDeals
+type DealSearchResult struct {
+	Deal
+	Score    float64           `json:"score"`    // relevance, higher is better; 0 when no term could use the index
+	Snippets map[string]string `json:"snippets"` // matching parts of DealName, DealRemark, DealPartner and FileText
+}
+
+// SearchOptions are the options of SearchDeals
+type SearchOptions struct {
+	Query          string // space-separated terms, all of which must match
+	HighlightStart string // put before each match in snippets
+	HighlightEnd   string // put after each match in snippets
+}
+
+// Snippets are made with these private marks around the matches; the text is then
+// HTML-escaped and the marks replaced by the highlight strings of the options, so that
+// content such as "<script>" in a deal or file is never returned as markup
+const (
+	snippetMarkStart = "\x02"
+	snippetMarkEnd   = "\x03"
+)
+
+// snippetMarks are the options used while making snippets
+var snippetMarks = SearchOptions{HighlightStart: snippetMarkStart, HighlightEnd: snippetMarkEnd}
+
+// stripSnippetMarks removes the private marks from text taken from a deal or file
+var stripSnippetMarks = strings.NewReplacer(snippetMarkStart, "", snippetMarkEnd, "")
+
+// renderSnippet HTML-escapes a snippet made with the private marks and replaces the
+// marks by the highlight strings. Unbalanced marks, which can only come from content
+// that contained them, are dropped.
+func renderSnippet(snippet string, options SearchOptions) string {
+	var b strings.Builder
+	open := false
+	for snippet != "" {
+		i := strings.IndexAny(snippet, snippetMarkStart+snippetMarkEnd)
+		if i < 0 {
+			b.WriteString(html.EscapeString(snippet))
+			break
+		}
+		b.WriteString(html.EscapeString(snippet[:i]))
+		switch mark := snippet[i : i+1]; {
+		case mark == snippetMarkStart && !open:
+			b.WriteString(options.HighlightStart)
+			open = true
+		case mark == snippetMarkEnd && open:
+			b.WriteString(options.HighlightEnd)
+			open = false
+		}
+		snippet = snippet[i+1:]
+	}
+	if open {
+		b.WriteString(options.HighlightEnd)
+	}
+	return b.String()
+}
+
+// snippetTokens is the length of a snippet in trigram tokens (about one character each)
+const snippetTokens = 32
+
+// fileSnippetTokens is the length of a snippet of a file text, the most FTS5 allows
+const fileSnippetTokens = 64
+
+// snippetColumns are the searched columns in the order of DealsFTS
+var snippetColumns = []string{"DealName", "DealRemark", "DealPartner"}
+
+// fileTextSnippet is the key of the snippet of the text extracted from the deal's files
+const fileTextSnippet = "FileText"
+
+// dealFilesIn returns the condition that the file of a deal or one of its active
+// attachments is among the hashes selected by hashQuery
+func dealFilesIn(hashQuery string) string {
+	return "Deals.Hash IN (" + hashQuery + ") OR Deals.NO IN (SELECT DealNO FROM Attachments WHERE Status = '" +
+		AttachmentActive + "' AND Hash IN (" + hashQuery + "))"
+}
+
+// searchTermCondition returns the condition that a term of a search appears in
+// DealName, DealRemark or DealPartner, or in the text extracted from the deal's files
+func searchTermCondition(term string) (string, []interface{}) {
+	if utf8.RuneCountInString(term) >= minSearchTermLength {
+		match := matchExpression([]string{term})
+		return "(Deals.rowid IN (SELECT rowid FROM DealsFTS WHERE DealsFTS MATCH ?) OR " +
+				dealFilesIn("SELECT Hash FROM FileTexts WHERE rowid IN (SELECT rowid FROM FileTextsFTS WHERE FileTextsFTS MATCH ?)") + ")",
+			[]interface{}{match, match, match}
+	}
+
+	pattern := likeContains(term)
+	return "(DealName LIKE ? ESCAPE '\\' OR DealRemark LIKE ? ESCAPE '\\' OR DealPartner LIKE ? ESCAPE '\\' OR " +
+			dealFilesIn("SELECT Hash FROM FileTexts WHERE Content LIKE ? ESCAPE '\\'") + ")",
+		[]interface{}{pattern, pattern, pattern, pattern, pattern}
+}
+
+// likeEscaper escapes the LIKE wildcards and the escape character itself
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// likeContains returns a LIKE pattern matching term anywhere as a literal string.
+// The condition must declare ESCAPE '\'.
+func likeContains(term string) string {
+	return "%" + likeEscaper.Replace(term) + "%"
+}
+
+// SearchDeals finds the deals of a period that contain every term of the query and
+// also match the other conditions of filter. A term matches if it appears in DealName,
+// DealRemark or DealPartner, or in the text extracted from the deal's file or active
+// attachments. Results are ranked by relevance (BM25 of the deal and of its best matching
+// file) and carry snippets of the matching columns with the matches highlighted.
+// A query whose terms are all shorter than three characters cannot use the index; its
+// results are in date order and the snippets are made without it.
+func SearchDeals(filter *DealFilter, options SearchOptions) ([]DealSearchResult, int, error) {
+	db, err := ConnectPeriodDB(filter.Period)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	long, short := splitSearchTerms(options.Query)
+	if len(long) == 0 && len(short) == 0 {
+		return nil, 0, fmt.Errorf("search query is empty")
+	}
+
+	// The joins only rank and make snippets; which deals match is decided per term below.
+	// The file text matches are materialized so that bm25 and snippet run on the index
+	// rather than in the aggregate that picks the best file of each deal.
+	with := ""
+	from := "Deals"
+	selectExtra := "0, '', '', '', ''"
+	order := " ORDER BY DealDate DESC, NO DESC"
+	var args []interface{}
+	if len(long) > 0 {
+		anyTerm := matchAnyExpression(long)
+		with = `WITH texts AS MATERIALIZED (SELECT FileTexts.Hash AS textHash, bm25(FileTextsFTS) AS textRank,
+		        snippet(FileTextsFTS, 0, ?, ?, '…', ?) AS textSnippet
+		        FROM FileTextsFTS JOIN FileTexts ON FileTexts.rowid = FileTextsFTS.rowid
+		        WHERE FileTextsFTS MATCH ?) `
+		args = append(args, snippetMarkStart, snippetMarkEnd, fileSnippetTokens, anyTerm)
+
+		from = `Deals
+		        LEFT JOIN (SELECT rowid AS matchID, bm25(DealsFTS) AS matchRank,
+		        snippet(DealsFTS, 0, ?, ?, '…', ?) AS snippet0,
+		        snippet(DealsFTS, 1, ?, ?, '…', ?) AS snippet1,
+		        snippet(DealsFTS, 2, ?, ?, '…', ?) AS snippet2
+		        FROM DealsFTS WHERE DealsFTS MATCH ?) AS matches ON Deals.rowid = matches.matchID
+		        LEFT JOIN (SELECT files.DealNO AS textNO, MIN(texts.textRank) AS textRank, texts.textSnippet AS textSnippet
+		        FROM (SELECT NO AS DealNO, Hash FROM Deals
+		              UNION SELECT DealNO, Hash FROM Attachments WHERE Status = '` + AttachmentActive + `') AS files
+		        JOIN texts ON texts.textHash = files.Hash
+		        GROUP BY files.DealNO) AS textMatches ON textMatches.textNO = Deals.NO`
+		for range snippetColumns {
+			args = append(args, snippetMarkStart, snippetMarkEnd, snippetTokens)
+		}
+		args = append(args, anyTerm)
+
+		selectExtra = `COALESCE(-matchRank, 0) + COALESCE(-textRank, 0) AS score, COALESCE(snippet0, ''),
+		               COALESCE(snippet1, ''), COALESCE(snippet2, ''), COALESCE(textSnippet, '')`
+		order = " ORDER BY score DESC, DealDate DESC, NO DESC"
+	}
+
+	where := " WHERE 1=1"
+	if filter.View != "history" {
+		where += " AND (RecStatus = 'NEW' OR RecStatus = 'DELETE') AND nextNO IS NULL"
+	}
+	for _, term := range append(long, short...) {
+		condition, termArgs := searchTermCondition(term)
+		where += " AND " + condition
+		args = append(args, termArgs...)
+	}
+	conditions, filterArgs := buildDealConditions(filter)
+	where += conditions
+	args = append(args, filterArgs...)
+
+	var totalCount int
+	if err := db.QueryRow(with+"SELECT COUNT(*) FROM "+from+where, args...).Scan(&totalCount); err != nil {
+		return nil, 0, fmt.Errorf("failed to count deals: %v", err)
+	}
+
+	query := with + "SELECT " + dealColumns + ", " + selectExtra + " FROM " + from + where + order
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = 1000
+	}
+	query += " LIMIT ? OFFSET ?"
+	args = append(args, limit, filter.Offset)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to search deals: %v", err)
+	}
+	defer rows.Close()
+
+	results := []DealSearchResult{}
+	for rows.Next() {
+		var result DealSearchResult
+		var snippets [4]string
+		if err := scanDeal(extraColumns{rows, []interface{}{&result.Score, &snippets[0], &snippets[1], &snippets[2], &snippets[3]}}, &result.Deal); err != nil {
+			return nil, 0, fmt.Errorf("failed to scan deal: %v", err)
+		}
+
+		values := []string{result.DealName, result.DealRemark, result.DealPartner}
+		result.Snippets = map[string]string{}
+		for i, column := range snippetColumns {
+			snippet := snippets[i]
+			if strings.Contains(snippet, snippetMarkStart) {
+				snippet = highlightOutsideMarks(snippet, short, snippetMarks)
+			} else {
+				snippet = highlightTerms(stripSnippetMarks.Replace(values[i]), short, snippetMarks)
+			}
+			if strings.Contains(snippet, snippetMarkStart) {
+				result.Snippets[column] = renderSnippet(snippet, options)
+			}
+		}
+		if strings.Contains(snippets[3], snippetMarkStart) {
+			result.Snippets[fileTextSnippet] = renderSnippet(highlightOutsideMarks(snippets[3], short, snippetMarks), options)
+		}
+		results = append(results, result)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("error iterating rows: %v", err)
+	}
+	rows.Close()
+
+	// Deals that matched only short terms in the text of their files get the snippet from it
+	if len(short) > 0 {
+		for i := range results {
+			if len(results[i].Snippets) > 0 {
+				continue
+			}
+			snippet, err := shortTermFileSnippet(db, &results[i].Deal, short, options)
+			if err != nil {
+				return nil, 0, err
+			}
+			if snippet != "" {
+				results[i].Snippets[fileTextSnippet] = snippet
+			}
+		}
+	}
+
+	return results, totalCount, nil
+}
+
+// shortTermFileSnippet makes a snippet of the first text of the files of a deal that
+// contains one of terms, for terms too short for the search index
+func shortTermFileSnippet(db *sql.DB, deal *Deal, terms []string, options SearchOptions) (string, error) {
+	rows, err := db.Query(`SELECT Content FROM FileTexts WHERE Hash = ?
+	                       OR Hash IN (SELECT Hash FROM Attachments WHERE DealNO = ? AND Status = ?)`,
+		deal.Hash, deal.NO, AttachmentActive)
+	if err != nil {
+		return "", fmt.Errorf("failed to get file texts: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var content string
+		if err := rows.Scan(&content); err != nil {
+			return "", fmt.Errorf("failed to scan file text: %v", err)
+		}
+		if snippet := highlightTerms(stripSnippetMarks.Replace(content), terms, snippetMarks); snippet != "" {
+			return renderSnippet(snippet, options), nil
+		}
+	}
+	return "", rows.Err()
+}
+
+// extraColumns scans the columns of scanDeal followed by extra columns
+type extraColumns struct {
+	row   rowScanner
+	extra []interface{}
+}
+
+func (e extraColumns) Scan(dest ...interface{}) error {
+	return e.row.Scan(append(dest, e.extra...)...)
+}
+
+// highlightTerms makes a snippet of text around the first of terms found in it, for
+// terms too short for the search index. It returns "" if no term is found.
+func highlightTerms(text string, terms []string, options SearchOptions) string {
+	runes := []rune(text)
+	marked, first := markTerms(runes, terms)
+	if first < 0 {
+		return ""
+	}
+
+	start, end := 0, len(runes)
+	if end-start > snippetTokens {
+		start = first - snippetTokens/4
+		if start < 0 {
+			start = 0
+		}
+		end = start + snippetTokens
+		if end > len(runes) {
+			end = len(runes)
+			start = end - snippetTokens
+		}
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	writeMarked(&b, runes[start:end], marked[start:end], options)
+	if end < len(runes) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
+
+// highlightOutsideMarks highlights terms in the parts of an index snippet that are not
+// highlighted yet, so that short terms of a query are marked along with the long ones
+func highlightOutsideMarks(snippet string, terms []string, options SearchOptions) string {
+	if len(terms) == 0 {
+		return snippet
+	}
+
+	var b strings.Builder
+	for snippet != "" {
+		i := strings.Index(snippet, options.HighlightStart)
+		if i < 0 {
+			i = len(snippet)
+		}
+		plain := []rune(snippet[:i])
+		marked, _ := markTerms(plain, terms)
+		writeMarked(&b, plain, marked, options)
+		snippet = snippet[i:]
+
+		// Copy the highlighted part as it is
+		if j := strings.Index(snippet, options.HighlightEnd); j >= 0 && snippet != "" {
+			b.WriteString(snippet[:j+len(options.HighlightEnd)])
+			snippet = snippet[j+len(options.HighlightEnd):]
+		} else {
+			b.WriteString(snippet)
+			snippet = ""
+		}
+	}
+	return b.String()
+}
+
+// markTerms returns which runes of text belong to an occurrence of one of terms,
+// ignoring case, and the position of the first occurrence or -1
+func markTerms(runes []rune, terms []string) ([]bool, int) {
+	lower := []rune(strings.ToLower(string(runes)))
+	if len(lower) != len(runes) {
+		lower = runes
+	}
+
+	marked := make([]bool, len(runes))
+	first := -1
+	for _, term := range terms {
+		t := []rune(strings.ToLower(term))
+		for i := 0; i+len(t) <= len(lower); i++ {
+			if string(lower[i:i+len(t)]) != string(t) {
+				continue
+			}
+			for j := i; j < i+len(t); j++ {
+				marked[j] = true
+			}
+			if first < 0 || i < first {
+				first = i
+			}
+		}
+	}
+	return marked, first
+}
+
+// writeMarked writes runes with each run of marked runes between the highlight marks
+func writeMarked(b *strings.Builder, runes []rune, marked []bool, options SearchOptions) {
+	for i, r := range runes {
+		if marked[i] && (i == 0 || !marked[i-1]) {
+			b.WriteString(options.HighlightStart)
+		}
+		b.WriteRune(r)
+		if marked[i] && (i == len(runes)-1 || !marked[i+1]) {
+			b.WriteString(options.HighlightEnd)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package models
+
+import (
+	"testing"
+)
+
+var htmlMarks = SearchOptions{HighlightStart: "<mark>", HighlightEnd: "</mark>"}
+
+func TestRenderSnippet(t *testing.T) {
+	tests := []struct {
+		name    string
+		snippet string
+		want    string
+	}{
+		{"plain text", "文房具", "文房具"},
+		{"highlight", "\x02文房\x03具", "<mark>文房</mark>具"},
+		{"markup in content", "<b>\x02文房具\x03</b> & co", "&lt;b&gt;<mark>文房具</mark>&lt;/b&gt; &amp; co"},
+		{"unclosed mark", "\x02文房具", "<mark>文房具</mark>"},
+		{"stray end mark", "文\x03房具", "文房具"},
+		{"nested start mark", "\x02文\x02房\x03具", "<mark>文房</mark>具"},
+	}
+
+	for _, tt := range tests {
+		if got := renderSnippet(tt.snippet, htmlMarks); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSearchDealsEscapesSnippets(t *testing.T) {
+	setupTestDB(t)
+	const period = "2025"
+	if _, err := ConnectToPeriod(period); err != nil {
+		t.Fatal(err)
+	}
+	deal := newTestDeal(`<img src=x onerror=alert(1)>文房具セット`, 1100)
+	deal.DealRemark = `<script>文具</script>`
+	if err := CreateDeal(period, deal); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query  string
+		column string
+		want   string
+	}{
+		// Through the index
+		{"文房具", "DealName", "&lt;img src=x onerror=alert(1)&gt;<mark>文房具</mark>セット"},
+		// Too short for the index
+		{"文具", "DealRemark", "&lt;script&gt;<mark>文具</mark>&lt;/script&gt;"},
+	}
+	for _, tt := range tests {
+		options := htmlMarks
+		options.Query = tt.query
+		results, _, err := SearchDeals(&DealFilter{Period: period}, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 1 {
+			t.Fatalf("%s: got %d results", tt.query, len(results))
+		}
+		if got := results[0].Snippets[tt.column]; got != tt.want {
+			t.Errorf("%s: %s snippet %q, want %q", tt.query, tt.column, got, tt.want)
+		}
+	}
+}
+
+func TestSearchDealsShortTermsMatchWildcardsLiterally(t *testing.T) {
+	setupTestDB(t)
+	const period = "2025"
+	if _, err := ConnectToPeriod(period); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"10%還元", "1000円", "A_B", "AXB", `C\D`} {
+		if err := CreateDeal(period, newTestDeal(name, 1000)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"0%", "10%還元"},
+		{"_B", "A_B"},
+		{`\D`, `C\D`},
+	}
+	for _, tt := range tests {
+		for _, search := range []string{"search", "keyword"} {
+			var names []string
+			if search == "search" {
+				options := htmlMarks
+				options.Query = tt.query
+				results, _, err := SearchDeals(&DealFilter{Period: period}, options)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, result := range results {
+					names = append(names, result.DealName)
+				}
+			} else {
+				deals, _, err := GetDeals(&DealFilter{Period: period, Keyword: tt.query})
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, deal := range deals {
+					names = append(names, deal.DealName)
+				}
+			}
+			if len(names) != 1 || names[0] != tt.want {
+				t.Errorf("%s %q: got %v, want [%s]", search, tt.query, names, tt.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Consumption tax categories of a deal
+const (
+	TaxRateStandard   = "10"           // standard rate 10%
+	TaxRateReduced    = "8"            // reduced rate 8% (軽減税率)
+	TaxRateExempt     = "exempt"       // non-taxable (非課税)
+	TaxRateOutOfScope = "out_of_scope" // not subject to consumption tax (不課税)
+	TaxRateMixed      = "mixed"        // a receipt with several rates; see TaxLines
+)
+
+// taxRateOrder lists the categories in the order they are reported
+var taxRateOrder = []string{TaxRateStandard, TaxRateReduced, TaxRateExempt, TaxRateOutOfScope}
+
+// TaxLine is the part of a deal's amount that falls under one tax category
+type TaxLine struct {
+	Rate               string `json:"rate"`
+	AmountIncludingTax int    `json:"amountIncludingTax"`
+	AmountExcludingTax int    `json:"amountExcludingTax"`
+	TaxAmount          int    `json:"taxAmount"`
+}
+
+// IsValidTaxRate reports whether rate is a tax category a line can have
+func IsValidTaxRate(rate string) bool {
+	for _, r := range taxRateOrder {
+		if r == rate {
+			return true
+		}
+	}
+	return false
+}
+
+// taxPercent returns the tax rate in percent, 0 for categories without tax
+func taxPercent(rate string) int {
+	switch rate {
+	case TaxRateStandard:
+		return 10
+	case TaxRateReduced:
+		return 8
+	}
+	return 0
+}
+
+// normalizeTaxLine fills in the amounts missing from a line and checks that they add up.
+// The tax amount printed on an invoice may be rounded in any direction and computed from
+// either the tax-exclusive or the tax-inclusive amount, so a given tax amount is accepted
+// when it is less than one yen away from either exact amount.
+func normalizeTaxLine(line *TaxLine) error {
+	if !IsValidTaxRate(line.Rate) {
+		return fmt.Errorf("invalid tax rate %q. Must be '10', '8', 'exempt' or 'out_of_scope'", line.Rate)
+	}
+	if line.AmountIncludingTax < 0 || line.AmountExcludingTax < 0 || line.TaxAmount < 0 {
+		return fmt.Errorf("tax amounts must not be negative")
+	}
+
+	percent := taxPercent(line.Rate)
+	if percent == 0 && line.TaxAmount != 0 {
+		return fmt.Errorf("tax amount must be 0 for tax rate %s", line.Rate)
+	}
+
+	switch {
+	case line.AmountIncludingTax == 0 && line.AmountExcludingTax == 0:
+		if line.TaxAmount != 0 {
+			return fmt.Errorf("tax amount is given without an amount for tax rate %s", line.Rate)
+		}
+	case line.AmountExcludingTax == 0:
+		if line.TaxAmount == 0 {
+			// Tax included in the amount, fractions rounded down
+			line.TaxAmount = line.AmountIncludingTax * percent / (100 + percent)
+		}
+		line.AmountExcludingTax = line.AmountIncludingTax - line.TaxAmount
+	case line.AmountIncludingTax == 0:
+		if line.TaxAmount == 0 {
+			line.TaxAmount = line.AmountExcludingTax * percent / 100
+		}
+		line.AmountIncludingTax = line.AmountExcludingTax + line.TaxAmount
+	case line.TaxAmount == 0:
+		line.TaxAmount = line.AmountIncludingTax - line.AmountExcludingTax
+	}
+
+	if line.AmountExcludingTax+line.TaxAmount != line.AmountIncludingTax {
+		return fmt.Errorf("amounts for tax rate %s do not add up: %d + %d != %d",
+			line.Rate, line.AmountExcludingTax, line.TaxAmount, line.AmountIncludingTax)
+	}
+	if !taxAmountMatches(line.TaxAmount, line.AmountExcludingTax*percent, 100) &&
+		!taxAmountMatches(line.TaxAmount, line.AmountIncludingTax*percent, 100+percent) {
+		return fmt.Errorf("tax amount %d does not match tax rate %s of %d", line.TaxAmount, line.Rate, line.AmountExcludingTax)
+	}
+
+	return nil
+}
+
+// taxAmountMatches reports whether tax is less than one yen away from the exact tax numerator/denominator
+func taxAmountMatches(tax, numerator, denominator int) bool {
+	diff := tax*denominator - numerator
+	return diff > -denominator && diff < denominator
+}
+
+// NormalizeDealTax validates the tax breakdown of a deal and fills in the derived amounts.
+// A deal either has no tax breakdown at all, a single TaxRate that applies to DealPrice,
+// or TaxLines with one line per rate. Deals with a breakdown always store their lines,
+// DealPrice is the tax-inclusive total, and TaxRate is "mixed" for several rates.
+func NormalizeDealTax(deal *Deal) error {
+	if len(deal.TaxLines) == 0 {
+		if deal.TaxRate == "" {
+			if deal.PriceExcludingTax != 0 || deal.TaxAmount != 0 {
+				return fmt.Errorf("tax rate is required when tax amounts are given")
+			}
+			return nil
+		}
+		if deal.TaxRate == TaxRateMixed {
+			return fmt.Errorf("tax lines are required for tax rate mixed")
+		}
+		deal.TaxLines = []TaxLine{{
+			Rate:               deal.TaxRate,
+			AmountIncludingTax: deal.DealPrice,
+			AmountExcludingTax: deal.PriceExcludingTax,
+			TaxAmount:          deal.TaxAmount,
+		}}
+	}
+
+	seen := map[string]bool{}
+	total := TaxLine{}
+	for i := range deal.TaxLines {
+		line := &deal.TaxLines[i]
+		if err := normalizeTaxLine(line); err != nil {
+			return err
+		}
+		if seen[line.Rate] {
+			return fmt.Errorf("duplicate tax line for tax rate %s", line.Rate)
+		}
+		seen[line.Rate] = true
+
+		total.AmountIncludingTax += line.AmountIncludingTax
+		total.AmountExcludingTax += line.AmountExcludingTax
+		total.TaxAmount += line.TaxAmount
+	}
+
+	if deal.DealPrice == 0 {
+		deal.DealPrice = total.AmountIncludingTax
+	} else if deal.DealPrice != total.AmountIncludingTax {
+		return fmt.Errorf("tax-inclusive amounts (%d) do not match DealPrice (%d)", total.AmountIncludingTax, deal.DealPrice)
+	}
+
+	deal.PriceExcludingTax = total.AmountExcludingTax
+	deal.TaxAmount = total.TaxAmount
+	deal.TaxRate = deal.TaxLines[0].Rate
+	if len(deal.TaxLines) > 1 {
+		deal.TaxRate = TaxRateMixed
+	}
+
+	return nil
+}
+
+// encodeTaxLines returns the value stored in the TaxBreakdown column
+func encodeTaxLines(lines []TaxLine) (string, error) {
+	if len(lines) == 0 {
+		return "", nil
+	}
+	data, err := json.Marshal(lines)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode tax lines: %v", err)
+	}
+	return string(data), nil
+}
+
+// decodeTaxLines parses the TaxBreakdown column
+func decodeTaxLines(value string) ([]TaxLine, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var lines []TaxLine
+	if err := json.Unmarshal([]byte(value), &lines); err != nil {
+		return nil, fmt.Errorf("failed to decode tax lines: %v", err)
+	}
+	return lines, nil
+}
+
+// taxDigestValue returns the tax breakdown as covered by the hash chain
+func taxDigestValue(lines []TaxLine) string {
+	parts := make([]string, len(lines))
+	for i, line := range lines {
+		parts[i] = fmt.Sprintf("%s/%d/%d/%d", line.Rate, line.AmountIncludingTax, line.AmountExcludingTax, line.TaxAmount)
+	}
+	return strings.Join(parts, ",")
+}
+
+// TaxAmounts are the totals of one group of deals in a tax summary
+type TaxAmounts struct {
+	DealCount          int `json:"dealCount"`
+	AmountIncludingTax int `json:"amountIncludingTax"`
+	AmountExcludingTax int `json:"amountExcludingTax"`
+	TaxAmount          int `json:"taxAmount"`
+}
+
+func (a *TaxAmounts) add(line TaxLine) {
+	a.DealCount++
+	a.AmountIncludingTax += line.AmountIncludingTax
+	a.AmountExcludingTax += line.AmountExcludingTax
+	a.TaxAmount += line.TaxAmount
+}
+
+// TaxRateSummary totals the deals of one tax category.
+// TaxAmount is the sum of the tax amounts of the deals (積上げ計算);
+// RecomputedTaxAmount is computed from the tax-inclusive total (割戻し計算).
+type TaxRateSummary struct {
+	Rate string `json:"rate"`
+	TaxAmounts
+	RecomputedTaxAmount  int        `json:"recomputedTaxAmount"`
+	WithInvoiceNumber    TaxAmounts `json:"withInvoiceNumber"`    // deals that recorded a registration number
+	WithoutInvoiceNumber TaxAmounts `json:"withoutInvoiceNumber"` // deals without one
+}
+
+// TaxSummary totals the tax breakdown of the active deals of a period
+type TaxSummary struct {
+	Period      string           `json:"period"`
+	FromDate    string           `json:"fromDate,omitempty"`
+	ToDate      string           `json:"toDate,omitempty"`
+	DealCount   int              `json:"dealCount"`
+	TotalAmount int              `json:"totalAmount"`
+	Rates       []TaxRateSummary `json:"rates"`
+	Unspecified TaxAmounts       `json:"unspecified"` // deals registered without a tax breakdown
+}
+
+// GetTaxSummary totals the tax breakdown of the deals matching filter by tax category.
+// Only the latest version of deals that are not deleted is counted. A deal with several
+// rates is counted once under each of its rates.
+func GetTaxSummary(filter *DealFilter) (*TaxSummary, error) {
+	db, err := ConnectPeriodDB(filter.Period)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `SELECT DealPrice, InvoiceNumber, TaxBreakdown FROM Deals
+	          WHERE RecStatus = 'NEW' AND nextNO IS NULL`
+	conditions, args := buildDealConditions(filter)
+	query += conditions
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query deals: %v", err)
+	}
+	defer rows.Close()
+
+	summary := &TaxSummary{
+		Period:   filter.Period,
+		FromDate: filter.FromDate,
+		ToDate:   filter.ToDate,
+	}
+	byRate := map[string]*TaxRateSummary{}
+	for _, rate := range taxRateOrder {
+		byRate[rate] = &TaxRateSummary{Rate: rate}
+	}
+
+	for rows.Next() {
+		var price int
+		var invoiceNumber, breakdown string
+		if err := rows.Scan(&price, &invoiceNumber, &breakdown); err != nil {
+			return nil, fmt.Errorf("failed to scan deal: %v", err)
+		}
+		summary.DealCount++
+		summary.TotalAmount += price
+
+		lines, err := decodeTaxLines(breakdown)
+		if err != nil {
+			return nil, err
+		}
+		if len(lines) == 0 {
+			summary.Unspecified.add(TaxLine{AmountIncludingTax: price})
+			continue
+		}
+
+		for _, line := range lines {
+			rateSummary, ok := byRate[line.Rate]
+			if !ok {
+				continue
+			}
+			rateSummary.add(line)
+			if invoiceNumber != "" {
+				rateSummary.WithInvoiceNumber.add(line)
+			} else {
+				rateSummary.WithoutInvoiceNumber.add(line)
+			}
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %v", err)
+	}
+
+	for _, rate := range taxRateOrder {
+		rateSummary := byRate[rate]
+		percent := taxPercent(rate)
+		rateSummary.RecomputedTaxAmount = rateSummary.AmountIncludingTax * percent / (100 + percent)
+		summary.Rates = append(summary.Rates, *rateSummary)
+	}
+
+	return summary, nil
+}
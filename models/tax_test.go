@@ -0,0 +1,193 @@
+package models
+
+import (
+	"testing"
+)
+
+func TestNormalizeTaxLineRounding(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    TaxLine
+		want    TaxLine
+		wantErr bool
+	}{
+		{"10% included", TaxLine{Rate: "10", AmountIncludingTax: 1100}, TaxLine{"10", 1100, 1000, 100}, false},
+		{"10% included rounds down", TaxLine{Rate: "10", AmountIncludingTax: 1099}, TaxLine{"10", 1099, 1000, 99}, false},
+		{"8% included rounds down", TaxLine{Rate: "8", AmountIncludingTax: 1079}, TaxLine{"8", 1079, 1000, 79}, false},
+		{"8% included small amount", TaxLine{Rate: "8", AmountIncludingTax: 13}, TaxLine{"8", 13, 13, 0}, false},
+		{"10% excluded rounds down", TaxLine{Rate: "10", AmountExcludingTax: 999}, TaxLine{"10", 1098, 999, 99}, false},
+		{"8% excluded rounds down", TaxLine{Rate: "8", AmountExcludingTax: 999}, TaxLine{"8", 1078, 999, 79}, false},
+		{"tax rounded up on the invoice", TaxLine{Rate: "10", AmountExcludingTax: 999, TaxAmount: 100}, TaxLine{"10", 1099, 999, 100}, false},
+		{"tax rounded to the nearest yen", TaxLine{Rate: "8", AmountIncludingTax: 1080, TaxAmount: 80}, TaxLine{"8", 1080, 1000, 80}, false},
+		{"tax derived from both amounts", TaxLine{Rate: "10", AmountIncludingTax: 1100, AmountExcludingTax: 1000}, TaxLine{"10", 1100, 1000, 100}, false},
+		{"exempt", TaxLine{Rate: "exempt", AmountIncludingTax: 500}, TaxLine{"exempt", 500, 500, 0}, false},
+		{"out of scope", TaxLine{Rate: "out_of_scope", AmountExcludingTax: 300}, TaxLine{"out_of_scope", 300, 300, 0}, false},
+		{"tax one yen off", TaxLine{Rate: "10", AmountExcludingTax: 999, TaxAmount: 101}, TaxLine{}, true},
+		{"tax of the other rate", TaxLine{Rate: "8", AmountExcludingTax: 1000, TaxAmount: 100}, TaxLine{}, true},
+		{"amounts do not add up", TaxLine{Rate: "10", AmountIncludingTax: 1100, AmountExcludingTax: 1000, TaxAmount: 90}, TaxLine{}, true},
+		{"tax on exempt amount", TaxLine{Rate: "exempt", AmountIncludingTax: 500, TaxAmount: 10}, TaxLine{}, true},
+		{"tax without amount", TaxLine{Rate: "10", TaxAmount: 10}, TaxLine{}, true},
+		{"negative amount", TaxLine{Rate: "10", AmountIncludingTax: -1100}, TaxLine{}, true},
+		{"unknown rate", TaxLine{Rate: "5", AmountIncludingTax: 1050}, TaxLine{}, true},
+	}
+
+	for _, tt := range tests {
+		line := tt.line
+		err := normalizeTaxLine(&line)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: got %+v, want an error", tt.name, line)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if line != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, line, tt.want)
+		}
+	}
+}
+
+func TestNormalizeDealTaxMixedRates(t *testing.T) {
+	tests := []struct {
+		name      string
+		deal      Deal
+		wantErr   bool
+		rate      string
+		price     int
+		excluding int
+		tax       int
+	}{
+		{
+			name: "10% and 8% rounded per rate",
+			deal: Deal{TaxLines: []TaxLine{
+				{Rate: "10", AmountIncludingTax: 1099},
+				{Rate: "8", AmountIncludingTax: 1079},
+			}},
+			rate: TaxRateMixed, price: 2178, excluding: 2000, tax: 178,
+		},
+		{
+			name: "matching DealPrice",
+			deal: Deal{DealPrice: 2180, TaxLines: []TaxLine{
+				{Rate: "10", AmountExcludingTax: 1000},
+				{Rate: "8", AmountExcludingTax: 1000},
+			}},
+			rate: TaxRateMixed, price: 2180, excluding: 2000, tax: 180,
+		},
+		{
+			name: "taxed and exempt lines",
+			deal: Deal{TaxLines: []TaxLine{
+				{Rate: "8", AmountIncludingTax: 540},
+				{Rate: "exempt", AmountIncludingTax: 200},
+			}},
+			rate: TaxRateMixed, price: 740, excluding: 700, tax: 40,
+		},
+		{
+			name: "single line is not mixed",
+			deal: Deal{TaxLines: []TaxLine{{Rate: "8", AmountIncludingTax: 1080}}},
+			rate: TaxRateReduced, price: 1080, excluding: 1000, tax: 80,
+		},
+		{
+			name: "single rate on DealPrice",
+			deal: Deal{DealPrice: 1099, TaxRate: "10"},
+			rate: TaxRateStandard, price: 1099, excluding: 1000, tax: 99,
+		},
+		{
+			name:    "DealPrice does not match the lines",
+			deal:    Deal{DealPrice: 2000, TaxLines: []TaxLine{{Rate: "10", AmountIncludingTax: 1100}, {Rate: "8", AmountIncludingTax: 1080}}},
+			wantErr: true,
+		},
+		{
+			name:    "duplicate rate",
+			deal:    Deal{TaxLines: []TaxLine{{Rate: "10", AmountIncludingTax: 1100}, {Rate: "10", AmountIncludingTax: 550}}},
+			wantErr: true,
+		},
+		{
+			name:    "mixed without lines",
+			deal:    Deal{DealPrice: 2180, TaxRate: TaxRateMixed},
+			wantErr: true,
+		},
+		{
+			name:    "amounts without rate",
+			deal:    Deal{DealPrice: 1100, TaxAmount: 100},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		deal := tt.deal
+		err := NormalizeDealTax(&deal)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: got %+v, want an error", tt.name, deal)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if deal.TaxRate != tt.rate || deal.DealPrice != tt.price || deal.PriceExcludingTax != tt.excluding || deal.TaxAmount != tt.tax {
+			t.Errorf("%s: got rate %s, price %d, excluding %d, tax %d; want %s, %d, %d, %d", tt.name,
+				deal.TaxRate, deal.DealPrice, deal.PriceExcludingTax, deal.TaxAmount, tt.rate, tt.price, tt.excluding, tt.tax)
+		}
+	}
+}
+
+func TestGetTaxSummaryMixedRates(t *testing.T) {
+	setupTestDB(t)
+	const period = "2025"
+	if _, err := ConnectToPeriod(period); err != nil {
+		t.Fatal(err)
+	}
+
+	mixed := newTestDeal("食料品と日用品", 0)
+	mixed.InvoiceNumber = "T7000012050002"
+	mixed.TaxLines = []TaxLine{{Rate: "10", AmountIncludingTax: 1099}, {Rate: "8", AmountIncludingTax: 1079}}
+	standard := newTestDeal("文房具", 550)
+	standard.TaxRate = TaxRateStandard
+	unspecified := newTestDeal("交通費", 300)
+	for _, deal := range []*Deal{mixed, standard, unspecified} {
+		if err := NormalizeDealTax(deal); err != nil {
+			t.Fatal(err)
+		}
+		if err := CreateDeal(period, deal); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	summary, err := GetTaxSummary(&DealFilter{Period: period})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.DealCount != 3 || summary.TotalAmount != 3028 {
+		t.Errorf("got %d deals totalling %d, want 3 totalling 3028", summary.DealCount, summary.TotalAmount)
+	}
+	if summary.Unspecified != (TaxAmounts{1, 300, 0, 0}) {
+		t.Errorf("unspecified: got %+v", summary.Unspecified)
+	}
+
+	want := map[string]struct {
+		amounts    TaxAmounts
+		recomputed int
+		invoice    TaxAmounts
+	}{
+		// 1099 + 550 with the tax summed per deal (99 + 50); 1649 × 10/110 = 149.9
+		"10": {TaxAmounts{2, 1649, 1500, 149}, 149, TaxAmounts{1, 1099, 1000, 99}},
+		"8":  {TaxAmounts{1, 1079, 1000, 79}, 79, TaxAmounts{1, 1079, 1000, 79}},
+	}
+	for _, rate := range summary.Rates {
+		expected, ok := want[rate.Rate]
+		if !ok {
+			if rate.DealCount != 0 {
+				t.Errorf("rate %s: got %+v, want no deals", rate.Rate, rate.TaxAmounts)
+			}
+			continue
+		}
+		if rate.TaxAmounts != expected.amounts || rate.RecomputedTaxAmount != expected.recomputed || rate.WithInvoiceNumber != expected.invoice {
+			t.Errorf("rate %s: got %+v, recomputed %d, with invoice number %+v", rate.Rate, rate.TaxAmounts, rate.RecomputedTaxAmount, rate.WithInvoiceNumber)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// DealTimestamp is an RFC 3161 timestamp token issued over the file hash of a deal
+type DealTimestamp struct {
+	DealNO        string `json:"dealNo"`
+	Hash          string `json:"hash"`
+	HashAlgorithm string `json:"hashAlgorithm"`
+	Token         []byte `json:"-"`
+	GenTime       string `json:"genTime"`
+	SerialNumber  string `json:"serialNumber"`
+	Policy        string `json:"policy"`
+	Authority     string `json:"authority"`
+	Created       string `json:"created"`
+}
+
+// SaveDealTimestamp stores the timestamp token of a deal in the given period.
+// A deal has at most one token; saving again replaces it.
+func SaveDealTimestamp(period string, ts *DealTimestamp) error {
+	db, err := ConnectPeriodDB(period)
+	if err != nil {
+		return err
+	}
+
+	if ts.Created == "" {
+		ts.Created = time.Now().Format("2006-01-02T15:04:05Z")
+	}
+
+	query := `INSERT OR REPLACE INTO Timestamps
+	          (DealNO, Hash, HashAlgorithm, Token, GenTime, SerialNumber, Policy, Authority, Created)
+	          VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	_, err = db.Exec(query, ts.DealNO, ts.Hash, ts.HashAlgorithm, ts.Token, ts.GenTime,
+		ts.SerialNumber, ts.Policy, ts.Authority, ts.Created)
+	if err != nil {
+		return fmt.Errorf("failed to save timestamp: %v", err)
+	}
+
+	return nil
+}
+
+// GetDealTimestamp returns the timestamp token of a deal in the given period
+func GetDealTimestamp(period, dealNO string) (*DealTimestamp, error) {
+	db, err := ConnectPeriodDB(period)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `SELECT DealNO, Hash, HashAlgorithm, Token, GenTime, SerialNumber, Policy, Authority, Created
+	          FROM Timestamps WHERE DealNO = ?`
+
+	ts, err := scanDealTimestamp(db.QueryRow(query, dealNO))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("timestamp for deal %s not found", dealNO)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get timestamp: %v", err)
+	}
+
+	return ts, nil
+}
+
+// SaveAttachmentTimestamp stores the timestamp token of an attachment in the given period.
+// An attachment has at most one token; saving again replaces it.
+func SaveAttachmentTimestamp(period string, attachmentID int64, ts *DealTimestamp) error {
+	db, err := ConnectPeriodDB(period)
+	if err != nil {
+		return err
+	}
+
+	if ts.Created == "" {
+		ts.Created = time.Now().Format("2006-01-02T15:04:05Z")
+	}
+
+	query := `INSERT OR REPLACE INTO AttachmentTimestamps
+	          (AttachmentID, DealNO, Hash, HashAlgorithm, Token, GenTime, SerialNumber, Policy, Authority, Created)
+	          VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	_, err = db.Exec(query, attachmentID, ts.DealNO, ts.Hash, ts.HashAlgorithm, ts.Token, ts.GenTime,
+		ts.SerialNumber, ts.Policy, ts.Authority, ts.Created)
+	if err != nil {
+		return fmt.Errorf("failed to save timestamp: %v", err)
+	}
+
+	return nil
+}
+
+// GetAttachmentTimestamp returns the timestamp token of an attachment in the given period.
+// Attachments carried over to a new version of a deal have no token of their own; the
+// token issued over the same content in the period is returned for them.
+func GetAttachmentTimestamp(period string, a *Attachment) (*DealTimestamp, error) {
+	db, err := ConnectPeriodDB(period)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `SELECT DealNO, Hash, HashAlgorithm, Token, GenTime, SerialNumber, Policy, Authority, Created
+	          FROM AttachmentTimestamps WHERE AttachmentID = ?`
+
+	ts, err := scanDealTimestamp(db.QueryRow(query, a.ID))
+	if err == sql.ErrNoRows {
+		ts, err := FindTimestampByHash(period, a.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("timestamp for attachment %d not found", a.ID)
+		}
+		return ts, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get timestamp: %v", err)
+	}
+
+	return ts, nil
+}
+
+// FindTimestampByHash returns the oldest timestamp token issued over the given hash in a period,
+// for a deal file or an attachment.
+// A token proves that the content existed at its time, so it can be shared by every deal
+// that carries the same file.
+func FindTimestampByHash(period, hash string) (*DealTimestamp, error) {
+	db, err := ConnectPeriodDB(period)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `SELECT DealNO, Hash, HashAlgorithm, Token, GenTime, SerialNumber, Policy, Authority, Created
+	          FROM Timestamps WHERE Hash = ?
+	          UNION ALL
+	          SELECT DealNO, Hash, HashAlgorithm, Token, GenTime, SerialNumber, Policy, Authority, Created
+	          FROM AttachmentTimestamps WHERE Hash = ?
+	          ORDER BY GenTime LIMIT 1`
+
+	ts, err := scanDealTimestamp(db.QueryRow(query, hash, hash))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("timestamp for hash %s not found", hash)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get timestamp: %v", err)
+	}
+
+	return ts, nil
+}
+
+func scanDealTimestamp(row *sql.Row) (*DealTimestamp, error) {
+	var ts DealTimestamp
+	var policy, authority sql.NullString
+	err := row.Scan(&ts.DealNO, &ts.Hash, &ts.HashAlgorithm, &ts.Token, &ts.GenTime,
+		&ts.SerialNumber, &policy, &authority, &ts.Created)
+	if err != nil {
+		return nil, err
+	}
+	ts.Policy = policy.String
+	ts.Authority = authority.String
+	return &ts, nil
+}
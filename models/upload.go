@@ -0,0 +1,385 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultUploadSessionTTL is how long an upload session is kept after its last chunk
+const DefaultUploadSessionTTL = 24 * time.Hour
+
+// uploadSessionTTL is the lifetime of an upload session after its last activity
+var uploadSessionTTL = DefaultUploadSessionTTL
+
+var uploadIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// busyUploads holds the sessions that are receiving a chunk or being attached to a deal
+var (
+	busyUploads      = map[string]bool{}
+	busyUploadsMutex sync.Mutex
+)
+
+// UploadSession is a resumable upload of one attachment. The client sends the file
+// in chunks, each starting at the current Offset, and attaches the completed upload
+// to a deal by its ID.
+type UploadSession struct {
+	ID      string `json:"id"`
+	Owner   string `json:"owner"`
+	Name    string `json:"name"`
+	Size    int64  `json:"size"`
+	Offset  int64  `json:"offset"`
+	Created string `json:"created"`
+	Expires string `json:"expires"`
+}
+
+// Complete reports whether all bytes of the upload have been received
+func (s *UploadSession) Complete() bool {
+	return s.Offset == s.Size
+}
+
+// SetUploadSessionTTL sets how long an upload session is kept after its last activity
+func SetUploadSessionTTL(ttl time.Duration) {
+	uploadSessionTTL = ttl
+}
+
+func createUploadTable(db *sql.DB) error {
+	query := `CREATE TABLE IF NOT EXISTS "UploadSessions" (
+		"id" TEXT PRIMARY KEY,
+		"owner" TEXT NOT NULL,
+		"name" TEXT NOT NULL DEFAULT '',
+		"size" INTEGER NOT NULL,
+		"received" INTEGER NOT NULL DEFAULT 0,
+		"created" TEXT,
+		"expires" TEXT
+	)`
+	if _, err := db.Exec(query); err != nil {
+		return fmt.Errorf("failed to create UploadSessions table: %v", err)
+	}
+	return nil
+}
+
+// uploadSessionPath returns the file that holds the received bytes of a session
+func uploadSessionPath(id string) string {
+	return filepath.Join(basePath, blobDirName, blobTempDirName, "session-"+id)
+}
+
+// CreateUploadSession starts a resumable upload of size bytes
+func CreateUploadSession(owner, name string, size int64) (*UploadSession, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("upload size must be greater than 0")
+	}
+
+	db, err := GetSystemDB()
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, fmt.Errorf("failed to generate upload id: %v", err)
+	}
+
+	// Only the file name of a client path is kept
+	if name = strings.ReplaceAll(name, `\`, "/"); name != "" {
+		name = path.Base(name)
+	}
+
+	now := time.Now()
+	session := &UploadSession{
+		ID:      hex.EncodeToString(raw),
+		Owner:   owner,
+		Name:    name,
+		Size:    size,
+		Created: now.Format("2006-01-02T15:04:05Z"),
+		Expires: now.Add(uploadSessionTTL).Format("2006-01-02T15:04:05Z"),
+	}
+
+	filePath := uploadSessionPath(session.ID)
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create upload directory: %v", err)
+	}
+	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upload file: %v", err)
+	}
+	file.Close()
+
+	_, err = db.Exec(`INSERT INTO UploadSessions (id, owner, name, size, received, created, expires)
+	                  VALUES (?, ?, ?, ?, 0, ?, ?)`,
+		session.ID, session.Owner, session.Name, session.Size, session.Created, session.Expires)
+	if err != nil {
+		os.Remove(filePath)
+		return nil, fmt.Errorf("failed to create upload session: %v", err)
+	}
+
+	return session, nil
+}
+
+// GetUploadSession returns an upload session of owner.
+// Sessions of other users and expired sessions are reported as not found.
+func GetUploadSession(id, owner string) (*UploadSession, error) {
+	if !uploadIDPattern.MatchString(id) {
+		return nil, fmt.Errorf("upload not found: %s", id)
+	}
+
+	db, err := GetSystemDB()
+	if err != nil {
+		return nil, err
+	}
+
+	session := &UploadSession{}
+	err = db.QueryRow(`SELECT id, owner, name, size, received, created, expires FROM UploadSessions WHERE id = ?`, id).Scan(
+		&session.ID, &session.Owner, &session.Name, &session.Size, &session.Offset, &session.Created, &session.Expires)
+	if err == sql.ErrNoRows || (err == nil && session.Owner != owner) {
+		return nil, fmt.Errorf("upload not found: %s", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get upload session: %v", err)
+	}
+
+	if session.Expires <= time.Now().Format("2006-01-02T15:04:05Z") {
+		return nil, fmt.Errorf("upload not found: %s", id)
+	}
+
+	return session, nil
+}
+
+// uploadSessionExists reports whether the record of a session exists, expired or not
+func uploadSessionExists(id string) bool {
+	db, err := GetSystemDB()
+	if err != nil {
+		return true
+	}
+
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM UploadSessions WHERE id = ?`, id).Scan(&count); err != nil {
+		return true
+	}
+	return count > 0
+}
+
+// WriteUploadChunk appends the bytes read from r to an upload session. offset must be
+// the current offset of the session. Bytes received before r fails are kept, so that
+// the client can resume from the offset returned in the session.
+func WriteUploadChunk(id, owner string, offset int64, r io.Reader) (*UploadSession, error) {
+	if !acquireUpload(id) {
+		return nil, fmt.Errorf("upload is busy: %s", id)
+	}
+	defer releaseUpload(id)
+
+	session, err := GetUploadSession(id, owner)
+	if err != nil {
+		return nil, err
+	}
+	if offset != session.Offset {
+		return session, fmt.Errorf("offset mismatch: the upload is at %d", session.Offset)
+	}
+
+	file, err := os.OpenFile(uploadSessionPath(id), os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open upload file: %v", err)
+	}
+	defer file.Close()
+
+	// Bytes beyond the declared size are never written
+	if err := file.Truncate(offset); err != nil {
+		return nil, fmt.Errorf("failed to write upload file: %v", err)
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to write upload file: %v", err)
+	}
+	written, copyErr := io.Copy(file, io.LimitReader(r, session.Size-offset))
+	if copyErr == nil && written == session.Size-offset {
+		var extra [1]byte
+		if n, _ := r.Read(extra[:]); n > 0 {
+			copyErr = fmt.Errorf("upload exceeds its declared size of %d bytes", session.Size)
+		}
+	}
+
+	if err := file.Sync(); err != nil {
+		return nil, fmt.Errorf("failed to write upload file: %v", err)
+	}
+
+	session.Offset += written
+	session.Expires = time.Now().Add(uploadSessionTTL).Format("2006-01-02T15:04:05Z")
+	if err := updateUploadSession(session); err != nil {
+		return nil, err
+	}
+
+	if copyErr != nil {
+		return session, fmt.Errorf("failed to receive upload: %v", copyErr)
+	}
+	return session, nil
+}
+
+func updateUploadSession(session *UploadSession) error {
+	db, err := GetSystemDB()
+	if err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(`UPDATE UploadSessions SET received = ?, expires = ? WHERE id = ?`,
+		session.Offset, session.Expires, session.ID); err != nil {
+		return fmt.Errorf("failed to update upload session: %v", err)
+	}
+	return nil
+}
+
+// DeleteUploadSession cancels an upload session of owner and removes its data
+func DeleteUploadSession(id, owner string) error {
+	if !acquireUpload(id) {
+		return fmt.Errorf("upload is busy: %s", id)
+	}
+	defer releaseUpload(id)
+
+	if _, err := GetUploadSession(id, owner); err != nil {
+		return err
+	}
+	return removeUploadSession(id)
+}
+
+// removeUploadSession deletes the record and the file of a session
+func removeUploadSession(id string) error {
+	db, err := GetSystemDB()
+	if err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(`DELETE FROM UploadSessions WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete upload session: %v", err)
+	}
+	if err := os.Remove(uploadSessionPath(id)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove upload file %s: %v", id, err)
+	}
+	return nil
+}
+
+// OpenUploadBlob returns a BlobWriter holding the content of a completed upload session,
+// so that it can be attached to a deal like a file sent with the request.
+// Commit moves the content into the blob store and ends the session; Abort keeps the
+// session so that attaching can be retried.
+func OpenUploadBlob(id, owner string) (*BlobWriter, *UploadSession, error) {
+	if !acquireUpload(id) {
+		return nil, nil, fmt.Errorf("upload is busy: %s", id)
+	}
+
+	session, err := GetUploadSession(id, owner)
+	if err != nil {
+		releaseUpload(id)
+		return nil, nil, err
+	}
+	if !session.Complete() {
+		releaseUpload(id)
+		return nil, session, fmt.Errorf("upload is not complete: %d of %d bytes received", session.Offset, session.Size)
+	}
+
+	file, err := os.OpenFile(uploadSessionPath(id), os.O_RDWR, 0644)
+	if err != nil {
+		releaseUpload(id)
+		return nil, nil, fmt.Errorf("failed to open upload file: %v", err)
+	}
+
+	writer := &BlobWriter{file: file, hash: sha256.New(), session: id}
+	if writer.size, err = io.Copy(writer.hash, file); err != nil || writer.size != session.Size {
+		file.Close()
+		releaseUpload(id)
+		if err == nil {
+			err = fmt.Errorf("%d bytes stored", writer.size)
+		}
+		return nil, nil, fmt.Errorf("failed to read upload file: %v", err)
+	}
+
+	return writer, session, nil
+}
+
+// CleanupExpiredUploads removes expired upload sessions and session files that have
+// no record, and returns the number of sessions removed
+func CleanupExpiredUploads() (int, error) {
+	db, err := GetSystemDB()
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := db.Query(`SELECT id FROM UploadSessions WHERE expires <= ?`, time.Now().Format("2006-01-02T15:04:05Z"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to query upload sessions: %v", err)
+	}
+	var expired []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan upload session: %v", err)
+		}
+		expired = append(expired, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error iterating rows: %v", err)
+	}
+
+	removed := 0
+	for _, id := range expired {
+		if !acquireUpload(id) {
+			continue
+		}
+		err := removeUploadSession(id)
+		releaseUpload(id)
+		if err != nil {
+			return removed, err
+		}
+		removed++
+	}
+
+	// Files left by sessions whose record is gone
+	entries, err := os.ReadDir(filepath.Join(basePath, blobDirName, blobTempDirName))
+	if err != nil {
+		return removed, nil
+	}
+	for _, entry := range entries {
+		id, ok := strings.CutPrefix(entry.Name(), "session-")
+		if !ok || !uploadIDPattern.MatchString(id) {
+			continue
+		}
+		if uploadSessionExists(id) {
+			continue
+		}
+		if acquireUpload(id) {
+			os.Remove(uploadSessionPath(id))
+			releaseUpload(id)
+		}
+	}
+
+	return removed, nil
+}
+
+// acquireUpload marks a session as busy; it returns false if it already is
+func acquireUpload(id string) bool {
+	busyUploadsMutex.Lock()
+	defer busyUploadsMutex.Unlock()
+
+	if busyUploads[id] {
+		return false
+	}
+	busyUploads[id] = true
+	return true
+}
+
+func releaseUpload(id string) {
+	busyUploadsMutex.Lock()
+	defer busyUploadsMutex.Unlock()
+
+	delete(busyUploads, id)
+}
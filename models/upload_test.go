@@ -0,0 +1,182 @@
+package models
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingReader returns data and then fails, as a request body whose connection dropped
+type failingReader struct {
+	data []byte
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestWriteUploadChunkOffsetMismatch(t *testing.T) {
+	setupTestDB(t)
+	session, err := CreateUploadSession("alice", "scan.pdf", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := WriteUploadChunk(session.ID, "alice", 0, strings.NewReader("0123")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Sending the first chunk again must not overwrite it
+	got, err := WriteUploadChunk(session.ID, "alice", 0, strings.NewReader("abcd"))
+	if err == nil || !strings.Contains(err.Error(), "offset mismatch") {
+		t.Fatalf("got %v", err)
+	}
+	if got == nil || got.Offset != 4 {
+		t.Errorf("session returned with the mismatch: %+v", got)
+	}
+	if data, _ := os.ReadFile(uploadSessionPath(session.ID)); string(data) != "0123" {
+		t.Errorf("upload file: got %q", data)
+	}
+
+	// Another user's session is not found
+	if _, err := WriteUploadChunk(session.ID, "bob", 4, strings.NewReader("4567")); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("chunk of another user: got %v", err)
+	}
+}
+
+func TestWriteUploadChunkOverDeclaredSize(t *testing.T) {
+	setupTestDB(t)
+	session, err := CreateUploadSession("alice", "scan.pdf", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := WriteUploadChunk(session.ID, "alice", 0, strings.NewReader("0123456789AB"))
+	if err == nil || !strings.Contains(err.Error(), "exceeds its declared size") {
+		t.Fatalf("got %v", err)
+	}
+	if got.Offset != 10 {
+		t.Errorf("offset: got %d, want 10", got.Offset)
+	}
+	if data, _ := os.ReadFile(uploadSessionPath(session.ID)); string(data) != "0123456789" {
+		t.Errorf("bytes beyond the declared size were written: %q", data)
+	}
+}
+
+func TestWriteUploadChunkResumesAfterPartialWrite(t *testing.T) {
+	setupTestDB(t)
+	content := []byte("%PDF-1.4 scanned receipt")
+	session, err := CreateUploadSession("alice", `C:\scans\receipt.pdf`, int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.Name != "receipt.pdf" {
+		t.Errorf("name: got %q", session.Name)
+	}
+
+	// The connection drops after 9 bytes; they are kept
+	got, err := WriteUploadChunk(session.ID, "alice", 0, &failingReader{data: content[:9]})
+	if err == nil || !strings.Contains(err.Error(), "failed to receive") {
+		t.Fatalf("got %v", err)
+	}
+	if got.Offset != 9 {
+		t.Fatalf("offset after the drop: got %d, want 9", got.Offset)
+	}
+	stored, err := GetUploadSession(session.ID, "alice")
+	if err != nil || stored.Offset != 9 || stored.Complete() {
+		t.Fatalf("stored session: %+v, %v", stored, err)
+	}
+	if _, _, err := OpenUploadBlob(session.ID, "alice"); err == nil || !strings.Contains(err.Error(), "not complete") {
+		t.Errorf("incomplete upload was opened: %v", err)
+	}
+
+	// The client resumes from the stored offset
+	got, err = WriteUploadChunk(session.ID, "alice", 9, bytes.NewReader(content[9:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Complete() {
+		t.Fatalf("upload is not complete: %+v", got)
+	}
+
+	writer, _, err := OpenUploadBlob(session.ID, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(content)
+	hash, err := writer.Commit(".pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != hex.EncodeToString(sum[:]) {
+		t.Errorf("hash: got %s", hash)
+	}
+	if _, err := GetUploadSession(session.ID, "alice"); err == nil {
+		t.Error("the session was kept after its content was committed")
+	}
+	path, err := BlobPath(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); !bytes.Equal(data, content) {
+		t.Errorf("stored blob: got %q", data)
+	}
+}
+
+func TestCleanupExpiredUploads(t *testing.T) {
+	setupTestDB(t)
+	expired, err := CreateUploadSession("alice", "old.pdf", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	active, err := CreateUploadSession("alice", "new.pdf", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	system, err := GetSystemDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Minute).Format("2006-01-02T15:04:05Z")
+	if _, err := system.Exec(`UPDATE UploadSessions SET expires = ? WHERE id = ?`, past, expired.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// A session file whose record is gone
+	stray := strings.Repeat("ab", 16)
+	if err := os.WriteFile(uploadSessionPath(stray), []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := GetUploadSession(expired.ID, "alice"); err == nil {
+		t.Error("expired session was returned")
+	}
+
+	removed, err := CleanupExpiredUploads()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("removed %d sessions, want 1", removed)
+	}
+	for _, id := range []string{expired.ID, stray} {
+		if _, err := os.Stat(uploadSessionPath(id)); !os.IsNotExist(err) {
+			t.Errorf("file of session %s was kept: %v", id, err)
+		}
+	}
+	if _, err := GetUploadSession(active.ID, "alice"); err != nil {
+		t.Errorf("active session was removed: %v", err)
+	}
+	if _, err := os.Stat(uploadSessionPath(active.ID)); err != nil {
+		t.Errorf("file of the active session was removed: %v", err)
+	}
+}
@@ -0,0 +1,520 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Roles, from the least to the most privileged
+const (
+	RoleViewer     = "viewer"     // can read deals and attachments
+	RoleClerk      = "clerk"      // can also register and update deals
+	RoleAccountant = "accountant" // can also delete and move deals, manage partners and periods
+	RoleAdmin      = "admin"      // can also manage users and system settings
+)
+
+// tokenPrefix marks API tokens issued by this server
+const tokenPrefix = "dck_"
+
+// tokenLastUsedInterval is how stale the last use of a token may get before it is
+// written again. Writing it on every request would serialize all requests on System.db.
+const tokenLastUsedInterval = time.Minute
+
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("denchokun"), bcrypt.DefaultCost)
+
+type User struct {
+	ID          int64  `json:"id"`
+	Username    string `json:"username"`
+	DisplayName string `json:"displayName"`
+	Role        string `json:"role"`
+	Disabled    bool   `json:"disabled"`
+	Created     string `json:"created"`
+	Updated     string `json:"updated"`
+}
+
+type UserRequest struct {
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	DisplayName string `json:"displayName"`
+	Role        string `json:"role"`
+	Disabled    *bool  `json:"disabled"`
+}
+
+// APIToken describes an issued bearer token. The token itself is only returned once
+// when it is created; only its SHA-256 hash is stored.
+type APIToken struct {
+	ID       int64   `json:"id"`
+	UserID   int64   `json:"userId"`
+	Name     string  `json:"name"`
+	Created  string  `json:"created"`
+	Expires  *string `json:"expires,omitempty"`
+	LastUsed *string `json:"lastUsed,omitempty"`
+	Revoked  bool    `json:"revoked"`
+}
+
+// IsValidRole checks if role is one of the defined roles
+func IsValidRole(role string) bool {
+	switch role {
+	case RoleViewer, RoleClerk, RoleAccountant, RoleAdmin:
+		return true
+	}
+	return false
+}
+
+// createUserTables creates the Users and ApiTokens tables in System.db
+func createUserTables(db *sql.DB) error {
+	queries := []string{
+		`CREATE TABLE IF NOT EXISTS "Users" (
+			"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+			"username" TEXT NOT NULL UNIQUE,
+			"displayName" TEXT,
+			"passwordHash" TEXT NOT NULL,
+			"role" TEXT NOT NULL,
+			"disabled" INTEGER NOT NULL DEFAULT 0,
+			"created" TEXT,
+			"updated" TEXT
+		)`,
+		`CREATE TABLE IF NOT EXISTS "ApiTokens" (
+			"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+			"userId" INTEGER NOT NULL,
+			"tokenHash" TEXT NOT NULL UNIQUE,
+			"name" TEXT,
+			"created" TEXT,
+			"expires" TEXT,
+			"lastUsed" TEXT,
+			"revoked" INTEGER NOT NULL DEFAULT 0
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_token_user ON ApiTokens(userId)`,
+	}
+
+	for _, query := range queries {
+		if _, err := db.Exec(query); err != nil {
+			return fmt.Errorf("failed to create user tables: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// CountUsers returns the number of registered users
+func CountUsers() (int, error) {
+	db, err := GetSystemDB()
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM Users").Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count users: %v", err)
+	}
+	return count, nil
+}
+
+// EnsureAdminUser creates the initial admin user when no user exists yet.
+// If password is empty a random one is generated; the password is returned only when a user was created.
+func EnsureAdminUser(username, password string) (string, error) {
+	count, err := CountUsers()
+	if err != nil {
+		return "", err
+	}
+	if count > 0 {
+		return "", nil
+	}
+
+	if password == "" {
+		raw := make([]byte, 12)
+		if _, err := rand.Read(raw); err != nil {
+			return "", fmt.Errorf("failed to generate password: %v", err)
+		}
+		password = hex.EncodeToString(raw)
+	}
+
+	_, err = CreateUser(&UserRequest{
+		Username:    username,
+		Password:    password,
+		DisplayName: "Administrator",
+		Role:        RoleAdmin,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return password, nil
+}
+
+// ValidateUserRequest validates the fields of a user request.
+// When creating, username, password and role are required.
+func ValidateUserRequest(req *UserRequest, creating bool) error {
+	if creating {
+		if strings.TrimSpace(req.Username) == "" {
+			return fmt.Errorf("username is required")
+		}
+		if req.Password == "" {
+			return fmt.Errorf("password is required")
+		}
+		if req.Role == "" {
+			return fmt.Errorf("role is required")
+		}
+	}
+	if req.Password != "" && len(req.Password) < 8 {
+		return fmt.Errorf("password must be at least 8 characters")
+	}
+	if req.Role != "" && !IsValidRole(req.Role) {
+		return fmt.Errorf("invalid role: %s (must be viewer, clerk, accountant or admin)", req.Role)
+	}
+	return nil
+}
+
+func CreateUser(req *UserRequest) (*User, error) {
+	if err := ValidateUserRequest(req, true); err != nil {
+		return nil, err
+	}
+
+	db, err := GetSystemDB()
+	if err != nil {
+		return nil, err
+	}
+
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash password: %v", err)
+	}
+
+	now := time.Now().Format("2006-01-02T15:04:05Z")
+	user := &User{
+		Username:    strings.TrimSpace(req.Username),
+		DisplayName: req.DisplayName,
+		Role:        req.Role,
+		Created:     now,
+		Updated:     now,
+	}
+	if req.Disabled != nil {
+		user.Disabled = *req.Disabled
+	}
+
+	result, err := db.Exec(`INSERT INTO Users (username, displayName, passwordHash, role, disabled, created, updated)
+	                        VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		user.Username, user.DisplayName, string(passwordHash), user.Role, user.Disabled, now, now)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return nil, fmt.Errorf("user already exists: %s", user.Username)
+		}
+		return nil, fmt.Errorf("failed to create user: %v", err)
+	}
+
+	user.ID, _ = result.LastInsertId()
+	return user, nil
+}
+
+func GetUsers() ([]User, error) {
+	db, err := GetSystemDB()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`SELECT id, username, displayName, role, disabled, created, updated
+	                       FROM Users ORDER BY username`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query users: %v", err)
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, *user)
+	}
+
+	return users, nil
+}
+
+func GetUserByID(id int64) (*User, error) {
+	db, err := GetSystemDB()
+	if err != nil {
+		return nil, err
+	}
+
+	row := db.QueryRow(`SELECT id, username, displayName, role, disabled, created, updated
+	                    FROM Users WHERE id = ?`, id)
+	user, err := scanUser(row)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("user not found: %d", id)
+	}
+	return user, err
+}
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanUser(row rowScanner) (*User, error) {
+	var user User
+	var displayName, created, updated sql.NullString
+	err := row.Scan(&user.ID, &user.Username, &displayName, &user.Role, &user.Disabled, &created, &updated)
+	if err == sql.ErrNoRows {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan user: %v", err)
+	}
+	user.DisplayName = displayName.String
+	user.Created = created.String
+	user.Updated = updated.String
+	return &user, nil
+}
+
+// UpdateUser changes the display name, password, role or disabled flag of a user.
+// Disabling a user or changing the password revokes all of the user's tokens.
+func UpdateUser(id int64, req *UserRequest) (*User, error) {
+	if err := ValidateUserRequest(req, false); err != nil {
+		return nil, err
+	}
+
+	db, err := GetSystemDB()
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := GetUserByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Format("2006-01-02T15:04:05Z")
+	revokeTokens := false
+
+	if req.DisplayName != "" {
+		user.DisplayName = req.DisplayName
+	}
+	if req.Role != "" {
+		user.Role = req.Role
+	}
+	if req.Disabled != nil {
+		user.Disabled = *req.Disabled
+		revokeTokens = revokeTokens || user.Disabled
+	}
+	user.Updated = now
+
+	_, err = tx.Exec("UPDATE Users SET displayName = ?, role = ?, disabled = ?, updated = ? WHERE id = ?",
+		user.DisplayName, user.Role, user.Disabled, now, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update user: %v", err)
+	}
+
+	if req.Password != "" {
+		passwordHash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash password: %v", err)
+		}
+		if _, err := tx.Exec("UPDATE Users SET passwordHash = ? WHERE id = ?", string(passwordHash), id); err != nil {
+			return nil, fmt.Errorf("failed to update password: %v", err)
+		}
+		revokeTokens = true
+	}
+
+	if revokeTokens {
+		if _, err := tx.Exec("UPDATE ApiTokens SET revoked = 1 WHERE userId = ?", id); err != nil {
+			return nil, fmt.Errorf("failed to revoke tokens: %v", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	return user, nil
+}
+
+// AuthenticateUser checks a username and password and returns the user
+func AuthenticateUser(username, password string) (*User, error) {
+	db, err := GetSystemDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var id int64
+	var passwordHash string
+	err = db.QueryRow("SELECT id, passwordHash FROM Users WHERE username = ?", username).Scan(&id, &passwordHash)
+	if err == sql.ErrNoRows {
+		// Compare against a dummy hash so that unknown users take as long as wrong passwords
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return nil, fmt.Errorf("invalid username or password")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user: %v", err)
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(password)); err != nil {
+		return nil, fmt.Errorf("invalid username or password")
+	}
+
+	user, err := GetUserByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if user.Disabled {
+		return nil, fmt.Errorf("user is disabled: %s", username)
+	}
+
+	return user, nil
+}
+
+// CreateAPIToken issues a new bearer token for a user.
+// A zero ttl creates a token that does not expire.
+func CreateAPIToken(userID int64, name string, ttl time.Duration) (string, *APIToken, error) {
+	db, err := GetSystemDB()
+	if err != nil {
+		return "", nil, err
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", nil, fmt.Errorf("failed to generate token: %v", err)
+	}
+	token := tokenPrefix + hex.EncodeToString(raw)
+
+	now := time.Now()
+	apiToken := &APIToken{
+		UserID:  userID,
+		Name:    name,
+		Created: now.Format("2006-01-02T15:04:05Z"),
+	}
+	if ttl > 0 {
+		expires := now.Add(ttl).Format("2006-01-02T15:04:05Z")
+		apiToken.Expires = &expires
+	}
+
+	result, err := db.Exec(`INSERT INTO ApiTokens (userId, tokenHash, name, created, expires)
+	                        VALUES (?, ?, ?, ?, ?)`,
+		userID, hashToken(token), name, apiToken.Created, apiToken.Expires)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create token: %v", err)
+	}
+
+	apiToken.ID, _ = result.LastInsertId()
+	return token, apiToken, nil
+}
+
+// AuthenticateToken returns the user that owns a valid (not revoked, not expired) token
+func AuthenticateToken(token string) (*User, *APIToken, error) {
+	db, err := GetSystemDB()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var apiToken APIToken
+	var name, created sql.NullString
+	err = db.QueryRow(`SELECT id, userId, name, created, expires, lastUsed, revoked
+	                   FROM ApiTokens WHERE tokenHash = ?`, hashToken(token)).
+		Scan(&apiToken.ID, &apiToken.UserID, &name, &created, &apiToken.Expires, &apiToken.LastUsed, &apiToken.Revoked)
+	if err == sql.ErrNoRows {
+		return nil, nil, fmt.Errorf("invalid token")
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get token: %v", err)
+	}
+	apiToken.Name = name.String
+	apiToken.Created = created.String
+
+	current := time.Now()
+	now := current.Format("2006-01-02T15:04:05Z")
+	if apiToken.Revoked {
+		return nil, nil, fmt.Errorf("token has been revoked")
+	}
+	if apiToken.Expires != nil && *apiToken.Expires <= now {
+		return nil, nil, fmt.Errorf("token has expired")
+	}
+
+	user, err := GetUserByID(apiToken.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if user.Disabled {
+		return nil, nil, fmt.Errorf("user is disabled: %s", user.Username)
+	}
+
+	// Last use is informational; a failure here must not reject the request
+	stale := current.Add(-tokenLastUsedInterval).Format("2006-01-02T15:04:05Z")
+	if apiToken.LastUsed == nil || *apiToken.LastUsed <= stale {
+		_, _ = db.Exec("UPDATE ApiTokens SET lastUsed = ? WHERE id = ?", now, apiToken.ID)
+		apiToken.LastUsed = &now
+	}
+
+	return user, &apiToken, nil
+}
+
+// GetAPITokens returns the tokens issued for a user
+func GetAPITokens(userID int64) ([]APIToken, error) {
+	db, err := GetSystemDB()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`SELECT id, userId, name, created, expires, lastUsed, revoked
+	                       FROM ApiTokens WHERE userId = ? ORDER BY id`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tokens: %v", err)
+	}
+	defer rows.Close()
+
+	tokens := []APIToken{}
+	for rows.Next() {
+		var apiToken APIToken
+		var name, created sql.NullString
+		err := rows.Scan(&apiToken.ID, &apiToken.UserID, &name, &created, &apiToken.Expires, &apiToken.LastUsed, &apiToken.Revoked)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan token: %v", err)
+		}
+		apiToken.Name = name.String
+		apiToken.Created = created.String
+		tokens = append(tokens, apiToken)
+	}
+
+	return tokens, nil
+}
+
+// RevokeAPIToken revokes a token of a user
+func RevokeAPIToken(userID, tokenID int64) error {
+	db, err := GetSystemDB()
+	if err != nil {
+		return err
+	}
+
+	result, err := db.Exec("UPDATE ApiTokens SET revoked = 1 WHERE id = ? AND userId = ?", tokenID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke token: %v", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to check affected rows: %v", err)
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("token not found: %d", tokenID)
+	}
+
+	return nil
+}
+
+// hashToken returns the value stored for a token; tokens are random, so a plain SHA-256 is sufficient
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,63 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAuthenticateTokenThrottlesLastUsed(t *testing.T) {
+	setupTestDB(t)
+
+	user, err := CreateUser(&UserRequest{Username: "clerk1", Password: "password123", Role: RoleClerk})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, issued, err := CreateAPIToken(user.ID, "script", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lastUsed := func() string {
+		var value string
+		if err := systemDB.QueryRow("SELECT COALESCE(lastUsed, '') FROM ApiTokens WHERE id = ?", issued.ID).Scan(&value); err != nil {
+			t.Fatal(err)
+		}
+		return value
+	}
+
+	// The first use is recorded
+	if _, _, err := AuthenticateToken(token); err != nil {
+		t.Fatal(err)
+	}
+	if lastUsed() == "" {
+		t.Fatal("first use was not recorded")
+	}
+
+	// A recent last use is not written again
+	recent := time.Now().Add(-10 * time.Second).Format("2006-01-02T15:04:05Z")
+	if _, err := systemDB.Exec("UPDATE ApiTokens SET lastUsed = ? WHERE id = ?", recent, issued.ID); err != nil {
+		t.Fatal(err)
+	}
+	_, used, err := AuthenticateToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := lastUsed(); got != recent {
+		t.Errorf("recent last use was rewritten: %s, want %s", got, recent)
+	}
+	if used.LastUsed == nil || *used.LastUsed != recent {
+		t.Errorf("returned last use %v, want %s", used.LastUsed, recent)
+	}
+
+	// A stale last use is refreshed
+	stale := time.Now().Add(-2 * tokenLastUsedInterval).Format("2006-01-02T15:04:05Z")
+	if _, err := systemDB.Exec("UPDATE ApiTokens SET lastUsed = ? WHERE id = ?", stale, issued.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := AuthenticateToken(token); err != nil {
+		t.Fatal(err)
+	}
+	if got := lastUsed(); got <= stale {
+		t.Errorf("stale last use was not refreshed: %s", got)
+	}
+}
@@ -1,201 +1,377 @@
 package preview
 
 import (
-	"crypto/md5"
-	"encoding/hex"
+	"container/list"
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
+// キャッシュの既定値
+const (
+	DefaultCacheMaxBytes = 256 * 1024 * 1024
+	DefaultCacheTTL      = 24 * time.Hour
+)
+
+// cacheFilePattern はキャッシュファイル名（SHA-256_幅x高さ_ページ.形式.cache）
+var cacheFilePattern = regexp.MustCompile(`^([0-9a-f]{64}_\d+x\d+_\d+\.(jpeg|png))\.cache$`)
+
+// CacheOptions はキャッシュの上限
+type CacheOptions struct {
+	MaxBytes int64         // キャッシュファイルの合計サイズの上限（0以下なら既定値）
+	TTL      time.Duration // 作成からの有効期間（0以下なら既定値）
+}
+
 // Cache はプレビュー画像のキャッシュを管理
+// 元ファイルの内容のSHA-256をキーにするので、ファイル名が変わってもキャッシュが使え、同じ内容のファイルは1つにまとまる
+// 合計サイズが上限を超えたら最後に使われてから最も時間がたったものから削除する
 type Cache struct {
-	baseDir string
-	mutex   sync.RWMutex
-	items   map[string]*CacheItem
+	baseDir  string
+	maxBytes int64
+	ttl      time.Duration
+
+	mutex     sync.Mutex
+	items     map[string]*list.Element // 値は *CacheItem
+	lru       *list.List               // 先頭が最近使われたもの
+	totalSize int64
+	hits      int64
+	misses    int64
+
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
 }
 
 // CacheItem はキャッシュアイテムの情報
 type CacheItem struct {
-	Path      string
-	CreatedAt time.Time
-	Size      int64
+	Key        string
+	Path       string
+	CreatedAt  time.Time
+	LastAccess time.Time
+	Size       int64
+}
+
+// CacheStats はキャッシュの統計情報
+type CacheStats struct {
+	Count     int           `json:"count"`
+	TotalSize int64         `json:"totalSize"`
+	MaxBytes  int64         `json:"maxBytes"`
+	TTL       time.Duration `json:"-"`
+	Hits      int64         `json:"hits"`
+	Misses    int64         `json:"misses"`
 }
 
 // NewCache は新しいキャッシュマネージャーを作成
-func NewCache(baseDir string) (*Cache, error) {
+// 使い終わったら Close で定期的なクリーンアップを止める
+func NewCache(baseDir string, options CacheOptions) (*Cache, error) {
 	// キャッシュディレクトリの作成
 	if err := os.MkdirAll(baseDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create cache directory: %w", err)
 	}
-	
+
+	if options.MaxBytes <= 0 {
+		options.MaxBytes = DefaultCacheMaxBytes
+	}
+	if options.TTL <= 0 {
+		options.TTL = DefaultCacheTTL
+	}
+
 	cache := &Cache{
-		baseDir: baseDir,
-		items:   make(map[string]*CacheItem),
+		baseDir:  baseDir,
+		maxBytes: options.MaxBytes,
+		ttl:      options.TTL,
+		items:    make(map[string]*list.Element),
+		lru:      list.New(),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
 	}
-	
+
 	// 既存のキャッシュファイルをスキャン
 	cache.scanExistingCache()
-	
+
 	// 定期的なクリーンアップを開始
 	go cache.startCleanupRoutine()
-	
+
 	return cache, nil
 }
 
 // generateCacheKey はキャッシュキーを生成
-func (c *Cache) generateCacheKey(filePath string, width, height, page int) string {
-	data := fmt.Sprintf("%s_%d_%d_%d", filePath, width, height, page)
-	hash := md5.Sum([]byte(data))
-	return hex.EncodeToString(hash[:])
+// 同じファイル・大きさでも画像形式が違えば別のキャッシュにする
+func generateCacheKey(contentHash string, width, height, page int, format string) (string, error) {
+	contentHash = strings.ToLower(contentHash)
+	key := fmt.Sprintf("%s_%dx%d_%d.%s", contentHash, width, height, page, format)
+	if !cacheFilePattern.MatchString(key + ".cache") {
+		return "", fmt.Errorf("invalid cache key: %s", key)
+	}
+	return key, nil
 }
 
 // Get はキャッシュから画像データを取得
-func (c *Cache) Get(filePath string, width, height, page int) ([]byte, bool) {
-	key := c.generateCacheKey(filePath, width, height, page)
-	
-	c.mutex.RLock()
-	item, exists := c.items[key]
-	c.mutex.RUnlock()
-	
-	if !exists {
+// contentHash は元ファイルの内容のSHA-256（16進数）
+func (c *Cache) Get(contentHash string, width, height, page int, format string) ([]byte, bool) {
+	key, err := generateCacheKey(contentHash, width, height, page, format)
+	if err != nil {
 		return nil, false
 	}
-	
-	// ファイルの更新時刻をチェック
-	fileInfo, err := os.Stat(filePath)
-	if err != nil {
+
+	c.mutex.Lock()
+	element, exists := c.items[key]
+	if !exists {
+		c.misses++
+		c.mutex.Unlock()
 		return nil, false
 	}
-	
-	// 元ファイルがキャッシュより新しい場合は無効
-	if fileInfo.ModTime().After(item.CreatedAt) {
-		c.Delete(key)
+	item := element.Value.(*CacheItem)
+	if time.Since(item.CreatedAt) > c.ttl {
+		c.removeElement(element)
+		c.misses++
+		c.mutex.Unlock()
 		return nil, false
 	}
-	
-	// キャッシュファイルを読み込み
-	data, err := os.ReadFile(item.Path)
-	if err != nil {
-		c.Delete(key)
+	path := item.Path
+	c.mutex.Unlock()
+
+	// キャッシュファイルはロックの外で読む（Put は名前の変更で置き換えるので途中の内容は読まない）
+	data, readErr := os.ReadFile(path)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// 読んでいる間に削除・置き換えされた項目は触らない
+	current := c.items[key] == element
+	if readErr != nil {
+		if current {
+			c.removeElement(element)
+		}
+		c.misses++
 		return nil, false
 	}
-	
+
+	if current {
+		item.LastAccess = time.Now()
+		c.lru.MoveToFront(element)
+	}
+	c.hits++
+
 	return data, true
 }
 
 // Put はキャッシュに画像データを保存
-func (c *Cache) Put(filePath string, width, height, page int, data []byte) error {
-	key := c.generateCacheKey(filePath, width, height, page)
-	
+// 一時ファイルに書き込んでから名前を変えるので、書き込み途中のファイルを読むことはない
+func (c *Cache) Put(contentHash string, width, height, page int, format string, data []byte) error {
+	key, err := generateCacheKey(contentHash, width, height, page, format)
+	if err != nil {
+		return err
+	}
+
+	size := int64(len(data))
+	if size > c.maxBytes {
+		return fmt.Errorf("preview is larger than the cache limit: %d bytes", size)
+	}
+
 	// キャッシュファイルのパスを生成
-	cachePath := filepath.Join(c.baseDir, fmt.Sprintf("%s.cache", key))
-	
-	// ファイルに書き込み
-	if err := os.WriteFile(cachePath, data, 0644); err != nil {
+	cachePath := filepath.Join(c.baseDir, key+".cache")
+
+	tempFile, err := os.CreateTemp(c.baseDir, key+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create cache file: %w", err)
+	}
+	tempPath := tempFile.Name()
+	if _, err := tempFile.Write(data); err != nil {
+		tempFile.Close()
+		os.Remove(tempPath)
 		return fmt.Errorf("failed to write cache file: %w", err)
 	}
-	
-	// キャッシュ情報を更新
-	c.mutex.Lock()
-	c.items[key] = &CacheItem{
-		Path:      cachePath,
-		CreatedAt: time.Now(),
-		Size:      int64(len(data)),
+	if err := tempFile.Close(); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to write cache file: %w", err)
 	}
-	c.mutex.Unlock()
-	
-	return nil
-}
 
-// Delete はキャッシュからアイテムを削除
-func (c *Cache) Delete(key string) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	
-	if item, exists := c.items[key]; exists {
-		os.Remove(item.Path)
+
+	if err := os.Rename(tempPath, cachePath); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to write cache file: %w", err)
+	}
+
+	// 同じキーの古い情報を置き換える（ファイルは上書き済み）
+	if element, exists := c.items[key]; exists {
+		c.totalSize -= element.Value.(*CacheItem).Size
+		c.lru.Remove(element)
 		delete(c.items, key)
 	}
+
+	now := time.Now()
+	c.addItem(&CacheItem{
+		Key:        key,
+		Path:       cachePath,
+		CreatedAt:  now,
+		LastAccess: now,
+		Size:       size,
+	}, true)
+	c.evict()
+
+	return nil
+}
+
+// addItem はキャッシュ情報を登録する（mutex を保持して呼ぶ）
+func (c *Cache) addItem(item *CacheItem, front bool) {
+	var element *list.Element
+	if front {
+		element = c.lru.PushFront(item)
+	} else {
+		element = c.lru.PushBack(item)
+	}
+	c.items[item.Key] = element
+	c.totalSize += item.Size
+}
+
+// removeElement はキャッシュファイルと情報を削除する（mutex を保持して呼ぶ）
+func (c *Cache) removeElement(element *list.Element) {
+	item := element.Value.(*CacheItem)
+	os.Remove(item.Path)
+	c.lru.Remove(element)
+	delete(c.items, item.Key)
+	c.totalSize -= item.Size
+}
+
+// evict は合計サイズが上限以下になるまで最も使われていないものを削除する（mutex を保持して呼ぶ）
+func (c *Cache) evict() {
+	for c.totalSize > c.maxBytes {
+		oldest := c.lru.Back()
+		if oldest == nil {
+			return
+		}
+		c.removeElement(oldest)
+	}
 }
 
 // scanExistingCache は既存のキャッシュファイルをスキャン
+// 最終アクセス時刻はファイルの更新時刻とし、書き込み途中の一時ファイルや古い形式のファイルは削除する
 func (c *Cache) scanExistingCache() {
-	pattern := filepath.Join(c.baseDir, "*.cache")
-	files, err := filepath.Glob(pattern)
+	entries, err := os.ReadDir(c.baseDir)
 	if err != nil {
 		return
 	}
-	
-	for _, file := range files {
-		info, err := os.Stat(file)
-		if err != nil {
+
+	var items []*CacheItem
+	for _, entry := range entries {
+		if entry.IsDir() {
 			continue
 		}
-		
-		key := filepath.Base(file)
-		key = key[:len(key)-6] // .cache を除去
-		
-		c.items[key] = &CacheItem{
-			Path:      file,
-			CreatedAt: info.ModTime(),
-			Size:      info.Size(),
+		path := filepath.Join(c.baseDir, entry.Name())
+
+		match := cacheFilePattern.FindStringSubmatch(entry.Name())
+		if match == nil {
+			os.Remove(path)
+			continue
 		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		items = append(items, &CacheItem{
+			Key:        match[1],
+			Path:       path,
+			CreatedAt:  info.ModTime(),
+			LastAccess: info.ModTime(),
+			Size:       info.Size(),
+		})
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// 新しいものが先頭になるように並べる
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].LastAccess.After(items[j].LastAccess)
+	})
+	for _, item := range items {
+		c.addItem(item, false)
 	}
+	c.evict()
 }
 
-// startCleanupRoutine は定期的なクリーンアップを実行
+// startCleanupRoutine は Close されるまで定期的なクリーンアップを実行
 func (c *Cache) startCleanupRoutine() {
-	ticker := time.NewTicker(1 * time.Hour)
+	defer close(c.done)
+
+	interval := c.ttl / 4
+	if interval > time.Hour {
+		interval = time.Hour
+	}
+	if interval < time.Minute {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
-	
-	for range ticker.C {
-		c.cleanup()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.cleanup()
+		case <-c.stop:
+			return
+		}
 	}
 }
 
-// cleanup は古いキャッシュを削除
+// cleanup は有効期間を過ぎたキャッシュを削除
 func (c *Cache) cleanup() {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	
+
 	now := time.Now()
-	maxAge := 24 * time.Hour
-	
-	for key, item := range c.items {
-		if now.Sub(item.CreatedAt) > maxAge {
-			os.Remove(item.Path)
-			delete(c.items, key)
+	for element := c.lru.Back(); element != nil; {
+		prev := element.Prev()
+		if now.Sub(element.Value.(*CacheItem).CreatedAt) > c.ttl {
+			c.removeElement(element)
 		}
+		element = prev
 	}
 }
 
+// Close は定期的なクリーンアップを止め、終了を待つ
+// キャッシュファイルは次回の起動で引き継ぐため削除しない
+func (c *Cache) Close() {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
+	<-c.done
+}
+
 // Clear はすべてのキャッシュをクリア
 func (c *Cache) Clear() error {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	
-	for key, item := range c.items {
-		if err := os.Remove(item.Path); err != nil {
-			// エラーは無視して続行
-		}
-		delete(c.items, key)
+
+	for element := c.lru.Front(); element != nil; {
+		next := element.Next()
+		c.removeElement(element)
+		element = next
 	}
-	
+
 	return nil
 }
 
 // GetStats はキャッシュの統計情報を取得
-func (c *Cache) GetStats() (count int, totalSize int64) {
-	c.mutex.RLock()
-	defer c.mutex.RUnlock()
-	
-	count = len(c.items)
-	for _, item := range c.items {
-		totalSize += item.Size
-	}
-	
-	return count, totalSize
-}
\ No newline at end of file
+func (c *Cache) GetStats() CacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return CacheStats{
+		Count:     len(c.items),
+		TotalSize: c.totalSize,
+		MaxBytes:  c.maxBytes,
+		TTL:       c.ttl,
+		Hits:      c.hits,
+		Misses:    c.misses,
+	}
+}
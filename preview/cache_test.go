@@ -0,0 +1,137 @@
+package preview
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// newTestCache creates a cache in a temporary directory that is closed when the test ends
+func newTestCache(t *testing.T, options CacheOptions) *Cache {
+	t.Helper()
+	cache, err := NewCache(t.TempDir(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cache.Close)
+	return cache
+}
+
+// testHash returns the content hash of the i-th test file
+func testHash(i int) string {
+	return fmt.Sprintf("%064x", i)
+}
+
+func putTestPreview(t *testing.T, cache *Cache, i int, data []byte) {
+	t.Helper()
+	if err := cache.Put(testHash(i), 200, 200, 1, "jpeg", data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func cached(cache *Cache, i int) bool {
+	_, ok := cache.Get(testHash(i), 200, 200, 1, "jpeg")
+	return ok
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newTestCache(t, CacheOptions{MaxBytes: 30})
+	data := bytes.Repeat([]byte("x"), 10)
+
+	for i := 1; i <= 3; i++ {
+		putTestPreview(t, cache, i, data)
+	}
+	// Using the oldest entry makes the second one the least recently used
+	if !cached(cache, 1) {
+		t.Fatal("first preview is not cached")
+	}
+	putTestPreview(t, cache, 4, data)
+
+	if cached(cache, 2) {
+		t.Error("least recently used preview 2 was kept")
+	}
+	// Used in this order, 1 becomes the least recently used again
+	for _, i := range []int{1, 3, 4} {
+		if !cached(cache, i) {
+			t.Errorf("preview %d was evicted", i)
+		}
+	}
+
+	putTestPreview(t, cache, 5, data)
+	if cached(cache, 1) {
+		t.Error("preview 1 was kept over more recently used ones")
+	}
+	if !cached(cache, 3) {
+		t.Error("preview 3 was evicted before preview 1")
+	}
+}
+
+func TestCacheByteLimit(t *testing.T) {
+	cache := newTestCache(t, CacheOptions{MaxBytes: 25})
+
+	putTestPreview(t, cache, 1, bytes.Repeat([]byte("a"), 10))
+	putTestPreview(t, cache, 2, bytes.Repeat([]byte("b"), 10))
+	putTestPreview(t, cache, 3, bytes.Repeat([]byte("c"), 10))
+
+	stats := cache.GetStats()
+	if stats.TotalSize > 25 || stats.Count != 2 {
+		t.Errorf("got %d previews of %d bytes, want 2 within 25 bytes", stats.Count, stats.TotalSize)
+	}
+
+	if err := cache.Put(testHash(4), 200, 200, 1, "jpeg", bytes.Repeat([]byte("d"), 26)); err == nil {
+		t.Error("a preview larger than the limit was stored")
+	}
+
+	// Replacing an entry counts its new size only
+	putTestPreview(t, cache, 3, bytes.Repeat([]byte("c"), 5))
+	if stats := cache.GetStats(); stats.TotalSize != 15 {
+		t.Errorf("total size after replacing: got %d, want 15", stats.TotalSize)
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	cache := newTestCache(t, CacheOptions{TTL: 50 * time.Millisecond})
+	putTestPreview(t, cache, 1, []byte("preview"))
+
+	path := cache.lru.Front().Value.(*CacheItem).Path
+	if !cached(cache, 1) {
+		t.Fatal("fresh preview is not cached")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if cached(cache, 1) {
+		t.Error("expired preview was returned")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expired cache file was not removed: %v", err)
+	}
+	if stats := cache.GetStats(); stats.Count != 0 || stats.TotalSize != 0 {
+		t.Errorf("expired preview is still counted: %+v", stats)
+	}
+}
+
+func TestCacheHitMissCounters(t *testing.T) {
+	cache := newTestCache(t, CacheOptions{})
+	putTestPreview(t, cache, 1, []byte("preview"))
+
+	data, ok := cache.Get(testHash(1), 200, 200, 1, "jpeg")
+	if !ok || string(data) != "preview" {
+		t.Fatalf("got %q, %v", data, ok)
+	}
+	cached(cache, 1)
+	cached(cache, 2)                             // not stored
+	cache.Get(testHash(1), 400, 400, 1, "jpeg")  // other size
+	cache.Get(testHash(1), 200, 200, 1, "png")   // other format
+	cache.Get("not a hash", 200, 200, 1, "jpeg") // invalid key, not counted
+
+	// A cache file removed behind the cache's back is a miss and drops the entry
+	os.Remove(cache.lru.Front().Value.(*CacheItem).Path)
+	cached(cache, 1)
+
+	stats := cache.GetStats()
+	if stats.Hits != 2 || stats.Misses != 4 || stats.Count != 0 {
+		t.Errorf("got %d hits, %d misses and %d previews; want 2, 4 and 0", stats.Hits, stats.Misses, stats.Count)
+	}
+}
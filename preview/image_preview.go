@@ -0,0 +1,322 @@
+package preview
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	_ "golang.org/x/image/bmp"
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+	_ "golang.org/x/image/webp"
+	"golang.org/x/text/encoding/japanese"
+)
+
+// テキストプレビューで読み込む最大バイト数
+const maxTextPreviewBytes = 64 * 1024
+
+// ImagePreviewGenerator はOSの機能を使わずGoだけでプレビューを生成する実装
+// 画像（JPEG/PNG/GIF/BMP/WebP）は縮小画像、テキストは先頭部分を描画した画像、それ以外は拡張子のアイコンを返す
+type ImagePreviewGenerator struct {
+	face font.Face // テキスト描画用のフォント
+}
+
+// NewImagePreviewGenerator は新しいプレビュージェネレータを作成
+// fontPath に TrueType/OpenType フォント（.ttf/.otf/.ttc）を指定すると日本語のテキストも描画できる
+// 空の場合は組み込みの英数字フォントを使い、描画できない文字は枠で表示する
+func NewImagePreviewGenerator(fontPath string) (*ImagePreviewGenerator, error) {
+	if fontPath == "" {
+		return &ImagePreviewGenerator{face: basicfont.Face7x13}, nil
+	}
+
+	data, err := os.ReadFile(fontPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read font: %w", err)
+	}
+
+	// .ttc はフォントコレクションなので先頭のフォントを使う
+	parsed, err := opentype.Parse(data)
+	if err != nil {
+		collection, collectionErr := opentype.ParseCollection(data)
+		if collectionErr != nil {
+			return nil, fmt.Errorf("failed to parse font %s: %w", fontPath, err)
+		}
+		if parsed, err = collection.Font(0); err != nil {
+			return nil, fmt.Errorf("failed to parse font %s: %w", fontPath, err)
+		}
+	}
+
+	face, err := opentype.NewFace(parsed, &opentype.FaceOptions{Size: 12, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create font face: %w", err)
+	}
+
+	return &ImagePreviewGenerator{face: face}, nil
+}
+
+// GeneratePreview はファイルの種類に応じたプレビュー画像を生成
+func (g *ImagePreviewGenerator) GeneratePreview(filePath string, width, height int) (image.Image, error) {
+	if _, err := os.Stat(filePath); err != nil {
+		return nil, fmt.Errorf("file not found: %w", err)
+	}
+
+	ext := strings.ToLower(filepath.Ext(filePath))
+	switch ext {
+	case ".jpg", ".jpeg", ".png", ".gif", ".bmp", ".webp":
+		return g.generateImagePreview(filePath, width, height)
+	case ".txt", ".log", ".md", ".csv", ".tsv", ".json", ".xml":
+		return g.generateTextPreview(filePath, width, height)
+	}
+
+	// 拡張子が違っていても画像として読めるものは画像として扱う
+	if img, err := g.generateImagePreview(filePath, width, height); err == nil {
+		return img, nil
+	}
+	return g.generateIcon(ext, width, height), nil
+}
+
+// GeneratePreviewBytes はプレビュー画像をバイト配列として生成
+func (g *ImagePreviewGenerator) GeneratePreviewBytes(filePath string, width, height int, format string) ([]byte, string, error) {
+	img, err := g.GeneratePreview(filePath, width, height)
+	if err != nil {
+		return nil, "", err
+	}
+	return encodeImage(img, format)
+}
+
+// generateImagePreview は画像を読み込み、縦横比を保って width x height に収まるよう縮小する
+// 元の画像より大きくはしない
+func (g *ImagePreviewGenerator) generateImagePreview(filePath string, width, height int) (image.Image, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// GIFは先頭のフレームを使う
+	src, _, err := image.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	bounds := src.Bounds()
+	w, h := fitSize(bounds.Dx(), bounds.Dy(), width, height)
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	// 透過部分はJPEGにしたときに黒くならないよう白で埋める
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, xdraw.Over, nil)
+
+	return dst, nil
+}
+
+// fitSize は縦横比を保って maxWidth x maxHeight に収まる大きさを返す
+func fitSize(width, height, maxWidth, maxHeight int) (int, int) {
+	if width <= 0 || height <= 0 {
+		return 1, 1
+	}
+	if width <= maxWidth && height <= maxHeight {
+		return width, height
+	}
+
+	scale := float64(maxWidth) / float64(width)
+	if s := float64(maxHeight) / float64(height); s < scale {
+		scale = s
+	}
+
+	w, h := int(float64(width)*scale), int(float64(height)*scale)
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	return w, h
+}
+
+// generateTextPreview はテキストファイルの先頭部分を白地に描画する
+// 長い行は折り返し、画像に収まらない行は描画しない
+func (g *ImagePreviewGenerator) generateTextPreview(filePath string, width, height int) (image.Image, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxTextPreviewBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+
+	const margin = 8
+	metrics := g.face.Metrics()
+	lineHeight := metrics.Height.Ceil()
+	if lineHeight <= 0 {
+		lineHeight = 13
+	}
+
+	drawer := &font.Drawer{
+		Dst:  dst,
+		Src:  image.NewUniform(color.Black),
+		Face: g.face,
+	}
+	maxX := fixed.I(width - margin)
+	newLine := func(y int) fixed.Point26_6 {
+		return fixed.Point26_6{X: fixed.I(margin), Y: fixed.I(y)}
+	}
+
+	y := margin + metrics.Ascent.Ceil()
+	drawer.Dot = newLine(y)
+	for _, r := range decodeText(data) {
+		if y > height-margin {
+			break
+		}
+		if r == '\n' {
+			y += lineHeight
+			drawer.Dot = newLine(y)
+			continue
+		}
+
+		advance, ok := g.face.GlyphAdvance(r)
+		if !ok {
+			// フォントにない文字（組み込みフォントでの日本語など）は全角幅の枠で表す
+			advance, _ = g.face.GlyphAdvance('M')
+			advance *= 2
+		}
+		if drawer.Dot.X+advance > maxX {
+			y += lineHeight
+			drawer.Dot = newLine(y)
+			if y > height-margin {
+				break
+			}
+		}
+
+		if ok {
+			drawer.DrawString(string(r))
+		} else {
+			drawMissingGlyph(dst, drawer.Dot, advance, metrics)
+			drawer.Dot.X += advance
+		}
+	}
+
+	return dst, nil
+}
+
+// decodeText はテキストをUTF-8として読み、UTF-8でなければShift_JISとして読む
+// タブは空白に、改行コードはLFにそろえる
+func decodeText(data []byte) string {
+	data = bytes.TrimPrefix(data, []byte("\xEF\xBB\xBF"))
+
+	// 読み込みの上限で途中までになった末尾の文字は判定から除く
+	valid := data
+	for i := 0; i < utf8.UTFMax && len(valid) > 0 && !utf8.Valid(valid); i++ {
+		valid = valid[:len(valid)-1]
+	}
+
+	text := string(data)
+	if !utf8.Valid(valid) {
+		if decoded, err := japanese.ShiftJIS.NewDecoder().Bytes(data); err == nil {
+			text = string(decoded)
+		}
+	}
+
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+	return strings.ReplaceAll(text, "\t", "    ")
+}
+
+// drawMissingGlyph はフォントにない文字の位置に枠を描く
+func drawMissingGlyph(dst *image.RGBA, dot fixed.Point26_6, advance fixed.Int26_6, metrics font.Metrics) {
+	gray := color.RGBA{0x99, 0x99, 0x99, 0xff}
+	x0, x1 := dot.X.Ceil()+1, (dot.X+advance).Floor()-1
+	y0, y1 := (dot.Y-metrics.Ascent).Ceil()+1, dot.Y.Floor()
+	for x := x0; x <= x1; x++ {
+		dst.Set(x, y0, gray)
+		dst.Set(x, y1, gray)
+	}
+	for y := y0; y <= y1; y++ {
+		dst.Set(x0, y, gray)
+		dst.Set(x1, y, gray)
+	}
+}
+
+// iconColor は拡張子ごとのアイコンの色
+func iconColor(ext string) color.RGBA {
+	switch ext {
+	case ".pdf":
+		return color.RGBA{0xd3, 0x2f, 0x2f, 0xff}
+	case ".doc", ".docx", ".odt", ".rtf":
+		return color.RGBA{0x1e, 0x63, 0xc4, 0xff}
+	case ".xls", ".xlsx", ".ods":
+		return color.RGBA{0x1d, 0x7a, 0x45, 0xff}
+	case ".ppt", ".pptx", ".odp":
+		return color.RGBA{0xd2, 0x6a, 0x1e, 0xff}
+	case ".zip", ".7z", ".rar", ".lzh", ".gz":
+		return color.RGBA{0x79, 0x55, 0x48, 0xff}
+	case ".xml", ".html", ".htm":
+		return color.RGBA{0x6a, 0x1b, 0x9a, 0xff}
+	}
+	return color.RGBA{0x54, 0x6e, 0x7a, 0xff}
+}
+
+// generateIcon は拡張子を表示した書類のアイコンを生成
+func (g *ImagePreviewGenerator) generateIcon(ext string, width, height int) image.Image {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.RGBA{0xf2, 0xf2, 0xf2, 0xff}), image.Point{}, draw.Src)
+
+	// 縦長の書類を中央に配置
+	pageHeight := height * 3 / 4
+	pageWidth := pageHeight * 3 / 4
+	if pageWidth > width*3/4 {
+		pageWidth = width * 3 / 4
+		pageHeight = pageWidth * 4 / 3
+	}
+	page := image.Rect((width-pageWidth)/2, (height-pageHeight)/2, (width+pageWidth)/2, (height+pageHeight)/2)
+	border := color.RGBA{0xb0, 0xb0, 0xb0, 0xff}
+	draw.Draw(dst, page, image.NewUniform(border), image.Point{}, draw.Src)
+	draw.Draw(dst, page.Inset(1), image.White, image.Point{}, draw.Src)
+
+	// 右上の折り返し
+	fold := pageWidth / 4
+	for y := 0; y < fold; y++ {
+		for x := fold - y; x < fold; x++ {
+			dst.Set(page.Max.X-fold+x, page.Min.Y+y, border)
+		}
+	}
+
+	// 拡張子のラベル
+	label := strings.ToUpper(strings.TrimPrefix(ext, "."))
+	if label == "" {
+		label = "FILE"
+	}
+	labelFace := basicfont.Face7x13
+	labelHeight := labelFace.Metrics().Height.Ceil() + 8
+	band := image.Rect(page.Min.X, page.Min.Y+pageHeight/2, page.Max.X, page.Min.Y+pageHeight/2+labelHeight)
+	draw.Draw(dst, band, image.NewUniform(iconColor(ext)), image.Point{}, draw.Src)
+
+	drawer := &font.Drawer{Dst: dst, Src: image.White, Face: labelFace}
+	textWidth := drawer.MeasureString(label)
+	drawer.Dot = fixed.Point26_6{
+		X: fixed.I(band.Min.X) + (fixed.I(band.Dx())-textWidth)/2,
+		Y: fixed.I(band.Min.Y + 4 + labelFace.Metrics().Ascent.Ceil()),
+	}
+	drawer.DrawString(label)
+
+	return dst
+}
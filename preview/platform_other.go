@@ -0,0 +1,9 @@
+//go:build !windows
+// +build !windows
+
+package preview
+
+// newPlatformGenerator はWindows以外ではOS固有のジェネレータがないことを返す
+func newPlatformGenerator(fallback *ImagePreviewGenerator) (Generator, bool) {
+	return nil, false
+}
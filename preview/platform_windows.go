@@ -0,0 +1,12 @@
+//go:build windows
+// +build windows
+
+package preview
+
+// newPlatformGenerator はWindowsのシェル機能を使うジェネレータを返す
+// シェル機能で作れないテキストやアイコンは fallback で生成する
+func newPlatformGenerator(fallback *ImagePreviewGenerator) (Generator, bool) {
+	generator := NewWindowsPreviewGenerator()
+	generator.fallback = fallback
+	return generator, true
+}
@@ -1,14 +1,19 @@
 package preview
 
 import (
+	"bytes"
+	"fmt"
 	"image"
+	"image/jpeg"
+	"image/png"
+	"strings"
 )
 
 // Generator はプレビュー画像を生成するインターフェース
 type Generator interface {
 	// GeneratePreview はファイルのプレビュー画像を生成する
 	GeneratePreview(filePath string, width, height int) (image.Image, error)
-	
+
 	// GeneratePreviewBytes はプレビュー画像をバイト配列として生成する
 	GeneratePreviewBytes(filePath string, width, height int, format string) ([]byte, string, error)
 }
@@ -31,4 +36,54 @@ func DefaultOptions() *Options {
 		Quality: 80,
 		Format:  "jpeg",
 	}
-}
\ No newline at end of file
+}
+
+// NewGenerator は設定に応じたプレビュージェネレータを作成する
+// kind が "auto"（または空）の場合はWindowsではシェル機能を使う実装、それ以外ではGoだけの実装を使う
+// "image" は常にGoだけの実装、"windows" はWindows以外ではエラーになる
+// fontPath はGoだけの実装でテキストを描画するフォント（空なら組み込みの英数字フォント）
+func NewGenerator(kind, fontPath string) (Generator, error) {
+	imageGenerator, err := NewImagePreviewGenerator(fontPath)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(kind) {
+	case "", "auto":
+		if generator, ok := newPlatformGenerator(imageGenerator); ok {
+			return generator, nil
+		}
+		return imageGenerator, nil
+	case "image":
+		return imageGenerator, nil
+	case "windows":
+		if generator, ok := newPlatformGenerator(imageGenerator); ok {
+			return generator, nil
+		}
+		return nil, fmt.Errorf("windows preview generator is not available on this platform")
+	default:
+		return nil, fmt.Errorf("unknown preview generator: %s (must be auto, image or windows)", kind)
+	}
+}
+
+// encodeImage はプレビュー画像を指定フォーマット（png/jpeg、既定はjpeg）でエンコードする
+func encodeImage(img image.Image, format string) ([]byte, string, error) {
+	var buf bytes.Buffer
+	var contentType string
+	var err error
+
+	switch strings.ToLower(format) {
+	case "png":
+		err = png.Encode(&buf, img)
+		contentType = "image/png"
+	default:
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 80})
+		contentType = "image/jpeg"
+	}
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	return buf.Bytes(), contentType, nil
+}
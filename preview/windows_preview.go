@@ -15,15 +15,16 @@ import (
 	"strings"
 	"syscall"
 	"unsafe"
-	
+
 	"github.com/go-ole/go-ole"
 	"golang.org/x/sys/windows"
 )
 
 // WindowsPreviewGenerator はWindows環境でのプレビュー生成実装
 type WindowsPreviewGenerator struct {
-	initialized bool
+	initialized   bool
 	powershellGen *PowerShellPreviewGenerator
+	fallback      *ImagePreviewGenerator // シェル機能で作れない場合のGoだけの実装
 }
 
 // NewWindowsPreviewGenerator は新しいWindowsプレビュージェネレータを作成
@@ -38,7 +39,7 @@ var (
 	shell32 = syscall.NewLazyDLL("shell32.dll")
 	ole32   = syscall.NewLazyDLL("ole32.dll")
 	gdi32   = syscall.NewLazyDLL("gdi32.dll")
-	
+
 	procSHCreateItemFromParsingName = shell32.NewProc("SHCreateItemFromParsingName")
 	procDeleteObject                = gdi32.NewProc("DeleteObject")
 )
@@ -86,16 +87,16 @@ func (g *WindowsPreviewGenerator) GeneratePreview(filePath string, width, height
 	// OSスレッドを固定（COMのSTAモデルに必要）
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
-	
+
 	fmt.Printf("WindowsPreviewGenerator: Starting preview generation for %s\n", filePath)
 	fmt.Printf("WindowsPreviewGenerator: Thread locked for COM STA\n")
-	
+
 	// ファイルの存在確認
 	if _, err := os.Stat(filePath); err != nil {
 		fmt.Printf("WindowsPreviewGenerator: File not found: %v\n", err)
 		return nil, fmt.Errorf("file not found: %w", err)
 	}
-	
+
 	// COM初期化（STAモデル）- 毎回初期化と解放を行う
 	fmt.Printf("WindowsPreviewGenerator: Initializing COM with STA model\n")
 	err := ole.CoInitializeEx(0, ole.COINIT_APARTMENTTHREADED)
@@ -104,7 +105,7 @@ func (g *WindowsPreviewGenerator) GeneratePreview(filePath string, width, height
 		return nil, fmt.Errorf("COM initialization failed: %w", err)
 	}
 	defer ole.CoUninitialize()
-	
+
 	// 絶対パスに変換
 	absPath, err := filepath.Abs(filePath)
 	if err != nil {
@@ -112,7 +113,7 @@ func (g *WindowsPreviewGenerator) GeneratePreview(filePath string, width, height
 		return nil, err
 	}
 	fmt.Printf("WindowsPreviewGenerator: Using absolute path: %s\n", absPath)
-	
+
 	// IShellItemImageFactoryを使用してプレビュー生成を試みる
 	fmt.Printf("WindowsPreviewGenerator: Attempting Shell API preview for extension: %s\n", filepath.Ext(filePath))
 	img, err := g.getShellItemPreview(absPath, width, height)
@@ -121,11 +122,11 @@ func (g *WindowsPreviewGenerator) GeneratePreview(filePath string, width, height
 		return img, nil
 	}
 	fmt.Printf("WindowsPreviewGenerator: Shell API failed: %v\n", err)
-	
+
 	// フォールバック: PowerShellまたはファイルタイプに応じた処理
 	ext := strings.ToLower(filepath.Ext(filePath))
 	fmt.Printf("WindowsPreviewGenerator: Falling back to alternative method for %s\n", ext)
-	
+
 	// PDFの場合はPowerShellジェネレータを試す
 	if ext == ".pdf" {
 		fmt.Printf("WindowsPreviewGenerator: Trying PowerShell generator for PDF\n")
@@ -136,9 +137,14 @@ func (g *WindowsPreviewGenerator) GeneratePreview(filePath string, width, height
 		}
 		fmt.Printf("WindowsPreviewGenerator: PowerShell generator failed: %v\n", err)
 	}
-	
+
+	if g.fallback != nil {
+		fmt.Printf("WindowsPreviewGenerator: Using Go preview generator for %s\n", ext)
+		return g.fallback.GeneratePreview(absPath, width, height)
+	}
+
 	switch ext {
-	case ".jpg", ".jpeg", ".png", ".gif", ".bmp":
+	case ".jpg", ".jpeg", ".png", ".gif", ".bmp", ".webp":
 		return g.loadImageFile(absPath)
 	case ".txt", ".log", ".md":
 		return g.generateTextPreview(absPath)
@@ -152,14 +158,14 @@ func (g *WindowsPreviewGenerator) GeneratePreview(filePath string, width, height
 // getShellItemPreview はIShellItemImageFactoryを使用してプレビューを取得
 func (g *WindowsPreviewGenerator) getShellItemPreview(filePath string, width, height int) (image.Image, error) {
 	fmt.Printf("getShellItemPreview: Starting for %s\n", filePath)
-	
+
 	// UTF16に変換
 	pathPtr, err := syscall.UTF16PtrFromString(filePath)
 	if err != nil {
 		fmt.Printf("getShellItemPreview: UTF16 conversion failed: %v\n", err)
 		return nil, err
 	}
-	
+
 	// IShellItemを作成
 	var shellItem uintptr
 	hr, _, _ := procSHCreateItemFromParsingName.Call(
@@ -168,17 +174,17 @@ func (g *WindowsPreviewGenerator) getShellItemPreview(filePath string, width, he
 		uintptr(unsafe.Pointer(IID_IShellItemImageFactory)),
 		uintptr(unsafe.Pointer(&shellItem)),
 	)
-	
+
 	if hr != 0 {
 		fmt.Printf("getShellItemPreview: SHCreateItemFromParsingName failed: 0x%x\n", hr)
 		return nil, fmt.Errorf("SHCreateItemFromParsingName failed: 0x%x", hr)
 	}
 	fmt.Printf("getShellItemPreview: IShellItem created successfully\n")
-	
+
 	// IShellItemImageFactoryにキャスト
 	factory := (*IShellItemImageFactory)(unsafe.Pointer(shellItem))
 	defer g.releaseShellItem(factory)
-	
+
 	// サイズ設定 - 256以下に制限
 	if width > 256 {
 		width = 256
@@ -199,15 +205,15 @@ func (g *WindowsPreviewGenerator) getShellItemPreview(filePath string, width, he
 		{SIIGBF_BIGGERSIZEOK | SIIGBF_RESIZETOFIT, "BIGGERSIZEOK"},
 		{0, "NO_FLAGS"},
 	}
-	
+
 	var hBitmap windows.Handle
 	var lastHR uintptr
 	var success bool
-	
+
 	// 各フラグパターンを順番に試す
 	for i, pattern := range flagPatterns {
 		fmt.Printf("getShellItemPreview: Trying pattern %d/%d - %s (flags: 0x%x)\n", i+1, len(flagPatterns), pattern.name, pattern.flags)
-		
+
 		hr, _, _ := syscall.Syscall6(
 			(*factory.vtbl).GetImage,
 			4,
@@ -219,7 +225,7 @@ func (g *WindowsPreviewGenerator) getShellItemPreview(filePath string, width, he
 			0,
 		)
 		lastHR = hr
-		
+
 		if hr == 0 {
 			fmt.Printf("getShellItemPreview: SUCCESS with %s pattern!\n", pattern.name)
 			success = true
@@ -228,13 +234,13 @@ func (g *WindowsPreviewGenerator) getShellItemPreview(filePath string, width, he
 			fmt.Printf("getShellItemPreview: Pattern %s failed: 0x%x\n", pattern.name, hr)
 		}
 	}
-	
+
 	if !success {
 		return nil, fmt.Errorf("GetImage failed with all patterns, last error: 0x%x", lastHR)
 	}
 	fmt.Printf("getShellItemPreview: Got HBITMAP handle: %v\n", hBitmap)
 	defer deleteObject(hBitmap)
-	
+
 	// HBITMAPをimage.Imageに変換
 	return g.convertHBitmapToImage(hBitmap)
 }
@@ -256,17 +262,17 @@ func (g *WindowsPreviewGenerator) convertHBitmapToImage(hBitmap windows.Handle)
 	// デフォルトの画像を返す（一時的な実装）
 	// TODO: 実際のHBITMAP変換を実装
 	fmt.Printf("convertHBitmapToImage: Returning default image (TODO: implement HBITMAP conversion)\n")
-	
+
 	// とりあえず空の画像を作成
 	img := image.NewRGBA(image.Rect(0, 0, 128, 128))
-	
+
 	// 簡単な色で塗りつぶし（デバッグ用）
 	for y := 0; y < 128; y++ {
 		for x := 0; x < 128; x++ {
 			img.Set(x, y, image.White)
 		}
 	}
-	
+
 	return img, nil
 }
 
@@ -277,7 +283,7 @@ func (g *WindowsPreviewGenerator) loadImageFile(filePath string) (image.Image, e
 		return nil, err
 	}
 	defer file.Close()
-	
+
 	img, _, err := image.Decode(file)
 	return img, err
 }
@@ -302,10 +308,10 @@ func (g *WindowsPreviewGenerator) GeneratePreviewBytes(filePath string, width, h
 	if err != nil {
 		return nil, "", err
 	}
-	
+
 	var buf bytes.Buffer
 	var contentType string
-	
+
 	switch strings.ToLower(format) {
 	case "png":
 		err = png.Encode(&buf, img)
@@ -317,11 +323,11 @@ func (g *WindowsPreviewGenerator) GeneratePreviewBytes(filePath string, width, h
 		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 80})
 		contentType = "image/jpeg"
 	}
-	
+
 	if err != nil {
 		return nil, "", err
 	}
-	
+
 	return buf.Bytes(), contentType, nil
 }
 
@@ -331,4 +337,4 @@ func (g *WindowsPreviewGenerator) Cleanup() {
 		ole.CoUninitialize()
 		g.initialized = false
 	}
-}
\ No newline at end of file
+}
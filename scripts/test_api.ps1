@@ -11,14 +11,26 @@ Write-Host "---------------"
 Invoke-RestMethod -Uri "$API_BASE/health" -Method GET | ConvertTo-Json
 Write-Host ""
 
+Write-Host "Login" -ForegroundColor Yellow
+Write-Host "-----"
+$loginData = @{
+    username = if ($env:DENCHOKUN_USER) { $env:DENCHOKUN_USER } else { "admin" }
+    password = $env:DENCHOKUN_ADMIN_PASSWORD
+} | ConvertTo-Json
+
+$login = Invoke-RestMethod -Uri "$API_BASE/auth/login" -Method POST -Body $loginData -ContentType "application/json"
+$HEADERS = @{ Authorization = "Bearer $($login.token)" }
+$login.user | ConvertTo-Json
+Write-Host ""
+
 Write-Host "2. Create Period (2024-01)" -ForegroundColor Yellow
 Write-Host "-------------------------"
-Invoke-RestMethod -Uri "$API_BASE/periods/$PERIOD/connect" -Method POST | ConvertTo-Json
+Invoke-RestMethod -Headers $HEADERS -Uri "$API_BASE/periods/$PERIOD/connect" -Method POST | ConvertTo-Json
 Write-Host ""
 
 Write-Host "3. Get Available Periods" -ForegroundColor Yellow
 Write-Host "------------------------"
-Invoke-RestMethod -Uri "$API_BASE/periods" -Method GET | ConvertTo-Json
+Invoke-RestMethod -Headers $HEADERS -Uri "$API_BASE/periods" -Method GET | ConvertTo-Json
 Write-Host ""
 
 Write-Host "4. Create Test Deal" -ForegroundColor Yellow
@@ -37,17 +49,17 @@ $dealData = @{
     }
 } | ConvertTo-Json -Depth 3
 
-Invoke-RestMethod -Uri "$API_BASE/deals" -Method POST -Body $dealData -ContentType "application/json" | ConvertTo-Json
+Invoke-RestMethod -Headers $HEADERS -Uri "$API_BASE/deals" -Method POST -Body $dealData -ContentType "application/json" | ConvertTo-Json
 Write-Host ""
 
 Write-Host "5. Get Deals List" -ForegroundColor Yellow
 Write-Host "-----------------"
-Invoke-RestMethod -Uri "$API_BASE/deals?period=$PERIOD" -Method GET | ConvertTo-Json
+Invoke-RestMethod -Headers $HEADERS -Uri "$API_BASE/deals?period=$PERIOD" -Method GET | ConvertTo-Json
 Write-Host ""
 
 Write-Host "6. Get Specific Deal" -ForegroundColor Yellow
 Write-Host "--------------------"
-Invoke-RestMethod -Uri "$API_BASE/deals/D240115001?period=$PERIOD" -Method GET | ConvertTo-Json
+Invoke-RestMethod -Headers $HEADERS -Uri "$API_BASE/deals/D240115001?period=$PERIOD" -Method GET | ConvertTo-Json
 Write-Host ""
 
 Write-Host "7. Create Deal Partner" -ForegroundColor Yellow
@@ -56,12 +68,38 @@ $partnerData = @{
     name = "テスト商店"
 } | ConvertTo-Json
 
-Invoke-RestMethod -Uri "$API_BASE/deal-partners?period=$PERIOD" -Method POST -Body $partnerData -ContentType "application/json" | ConvertTo-Json
+Invoke-RestMethod -Headers $HEADERS -Uri "$API_BASE/deal-partners?period=$PERIOD" -Method POST -Body $partnerData -ContentType "application/json" | ConvertTo-Json
 Write-Host ""
 
 Write-Host "8. Get Deal Partners" -ForegroundColor Yellow
 Write-Host "--------------------"
-Invoke-RestMethod -Uri "$API_BASE/deal-partners?period=$PERIOD" -Method GET | ConvertTo-Json
+Invoke-RestMethod -Headers $HEADERS -Uri "$API_BASE/deal-partners?period=$PERIOD" -Method GET | ConvertTo-Json
+Write-Host ""
+
+Write-Host "9. Create Mixed Tax Rate Deal" -ForegroundColor Yellow
+Write-Host "-----------------------------"
+$taxDealData = @{
+    period = "2024-01"
+    dealData = @{
+        DealType = "領収書"
+        DealDate = "2024-01-20"
+        DealName = "会議用飲食物"
+        DealPartner = "オフィス用品店"
+        DealPrice = 1640
+        RecStatus = "NEW"
+        TaxLines = @(
+            @{ rate = "8"; amountIncludingTax = 540 },
+            @{ rate = "10"; amountIncludingTax = 1100 }
+        )
+    }
+} | ConvertTo-Json -Depth 4
+
+Invoke-RestMethod -Headers $HEADERS -Uri "$API_BASE/deals" -Method POST -Body $taxDealData -ContentType "application/json" | ConvertTo-Json
+Write-Host ""
+
+Write-Host "10. Get Tax Summary" -ForegroundColor Yellow
+Write-Host "-------------------"
+Invoke-RestMethod -Headers $HEADERS -Uri "$API_BASE/periods/tax-summary?period=$PERIOD" -Method GET | ConvertTo-Json -Depth 4
 Write-Host ""
 
 Write-Host "=========================================" -ForegroundColor Cyan
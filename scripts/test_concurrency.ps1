@@ -0,0 +1,155 @@
+$API_BASE = if ($env:DENCHOKUN_API_BASE) { $env:DENCHOKUN_API_BASE } else { "http://localhost:8080/v1/api" }
+$PERIODS = @("concurrency-a", "concurrency-b")
+$READERS_PER_PERIOD = 3
+$DEALS_PER_PERIOD = 10
+
+Write-Host "=========================================" -ForegroundColor Cyan
+Write-Host "電帳君 API Concurrency Test Script" -ForegroundColor Cyan
+Write-Host "=========================================" -ForegroundColor Cyan
+Write-Host "Requests for different periods run in parallel and must never see each other's deals."
+Write-Host ""
+
+Write-Host "1. Login" -ForegroundColor Yellow
+Write-Host "--------"
+$loginData = @{
+    username = if ($env:DENCHOKUN_USER) { $env:DENCHOKUN_USER } else { "admin" }
+    password = $env:DENCHOKUN_ADMIN_PASSWORD
+} | ConvertTo-Json
+
+$login = Invoke-RestMethod -Uri "$API_BASE/auth/login" -Method POST -Body $loginData -ContentType "application/json"
+$TOKEN = $login.token
+$HEADERS = @{ Authorization = "Bearer $TOKEN" }
+Write-Host "Logged in as $($login.user.username)"
+Write-Host ""
+
+Write-Host "2. Create Periods" -ForegroundColor Yellow
+Write-Host "-----------------"
+foreach ($period in $PERIODS) {
+    $periodData = @{
+        name = $period
+        fromDate = "2024-01-01"
+        toDate = "2024-12-31"
+    } | ConvertTo-Json
+
+    try {
+        Invoke-RestMethod -Headers $HEADERS -Uri "$API_BASE/periods" -Method POST -Body $periodData -ContentType "application/json" | Out-Null
+        Write-Host "Created $period"
+    } catch {
+        Write-Host "Using existing $period"
+    }
+}
+Write-Host ""
+
+Write-Host "3. Register and Read Deals in Parallel" -ForegroundColor Yellow
+Write-Host "--------------------------------------"
+
+# 登録ワーカーは自分の期間に取引を登録し、直後に同じ期間から読み戻す
+# 参照ワーカーは同じ期間の一覧を繰り返し取得する
+# 他の期間の取引が1件でも返れば分離されていない
+$worker = {
+    param($ApiBase, $Token, $Period, $Register, $Count)
+
+    $headers = @{ Authorization = "Bearer $Token" }
+    $failures = @()
+    $created = @()
+
+    for ($i = 1; $i -le $Count; $i++) {
+        $name = "isolation-$Period-$i"
+        $dealData = @{
+            period = $Period
+            dealData = @{
+                DealType = "領収書"
+                DealDate = "2024-06-01"
+                DealName = $name
+                DealPartner = "並行テスト"
+                DealPrice = $i
+                RecStatus = "NEW"
+            }
+        } | ConvertTo-Json -Depth 3
+
+        try {
+            if (-not $Register) {
+                $list = Invoke-RestMethod -Headers $headers -Uri "$ApiBase/deals?period=$Period&limit=1000" -Method GET
+                foreach ($d in $list.deals) {
+                    if ($d.DealName -like "isolation-*" -and $d.DealName -notlike "isolation-$Period-*") {
+                        $failures += "${Period}: returned deal $($d.NO) of another period ($($d.DealName))"
+                    }
+                }
+                Start-Sleep -Milliseconds 100
+                continue
+            }
+
+            $result = Invoke-RestMethod -Headers $headers -Uri "$ApiBase/deals" -Method POST -Body ([System.Text.Encoding]::UTF8.GetBytes($dealData)) -ContentType "application/json; charset=utf-8"
+            $created += $result.dealNo
+
+            $deal = Invoke-RestMethod -Headers $headers -Uri "$ApiBase/deals/$($result.dealNo)?period=$Period" -Method GET
+            if ($deal.deal.DealName -ne $name) {
+                $failures += "$Period/$($result.dealNo): expected $name, got $($deal.deal.DealName)"
+            }
+
+            $list = Invoke-RestMethod -Headers $headers -Uri "$ApiBase/deals?period=$Period&limit=1000" -Method GET
+            foreach ($d in $list.deals) {
+                if ($d.DealName -like "isolation-*" -and $d.DealName -notlike "isolation-$Period-*") {
+                    $failures += "${Period}: returned deal $($d.NO) of another period ($($d.DealName))"
+                }
+            }
+        } catch {
+            $failures += "${Period}: request failed: $($_.Exception.Message)"
+        }
+
+        # 取引番号は秒単位のため同じ秒に同じ端末から同じ期間へ登録しない
+        Start-Sleep -Milliseconds 1100
+    }
+
+    [PSCustomObject]@{
+        Period = $Period
+        Created = $created
+        Failures = $failures
+    }
+}
+
+# 期間ごとの取引番号が同じになっても、それぞれの期間の取引が返ることを確認する
+$jobs = @()
+foreach ($period in $PERIODS) {
+    $jobs += Start-Job -ScriptBlock $worker -ArgumentList $API_BASE, $TOKEN, $period, $true, $DEALS_PER_PERIOD
+    for ($r = 1; $r -le $READERS_PER_PERIOD; $r++) {
+        $jobs += Start-Job -ScriptBlock $worker -ArgumentList $API_BASE, $TOKEN, $period, $false, ($DEALS_PER_PERIOD * 10)
+    }
+}
+
+$results = $jobs | Wait-Job | Receive-Job
+$jobs | Remove-Job
+
+$failures = @($results | ForEach-Object { $_.Failures } | Where-Object { $_ })
+foreach ($period in $PERIODS) {
+    $count = @($results | Where-Object { $_.Period -eq $period } | ForEach-Object { $_.Created }).Count
+    Write-Host "$period : $count deals registered"
+}
+Write-Host ""
+
+Write-Host "4. Verify Each Period" -ForegroundColor Yellow
+Write-Host "---------------------"
+foreach ($period in $PERIODS) {
+    $list = Invoke-RestMethod -Headers $HEADERS -Uri "$API_BASE/deals?period=$period&limit=1000" -Method GET
+    $foreign = @($list.deals | Where-Object { $_.DealName -like "isolation-*" -and $_.DealName -notlike "isolation-$period-*" })
+    if ($foreign.Count -gt 0) {
+        $failures += "${period}: contains $($foreign.Count) deals of another period"
+    }
+
+    $chain = Invoke-RestMethod -Headers $HEADERS -Uri "$API_BASE/periods/verify-chain?period=$period" -Method GET
+    if (-not $chain.verification.valid) {
+        $failures += "${period}: hash chain is broken"
+    }
+    Write-Host "$period : $($list.count) deals, chain valid = $($chain.verification.valid)"
+}
+Write-Host ""
+
+Write-Host "=========================================" -ForegroundColor Cyan
+if ($failures.Count -gt 0) {
+    Write-Host "FAILED: $($failures.Count) isolation errors" -ForegroundColor Red
+    $failures | ForEach-Object { Write-Host "  $_" -ForegroundColor Red }
+    Write-Host "=========================================" -ForegroundColor Cyan
+    exit 1
+}
+Write-Host "Test Complete! Periods are isolated." -ForegroundColor Green
+Write-Host "=========================================" -ForegroundColor Cyan
@@ -0,0 +1,531 @@
+package textextract
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"context"
+	"encoding/ascii85"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+)
+
+// maxStreamSize は展開後のストリームの最大サイズ（圧縮爆弾対策）
+const maxStreamSize = 64 << 20
+
+// maxPDFDepth はフォームXObjectやページツリーをたどる深さの上限
+const maxPDFDepth = 16
+
+// maxPDFOperations は文書全体で解釈するコンテンツストリームの字句（演算子と引数）と
+// フォントを読み込むたびに展開するコードの数の合計の上限
+// フォームXObjectを何度も呼ぶ入れ子や、大きなCMapのフォントを何度も選ぶ文書で処理が増え続けるのを防ぐ
+const maxPDFOperations = 16 << 20
+
+// maxPDFDecodedSize は文書全体で展開するストリームの合計サイズの上限
+const maxPDFDecodedSize = 256 << 20
+
+// pdfObject は間接オブジェクト
+type pdfObject struct {
+	value  interface{}
+	stream []byte // ストリームの場合の（フィルター適用前の）データ
+}
+
+// pdfDocument は読み込んだPDF
+// 相互参照表は使わず、ファイル全体から「番号 世代 obj」を探して読む（後から現れたものが優先）
+type pdfDocument struct {
+	objects   map[int]*pdfObject
+	trailer   pdfDict
+	encrypted bool
+	fonts     map[int]*pdfFont // 間接オブジェクトのフォントのキャッシュ
+	cmaps     map[int]*pdfCMap // CMapのストリームのキャッシュ
+
+	ctx        context.Context
+	forms      map[int]bool // 描画中のフォームXObject（自身を呼ぶフォームを止めるため）
+	operations int          // 解釈した字句の数
+	decoded    int          // 展開したストリームの合計サイズ
+	err        error        // 上限を超えたか ctx が終了した場合のエラー
+}
+
+var pdfObjectHeader = regexp.MustCompile(`(\d+)\s+(\d+)\s+obj\b`)
+
+// extractPDF はPDFの全ページのテキストを取り出す
+func extractPDF(ctx context.Context, data []byte) (string, error) {
+	doc := parsePDF(ctx, data)
+	if doc.encrypted {
+		return "", ErrEncrypted
+	}
+
+	w := &textWriter{}
+	for _, page := range doc.pages() {
+		if w.full() || doc.err != nil {
+			break
+		}
+		content := doc.pageContent(page.dict)
+		doc.showText(content, page.resources, identityMatrix, w, 0)
+		w.endPage()
+	}
+	if doc.err != nil {
+		return "", doc.err
+	}
+	return w.String(), nil
+}
+
+// step は字句を1つ解釈する前に呼び、上限を超えたか ctx が終了していれば false を返す
+func (d *pdfDocument) step() bool {
+	return d.spend(1)
+}
+
+// spend は n 回分の処理（字句の解釈やCMapの展開）を数え、上限を超えたか ctx が終了していれば false を返す
+func (d *pdfDocument) spend(n int) bool {
+	if d.err != nil {
+		return false
+	}
+	before := d.operations
+	d.operations += n
+	if d.operations > maxPDFOperations {
+		d.err = ErrTooComplex
+		return false
+	}
+	if d.operations/1024 != before/1024 {
+		if err := d.ctx.Err(); err != nil {
+			d.err = err
+			return false
+		}
+	}
+	return true
+}
+
+// parsePDF はPDFのオブジェクトを読み込む
+func parsePDF(ctx context.Context, data []byte) *pdfDocument {
+	doc := &pdfDocument{
+		objects: map[int]*pdfObject{},
+		trailer: pdfDict{},
+		fonts:   map[int]*pdfFont{},
+		cmaps:   map[int]*pdfCMap{},
+		ctx:     ctx,
+		forms:   map[int]bool{},
+	}
+
+	pos := 0
+	for pos < len(data) {
+		loc := pdfObjectHeader.FindSubmatchIndex(data[pos:])
+		if loc == nil {
+			break
+		}
+		num := atoi(data[pos+loc[2] : pos+loc[3]])
+		l := &pdfLexer{data: data, pos: pos + loc[1]}
+		value, _ := l.object(true)
+		obj := &pdfObject{value: value}
+
+		save := l.pos
+		if tok, ok := l.token(); ok && tok == pdfKeyword("stream") {
+			obj.stream, l.pos = readStreamData(data, l.pos, value)
+		} else {
+			l.pos = save
+		}
+		doc.objects[num] = obj
+		pos = l.pos
+
+		// 相互参照ストリームがトレーラーを兼ねる
+		if dict, ok := value.(pdfDict); ok && dict[pdfName("Type")] == pdfName("XRef") {
+			doc.mergeTrailer(dict)
+		}
+	}
+
+	// 従来の trailer 辞書（増分更新では最後のものが有効だが、/Root などは前のものにもある）
+	for i := 0; i < len(data); {
+		j := bytes.Index(data[i:], []byte("trailer"))
+		if j < 0 {
+			break
+		}
+		l := &pdfLexer{data: data, pos: i + j + len("trailer")}
+		if dict, ok := l.object(true); ok {
+			if d, isDict := dict.(pdfDict); isDict {
+				doc.mergeTrailer(d)
+			}
+		}
+		i = l.pos
+	}
+
+	doc.loadObjectStreams()
+	return doc
+}
+
+// mergeTrailer はトレーラーの項目を、まだないものだけ加える
+func (d *pdfDocument) mergeTrailer(dict pdfDict) {
+	for _, key := range []pdfName{"Root", "Encrypt"} {
+		if value, ok := dict[key]; ok {
+			if _, exists := d.trailer[key]; !exists || key == "Root" {
+				d.trailer[key] = value
+			}
+		}
+	}
+	if _, ok := d.trailer["Encrypt"]; ok {
+		d.encrypted = true
+	}
+}
+
+// readStreamData は stream キーワードの後のデータを返す
+// /Length が直接の数値で endstream と合っていればそれを使い、そうでなければ endstream を探す
+func readStreamData(data []byte, pos int, value interface{}) ([]byte, int) {
+	if pos < len(data) && data[pos] == '\r' {
+		pos++
+	}
+	if pos < len(data) && data[pos] == '\n' {
+		pos++
+	}
+
+	if dict, ok := value.(pdfDict); ok {
+		if n, ok := dict[pdfName("Length")].(float64); ok && n >= 0 && pos+int(n) <= len(data) {
+			end := pos + int(n)
+			rest := bytes.TrimLeft(data[end:min(end+32, len(data))], " \t\r\n\f")
+			if bytes.HasPrefix(rest, []byte("endstream")) {
+				return data[pos:end], end + bytes.Index(data[end:], []byte("endstream")) + len("endstream")
+			}
+		}
+	}
+
+	end := bytes.Index(data[pos:], []byte("endstream"))
+	if end < 0 {
+		return data[pos:], len(data)
+	}
+	stream := bytes.TrimRight(data[pos:pos+end], "\r\n")
+	return stream, pos + end + len("endstream")
+}
+
+// loadObjectStreams はオブジェクトストリーム（PDF 1.5）に格納されたオブジェクトを読み込む
+func (d *pdfDocument) loadObjectStreams() {
+	for _, obj := range d.objects {
+		dict, ok := obj.value.(pdfDict)
+		if !ok || dict[pdfName("Type")] != pdfName("ObjStm") {
+			continue
+		}
+		data, err := d.decodeStream(obj)
+		if err != nil {
+			continue
+		}
+		count, _ := dict[pdfName("N")].(float64)
+		first, _ := dict[pdfName("First")].(float64)
+
+		l := &pdfLexer{data: data}
+		for i := 0; i < int(count); i++ {
+			numTok, ok1 := l.token()
+			offTok, ok2 := l.token()
+			num, isNum := numTok.(float64)
+			off, isOff := offTok.(float64)
+			if !ok1 || !ok2 || !isNum || !isOff {
+				break
+			}
+			if _, exists := d.objects[int(num)]; exists {
+				continue
+			}
+			start := int(first) + int(off)
+			if start < 0 || start >= len(data) {
+				continue
+			}
+			ol := &pdfLexer{data: data, pos: start}
+			if value, ok := ol.object(true); ok {
+				d.objects[int(num)] = &pdfObject{value: value}
+			}
+		}
+	}
+}
+
+// resolve は間接参照をたどって値を返す
+func (d *pdfDocument) resolve(value interface{}) interface{} {
+	for i := 0; i < maxPDFDepth; i++ {
+		ref, ok := value.(pdfRef)
+		if !ok {
+			return value
+		}
+		obj := d.objects[ref.num]
+		if obj == nil {
+			return nil
+		}
+		value = obj.value
+	}
+	return nil
+}
+
+// dict は値を辞書として返す（辞書でなければ nil）
+func (d *pdfDocument) dict(value interface{}) pdfDict {
+	dict, _ := d.resolve(value).(pdfDict)
+	return dict
+}
+
+// streamOf は値がストリームの参照であればそのオブジェクトを返す
+func (d *pdfDocument) streamOf(value interface{}) *pdfObject {
+	for i := 0; i < maxPDFDepth; i++ {
+		ref, ok := value.(pdfRef)
+		if !ok {
+			return nil
+		}
+		obj := d.objects[ref.num]
+		if obj == nil {
+			return nil
+		}
+		if obj.stream != nil {
+			return obj
+		}
+		value = obj.value
+	}
+	return nil
+}
+
+// decodeStream はストリームのフィルターを適用したデータを返す
+// FlateDecode、ASCIIHexDecode、ASCII85Decode に対応し、それ以外（画像用など）はエラーになる
+// 展開したサイズの合計が maxPDFDecodedSize を超えると、それ以降は ErrTooComplex になる
+func (d *pdfDocument) decodeStream(obj *pdfObject) ([]byte, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	dict, _ := obj.value.(pdfDict)
+	var filters []interface{}
+	switch f := d.resolve(dict[pdfName("Filter")]).(type) {
+	case pdfName:
+		filters = []interface{}{f}
+	case pdfArray:
+		filters = f
+	}
+	var params []interface{}
+	switch p := d.resolve(dict[pdfName("DecodeParms")]).(type) {
+	case pdfDict:
+		params = []interface{}{p}
+	case pdfArray:
+		params = p
+	}
+
+	data := obj.stream
+	for i, filter := range filters {
+		var err error
+		switch d.resolve(filter) {
+		case pdfName("FlateDecode"), pdfName("Fl"):
+			data, err = inflate(data)
+			if err == nil && i < len(params) {
+				data, err = applyPredictor(data, d.dict(params[i]))
+			}
+		case pdfName("ASCIIHexDecode"), pdfName("AHx"):
+			data = []byte((&pdfLexer{data: append(append([]byte("<"), data...), '>')}).hexString())
+		case pdfName("ASCII85Decode"), pdfName("A85"):
+			data, err = decodeASCII85(data)
+		default:
+			err = fmt.Errorf("unsupported filter %v", filter)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	d.decoded += len(data)
+	if d.decoded > maxPDFDecodedSize {
+		d.err = ErrTooComplex
+		return nil, d.err
+	}
+	return data, nil
+}
+
+// inflate はFlate圧縮を展開する。壊れたデータは展開できたところまでを返す
+func inflate(data []byte) ([]byte, error) {
+	var r io.ReadCloser
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		// zlibのヘッダーがないデータ
+		r = flate.NewReader(bytes.NewReader(data))
+	}
+	defer r.Close()
+
+	out, err := io.ReadAll(io.LimitReader(r, maxStreamSize))
+	if err != nil && len(out) == 0 {
+		return nil, fmt.Errorf("failed to inflate stream: %v", err)
+	}
+	return out, nil
+}
+
+// applyPredictor はPNG予測子（/Predictor 10以上）を戻す
+func applyPredictor(data []byte, params pdfDict) ([]byte, error) {
+	predictor, _ := params[pdfName("Predictor")].(float64)
+	if predictor < 10 {
+		return data, nil
+	}
+	columns := 1
+	if c, ok := params[pdfName("Columns")].(float64); ok && c > 0 {
+		columns = int(c)
+	}
+	colors := 1
+	if c, ok := params[pdfName("Colors")].(float64); ok && c > 0 {
+		colors = int(c)
+	}
+	bits := 8
+	if b, ok := params[pdfName("BitsPerComponent")].(float64); ok && b > 0 {
+		bits = int(b)
+	}
+	bpp := max((colors*bits+7)/8, 1)
+	rowSize := (columns*colors*bits + 7) / 8
+
+	var out []byte
+	prev := make([]byte, rowSize)
+	for i := 0; i+rowSize+1 <= len(data); i += rowSize + 1 {
+		kind := data[i]
+		row := append([]byte(nil), data[i+1:i+1+rowSize]...)
+		for j := range row {
+			var left, up, upLeft byte
+			if j >= bpp {
+				left = row[j-bpp]
+				upLeft = prev[j-bpp]
+			}
+			up = prev[j]
+			switch kind {
+			case 1:
+				row[j] += left
+			case 2:
+				row[j] += up
+			case 3:
+				row[j] += byte((int(left) + int(up)) / 2)
+			case 4:
+				row[j] += paeth(left, up, upLeft)
+			}
+		}
+		out = append(out, row...)
+		prev = row
+	}
+	return out, nil
+}
+
+// paeth はPNGのPaeth予測子
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	if pa <= pb && pa <= pc {
+		return a
+	}
+	if pb <= pc {
+		return b
+	}
+	return c
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// decodeASCII85 はASCII85を戻す（<~ ~> と空白は除く）
+func decodeASCII85(data []byte) ([]byte, error) {
+	data = bytes.TrimPrefix(bytes.TrimSpace(data), []byte("<~"))
+	if i := bytes.Index(data, []byte("~>")); i >= 0 {
+		data = data[:i]
+	}
+	out := make([]byte, 4*len(data)/5+4)
+	n, _, err := ascii85.Decode(out, data, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode ASCII85 stream: %v", err)
+	}
+	return out[:n], nil
+}
+
+// pdfPage はページの辞書と（親から継承したものを含む）リソース
+type pdfPage struct {
+	dict      pdfDict
+	resources pdfDict
+}
+
+// pages はページツリーの順にページを返す
+// カタログからたどれない場合は /Type /Page のオブジェクトを番号順に返す
+func (d *pdfDocument) pages() []pdfPage {
+	var pages []pdfPage
+	visited := map[int]bool{}
+
+	var walk func(node interface{}, resources pdfDict, depth int)
+	walk = func(node interface{}, resources pdfDict, depth int) {
+		if ref, ok := node.(pdfRef); ok {
+			if visited[ref.num] {
+				return
+			}
+			visited[ref.num] = true
+		}
+		dict := d.dict(node)
+		if dict == nil || depth > maxPDFDepth {
+			return
+		}
+		if r := d.dict(dict[pdfName("Resources")]); r != nil {
+			resources = r
+		}
+		if kids, ok := d.resolve(dict[pdfName("Kids")]).(pdfArray); ok {
+			for _, kid := range kids {
+				walk(kid, resources, depth+1)
+			}
+			return
+		}
+		if dict[pdfName("Type")] == pdfName("Page") || dict[pdfName("Contents")] != nil {
+			pages = append(pages, pdfPage{dict: dict, resources: resources})
+		}
+	}
+
+	if root := d.dict(d.trailer[pdfName("Root")]); root != nil {
+		walk(root[pdfName("Pages")], nil, 0)
+	}
+	if len(pages) > 0 {
+		return pages
+	}
+
+	var nums []int
+	for num, obj := range d.objects {
+		if dict, ok := obj.value.(pdfDict); ok && dict[pdfName("Type")] == pdfName("Page") {
+			nums = append(nums, num)
+		}
+	}
+	sort.Ints(nums)
+	for _, num := range nums {
+		dict := d.objects[num].value.(pdfDict)
+		resources := d.dict(dict[pdfName("Resources")])
+		for parent, depth := d.dict(dict[pdfName("Parent")]), 0; resources == nil && parent != nil && depth < maxPDFDepth; depth++ {
+			resources = d.dict(parent[pdfName("Resources")])
+			parent = d.dict(parent[pdfName("Parent")])
+		}
+		pages = append(pages, pdfPage{dict: dict, resources: resources})
+	}
+	return pages
+}
+
+// pageContent はページのコンテンツストリームを展開してつなげる
+func (d *pdfDocument) pageContent(page pdfDict) []byte {
+	var refs []interface{}
+	switch contents := page[pdfName("Contents")].(type) {
+	case pdfRef:
+		if array, ok := d.resolve(contents).(pdfArray); ok {
+			refs = array
+		} else {
+			refs = []interface{}{contents}
+		}
+	case pdfArray:
+		refs = contents
+	}
+
+	var content []byte
+	for _, ref := range refs {
+		obj := d.streamOf(ref)
+		if obj == nil {
+			continue
+		}
+		data, err := d.decodeStream(obj)
+		if err != nil {
+			continue
+		}
+		content = append(content, data...)
+		content = append(content, '\n')
+	}
+	return content
+}
+
+// atoi は数字だけのバイト列を整数にする
+func atoi(b []byte) int {
+	n := 0
+	for _, c := range b {
+		n = n*10 + int(c-'0')
+	}
+	return n
+}
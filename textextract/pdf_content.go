@@ -0,0 +1,347 @@
+package textextract
+
+import (
+	"bytes"
+	"math"
+	"strings"
+)
+
+// pdfMatrix は変換行列 [a b c d e f]
+type pdfMatrix [6]float64
+
+var identityMatrix = pdfMatrix{1, 0, 0, 1, 0, 0}
+
+// multiply は m × n を返す
+func (m pdfMatrix) multiply(n pdfMatrix) pdfMatrix {
+	return pdfMatrix{
+		m[0]*n[0] + m[1]*n[2],
+		m[0]*n[1] + m[1]*n[3],
+		m[2]*n[0] + m[3]*n[2],
+		m[2]*n[1] + m[3]*n[3],
+		m[4]*n[0] + m[5]*n[2] + n[4],
+		m[4]*n[1] + m[5]*n[3] + n[5],
+	}
+}
+
+// graphicsState はテキストの位置の計算に使うグラフィックス状態
+type graphicsState struct {
+	ctm       pdfMatrix
+	font      *pdfFont
+	fontSize  float64
+	charSpace float64 // Tc
+	wordSpace float64 // Tw
+	scale     float64 // Tz（1で100%）
+	leading   float64 // TL
+	rise      float64 // Ts
+}
+
+// contentInterpreter はコンテンツストリームのテキスト描画を textWriter に書く
+type contentInterpreter struct {
+	doc       *pdfDocument
+	resources pdfDict
+	w         *textWriter
+	depth     int
+
+	gs    graphicsState
+	stack []graphicsState
+	tm    pdfMatrix // テキスト行列
+	tlm   pdfMatrix // テキスト行の行列
+}
+
+// showText はコンテンツストリームを解釈してテキストを書く
+func (d *pdfDocument) showText(content []byte, resources pdfDict, ctm pdfMatrix, w *textWriter, depth int) {
+	in := &contentInterpreter{
+		doc:       d,
+		resources: resources,
+		w:         w,
+		depth:     depth,
+		gs:        graphicsState{ctm: ctm, scale: 1},
+		tm:        identityMatrix,
+		tlm:       identityMatrix,
+	}
+	in.run(content)
+}
+
+// run は演算子ごとに処理する
+func (in *contentInterpreter) run(content []byte) {
+	l := &pdfLexer{data: content}
+	var operands []interface{}
+	for !in.w.full() && in.doc.step() {
+		tok, ok := l.object(false)
+		if !ok {
+			return
+		}
+		op, isOp := tok.(pdfKeyword)
+		if !isOp {
+			operands = append(operands, tok)
+			continue
+		}
+		if op == "BI" {
+			skipInlineImage(l)
+		} else {
+			in.operator(string(op), operands)
+		}
+		operands = operands[:0]
+	}
+}
+
+// skipInlineImage はインライン画像（BI … ID データ EI）を読み飛ばす
+func skipInlineImage(l *pdfLexer) {
+	for {
+		tok, ok := l.token()
+		if !ok {
+			return
+		}
+		if tok == pdfKeyword("ID") {
+			break
+		}
+	}
+	for l.pos+2 < len(l.data) {
+		i := bytes.Index(l.data[l.pos:], []byte("EI"))
+		if i < 0 {
+			l.pos = len(l.data)
+			return
+		}
+		end := l.pos + i
+		l.pos = end + 2
+		if end > 0 && isPDFSpace(l.data[end-1]) && (l.pos >= len(l.data) || isPDFSpace(l.data[l.pos])) {
+			return
+		}
+	}
+	l.pos = len(l.data)
+}
+
+// numbers は演算子の数値の引数を返す（数が合わなければ ok が false）
+func numbers(operands []interface{}, n int) ([]float64, bool) {
+	if len(operands) < n {
+		return nil, false
+	}
+	values := make([]float64, n)
+	for i, v := range operands[len(operands)-n:] {
+		f, ok := v.(float64)
+		if !ok {
+			return nil, false
+		}
+		values[i] = f
+	}
+	return values, true
+}
+
+// operator は演算子を1つ処理する
+func (in *contentInterpreter) operator(op string, operands []interface{}) {
+	switch op {
+	case "q":
+		in.stack = append(in.stack, in.gs)
+	case "Q":
+		if n := len(in.stack); n > 0 {
+			in.gs = in.stack[n-1]
+			in.stack = in.stack[:n-1]
+		}
+	case "cm":
+		if v, ok := numbers(operands, 6); ok {
+			in.gs.ctm = pdfMatrix{v[0], v[1], v[2], v[3], v[4], v[5]}.multiply(in.gs.ctm)
+		}
+	case "BT":
+		in.tm, in.tlm = identityMatrix, identityMatrix
+	case "Tf":
+		if len(operands) >= 2 {
+			if name, ok := operands[len(operands)-2].(pdfName); ok {
+				in.gs.font = in.doc.font(in.resources, name)
+			}
+			if size, ok := operands[len(operands)-1].(float64); ok {
+				in.gs.fontSize = size
+			}
+		}
+	case "Tc":
+		if v, ok := numbers(operands, 1); ok {
+			in.gs.charSpace = v[0]
+		}
+	case "Tw":
+		if v, ok := numbers(operands, 1); ok {
+			in.gs.wordSpace = v[0]
+		}
+	case "Tz":
+		if v, ok := numbers(operands, 1); ok {
+			in.gs.scale = v[0] / 100
+		}
+	case "TL":
+		if v, ok := numbers(operands, 1); ok {
+			in.gs.leading = v[0]
+		}
+	case "Ts":
+		if v, ok := numbers(operands, 1); ok {
+			in.gs.rise = v[0]
+		}
+	case "Td":
+		if v, ok := numbers(operands, 2); ok {
+			in.moveLine(v[0], v[1])
+		}
+	case "TD":
+		if v, ok := numbers(operands, 2); ok {
+			in.gs.leading = -v[1]
+			in.moveLine(v[0], v[1])
+		}
+	case "Tm":
+		if v, ok := numbers(operands, 6); ok {
+			in.tlm = pdfMatrix{v[0], v[1], v[2], v[3], v[4], v[5]}
+			in.tm = in.tlm
+		}
+	case "T*":
+		in.moveLine(0, -in.gs.leading)
+	case "Tj":
+		if len(operands) > 0 {
+			in.show(operands[len(operands)-1])
+		}
+	case "'":
+		in.moveLine(0, -in.gs.leading)
+		if len(operands) > 0 {
+			in.show(operands[len(operands)-1])
+		}
+	case "\"":
+		if len(operands) >= 3 {
+			if v, ok := numbers(operands[:len(operands)-1], 2); ok {
+				in.gs.wordSpace, in.gs.charSpace = v[0], v[1]
+			}
+			in.moveLine(0, -in.gs.leading)
+			in.show(operands[len(operands)-1])
+		}
+	case "TJ":
+		if len(operands) > 0 {
+			if array, ok := operands[len(operands)-1].(pdfArray); ok {
+				for _, item := range array {
+					if n, ok := item.(float64); ok {
+						in.tm = pdfMatrix{1, 0, 0, 1, -n / 1000 * in.gs.fontSize * in.gs.scale, 0}.multiply(in.tm)
+						continue
+					}
+					in.show(item)
+				}
+			}
+		}
+	case "Do":
+		if len(operands) > 0 {
+			if name, ok := operands[len(operands)-1].(pdfName); ok {
+				in.form(name)
+			}
+		}
+	}
+}
+
+// moveLine は次の行の先頭に移動する（Td）
+func (in *contentInterpreter) moveLine(tx, ty float64) {
+	in.tlm = pdfMatrix{1, 0, 0, 1, tx, ty}.multiply(in.tlm)
+	in.tm = in.tlm
+}
+
+// show は文字列を描画し、描画位置を進める
+func (in *contentInterpreter) show(operand interface{}) {
+	s, ok := operand.(pdfString)
+	if !ok || in.gs.font == nil {
+		return
+	}
+
+	gs := &in.gs
+	trm := pdfMatrix{gs.fontSize * gs.scale, 0, 0, gs.fontSize, 0, gs.rise}.multiply(in.tm).multiply(gs.ctm)
+	start := trm
+	size := math.Hypot(trm[2], trm[3])
+
+	var text strings.Builder
+	gs.font.decode(s, func(glyph string, width float64, singleSpace bool) {
+		text.WriteString(glyph)
+		advance := width*gs.fontSize + gs.charSpace
+		if singleSpace {
+			advance += gs.wordSpace
+		}
+		in.tm = pdfMatrix{1, 0, 0, 1, advance * gs.scale, 0}.multiply(in.tm)
+	})
+	end := pdfMatrix{gs.fontSize * gs.scale, 0, 0, gs.fontSize, 0, gs.rise}.multiply(in.tm).multiply(gs.ctm)
+
+	in.w.write(text.String(), start[4], start[5], end[4], size)
+}
+
+// form はフォームXObjectの内容を描画する
+// 描画中のフォームを（直接または間接に）また呼ぶ場合は何もしない
+func (in *contentInterpreter) form(name pdfName) {
+	if in.depth >= maxPDFDepth {
+		return
+	}
+	xobjects := in.doc.dict(in.resources[pdfName("XObject")])
+	ref, ok := xobjects[name].(pdfRef)
+	if !ok || in.doc.forms[ref.num] {
+		return
+	}
+	obj := in.doc.streamOf(ref)
+	if obj == nil {
+		return
+	}
+	dict, _ := obj.value.(pdfDict)
+	if dict[pdfName("Subtype")] != pdfName("Form") {
+		return
+	}
+	content, err := in.doc.decodeStream(obj)
+	if err != nil {
+		return
+	}
+
+	ctm := in.gs.ctm
+	if m, ok := in.doc.resolve(dict[pdfName("Matrix")]).(pdfArray); ok && len(m) == 6 {
+		if v, ok := numbers(m, 6); ok {
+			ctm = pdfMatrix{v[0], v[1], v[2], v[3], v[4], v[5]}.multiply(ctm)
+		}
+	}
+	resources := in.doc.dict(dict[pdfName("Resources")])
+	if resources == nil {
+		resources = in.resources
+	}
+	in.doc.forms[ref.num] = true
+	defer delete(in.doc.forms, ref.num)
+	in.doc.showText(content, resources, ctm, in.w, in.depth+1)
+}
+
+// textWriter は描画された文字列を位置から行と空白を補ってつなげる
+type textWriter struct {
+	b       strings.Builder
+	started bool
+	lastY   float64
+	lastEnd float64 // 前の文字列の終わりのX座標
+}
+
+// write は (x, y) から endX まで描画された文字列を書く
+// 前の文字列と縦の位置が文字の高さの半分以上違えば改行し、同じ行で横に離れていれば空白を入れる
+func (w *textWriter) write(text string, x, y, endX, size float64) {
+	if text == "" || w.full() {
+		return
+	}
+	if size <= 0 {
+		size = 1
+	}
+
+	if w.started {
+		switch {
+		case math.Abs(y-w.lastY) > size/2:
+			w.b.WriteByte('\n')
+		case x-w.lastEnd > size*0.2 || w.lastEnd-x > size:
+			w.b.WriteByte(' ')
+		}
+	}
+	w.b.WriteString(text)
+	w.started = true
+	w.lastY = y
+	w.lastEnd = endX
+}
+
+// endPage はページの終わりで改行する
+func (w *textWriter) endPage() {
+	if w.started {
+		w.b.WriteByte('\n')
+		w.started = false
+	}
+}
+
+// full はテキストが MaxTextSize に達したかを返す
+func (w *textWriter) full() bool {
+	return w.b.Len() >= MaxTextSize
+}
+
+func (w *textWriter) String() string {
+	return w.b.String()
+}
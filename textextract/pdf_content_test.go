@@ -0,0 +1,38 @@
+package textextract
+
+import (
+	"context"
+	"testing"
+)
+
+func TestTJSpacing(t *testing.T) {
+	// 幅のないフォントの文字は0.5em、フォントサイズ10では5の幅になる
+	// 文字列の間が文字の高さの0.2倍（2）より広ければ空白を入れる
+	resources := pdfDict{"Font": pdfDict{"F1": pdfDict{"Subtype": pdfName("Type1")}}}
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"kerning", "[(A) -100 (B)] TJ", "AB"},
+		{"word gap", "[(Hello) -300 (World)] TJ", "Hello World"},
+		{"small positive adjustment", "[(A) 300 (B)] TJ", "AB"},
+		{"large positive adjustment", "[(A) 2000 (B)] TJ", "A B"},
+		{"several adjustments", "[(A) -100 -150 (B)] TJ", "A B"},
+		{"adjustment at the start", "[-5000 (A)] TJ", "A"},
+		{"character spacing is part of the string", "3 Tc [(A) (B)] TJ", "AB"},
+		{"word spacing is part of the string", "3 Tw [(A ) (B)] TJ", "A B"},
+		{"horizontal scaling", "50 Tz [(A) -300 (B)] TJ", "AB"},
+		{"separate strings", "(Hello) Tj [-300 (World)] TJ", "Hello World"},
+		{"next line", "[(A)] TJ 0 -12 Td [(B)] TJ", "A\nB"},
+	}
+
+	for _, tt := range tests {
+		doc := parsePDF(context.Background(), nil)
+		w := &textWriter{}
+		doc.showText([]byte("BT /F1 10 Tf "+tt.content+" ET"), resources, identityMatrix, w, 0)
+		if got := w.String(); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
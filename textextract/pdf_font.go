@@ -0,0 +1,452 @@
+package textextract
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+)
+
+// pdfFont は文字列のコードを文字に変換するためのフォントの情報
+type pdfFont struct {
+	composite bool              // Type0（CIDフォント）
+	ranges    []codespaceRange  // コードのバイト数を決めるコード空間（CMapから）
+	toUnicode map[uint64]string // ToUnicode CMap（codeKey をキーとする）
+	encoding  [256]rune         // 単純フォントの文字コード表
+	cmapName  string            // Type0の定義済みCMapの名前（Identity-H、90ms-RKSJ-H など）
+
+	widths       map[int]float64 // コードごとの幅（グリフ空間、1000で1em）
+	defaultWidth float64
+	scale        float64 // グリフ空間からテキスト空間への倍率（Type3以外は0.001）
+}
+
+// codespaceRange はCMapのコード空間の範囲
+type codespaceRange struct {
+	low, high []byte
+}
+
+// codeKey はバイト数の違うコードを区別するためのキー
+func codeKey(code []byte) uint64 {
+	return uint64(len(code))<<32 | uint64(bytesValue(code))
+}
+
+// font はリソースのフォント名のフォントを返す
+func (d *pdfDocument) font(resources pdfDict, name pdfName) *pdfFont {
+	fonts := d.dict(resources[pdfName("Font")])
+	ref := fonts[name]
+	if r, ok := ref.(pdfRef); ok {
+		if font, cached := d.fonts[r.num]; cached {
+			return font
+		}
+		font := d.loadFont(d.dict(ref))
+		d.fonts[r.num] = font
+		return font
+	}
+	return d.loadFont(d.dict(ref))
+}
+
+// loadFont はフォント辞書を読み込む
+func (d *pdfDocument) loadFont(dict pdfDict) *pdfFont {
+	font := &pdfFont{widths: map[int]float64{}, defaultWidth: 500, scale: 0.001}
+	if dict == nil {
+		font.encoding = standardEncoding()
+		return font
+	}
+
+	subtype := dict[pdfName("Subtype")]
+	if subtype == pdfName("Type0") {
+		font.composite = true
+		font.defaultWidth = 1000
+		switch enc := dict[pdfName("Encoding")].(type) {
+		case pdfName:
+			font.cmapName = string(enc)
+		case pdfRef:
+			if cmap := d.cmap(enc); cmap != nil {
+				font.ranges = cmap.ranges
+			}
+		}
+		if descendants, ok := d.resolve(dict[pdfName("DescendantFonts")]).(pdfArray); ok && len(descendants) > 0 {
+			d.spend(d.loadCIDWidths(font, d.dict(descendants[0])))
+		}
+	} else {
+		font.encoding = d.simpleEncoding(dict)
+		if subtype == pdfName("Type3") {
+			if matrix, ok := d.resolve(dict[pdfName("FontMatrix")]).(pdfArray); ok && len(matrix) > 0 {
+				if s, ok := d.resolve(matrix[0]).(float64); ok {
+					font.scale = s
+				}
+			}
+		}
+		first, _ := d.resolve(dict[pdfName("FirstChar")]).(float64)
+		if widths, ok := d.resolve(dict[pdfName("Widths")]).(pdfArray); ok {
+			for i, w := range widths {
+				if v, ok := d.resolve(w).(float64); ok {
+					font.widths[int(first)+i] = v
+				}
+			}
+		}
+	}
+
+	if cmap := d.cmap(dict[pdfName("ToUnicode")]); cmap != nil {
+		font.toUnicode = cmap.toUnicode
+		if len(font.ranges) == 0 {
+			font.ranges = cmap.ranges
+		}
+	}
+	return font
+}
+
+// cmap は value が参照するCMapのストリームを読み込む（読めなければ nil）
+// 同じCMapを使うフォントが間接オブジェクトでなく何度も読み込まれても、展開は1度だけにする
+func (d *pdfDocument) cmap(value interface{}) *pdfCMap {
+	ref, ok := value.(pdfRef)
+	if !ok {
+		return nil
+	}
+	if cmap, cached := d.cmaps[ref.num]; cached {
+		return cmap
+	}
+
+	var cmap *pdfCMap
+	if obj := d.streamOf(ref); obj != nil {
+		if data, err := d.decodeStream(obj); err == nil {
+			cmap = parseCMap(data)
+			d.spend(cmap.expanded)
+		}
+	}
+	d.cmaps[ref.num] = cmap
+	return cmap
+}
+
+// loadCIDWidths はCIDフォントの /W と /DW を読み、範囲から展開したコードの数を返す
+// 展開するのは合わせて maxCMapEntries までで、それ以降の範囲は無視する
+func (d *pdfDocument) loadCIDWidths(font *pdfFont, cidFont pdfDict) (expanded int) {
+	if cidFont == nil {
+		return 0
+	}
+	if dw, ok := d.resolve(cidFont[pdfName("DW")]).(float64); ok {
+		font.defaultWidth = dw
+	}
+	w, _ := d.resolve(cidFont[pdfName("W")]).(pdfArray)
+	for i := 0; i < len(w); {
+		first, ok := d.resolve(w[i]).(float64)
+		if !ok || i+1 >= len(w) {
+			return expanded
+		}
+		if list, ok := d.resolve(w[i+1]).(pdfArray); ok {
+			// c [w1 w2 ...]
+			for j, v := range list {
+				if width, ok := d.resolve(v).(float64); ok {
+					font.widths[int(first)+j] = width
+				}
+			}
+			i += 2
+			continue
+		}
+		// c1 c2 w
+		if i+2 >= len(w) {
+			return expanded
+		}
+		last, _ := d.resolve(w[i+1]).(float64)
+		width, _ := d.resolve(w[i+2]).(float64)
+		if last-first <= 0xFFFF && expanded+int(last-first) < maxCMapEntries {
+			for c := int(first); c <= int(last); c++ {
+				font.widths[c] = width
+				expanded++
+			}
+		}
+		i += 3
+	}
+	return expanded
+}
+
+// simpleEncoding は単純フォントの /Encoding（基本の表と /Differences）から文字コード表を作る
+func (d *pdfDocument) simpleEncoding(dict pdfDict) [256]rune {
+	table := standardEncoding()
+	apply := func(name interface{}) {
+		switch name {
+		case pdfName("WinAnsiEncoding"):
+			table = charmapEncoding(charmap.Windows1252)
+		case pdfName("MacRomanEncoding"):
+			table = charmapEncoding(charmap.Macintosh)
+		}
+	}
+
+	switch enc := d.resolve(dict[pdfName("Encoding")]).(type) {
+	case pdfName:
+		apply(enc)
+	case pdfDict:
+		apply(enc[pdfName("BaseEncoding")])
+		if diffs, ok := d.resolve(enc[pdfName("Differences")]).(pdfArray); ok {
+			code := 0
+			for _, item := range diffs {
+				switch v := d.resolve(item).(type) {
+				case float64:
+					code = int(v)
+				case pdfName:
+					if code >= 0 && code < 256 {
+						if r := glyphRune(string(v)); r != 0 {
+							table[code] = r
+						}
+					}
+					code++
+				}
+			}
+		}
+	}
+	return table
+}
+
+// standardEncoding はStandardEncodingの近似（ASCIIの範囲とLatin-1）
+func standardEncoding() [256]rune {
+	var table [256]rune
+	for i := 32; i < 256; i++ {
+		table[i] = rune(i)
+	}
+	table[0x27] = '’'
+	table[0x60] = '‘'
+	return table
+}
+
+// charmapEncoding は1バイトの文字コード表を作る
+func charmapEncoding(cm *charmap.Charmap) [256]rune {
+	var table [256]rune
+	for i := 32; i < 256; i++ {
+		table[i] = cm.DecodeByte(byte(i))
+	}
+	return table
+}
+
+// glyphNames はよく使われるグリフ名の文字
+var glyphNames = map[string]rune{
+	"space": ' ', "exclam": '!', "quotedbl": '"', "numbersign": '#', "dollar": '$', "percent": '%',
+	"ampersand": '&', "quotesingle": '\'', "quoteright": '’', "quoteleft": '‘', "parenleft": '(',
+	"parenright": ')', "asterisk": '*', "plus": '+', "comma": ',', "hyphen": '-', "period": '.',
+	"slash": '/', "zero": '0', "one": '1', "two": '2', "three": '3', "four": '4', "five": '5',
+	"six": '6', "seven": '7', "eight": '8', "nine": '9', "colon": ':', "semicolon": ';', "less": '<',
+	"equal": '=', "greater": '>', "question": '?', "at": '@', "bracketleft": '[', "backslash": '\\',
+	"bracketright": ']', "asciicircum": '^', "underscore": '_', "grave": '`', "braceleft": '{',
+	"bar": '|', "braceright": '}', "asciitilde": '~', "yen": '¥', "endash": '–', "emdash": '—',
+	"quotedblleft": '“', "quotedblright": '”', "bullet": '•', "ellipsis": '…', "copyright": '©',
+	"registered": '®', "degree": '°', "multiply": '×', "divide": '÷', "minus": '−', "fi": 'ﬁ', "fl": 'ﬂ',
+	"Euro": '€', "nbspace": ' ', "sfthyphen": '-',
+}
+
+// glyphRune はグリフ名の文字を返す（不明なら0）
+func glyphRune(name string) rune {
+	if r, ok := glyphNames[name]; ok {
+		return r
+	}
+	if len(name) == 1 && (name[0] >= 'A' && name[0] <= 'Z' || name[0] >= 'a' && name[0] <= 'z') {
+		return rune(name[0])
+	}
+	for _, prefix := range []string{"uni", "u"} {
+		if strings.HasPrefix(name, prefix) && len(name) >= len(prefix)+4 {
+			hex := name[len(prefix):]
+			if prefix == "uni" {
+				hex = hex[:4]
+			}
+			if v, err := strconv.ParseUint(hex, 16, 32); err == nil {
+				return rune(v)
+			}
+		}
+	}
+	return 0
+}
+
+// decode は文字列のコードを文字にし、各コードの幅（テキスト空間、1emで1）を fn に渡す
+// fn の singleSpace は1バイトのコード32（語間隔 Tw の対象）かを表す
+func (f *pdfFont) decode(s []byte, fn func(text string, width float64, singleSpace bool)) {
+	// 定義済みCMapでToUnicodeがない場合は、文字列全体を文字コードとして変換する
+	if f.composite && f.toUnicode == nil {
+		text := f.decodePredefined(s)
+		fn(text, float64(len([]rune(text)))*f.defaultWidth*f.scale, false)
+		return
+	}
+
+	for i := 0; i < len(s); {
+		n := f.codeLength(s[i:])
+		code := s[i : i+n]
+		i += n
+
+		value := 0
+		for _, b := range code {
+			value = value<<8 | int(b)
+		}
+		width, ok := f.widths[value]
+		if !ok {
+			width = f.defaultWidth
+		}
+
+		text, mapped := f.toUnicode[codeKey(code)]
+		if !mapped && !f.composite && n == 1 {
+			if r := f.encoding[code[0]]; r != 0 {
+				text = string(r)
+			}
+		}
+		fn(text, width*f.scale, n == 1 && code[0] == 32)
+	}
+}
+
+// codeLength はコード空間から次のコードのバイト数を決める
+func (f *pdfFont) codeLength(s []byte) int {
+	for n := 1; n <= 4 && n <= len(s); n++ {
+		for _, r := range f.ranges {
+			if len(r.low) != n {
+				continue
+			}
+			inRange := true
+			for j := 0; j < n; j++ {
+				if s[j] < r.low[j] || s[j] > r.high[j] {
+					inRange = false
+					break
+				}
+			}
+			if inRange {
+				return n
+			}
+		}
+	}
+	if f.composite && len(s) >= 2 {
+		return 2
+	}
+	return 1
+}
+
+// decodePredefined は定義済みCMapの文字列を変換する
+// Shift_JIS（RKSJ）とUnicode（UCS2、UTF16）のCMapに対応し、Identity などは変換できない
+func (f *pdfFont) decodePredefined(s []byte) string {
+	switch {
+	case strings.Contains(f.cmapName, "RKSJ"):
+		if decoded, err := japanese.ShiftJIS.NewDecoder().Bytes(s); err == nil {
+			return string(decoded)
+		}
+	case strings.Contains(f.cmapName, "UCS2") || strings.Contains(f.cmapName, "UTF16"):
+		return decodeUTF16(s, true)
+	case strings.Contains(f.cmapName, "EUC"):
+		if decoded, err := japanese.EUCJP.NewDecoder().Bytes(s); err == nil {
+			return string(decoded)
+		}
+	}
+	return ""
+}
+
+// pdfCMap はCMapから読み取った情報
+type pdfCMap struct {
+	ranges    []codespaceRange
+	toUnicode map[uint64]string
+	expanded  int // bfrange から展開したコードの数
+}
+
+// maxCMapRange は bfrange 1つで展開するコードの上限
+const maxCMapRange = 0xFFFF
+
+// maxCMapEntries はCMap（と /W）1つで範囲から展開するコードの合計の上限
+const maxCMapEntries = 1 << 20
+
+// parseCMap はCMapの codespacerange、bfchar、bfrange を読む
+func parseCMap(data []byte) *pdfCMap {
+	cmap := &pdfCMap{toUnicode: map[uint64]string{}}
+	l := &pdfLexer{data: data}
+
+	var operands []interface{}
+	for {
+		tok, ok := l.object(false)
+		if !ok {
+			break
+		}
+		keyword, isKeyword := tok.(pdfKeyword)
+		if !isKeyword {
+			operands = append(operands, tok)
+			continue
+		}
+
+		switch keyword {
+		case "endcodespacerange":
+			for i := 0; i+1 < len(operands); i += 2 {
+				low, ok1 := operands[i].(pdfString)
+				high, ok2 := operands[i+1].(pdfString)
+				if ok1 && ok2 && len(low) == len(high) && len(low) > 0 {
+					cmap.ranges = append(cmap.ranges, codespaceRange{low, high})
+				}
+			}
+		case "endbfchar":
+			for i := 0; i+1 < len(operands); i += 2 {
+				src, ok := operands[i].(pdfString)
+				if !ok {
+					continue
+				}
+				switch dst := operands[i+1].(type) {
+				case pdfString:
+					cmap.toUnicode[codeKey(src)] = decodeUTF16(dst, true)
+				case pdfName:
+					if r := glyphRune(string(dst)); r != 0 {
+						cmap.toUnicode[codeKey(src)] = string(r)
+					}
+				}
+			}
+		case "endbfrange":
+			for i := 0; i+2 < len(operands); i += 3 {
+				low, ok1 := operands[i].(pdfString)
+				high, ok2 := operands[i+1].(pdfString)
+				if !ok1 || !ok2 || len(low) != len(high) || len(low) == 0 || len(low) > 4 {
+					continue
+				}
+				start, end := bytesValue(low), bytesValue(high)
+				if end < start || end-start > maxCMapRange || cmap.expanded+int(end-start) >= maxCMapEntries {
+					continue
+				}
+				code := append([]byte(nil), low...)
+				// オフセットで数える（end が 0xFFFFFFFF でも止まるように）
+				for offset := 0; offset <= int(end-start); offset++ {
+					cmap.expanded++
+					setBytesValue(code, start+uint32(offset))
+					switch dst := operands[i+2].(type) {
+					case pdfString:
+						cmap.toUnicode[codeKey(code)] = offsetUTF16(dst, offset)
+					case pdfArray:
+						if offset < len(dst) {
+							if s, ok := dst[offset].(pdfString); ok {
+								cmap.toUnicode[codeKey(code)] = decodeUTF16(s, true)
+							}
+						}
+					}
+				}
+			}
+		}
+		operands = operands[:0]
+	}
+	return cmap
+}
+
+// bytesValue はビッグエンディアンのバイト列の値を返す
+func bytesValue(b []byte) uint32 {
+	var v uint32
+	for _, c := range b {
+		v = v<<8 | uint32(c)
+	}
+	return v
+}
+
+// setBytesValue は v をビッグエンディアンで b に書く
+func setBytesValue(b []byte, v uint32) {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i] = byte(v)
+		v >>= 8
+	}
+}
+
+// offsetUTF16 はUTF-16BEの文字列の最後の単位に offset を足して変換する（bfrange の展開）
+func offsetUTF16(s []byte, offset int) string {
+	if len(s) < 2 {
+		return ""
+	}
+	units := make([]uint16, 0, len(s)/2)
+	for i := 0; i+1 < len(s); i += 2 {
+		units = append(units, uint16(s[i])<<8|uint16(s[i+1]))
+	}
+	units[len(units)-1] += uint16(offset)
+	return string(utf16.Decode(units))
+}
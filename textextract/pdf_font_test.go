@@ -0,0 +1,81 @@
+package textextract
+
+import (
+	"strings"
+	"testing"
+)
+
+const testCMap = `/CIDInit /ProcSet findresource begin
+12 dict begin
+begincmap
+/CMapName /Test def
+1 begincodespacerange
+<0000> <FFFF>
+endcodespacerange
+3 beginbfchar
+<0001> <9818>
+<0002> <53CE66F8>
+<0003> /yen
+endbfchar
+2 beginbfrange
+<0010> <0012> <0041>
+<0020> <0021> [<91D1> <D83DDE00>]
+endbfrange
+endcmap
+CMapName currentdict /CMap defineresource pop
+end
+end`
+
+func TestParseCMapToUnicode(t *testing.T) {
+	cmap := parseCMap([]byte(testCMap))
+	font := &pdfFont{composite: true, ranges: cmap.ranges, toUnicode: cmap.toUnicode, widths: map[int]float64{}, defaultWidth: 1000, scale: 0.001}
+
+	tests := []struct {
+		name string
+		code []byte
+		want string
+	}{
+		{"bfchar", []byte{0x00, 0x01}, "領"},
+		{"bfchar of two characters", []byte{0x00, 0x02}, "収書"},
+		{"bfchar glyph name", []byte{0x00, 0x03}, "¥"},
+		{"bfrange start", []byte{0x00, 0x10}, "A"},
+		{"bfrange offset", []byte{0x00, 0x12}, "C"},
+		{"bfrange array", []byte{0x00, 0x20}, "金"},
+		{"bfrange array surrogate pair", []byte{0x00, 0x21}, "😀"},
+		{"string of codes", []byte{0x00, 0x01, 0x00, 0x02, 0x00, 0x11}, "領収書B"},
+		{"unmapped code", []byte{0x00, 0x30}, ""},
+		{"odd byte", []byte{0x00, 0x01, 0x00}, "領"},
+	}
+
+	for _, tt := range tests {
+		var got string
+		font.decode(tt.code, func(text string, width float64, singleSpace bool) {
+			got += text
+		})
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseCMapLimits(t *testing.T) {
+	tests := []struct {
+		name  string
+		cmap  string
+		codes int
+	}{
+		{"range too large", "1 beginbfrange <000000> <FFFFFF> <0041> endbfrange", 0},
+		{"range end before start", "1 beginbfrange <0010> <0001> <0041> endbfrange", 0},
+		{"codes of different lengths", "1 beginbfrange <00> <0010> <0041> endbfrange", 0},
+		{"largest range", "1 beginbfrange <0000> <FFFF> <0041> endbfrange", 0x10000},
+		{"range ending at the largest code", "1 beginbfrange <FFFFFFFE> <FFFFFFFF> <0041> endbfrange", 2},
+		{"ranges over the limit", strings.Repeat("<000000> <00FFFF> <0041>\n<010000> <01FFFF> <0041>\n", 9) + "endbfrange", 0x20000},
+		{"missing destination", "1 beginbfchar <0001> endbfchar", 0},
+	}
+
+	for _, tt := range tests {
+		if got := len(parseCMap([]byte(tt.cmap)).toUnicode); got != tt.codes {
+			t.Errorf("%s: got %d codes, want %d", tt.name, got, tt.codes)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package textextract
+
+import (
+	"strconv"
+)
+
+// PDFのオブジェクト
+// 数値は float64、真偽値は bool、null は nil で表す
+type (
+	pdfName    string
+	pdfString  []byte
+	pdfKeyword string // obj、stream、R や、コンテンツストリームの演算子
+	pdfArray   []interface{}
+	pdfDict    map[pdfName]interface{}
+	pdfRef     struct{ num, gen int }
+)
+
+// pdfLexer はPDFの字句を読む
+type pdfLexer struct {
+	data []byte
+	pos  int
+}
+
+// isPDFSpace はPDFの空白文字かを返す
+func isPDFSpace(c byte) bool {
+	switch c {
+	case ' ', '\t', '\r', '\n', '\f', 0:
+		return true
+	}
+	return false
+}
+
+// isPDFDelimiter はPDFの区切り文字かを返す
+func isPDFDelimiter(c byte) bool {
+	switch c {
+	case '(', ')', '<', '>', '[', ']', '{', '}', '/', '%':
+		return true
+	}
+	return false
+}
+
+// skipSpace は空白とコメントを読み飛ばす
+func (l *pdfLexer) skipSpace() {
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		if c == '%' {
+			for l.pos < len(l.data) && l.data[l.pos] != '\r' && l.data[l.pos] != '\n' {
+				l.pos++
+			}
+			continue
+		}
+		if !isPDFSpace(c) {
+			return
+		}
+		l.pos++
+	}
+}
+
+// token は次の字句を返す。区切り記号（[ ] << >> { }）は pdfKeyword で返し、終端では ok が false になる
+func (l *pdfLexer) token() (tok interface{}, ok bool) {
+	l.skipSpace()
+	if l.pos >= len(l.data) {
+		return nil, false
+	}
+
+	c := l.data[l.pos]
+	switch c {
+	case '/':
+		return l.name(), true
+	case '(':
+		return l.literalString(), true
+	case '<':
+		if l.pos+1 < len(l.data) && l.data[l.pos+1] == '<' {
+			l.pos += 2
+			return pdfKeyword("<<"), true
+		}
+		return l.hexString(), true
+	case '>':
+		l.pos++
+		if l.pos < len(l.data) && l.data[l.pos] == '>' {
+			l.pos++
+			return pdfKeyword(">>"), true
+		}
+		return pdfKeyword(">"), true
+	case '[', ']', '{', '}', ')':
+		l.pos++
+		return pdfKeyword(string(c)), true
+	}
+
+	start := l.pos
+	for l.pos < len(l.data) && !isPDFSpace(l.data[l.pos]) && !isPDFDelimiter(l.data[l.pos]) {
+		l.pos++
+	}
+	word := string(l.data[start:l.pos])
+	if isPDFNumber(word) {
+		n, err := strconv.ParseFloat(word, 64)
+		if err == nil {
+			return n, true
+		}
+	}
+	switch word {
+	case "true":
+		return true, true
+	case "false":
+		return false, true
+	case "null":
+		return nil, true
+	}
+	return pdfKeyword(word), true
+}
+
+// isPDFNumber は数値の字句かを返す
+func isPDFNumber(word string) bool {
+	if word == "" {
+		return false
+	}
+	digits := 0
+	for i := 0; i < len(word); i++ {
+		c := word[i]
+		switch {
+		case c >= '0' && c <= '9':
+			digits++
+		case (c == '+' || c == '-') && i == 0:
+		case c == '.':
+		default:
+			return false
+		}
+	}
+	return digits > 0
+}
+
+// name は / から始まる名前を読む（#xx はそのバイトにする）
+func (l *pdfLexer) name() pdfName {
+	l.pos++
+	var b []byte
+	for l.pos < len(l.data) && !isPDFSpace(l.data[l.pos]) && !isPDFDelimiter(l.data[l.pos]) {
+		c := l.data[l.pos]
+		if c == '#' && l.pos+2 < len(l.data) {
+			if v, err := strconv.ParseUint(string(l.data[l.pos+1:l.pos+3]), 16, 8); err == nil {
+				b = append(b, byte(v))
+				l.pos += 3
+				continue
+			}
+		}
+		b = append(b, c)
+		l.pos++
+	}
+	return pdfName(b)
+}
+
+// literalString は ( ) で囲まれた文字列を読む
+func (l *pdfLexer) literalString() pdfString {
+	l.pos++
+	var b []byte
+	depth := 1
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		l.pos++
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return b
+			}
+		case '\\':
+			if l.pos >= len(l.data) {
+				return b
+			}
+			e := l.data[l.pos]
+			l.pos++
+			switch e {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r':
+				if l.pos < len(l.data) && l.data[l.pos] == '\n' {
+					l.pos++
+				}
+				continue
+			case '\n':
+				continue
+			default:
+				if e >= '0' && e <= '7' {
+					v := int(e - '0')
+					for i := 0; i < 2 && l.pos < len(l.data) && l.data[l.pos] >= '0' && l.data[l.pos] <= '7'; i++ {
+						v = v*8 + int(l.data[l.pos]-'0')
+						l.pos++
+					}
+					c = byte(v)
+				} else {
+					c = e
+				}
+			}
+		}
+		b = append(b, c)
+	}
+	return b
+}
+
+// hexString は < > で囲まれた16進数の文字列を読む
+func (l *pdfLexer) hexString() pdfString {
+	l.pos++
+	var b []byte
+	var high byte
+	odd := false
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		l.pos++
+		if c == '>' {
+			break
+		}
+		v, ok := hexValue(c)
+		if !ok {
+			continue
+		}
+		if odd {
+			b = append(b, high<<4|v)
+		} else {
+			high = v
+		}
+		odd = !odd
+	}
+	if odd {
+		b = append(b, high<<4)
+	}
+	return b
+}
+
+// hexValue は16進数の1桁の値を返す
+func hexValue(c byte) (byte, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0', true
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10, true
+	case c >= 'A' && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+// object は次のオブジェクトを読む。配列と辞書は中身まで読み、
+// refs が true なら「番号 世代 R」を pdfRef にする（コンテンツストリームでは false）
+func (l *pdfLexer) object(refs bool) (interface{}, bool) {
+	tok, ok := l.token()
+	if !ok {
+		return nil, false
+	}
+
+	switch t := tok.(type) {
+	case pdfKeyword:
+		switch t {
+		case "[":
+			array := pdfArray{}
+			for {
+				save := l.pos
+				if next, ok := l.token(); !ok {
+					return array, true
+				} else if next == pdfKeyword("]") {
+					return array, true
+				}
+				l.pos = save
+				value, ok := l.object(refs)
+				if !ok {
+					return array, true
+				}
+				array = append(array, value)
+			}
+		case "<<":
+			dict := pdfDict{}
+			for {
+				key, ok := l.token()
+				if !ok || key == pdfKeyword(">>") {
+					return dict, true
+				}
+				name, isName := key.(pdfName)
+				if !isName {
+					continue
+				}
+				save := l.pos
+				if next, ok := l.token(); !ok || next == pdfKeyword(">>") {
+					return dict, true
+				}
+				l.pos = save
+				value, ok := l.object(refs)
+				if !ok {
+					return dict, true
+				}
+				dict[name] = value
+			}
+		}
+	case float64:
+		if refs && t == float64(int(t)) && t >= 0 {
+			save := l.pos
+			if gen, ok := l.token(); ok {
+				if g, isNum := gen.(float64); isNum {
+					if r, ok := l.token(); ok && r == pdfKeyword("R") {
+						return pdfRef{int(t), int(g)}, true
+					}
+				}
+			}
+			l.pos = save
+		}
+	}
+	return tok, true
+}
@@ -0,0 +1,71 @@
+package textextract
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLexerTokens(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []interface{}
+	}{
+		{"numbers", "12 -3.5 +.5 0.", []interface{}{12.0, -3.5, 0.5, 0.0}},
+		{"not a number", "1-2 . -", []interface{}{pdfKeyword("1-2"), pdfKeyword("."), pdfKeyword("-")}},
+		{"names", "/Type/Font /A#20B /#", []interface{}{pdfName("Type"), pdfName("Font"), pdfName("A B"), pdfName("#")}},
+		{"literal string", `(a (b) c)`, []interface{}{pdfString("a (b) c")}},
+		{"escapes", `(\(\)\\\n\t\101\7x\q)`, []interface{}{pdfString("()\\\n\tA\ax" + "q")}},
+		{"line continuation", "(ab\\\r\ncd)", []interface{}{pdfString("abcd")}},
+		{"unterminated string", "(abc", []interface{}{pdfString("abc")}},
+		{"hex string", "<48 65 6c6C6F>", []interface{}{pdfString("Hello")}},
+		{"odd hex string", "<414>", []interface{}{pdfString("A@")}},
+		{"delimiters", "<< >> [ ] { }", []interface{}{pdfKeyword("<<"), pdfKeyword(">>"), pdfKeyword("["), pdfKeyword("]"), pdfKeyword("{"), pdfKeyword("}")}},
+		{"keywords", "true false null BT Tj", []interface{}{true, false, nil, pdfKeyword("BT"), pdfKeyword("Tj")}},
+		{"comments", "1 % comment ( [\n2%\r3", []interface{}{1.0, 2.0, 3.0}},
+		{"no space before delimiter", "/F1 12 Tf[(A)]TJ", []interface{}{pdfName("F1"), 12.0, pdfKeyword("Tf"), pdfKeyword("["), pdfString("A"), pdfKeyword("]"), pdfKeyword("TJ")}},
+	}
+
+	for _, tt := range tests {
+		l := &pdfLexer{data: []byte(tt.input)}
+		var got []interface{}
+		for {
+			tok, ok := l.token()
+			if !ok {
+				break
+			}
+			got = append(got, tok)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %#v, want %#v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLexerObject(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		refs  bool
+		want  interface{}
+	}{
+		{"reference", "12 0 R", true, pdfRef{12, 0}},
+		{"reference in content", "12 0 R", false, 12.0},
+		{"number followed by number", "12 0 obj", true, 12.0},
+		{"array", "[1 (a) /B [2] 3 0 R]", true, pdfArray{1.0, pdfString("a"), pdfName("B"), pdfArray{2.0}, pdfRef{3, 0}}},
+		{"dict", "<< /Type /Page /Kids [4 0 R] /Count 1 >>", true,
+			pdfDict{"Type": pdfName("Page"), "Kids": pdfArray{pdfRef{4, 0}}, "Count": 1.0}},
+		{"nested dict", "<</A<</B 1>>>>", true, pdfDict{"A": pdfDict{"B": 1.0}}},
+		{"key without value", "<< /A 1 /B >>", true, pdfDict{"A": 1.0}},
+		{"unterminated array", "[1 2", true, pdfArray{1.0, 2.0}},
+		{"unterminated dict", "<< /A [1", true, pdfDict{"A": pdfArray{1.0}}},
+	}
+
+	for _, tt := range tests {
+		l := &pdfLexer{data: []byte(tt.input)}
+		got, ok := l.object(tt.refs)
+		if !ok || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %#v, %v, want %#v", tt.name, got, ok, tt.want)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package textextract
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"context"
+	"encoding/ascii85"
+	"errors"
+	"testing"
+)
+
+func zlibBytes(data []byte) []byte {
+	var b bytes.Buffer
+	w := zlib.NewWriter(&b)
+	w.Write(data)
+	w.Close()
+	return b.Bytes()
+}
+
+func flateBytes(data []byte) []byte {
+	var b bytes.Buffer
+	w, _ := flate.NewWriter(&b, flate.DefaultCompression)
+	w.Write(data)
+	w.Close()
+	return b.Bytes()
+}
+
+func ascii85Bytes(data []byte) []byte {
+	out := make([]byte, ascii85.MaxEncodedLen(len(data)))
+	return append(append([]byte("<~"), out[:ascii85.Encode(out, data)]...), "~>"...)
+}
+
+func TestDecodeStreamFilters(t *testing.T) {
+	content := []byte("BT /F1 12 Tf (領収書) Tj ET")
+	compressed := zlibBytes(content)
+
+	tests := []struct {
+		name    string
+		dict    pdfDict
+		stream  []byte
+		want    []byte
+		wantErr bool
+	}{
+		{"no filter", pdfDict{}, content, content, false},
+		{"FlateDecode", pdfDict{"Filter": pdfName("FlateDecode")}, compressed, content, false},
+		{"FlateDecode abbreviation", pdfDict{"Filter": pdfName("Fl")}, compressed, content, false},
+		{"FlateDecode without zlib header", pdfDict{"Filter": pdfName("FlateDecode")}, flateBytes(content), content, false},
+		{"truncated FlateDecode", pdfDict{"Filter": pdfName("FlateDecode")}, compressed[:len(compressed)-6], content, false},
+		{"FlateDecode of garbage", pdfDict{"Filter": pdfName("FlateDecode")}, []byte("not compressed"), nil, true},
+		{"FlateDecode with PNG Up predictor", pdfDict{
+			"Filter":      pdfName("FlateDecode"),
+			"DecodeParms": pdfDict{"Predictor": 12.0, "Columns": 2.0},
+		}, zlibBytes([]byte{2, 1, 2, 2, 1, 1}), []byte{1, 2, 2, 3}, false},
+		{"ASCIIHexDecode", pdfDict{"Filter": pdfName("ASCIIHexDecode")}, []byte("48 65 6C\n6c 6F>"), []byte("Hello"), false},
+		{"ASCIIHexDecode odd digits", pdfDict{"Filter": pdfName("AHx")}, []byte("414"), []byte("A@"), false},
+		{"ASCII85Decode", pdfDict{"Filter": pdfName("ASCII85Decode")}, ascii85Bytes(content), content, false},
+		{"ASCII85Decode without markers", pdfDict{"Filter": pdfName("A85")}, []byte("87cURDZ"), []byte("Hello"), false},
+		{"ASCII85Decode zero group", pdfDict{"Filter": pdfName("A85")}, []byte("<~z~>"), []byte{0, 0, 0, 0}, false},
+		{"invalid ASCII85", pdfDict{"Filter": pdfName("A85")}, []byte("<~abc{~>"), nil, true},
+		{"filter chain", pdfDict{"Filter": pdfArray{pdfName("ASCII85Decode"), pdfName("FlateDecode")}}, ascii85Bytes(compressed), content, false},
+		{"unsupported filter", pdfDict{"Filter": pdfName("DCTDecode")}, content, nil, true},
+	}
+
+	for _, tt := range tests {
+		doc := parsePDF(context.Background(), nil)
+		got, err := doc.decodeStream(&pdfObject{value: tt.dict, stream: tt.stream})
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: got %q, want an error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: got %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestDecodeStreamBudget(t *testing.T) {
+	doc := parsePDF(context.Background(), nil)
+	obj := &pdfObject{value: pdfDict{"Filter": pdfName("FlateDecode")}, stream: zlibBytes(make([]byte, maxStreamSize))}
+	for i := 0; i < maxPDFDecodedSize/maxStreamSize; i++ {
+		if _, err := doc.decodeStream(obj); err != nil {
+			t.Fatalf("stream %d: %v", i, err)
+		}
+	}
+	if _, err := doc.decodeStream(obj); !errors.Is(err, ErrTooComplex) {
+		t.Errorf("over the budget: got %v, want %v", err, ErrTooComplex)
+	}
+	if _, err := doc.decodeStream(&pdfObject{value: pdfDict{}, stream: []byte("BT ET")}); !errors.Is(err, ErrTooComplex) {
+		t.Errorf("after the budget: got %v, want %v", err, ErrTooComplex)
+	}
+}
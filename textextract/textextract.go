@@ -0,0 +1,147 @@
+// Package textextract は添付ファイルから検索用のテキストを取り出す
+// PDF（非圧縮とFlate圧縮のコンテンツストリーム）とテキストファイル（.txt/.csv）に対応し、Goだけで動作する
+package textextract
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/unicode/norm"
+)
+
+// MaxFileSize はテキストを取り出すファイルの最大サイズ
+const MaxFileSize = 64 << 20
+
+// MaxTextSize は取り出すテキストの最大バイト数（超えた分は切り捨てる）
+const MaxTextSize = 1 << 20
+
+var (
+	// ErrUnsupported はテキストを取り出せない種類のファイル
+	ErrUnsupported = errors.New("unsupported file type")
+	// ErrTooLarge はMaxFileSizeを超えるファイル
+	ErrTooLarge = errors.New("file is too large")
+	// ErrEncrypted は暗号化されたPDF
+	ErrEncrypted = errors.New("encrypted PDF is not supported")
+	// ErrTooComplex は演算子の数か展開するデータの量が上限を超えたPDF
+	ErrTooComplex = errors.New("PDF is too complex to extract text from")
+)
+
+// Supported は name の拡張子のファイルからテキストを取り出せるかを返す
+func Supported(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".pdf", ".txt", ".csv":
+		return true
+	}
+	return false
+}
+
+// Extract は path のファイルからテキストを取り出す
+// 種類は内容（PDFのヘッダー）と拡張子で判定し、対応していない場合は ErrUnsupported を返す
+// 結果はNFKCで正規化し（PDFでよく使われる康煕部首などを通常の漢字にするため）、空行と行末の空白を除く
+func Extract(path string) (string, error) {
+	return ExtractContext(context.Background(), path)
+}
+
+// ExtractContext は Extract と同じだが、ctx が終了するとPDFの解釈を止めて ctx のエラーを返す
+func ExtractContext(ctx context.Context, path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read file: %v", err)
+	}
+	if info.Size() > MaxFileSize {
+		return "", ErrTooLarge
+	}
+
+	ext := strings.ToLower(filepath.Ext(path))
+	if !Supported(path) {
+		return "", ErrUnsupported
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read file: %v", err)
+	}
+
+	var text string
+	if ext == ".pdf" || bytes.HasPrefix(data, []byte("%PDF-")) {
+		text, err = extractPDF(ctx, data)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		text = decodeText(data)
+	}
+
+	return cleanText(text), nil
+}
+
+// decodeText はテキストファイルを文字列にする
+// BOMのあるUTF-8/UTF-16、正しいUTF-8、それ以外はShift_JISとして扱う
+func decodeText(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xEF, 0xBB, 0xBF}):
+		return string(data[3:])
+	case bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+		return decodeUTF16(data[2:], true)
+	case bytes.HasPrefix(data, []byte{0xFF, 0xFE}):
+		return decodeUTF16(data[2:], false)
+	case utf8.Valid(data):
+		return string(data)
+	}
+
+	decoded, err := japanese.ShiftJIS.NewDecoder().Bytes(data)
+	if err != nil {
+		return strings.ToValidUTF8(string(data), "")
+	}
+	return string(decoded)
+}
+
+// decodeUTF16 はUTF-16のバイト列を文字列にする
+func decodeUTF16(data []byte, bigEndian bool) string {
+	units := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		if bigEndian {
+			units = append(units, uint16(data[i])<<8|uint16(data[i+1]))
+		} else {
+			units = append(units, uint16(data[i+1])<<8|uint16(data[i]))
+		}
+	}
+	return string(utf16.Decode(units))
+}
+
+// cleanText は取り出したテキストを正規化し、制御文字、行末の空白と空行を除いて MaxTextSize までに切り詰める
+func cleanText(text string) string {
+	text = norm.NFKC.String(text)
+
+	var b strings.Builder
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.Map(func(r rune) rune {
+			if r == '\t' {
+				return ' '
+			}
+			if unicode.IsControl(r) || r == utf8.RuneError {
+				return -1
+			}
+			return r
+		}, line)
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if b.Len()+len(line)+1 > MaxTextSize {
+			break
+		}
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
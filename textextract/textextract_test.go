@@ -0,0 +1,165 @@
+package textextract
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// buildPDF は objects を 1 0 obj から順に番号をつけて並べたPDFを作る（1番はカタログ）
+func buildPDF(objects ...string) []byte {
+	var b strings.Builder
+	b.WriteString("%PDF-1.4\n")
+	for i, obj := range objects {
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	b.WriteString("trailer\n<< /Root 1 0 R >>\n%%EOF\n")
+	return []byte(b.String())
+}
+
+// pdfStreamObject は dict に /Length を加えたストリームのオブジェクトを作る
+func pdfStreamObject(dict, content string) string {
+	return fmt.Sprintf("<< %s /Length %d >>\nstream\n%s\nendstream", dict, len(content), content)
+}
+
+// onePagePDF はコンテンツストリームが content の1ページのPDFを作る
+// フォント /F1 と、4番以降のオブジェクトを extra で渡す
+func onePagePDF(resources, content string, extra ...string) []byte {
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		fmt.Sprintf("<< /Type /Page /Parent 2 0 R /Resources << /Font << /F1 << /Type /Font /Subtype /Type1 >> >> %s >> /Contents 4 0 R >>", resources),
+		pdfStreamObject("", content),
+	}
+	return buildPDF(append(objects, extra...)...)
+}
+
+// writeTemp は data を name のファイルに書いてパスを返す
+func writeTemp(t testing.TB, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestExtractPDF(t *testing.T) {
+	path := writeTemp(t, "receipt.pdf", onePagePDF("", "BT /F1 12 Tf 72 720 Td (Receipt) Tj 0 -20 Td (Total 1100) Tj ET"))
+	text, err := Extract(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "Receipt\nTotal 1100" {
+		t.Errorf("got %q", text)
+	}
+}
+
+func TestExtractRecursiveForm(t *testing.T) {
+	calls := strings.Repeat("/X Do ", 8)
+	tests := []struct {
+		name    string
+		pdf     []byte
+		want    string
+		wantErr error
+	}{
+		{
+			// 自身を8回呼ぶフォーム（制限がなければ8^16回描画する）
+			name: "form calling itself",
+			pdf: onePagePDF("/XObject << /X 5 0 R >>", "/X Do",
+				pdfStreamObject("/Type /XObject /Subtype /Form /Resources << /Font << /F1 << /Subtype /Type1 >> >> /XObject << /X 5 0 R >> >>",
+					"BT /F1 12 Tf (Form) Tj ET "+calls)),
+			want: "Form",
+		},
+		{
+			// 互いに呼び合う2つのフォーム
+			name: "forms calling each other",
+			pdf: onePagePDF("/XObject << /X 5 0 R >>", "/X Do",
+				pdfStreamObject("/Subtype /Form /Resources << /XObject << /X 6 0 R >> >>", calls),
+				pdfStreamObject("/Subtype /Form /Resources << /XObject << /X 5 0 R >> >>", calls)),
+			want: "",
+		},
+		{
+			// 大きなToUnicodeのフォント（間接オブジェクトでないのでキャッシュされない）を何度も選ぶ
+			name: "large font selected many times",
+			pdf: buildPDF("<< /Type /Catalog /Pages 2 0 R >>",
+				"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+				"<< /Type /Page /Parent 2 0 R /Resources << /Font << /F1 << /Subtype /Type0 /ToUnicode 5 0 R >> >> >> /Contents 4 0 R >>",
+				pdfStreamObject("", strings.Repeat("/F1 1 Tf ", 20000)+"BT <0002> Tj ET"),
+				pdfStreamObject("", "1 beginbfrange <0000> <FFFF> <3042> endbfrange")),
+			want: "い",
+		},
+		{
+			// 次のフォームを8回呼ぶ別々のフォームの連なり（再帰ではないが描画は指数的に増える）
+			name:    "chain of forms",
+			pdf:     formChainPDF(maxPDFDepth, calls),
+			wantErr: ErrTooComplex,
+		},
+	}
+
+	for _, tt := range tests {
+		path := writeTemp(t, "form.pdf", tt.pdf)
+		text, err := Extract(path)
+		if tt.wantErr != nil {
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("%s: got %q, %v, want %v", tt.name, text, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || text != tt.want {
+			t.Errorf("%s: got %q, %v, want %q", tt.name, text, err, tt.want)
+		}
+	}
+}
+
+func TestExtractContextCanceled(t *testing.T) {
+	path := writeTemp(t, "form.pdf", formChainPDF(maxPDFDepth, strings.Repeat("/X Do ", 8)))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ExtractContext(ctx, path); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+}
+
+// formChainPDF は n 個のフォームがそれぞれ次のフォームを calls の回数だけ呼ぶPDFを作る
+func formChainPDF(n int, calls string) []byte {
+	var forms []string
+	for i := 0; i < n; i++ {
+		resources := ""
+		if i < n-1 {
+			resources = fmt.Sprintf("/Resources << /XObject << /X %d 0 R >> >>", 6+i)
+		}
+		forms = append(forms, pdfStreamObject("/Subtype /Form "+resources, calls))
+	}
+	return onePagePDF("/XObject << /X 5 0 R >>", "/X Do", forms...)
+}
+
+func FuzzExtract(f *testing.F) {
+	f.Add(onePagePDF("", "BT /F1 12 Tf 72 720 Td (Receipt) Tj ET"))
+	f.Add(onePagePDF("", "BT /F1 10 Tf [(A) -300 (B)] TJ ET BI /W 1 /H 1 ID x EI"))
+	f.Add(onePagePDF("/XObject << /X 5 0 R >>", "/X Do",
+		pdfStreamObject("/Subtype /Form /Resources << /XObject << /X 5 0 R >> >>", "/X Do /X Do")))
+	f.Add(buildPDF("<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [2 0 R] >>",
+		pdfStreamObject("/Type /ObjStm /N 1 /First 4", "3 0 << /Type /Page >>")))
+	f.Add([]byte("%PDF-1.7\n1 0 obj << /Filter /FlateDecode /Length 3 >> stream\nabc\nendstream"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		path := writeTemp(t, "fuzz.pdf", data)
+		text, err := Extract(path)
+		if err != nil {
+			return
+		}
+		if !utf8.ValidString(text) {
+			t.Errorf("invalid UTF-8: %q", text)
+		}
+		if len(text) > MaxTextSize {
+			t.Errorf("text of %d bytes", len(text))
+		}
+	})
+}
@@ -0,0 +1,102 @@
+package tsa
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+// HTTPClient はRFC 3161のHTTPトランスポートでTSAにタイムスタンプを要求するクライアント
+type HTTPClient struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPClient は新しいHTTP TSAクライアントを作成
+func NewHTTPClient(url string) *HTTPClient {
+	return &HTTPClient{
+		url:    url,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Name はTSAのURLを返す
+func (c *HTTPClient) Name() string {
+	return c.url
+}
+
+// Timestamp はTSAにタイムスタンプを要求する
+func (c *HTTPClient) Timestamp(digest []byte) (*Token, error) {
+	nonce, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	req := timeStampReq{
+		Version: 1,
+		MessageImprint: messageImprint{
+			HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue},
+			HashedMessage: digest,
+		},
+		Nonce:   nonce,
+		CertReq: true,
+	}
+	reqDER, err := asn1.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode timestamp request: %w", err)
+	}
+
+	resp, err := c.client.Post(c.url, "application/timestamp-query", bytes.NewReader(reqDER))
+	if err != nil {
+		return nil, fmt.Errorf("timestamp request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("timestamp authority returned HTTP %d", resp.StatusCode)
+	}
+
+	respDER, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read timestamp response: %w", err)
+	}
+
+	var tsResp timeStampResp
+	if _, err := asn1.Unmarshal(respDER, &tsResp); err != nil {
+		return nil, fmt.Errorf("failed to parse timestamp response: %w", err)
+	}
+
+	// 0: granted, 1: grantedWithMods
+	if tsResp.Status.Status != 0 && tsResp.Status.Status != 1 {
+		return nil, fmt.Errorf("timestamp request rejected with status %d", tsResp.Status.Status)
+	}
+	if len(tsResp.TimeStampToken.FullBytes) == 0 {
+		return nil, fmt.Errorf("timestamp response does not contain a token")
+	}
+
+	tokenDER := tsResp.TimeStampToken.FullBytes
+	_, info, err := parseToken(tokenDER)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(info.MessageImprint.HashedMessage, digest) {
+		return nil, fmt.Errorf("timestamp token does not match the requested hash")
+	}
+	if info.Nonce == nil || info.Nonce.Cmp(nonce) != 0 {
+		return nil, fmt.Errorf("timestamp token nonce does not match the request")
+	}
+
+	return &Token{
+		DER:          tokenDER,
+		GenTime:      info.GenTime,
+		SerialNumber: info.SerialNumber.Text(16),
+		Policy:       info.Policy.String(),
+	}, nil
+}
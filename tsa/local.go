@@ -0,0 +1,286 @@
+package tsa
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// LocalAuthority は自己署名証明書でタイムスタンプトークンを発行するローカルTSA
+// オフライン環境やテスト用であり、第三者による時刻証明にはならない
+type LocalAuthority struct {
+	key  *ecdsa.PrivateKey
+	cert *x509.Certificate
+}
+
+// NewLocalAuthority は鍵と証明書を keyDir から読み込む（存在しない場合は作成する）
+func NewLocalAuthority(keyDir string) (*LocalAuthority, error) {
+	keyPath := filepath.Join(keyDir, "tsa.key")
+	certPath := filepath.Join(keyDir, "tsa.crt")
+
+	if _, err := os.Stat(keyPath); os.IsNotExist(err) {
+		if err := createLocalKeyPair(keyDir, keyPath, certPath); err != nil {
+			return nil, err
+		}
+	}
+
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TSA key: %w", err)
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, fmt.Errorf("invalid TSA key file: %s", keyPath)
+	}
+	parsedKey, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse TSA key: %w", err)
+	}
+	key, ok := parsedKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("TSA key must be an ECDSA key")
+	}
+
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TSA certificate: %w", err)
+	}
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil {
+		return nil, fmt.Errorf("invalid TSA certificate file: %s", certPath)
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse TSA certificate: %w", err)
+	}
+
+	return &LocalAuthority{key: key, cert: cert}, nil
+}
+
+// createLocalKeyPair はローカルTSA用のECDSA鍵と自己署名証明書を作成する
+func createLocalKeyPair(keyDir, keyPath, certPath string) error {
+	if err := os.MkdirAll(keyDir, 0700); err != nil {
+		return fmt.Errorf("failed to create TSA key directory: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate TSA key: %w", err)
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+
+	// RFC 3161 ではタイムスタンプ用の拡張鍵用途は critical でなければならない
+	extKeyUsage, err := asn1.Marshal([]asn1.ObjectIdentifier{oidTimeStamping})
+	if err != nil {
+		return fmt.Errorf("failed to encode extended key usage: %w", err)
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "Denchokun Local TSA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(20, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		ExtraExtensions: []pkix.Extension{
+			{Id: oidExtKeyUsage, Critical: true, Value: extKeyUsage},
+		},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("failed to create TSA certificate: %w", err)
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to encode TSA key: %w", err)
+	}
+
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return fmt.Errorf("failed to write TSA key: %w", err)
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0644); err != nil {
+		return fmt.Errorf("failed to write TSA certificate: %w", err)
+	}
+
+	return nil
+}
+
+// randomSerial は128ビットのランダムなシリアル番号を生成する
+func randomSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+	return serial, nil
+}
+
+// Name はローカルTSAの識別名を返す
+func (a *LocalAuthority) Name() string {
+	return "local"
+}
+
+// Certificate はローカルTSAの証明書を返す
+func (a *LocalAuthority) Certificate() *x509.Certificate {
+	return a.cert
+}
+
+// Timestamp はハッシュ値に対するタイムスタンプトークンを発行する
+func (a *LocalAuthority) Timestamp(digest []byte) (*Token, error) {
+	if len(digest) != sha256.Size {
+		return nil, fmt.Errorf("digest must be a SHA-256 hash")
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	sha256Algorithm := pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue}
+	genTime := time.Now().UTC().Truncate(time.Second)
+
+	info := tstInfo{
+		Version: 1,
+		Policy:  oidLocalPolicy,
+		MessageImprint: messageImprint{
+			HashAlgorithm: sha256Algorithm,
+			HashedMessage: digest,
+		},
+		SerialNumber: serial,
+		GenTime:      genTime,
+	}
+	infoDER, err := asn1.Marshal(info)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode TSTInfo: %w", err)
+	}
+
+	signedAttrs, err := a.signedAttributes(infoDER)
+	if err != nil {
+		return nil, err
+	}
+
+	// 署名対象は SET OF としてエンコードした署名属性
+	attrsSet, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: signedAttrs})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode signed attributes: %w", err)
+	}
+	attrsDigest := sha256.Sum256(attrsSet)
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, attrsDigest[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign timestamp: %w", err)
+	}
+
+	sid, err := asn1.Marshal(issuerAndSerialNumber{
+		Issuer:       asn1.RawValue{FullBytes: a.cert.RawIssuer},
+		SerialNumber: a.cert.SerialNumber,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode signer identifier: %w", err)
+	}
+
+	sd := signedData{
+		Version:          3,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{sha256Algorithm},
+		EncapContentInfo: encapsulatedContentInfo{
+			EContentType: oidTSTInfo,
+			EContent:     infoDER,
+		},
+		Certificates: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: a.cert.Raw},
+		SignerInfos: []signerInfo{{
+			Version:            1,
+			SID:                asn1.RawValue{FullBytes: sid},
+			DigestAlgorithm:    sha256Algorithm,
+			SignedAttrs:        asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signedAttrs},
+			SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256},
+			Signature:          signature,
+		}},
+	}
+	sdDER, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode SignedData: %w", err)
+	}
+
+	tokenDER, err := asn1.Marshal(contentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: sdDER},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode timestamp token: %w", err)
+	}
+
+	return &Token{
+		DER:          tokenDER,
+		GenTime:      genTime,
+		SerialNumber: serial.Text(16),
+		Policy:       oidLocalPolicy.String(),
+	}, nil
+}
+
+// signedAttributes は署名属性（contentType, messageDigest, signingCertificateV2）をDERの順序で連結して返す
+func (a *LocalAuthority) signedAttributes(infoDER []byte) ([]byte, error) {
+	contentType, err := asn1.Marshal(oidTSTInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	infoDigest := sha256.Sum256(infoDER)
+	messageDigest, err := asn1.Marshal(infoDigest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	// SigningCertificateV2 ::= SEQUENCE { certs SEQUENCE OF ESSCertIDv2 }
+	// ESSCertIDv2 のハッシュアルゴリズムは既定値（SHA-256）のため省略
+	certHash := sha256.Sum256(a.cert.Raw)
+	signingCert, err := asn1.Marshal(struct {
+		Certs []struct{ CertHash []byte }
+	}{
+		Certs: []struct{ CertHash []byte }{{CertHash: certHash[:]}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var attrs [][]byte
+	for _, attr := range []struct {
+		oid   asn1.ObjectIdentifier
+		value []byte
+	}{
+		{oidContentType, contentType},
+		{oidMessageDigest, messageDigest},
+		{oidSigningCertV2, signingCert},
+	} {
+		encoded, err := asn1.Marshal(attribute{
+			Type:   attr.oid,
+			Values: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: attr.value},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode signed attribute: %w", err)
+		}
+		attrs = append(attrs, encoded)
+	}
+
+	// DERのSET OFは要素をエンコード順に並べる
+	sort.Slice(attrs, func(i, j int) bool {
+		return bytes.Compare(attrs[i], attrs[j]) < 0
+	})
+
+	return bytes.Join(attrs, nil), nil
+}
@@ -0,0 +1,473 @@
+package tsa
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+// Authority はタイムスタンプ局（TSA）のインターフェース
+type Authority interface {
+	// Timestamp はSHA-256ハッシュ値に対するタイムスタンプトークンを取得する
+	Timestamp(digest []byte) (*Token, error)
+
+	// Name はTSAの識別名（URLまたは"local"）を返す
+	Name() string
+}
+
+// Token はRFC 3161のタイムスタンプトークン
+type Token struct {
+	DER          []byte    // TimeStampToken（CMS ContentInfo）のDERエンコード
+	GenTime      time.Time // TSAが付与した時刻
+	SerialNumber string    // TSAが付与したシリアル番号（16進）
+	Policy       string    // TSAポリシーOID
+}
+
+// VerifyResult はタイムスタンプトークンの検証結果
+type VerifyResult struct {
+	Verified       bool      `json:"verified"`
+	ImprintMatches bool      `json:"imprintMatches"` // トークンのハッシュ値とファイルのハッシュ値が一致するか
+	SignatureValid bool      `json:"signatureValid"` // TSAの署名が正しいか
+	Trusted        bool      `json:"trusted"`        // 署名者の証明書が信頼するTSA証明書につながるか
+	GenTime        time.Time `json:"genTime"`
+	SerialNumber   string    `json:"serialNumber"`
+	Policy         string    `json:"policy"`
+	Signer         string    `json:"signer"`
+	Message        string    `json:"message,omitempty"`
+}
+
+// NewAuthority は設定値からTSAを作成する
+// "off" の場合は nil を返し、URLの場合はHTTPクライアント、それ以外はローカルTSAを使用する
+func NewAuthority(spec string, keyDir string) (Authority, error) {
+	switch {
+	case spec == "off":
+		return nil, nil
+	case strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://"):
+		return NewHTTPClient(spec), nil
+	case spec == "" || spec == "local":
+		return NewLocalAuthority(keyDir)
+	default:
+		return nil, fmt.Errorf("unsupported timestamp authority: %s", spec)
+	}
+}
+
+// OID定義
+var (
+	oidSHA256          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+	oidSignedData      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidTSTInfo         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+	oidContentType     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSigningCert     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 12}
+	oidSigningCertV2   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 47}
+	oidRSAEncryption   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidSHA256WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidSHA384WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 12}
+	oidSHA512WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidECDSAWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+	oidECDSAWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}
+	oidECPublicKey     = asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+	oidExtKeyUsage     = asn1.ObjectIdentifier{2, 5, 29, 37}
+	oidTimeStamping    = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 8}
+
+	// ローカルTSAのポリシーOID（公的なポリシーではないためexample arcを使用）
+	oidLocalPolicy = asn1.ObjectIdentifier{2, 999, 3161, 1}
+)
+
+// RFC 3161 / RFC 5652 のASN.1構造体
+type messageImprint struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	HashedMessage []byte
+}
+
+type timeStampReq struct {
+	Version        int
+	MessageImprint messageImprint
+	ReqPolicy      asn1.ObjectIdentifier `asn1:"optional"`
+	Nonce          *big.Int              `asn1:"optional"`
+	CertReq        bool                  `asn1:"optional"`
+}
+
+type pkiStatusInfo struct {
+	Status int
+}
+
+type timeStampResp struct {
+	Status         pkiStatusInfo
+	TimeStampToken asn1.RawValue `asn1:"optional"`
+}
+
+type tstInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint messageImprint
+	SerialNumber   *big.Int
+	GenTime        time.Time `asn1:"generalized"`
+	Accuracy       accuracy  `asn1:"optional"`
+	Ordering       bool      `asn1:"optional"`
+	Nonce          *big.Int  `asn1:"optional"`
+}
+
+type accuracy struct {
+	Seconds int `asn1:"optional"`
+	Millis  int `asn1:"optional,tag:0"`
+	Micros  int `asn1:"optional,tag:1"`
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"tag:0"`
+}
+
+type encapsulatedContentInfo struct {
+	EContentType asn1.ObjectIdentifier
+	EContent     []byte `asn1:"explicit,optional,tag:0"`
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo encapsulatedContentInfo
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+type issuerAndSerialNumber struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type signerInfo struct {
+	Version            int
+	SID                asn1.RawValue
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+	UnsignedAttrs      asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue `asn1:"set"`
+}
+
+// RFC 2634 / RFC 5035 の SigningCertificate(V2) 属性
+// ESSCertID にはハッシュアルゴリズムがなく（SHA-1）、ESSCertIDv2 では省略時SHA-256
+type signingCertificate struct {
+	Certs    []essCertID
+	Policies asn1.RawValue `asn1:"optional"`
+}
+
+type essCertID struct {
+	HashAlgorithm pkix.AlgorithmIdentifier `asn1:"optional"`
+	CertHash      []byte
+	IssuerSerial  asn1.RawValue `asn1:"optional"`
+}
+
+// hashForOID はダイジェストアルゴリズムOIDに対応するハッシュ関数を返す
+func hashForOID(oid asn1.ObjectIdentifier) (crypto.Hash, error) {
+	switch {
+	case oid.Equal(oidSHA256):
+		return crypto.SHA256, nil
+	case oid.Equal(oidSHA384):
+		return crypto.SHA384, nil
+	case oid.Equal(oidSHA512):
+		return crypto.SHA512, nil
+	}
+	return 0, fmt.Errorf("unsupported digest algorithm: %s", oid)
+}
+
+// signatureAlgorithm は署名アルゴリズムとダイジェストの組み合わせをx509の署名アルゴリズムに変換
+func signatureAlgorithm(sigOID asn1.ObjectIdentifier, hash crypto.Hash) (x509.SignatureAlgorithm, error) {
+	switch {
+	case sigOID.Equal(oidSHA256WithRSA):
+		return x509.SHA256WithRSA, nil
+	case sigOID.Equal(oidSHA384WithRSA):
+		return x509.SHA384WithRSA, nil
+	case sigOID.Equal(oidSHA512WithRSA):
+		return x509.SHA512WithRSA, nil
+	case sigOID.Equal(oidECDSAWithSHA256):
+		return x509.ECDSAWithSHA256, nil
+	case sigOID.Equal(oidECDSAWithSHA384):
+		return x509.ECDSAWithSHA384, nil
+	case sigOID.Equal(oidECDSAWithSHA512):
+		return x509.ECDSAWithSHA512, nil
+	case sigOID.Equal(oidRSAEncryption):
+		switch hash {
+		case crypto.SHA256:
+			return x509.SHA256WithRSA, nil
+		case crypto.SHA384:
+			return x509.SHA384WithRSA, nil
+		case crypto.SHA512:
+			return x509.SHA512WithRSA, nil
+		}
+	case sigOID.Equal(oidECPublicKey):
+		switch hash {
+		case crypto.SHA256:
+			return x509.ECDSAWithSHA256, nil
+		case crypto.SHA384:
+			return x509.ECDSAWithSHA384, nil
+		case crypto.SHA512:
+			return x509.ECDSAWithSHA512, nil
+		}
+	}
+	return x509.UnknownSignatureAlgorithm, fmt.Errorf("unsupported signature algorithm: %s", sigOID)
+}
+
+// parseToken はタイムスタンプトークンを解析してSignedDataとTSTInfoを取り出す
+func parseToken(der []byte) (*signedData, *tstInfo, error) {
+	var ci contentInfo
+	if rest, err := asn1.Unmarshal(der, &ci); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse ContentInfo: %w", err)
+	} else if len(rest) > 0 {
+		return nil, nil, fmt.Errorf("trailing data after ContentInfo")
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return nil, nil, fmt.Errorf("token is not SignedData: %s", ci.ContentType)
+	}
+
+	var sd signedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse SignedData: %w", err)
+	}
+	if !sd.EncapContentInfo.EContentType.Equal(oidTSTInfo) {
+		return nil, nil, fmt.Errorf("encapsulated content is not TSTInfo: %s", sd.EncapContentInfo.EContentType)
+	}
+
+	var info tstInfo
+	if _, err := asn1.Unmarshal(sd.EncapContentInfo.EContent, &info); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse TSTInfo: %w", err)
+	}
+
+	return &sd, &info, nil
+}
+
+// ParseToken はDERエンコードされたタイムスタンプトークンを解析する
+func ParseToken(der []byte) (*Token, error) {
+	_, info, err := parseToken(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Token{
+		DER:          der,
+		GenTime:      info.GenTime,
+		SerialNumber: info.SerialNumber.Text(16),
+		Policy:       info.Policy.String(),
+	}, nil
+}
+
+// LoadTrustPool は信頼するTSA証明書（TSAの証明書またはその発行元）をPEMファイルから読み込んで roots に追加する
+func LoadTrustPool(roots *x509.CertPool, pemPath string) error {
+	data, err := os.ReadFile(pemPath)
+	if err != nil {
+		return fmt.Errorf("failed to read trusted TSA certificates: %w", err)
+	}
+	if !roots.AppendCertsFromPEM(data) {
+		return fmt.Errorf("no certificates found in %s", pemPath)
+	}
+	return nil
+}
+
+// Verify はタイムスタンプトークンがSHA-256ハッシュ値に対して有効か検証する
+// トークン内のハッシュ値の一致とTSA署名に加え、署名者の証明書がタイムスタンプ用で
+// roots の証明書につながることを確認する。トークンに含まれる証明書は誰でも作れるため、
+// roots が nil なら署名が正しくても検証済みにはならない
+func Verify(der []byte, digest []byte, roots *x509.CertPool) (*VerifyResult, error) {
+	sd, info, err := parseToken(der)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &VerifyResult{
+		GenTime:      info.GenTime,
+		SerialNumber: info.SerialNumber.Text(16),
+		Policy:       info.Policy.String(),
+	}
+
+	// メッセージインプリントの確認
+	result.ImprintMatches = info.MessageImprint.HashAlgorithm.Algorithm.Equal(oidSHA256) &&
+		bytes.Equal(info.MessageImprint.HashedMessage, digest)
+
+	// 署名の確認
+	signer, err := verifySignature(sd)
+	if err != nil {
+		result.Message = err.Error()
+	} else {
+		result.SignatureValid = true
+		result.Signer = signer.Subject.String()
+		if err := verifySigner(signer, sd, info.GenTime, roots); err != nil {
+			result.Message = err.Error()
+		} else {
+			result.Trusted = true
+		}
+	}
+
+	result.Verified = result.ImprintMatches && result.SignatureValid && result.Trusted
+	if !result.ImprintMatches && result.Message == "" {
+		result.Message = "timestamp token does not cover the file hash"
+	}
+
+	return result, nil
+}
+
+// verifySigner は署名者の証明書がトークンの時刻に有効なタイムスタンプ用の証明書で、
+// 信頼するTSA証明書につながるかを確認する（中間証明書はトークンに含まれるものを使う）
+func verifySigner(signer *x509.Certificate, sd *signedData, genTime time.Time, roots *x509.CertPool) error {
+	if roots == nil {
+		return fmt.Errorf("no trusted TSA certificates are configured")
+	}
+
+	intermediates := x509.NewCertPool()
+	if certs, err := x509.ParseCertificates(sd.Certificates.Bytes); err == nil {
+		for _, cert := range certs {
+			if cert != signer {
+				intermediates.AddCert(cert)
+			}
+		}
+	}
+
+	_, err := signer.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   genTime,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping},
+	})
+	if err != nil {
+		return fmt.Errorf("signer certificate is not trusted: %w", err)
+	}
+	return nil
+}
+
+// verifySignature はSignedDataの署名者情報を検証し、署名者の証明書を返す
+func verifySignature(sd *signedData) (*x509.Certificate, error) {
+	if len(sd.SignerInfos) != 1 {
+		return nil, fmt.Errorf("expected exactly one signer, found %d", len(sd.SignerInfos))
+	}
+	si := sd.SignerInfos[0]
+
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil || len(certs) == 0 {
+		return nil, fmt.Errorf("token does not contain the TSA certificate")
+	}
+
+	// 署名者の証明書を発行者とシリアル番号で特定
+	var signer *x509.Certificate
+	var ias issuerAndSerialNumber
+	if _, err := asn1.Unmarshal(si.SID.FullBytes, &ias); err == nil {
+		for _, cert := range certs {
+			if cert.SerialNumber.Cmp(ias.SerialNumber) == 0 && bytes.Equal(cert.RawIssuer, ias.Issuer.FullBytes) {
+				signer = cert
+				break
+			}
+		}
+	} else if len(certs) == 1 {
+		signer = certs[0]
+	}
+	if signer == nil {
+		return nil, fmt.Errorf("signer certificate not found in token")
+	}
+
+	hash, err := hashForOID(si.DigestAlgorithm.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(si.SignedAttrs.Bytes) == 0 {
+		return nil, fmt.Errorf("signed attributes are missing")
+	}
+
+	// 署名属性の contentType, messageDigest, signingCertificate(V2) を取り出す
+	var contentType asn1.ObjectIdentifier
+	var contentDigest []byte
+	var certID *essCertID
+	certHash := crypto.SHA256
+	rest := si.SignedAttrs.Bytes
+	for len(rest) > 0 {
+		var attr attribute
+		rest, err = asn1.Unmarshal(rest, &attr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse signed attribute: %w", err)
+		}
+		switch {
+		case attr.Type.Equal(oidContentType):
+			if _, err := asn1.Unmarshal(attr.Values.Bytes, &contentType); err != nil {
+				return nil, fmt.Errorf("failed to parse contentType: %w", err)
+			}
+		case attr.Type.Equal(oidMessageDigest):
+			if _, err := asn1.Unmarshal(attr.Values.Bytes, &contentDigest); err != nil {
+				return nil, fmt.Errorf("failed to parse messageDigest: %w", err)
+			}
+		// 両方ある場合は SigningCertificateV2 を使う
+		case attr.Type.Equal(oidSigningCertV2), attr.Type.Equal(oidSigningCert) && certID == nil:
+			var sc signingCertificate
+			if _, err := asn1.Unmarshal(attr.Values.Bytes, &sc); err != nil || len(sc.Certs) == 0 {
+				return nil, fmt.Errorf("failed to parse signingCertificate attribute")
+			}
+			certID = &sc.Certs[0]
+			switch {
+			case attr.Type.Equal(oidSigningCert):
+				certHash = crypto.SHA1
+			case len(certID.HashAlgorithm.Algorithm) > 0:
+				if certHash, err = hashForOID(certID.HashAlgorithm.Algorithm); err != nil {
+					return nil, err
+				}
+			default:
+				certHash = crypto.SHA256
+			}
+		}
+	}
+
+	// 署名対象の内容がTSTInfoであること（RFC 5652 11.1）
+	if !contentType.Equal(oidTSTInfo) {
+		return nil, fmt.Errorf("contentType attribute is not id-ct-TSTInfo")
+	}
+
+	// messageDigest属性がTSTInfoのハッシュ値と一致するか確認
+	h := hash.New()
+	h.Write(sd.EncapContentInfo.EContent)
+	if !bytes.Equal(h.Sum(nil), contentDigest) {
+		return nil, fmt.Errorf("messageDigest does not match TSTInfo")
+	}
+
+	// ESSCertID(v2) が署名者の証明書を指すこと（RFC 3161 2.4.1、証明書の差し替え防止）
+	if certID == nil {
+		return nil, fmt.Errorf("signingCertificate attribute is missing")
+	}
+	ch := certHash.New()
+	ch.Write(signer.Raw)
+	if !bytes.Equal(ch.Sum(nil), certID.CertHash) {
+		return nil, fmt.Errorf("signer certificate does not match ESSCertID")
+	}
+
+	// 署名対象は [0] IMPLICIT ではなく SET OF としてエンコードした署名属性
+	signedBytes := make([]byte, len(si.SignedAttrs.FullBytes))
+	copy(signedBytes, si.SignedAttrs.FullBytes)
+	signedBytes[0] = 0x31
+
+	algo, err := signatureAlgorithm(si.SignatureAlgorithm.Algorithm, hash)
+	if err != nil {
+		return nil, err
+	}
+	if err := signer.CheckSignature(algo, signedBytes, si.Signature); err != nil {
+		return nil, fmt.Errorf("signature verification failed: %w", err)
+	}
+
+	return signer, nil
+}
@@ -0,0 +1,273 @@
+package tsa
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestAuthority creates a local TSA with its own self-signed certificate
+func newTestAuthority(t *testing.T) *LocalAuthority {
+	t.Helper()
+	authority, err := NewLocalAuthority(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return authority
+}
+
+// newIssuedAuthority creates a TSA whose certificate is issued by a new CA.
+// timestamping selects whether the certificate has the timestamping key usage.
+func newIssuedAuthority(t *testing.T, timestamping bool) (*LocalAuthority, *x509.Certificate) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Root CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "Test TSA"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	if timestamping {
+		value, err := asn1.Marshal([]asn1.ObjectIdentifier{oidTimeStamping})
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.ExtraExtensions = []pkix.Extension{{Id: oidExtKeyUsage, Critical: true, Value: value}}
+	} else {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning}
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &LocalAuthority{key: key, cert: cert}, ca
+}
+
+func poolOf(certs ...*x509.Certificate) *x509.CertPool {
+	pool := x509.NewCertPool()
+	for _, cert := range certs {
+		pool.AddCert(cert)
+	}
+	return pool
+}
+
+func TestVerify(t *testing.T) {
+	digest := sha256.Sum256([]byte("receipt"))
+	other := sha256.Sum256([]byte("another receipt"))
+
+	trusted := newTestAuthority(t)
+	forger := newTestAuthority(t)
+	issued, ca := newIssuedAuthority(t, true)
+	codeSigning, codeSigningCA := newIssuedAuthority(t, false)
+
+	tests := []struct {
+		name      string
+		authority *LocalAuthority
+		roots     *x509.CertPool
+		digest    []byte
+		imprint   bool
+		signature bool
+		trusted   bool
+	}{
+		{"trusted self-signed TSA", trusted, poolOf(trusted.Certificate()), digest[:], true, true, true},
+		{"different file", trusted, poolOf(trusted.Certificate()), other[:], false, true, true},
+		{"forged self-signed token", forger, poolOf(trusted.Certificate()), digest[:], true, true, false},
+		{"no trusted certificates", trusted, nil, digest[:], true, true, false},
+		{"empty trust pool", trusted, x509.NewCertPool(), digest[:], true, true, false},
+		{"TSA issued by a trusted CA", issued, poolOf(ca), digest[:], true, true, true},
+		{"TSA issued by another CA", issued, poolOf(trusted.Certificate()), digest[:], true, true, false},
+		{"certificate without timestamping usage", codeSigning, poolOf(codeSigningCA), digest[:], true, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := tt.authority.Timestamp(digest[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result, err := Verify(token.DER, tt.digest, tt.roots)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.ImprintMatches != tt.imprint || result.SignatureValid != tt.signature || result.Trusted != tt.trusted {
+				t.Errorf("got imprint %v, signature %v, trusted %v (%s); want %v, %v, %v",
+					result.ImprintMatches, result.SignatureValid, result.Trusted, result.Message, tt.imprint, tt.signature, tt.trusted)
+			}
+			want := tt.imprint && tt.signature && tt.trusted
+			if result.Verified != want {
+				t.Errorf("Verified = %v, want %v", result.Verified, want)
+			}
+		})
+	}
+}
+
+func TestVerifyRejectsTamperedToken(t *testing.T) {
+	authority := newTestAuthority(t)
+	digest := sha256.Sum256([]byte("receipt"))
+	token, err := authority.Timestamp(digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Change a byte of the signature at the end of the token
+	tampered := append([]byte(nil), token.DER...)
+	tampered[len(tampered)-3] ^= 0xff
+
+	result, err := Verify(tampered, digest[:], poolOf(authority.Certificate()))
+	if err != nil {
+		return // a token that no longer parses is rejected as well
+	}
+	if result.SignatureValid || result.Verified {
+		t.Errorf("tampered token verified: %+v", result)
+	}
+}
+
+// resignToken replaces a signed attribute of a token issued by a and signs the
+// attributes again with a's key, so that only the replaced attribute is wrong
+func resignToken(t *testing.T, a *LocalAuthority, der []byte, oid asn1.ObjectIdentifier, value []byte) []byte {
+	t.Helper()
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(der, &ci); err != nil {
+		t.Fatal(err)
+	}
+	var sd signedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		t.Fatal(err)
+	}
+	si := &sd.SignerInfos[0]
+
+	var attrs [][]byte
+	for rest := si.SignedAttrs.Bytes; len(rest) > 0; {
+		var attr attribute
+		var err error
+		if rest, err = asn1.Unmarshal(rest, &attr); err != nil {
+			t.Fatal(err)
+		}
+		if attr.Type.Equal(oid) {
+			attr.Values = asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: value}
+		}
+		encoded, err := asn1.Marshal(attr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		attrs = append(attrs, encoded)
+	}
+	sort.Slice(attrs, func(i, j int) bool { return bytes.Compare(attrs[i], attrs[j]) < 0 })
+	signedAttrs := bytes.Join(attrs, nil)
+
+	attrsSet, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: signedAttrs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrsDigest := sha256.Sum256(attrsSet)
+	if si.Signature, err = ecdsa.SignASN1(rand.Reader, a.key, attrsDigest[:]); err != nil {
+		t.Fatal(err)
+	}
+	si.SignedAttrs = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signedAttrs}
+
+	sdDER, err := asn1.Marshal(sd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ci.Content = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: sdDER}
+	tokenDER, err := asn1.Marshal(ci)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tokenDER
+}
+
+func TestVerifyChecksSignedAttributes(t *testing.T) {
+	authority := newTestAuthority(t)
+	other := newTestAuthority(t)
+	digest := sha256.Sum256([]byte("receipt"))
+	token, err := authority.Timestamp(digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signingCert := func(cert *x509.Certificate) []byte {
+		certHash := sha256.Sum256(cert.Raw)
+		value, err := asn1.Marshal(signingCertificate{Certs: []essCertID{{CertHash: certHash[:]}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return value
+	}
+	signedDataType, err := asn1.Marshal(oidSignedData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		oid     asn1.ObjectIdentifier
+		value   []byte
+		message string
+	}{
+		{"re-signed unchanged", oidSigningCertV2, signingCert(authority.Certificate()), ""},
+		{"ESSCertID of another certificate", oidSigningCertV2, signingCert(other.Certificate()), "ESSCertID"},
+		{"contentType other than TSTInfo", oidContentType, signedDataType, "contentType"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			der := resignToken(t, authority, token.DER, tt.oid, tt.value)
+			result, err := Verify(der, digest[:], poolOf(authority.Certificate()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.message == "" {
+				if !result.Verified {
+					t.Errorf("re-signed token was rejected: %s", result.Message)
+				}
+				return
+			}
+			if result.SignatureValid || result.Verified || !strings.Contains(result.Message, tt.message) {
+				t.Errorf("got signature %v, verified %v (%s); want a rejection mentioning %s",
+					result.SignatureValid, result.Verified, result.Message, tt.message)
+			}
+		})
+	}
+}